@@ -6,10 +6,13 @@
 Package api is a generated protocol buffer package.
 
 It is generated from these files:
+
 	api/api.proto
 
 It has these top-level messages:
+
 	Client
+	ClaimMapping
 	CreateClientReq
 	CreateClientResp
 	DeleteClientReq
@@ -50,13 +53,28 @@ const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 // Client represents an OAuth2 client.
 type Client struct {
-	Id           string   `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
-	Secret       string   `protobuf:"bytes,2,opt,name=secret" json:"secret,omitempty"`
-	RedirectUris []string `protobuf:"bytes,3,rep,name=redirect_uris,json=redirectUris" json:"redirect_uris,omitempty"`
-	TrustedPeers []string `protobuf:"bytes,4,rep,name=trusted_peers,json=trustedPeers" json:"trusted_peers,omitempty"`
-	Public       bool     `protobuf:"varint,5,opt,name=public" json:"public,omitempty"`
-	Name         string   `protobuf:"bytes,6,opt,name=name" json:"name,omitempty"`
-	LogoUrl      string   `protobuf:"bytes,7,opt,name=logo_url,json=logoUrl" json:"logo_url,omitempty"`
+	Id                             string          `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Secret                         string          `protobuf:"bytes,2,opt,name=secret" json:"secret,omitempty"`
+	RedirectUris                   []string        `protobuf:"bytes,3,rep,name=redirect_uris,json=redirectUris" json:"redirect_uris,omitempty"`
+	TrustedPeers                   []string        `protobuf:"bytes,4,rep,name=trusted_peers,json=trustedPeers" json:"trusted_peers,omitempty"`
+	Public                         bool            `protobuf:"varint,5,opt,name=public" json:"public,omitempty"`
+	Name                           string          `protobuf:"bytes,6,opt,name=name" json:"name,omitempty"`
+	LogoUrl                        string          `protobuf:"bytes,7,opt,name=logo_url,json=logoUrl" json:"logo_url,omitempty"`
+	PostLogoutRedirectUris         []string        `protobuf:"bytes,8,rep,name=post_logout_redirect_uris,json=postLogoutRedirectUris" json:"post_logout_redirect_uris,omitempty"`
+	AllowClientCredentials         bool            `protobuf:"varint,9,opt,name=allow_client_credentials,json=allowClientCredentials" json:"allow_client_credentials,omitempty"`
+	AllowedScopes                  []string        `protobuf:"bytes,10,rep,name=allowed_scopes,json=allowedScopes" json:"allowed_scopes,omitempty"`
+	AllowPasswordGrant             bool            `protobuf:"varint,11,opt,name=allow_password_grant,json=allowPasswordGrant" json:"allow_password_grant,omitempty"`
+	Jwks                           []byte          `protobuf:"bytes,12,opt,name=jwks,proto3" json:"jwks,omitempty"`
+	IdTokenSignedResponseAlg       string          `protobuf:"bytes,13,opt,name=id_token_signed_response_alg,json=idTokenSignedResponseAlg" json:"id_token_signed_response_alg,omitempty"`
+	SubjectType                    string          `protobuf:"bytes,14,opt,name=subject_type,json=subjectType" json:"subject_type,omitempty"`
+	SectorIdentifier               string          `protobuf:"bytes,15,opt,name=sector_identifier,json=sectorIdentifier" json:"sector_identifier,omitempty"`
+	ClaimMappings                  []*ClaimMapping `protobuf:"bytes,16,rep,name=claim_mappings,json=claimMappings" json:"claim_mappings,omitempty"`
+	JwksUri                        string          `protobuf:"bytes,17,opt,name=jwks_uri,json=jwksUri" json:"jwks_uri,omitempty"`
+	TokenEndpointAuthMethod        string          `protobuf:"bytes,18,opt,name=token_endpoint_auth_method,json=tokenEndpointAuthMethod" json:"token_endpoint_auth_method,omitempty"`
+	TlsClientAuthSubjectDn         string          `protobuf:"bytes,19,opt,name=tls_client_auth_subject_dn,json=tlsClientAuthSubjectDn" json:"tls_client_auth_subject_dn,omitempty"`
+	TlsClientCertificateThumbprint string          `protobuf:"bytes,20,opt,name=tls_client_certificate_thumbprint,json=tlsClientCertificateThumbprint" json:"tls_client_certificate_thumbprint,omitempty"`
+	SecretHash                     string          `protobuf:"bytes,21,opt,name=secret_hash,json=secretHash" json:"secret_hash,omitempty"`
+	RequestUris                    []string        `protobuf:"bytes,22,rep,name=request_uris,json=requestUris" json:"request_uris,omitempty"`
 }
 
 func (m *Client) Reset()                    { *m = Client{} }
@@ -64,6 +82,26 @@ func (m *Client) String() string            { return proto.CompactTextString(m)
 func (*Client) ProtoMessage()               {}
 func (*Client) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
+func (m *Client) GetClaimMappings() []*ClaimMapping {
+	if m != nil {
+		return m.ClaimMappings
+	}
+	return nil
+}
+
+// ClaimMapping releases a custom claim of the end user to the client.
+type ClaimMapping struct {
+	Claim    string `protobuf:"bytes,1,opt,name=claim" json:"claim,omitempty"`
+	From     string `protobuf:"bytes,2,opt,name=from" json:"from,omitempty"`
+	Template string `protobuf:"bytes,3,opt,name=template" json:"template,omitempty"`
+	Scope    string `protobuf:"bytes,4,opt,name=scope" json:"scope,omitempty"`
+}
+
+func (m *ClaimMapping) Reset()                    { *m = ClaimMapping{} }
+func (m *ClaimMapping) String() string            { return proto.CompactTextString(m) }
+func (*ClaimMapping) ProtoMessage()               {}
+func (*ClaimMapping) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
 // CreateClientReq is a request to make a client.
 type CreateClientReq struct {
 	Client *Client `protobuf:"bytes,1,opt,name=client" json:"client,omitempty"`
@@ -72,7 +110,7 @@ type CreateClientReq struct {
 func (m *CreateClientReq) Reset()                    { *m = CreateClientReq{} }
 func (m *CreateClientReq) String() string            { return proto.CompactTextString(m) }
 func (*CreateClientReq) ProtoMessage()               {}
-func (*CreateClientReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+func (*CreateClientReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
 
 func (m *CreateClientReq) GetClient() *Client {
 	if m != nil {
@@ -90,7 +128,7 @@ type CreateClientResp struct {
 func (m *CreateClientResp) Reset()                    { *m = CreateClientResp{} }
 func (m *CreateClientResp) String() string            { return proto.CompactTextString(m) }
 func (*CreateClientResp) ProtoMessage()               {}
-func (*CreateClientResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+func (*CreateClientResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
 func (m *CreateClientResp) GetClient() *Client {
 	if m != nil {
@@ -108,7 +146,7 @@ type DeleteClientReq struct {
 func (m *DeleteClientReq) Reset()                    { *m = DeleteClientReq{} }
 func (m *DeleteClientReq) String() string            { return proto.CompactTextString(m) }
 func (*DeleteClientReq) ProtoMessage()               {}
-func (*DeleteClientReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*DeleteClientReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 // DeleteClientResp determines if the.
 type DeleteClientResp struct {
@@ -118,7 +156,7 @@ type DeleteClientResp struct {
 func (m *DeleteClientResp) Reset()                    { *m = DeleteClientResp{} }
 func (m *DeleteClientResp) String() string            { return proto.CompactTextString(m) }
 func (*DeleteClientResp) ProtoMessage()               {}
-func (*DeleteClientResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+func (*DeleteClientResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
 
 // Password is an email for password mapping managed by the storage.
 type Password struct {
@@ -132,7 +170,7 @@ type Password struct {
 func (m *Password) Reset()                    { *m = Password{} }
 func (m *Password) String() string            { return proto.CompactTextString(m) }
 func (*Password) ProtoMessage()               {}
-func (*Password) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+func (*Password) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
 
 // CreatePasswordReq is a request to make a password.
 type CreatePasswordReq struct {
@@ -142,7 +180,7 @@ type CreatePasswordReq struct {
 func (m *CreatePasswordReq) Reset()                    { *m = CreatePasswordReq{} }
 func (m *CreatePasswordReq) String() string            { return proto.CompactTextString(m) }
 func (*CreatePasswordReq) ProtoMessage()               {}
-func (*CreatePasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+func (*CreatePasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
 
 func (m *CreatePasswordReq) GetPassword() *Password {
 	if m != nil {
@@ -159,7 +197,7 @@ type CreatePasswordResp struct {
 func (m *CreatePasswordResp) Reset()                    { *m = CreatePasswordResp{} }
 func (m *CreatePasswordResp) String() string            { return proto.CompactTextString(m) }
 func (*CreatePasswordResp) ProtoMessage()               {}
-func (*CreatePasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+func (*CreatePasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
 
 // UpdatePasswordReq is a request to modify an existing password.
 type UpdatePasswordReq struct {
@@ -172,7 +210,7 @@ type UpdatePasswordReq struct {
 func (m *UpdatePasswordReq) Reset()                    { *m = UpdatePasswordReq{} }
 func (m *UpdatePasswordReq) String() string            { return proto.CompactTextString(m) }
 func (*UpdatePasswordReq) ProtoMessage()               {}
-func (*UpdatePasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+func (*UpdatePasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
 
 // UpdatePasswordResp returns the response from modifying an existing password.
 type UpdatePasswordResp struct {
@@ -182,7 +220,7 @@ type UpdatePasswordResp struct {
 func (m *UpdatePasswordResp) Reset()                    { *m = UpdatePasswordResp{} }
 func (m *UpdatePasswordResp) String() string            { return proto.CompactTextString(m) }
 func (*UpdatePasswordResp) ProtoMessage()               {}
-func (*UpdatePasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+func (*UpdatePasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
 
 // DeletePasswordReq is a request to delete a password.
 type DeletePasswordReq struct {
@@ -192,7 +230,7 @@ type DeletePasswordReq struct {
 func (m *DeletePasswordReq) Reset()                    { *m = DeletePasswordReq{} }
 func (m *DeletePasswordReq) String() string            { return proto.CompactTextString(m) }
 func (*DeletePasswordReq) ProtoMessage()               {}
-func (*DeletePasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+func (*DeletePasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
 
 // DeletePasswordResp returns the response from deleting a password.
 type DeletePasswordResp struct {
@@ -202,7 +240,7 @@ type DeletePasswordResp struct {
 func (m *DeletePasswordResp) Reset()                    { *m = DeletePasswordResp{} }
 func (m *DeletePasswordResp) String() string            { return proto.CompactTextString(m) }
 func (*DeletePasswordResp) ProtoMessage()               {}
-func (*DeletePasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+func (*DeletePasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
 
 // ListPasswordReq is a request to enumerate passwords.
 type ListPasswordReq struct {
@@ -211,7 +249,7 @@ type ListPasswordReq struct {
 func (m *ListPasswordReq) Reset()                    { *m = ListPasswordReq{} }
 func (m *ListPasswordReq) String() string            { return proto.CompactTextString(m) }
 func (*ListPasswordReq) ProtoMessage()               {}
-func (*ListPasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+func (*ListPasswordReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
 
 // ListPasswordResp returs a list of passwords.
 type ListPasswordResp struct {
@@ -221,7 +259,7 @@ type ListPasswordResp struct {
 func (m *ListPasswordResp) Reset()                    { *m = ListPasswordResp{} }
 func (m *ListPasswordResp) String() string            { return proto.CompactTextString(m) }
 func (*ListPasswordResp) ProtoMessage()               {}
-func (*ListPasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+func (*ListPasswordResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
 
 func (m *ListPasswordResp) GetPasswords() []*Password {
 	if m != nil {
@@ -237,7 +275,7 @@ type VersionReq struct {
 func (m *VersionReq) Reset()                    { *m = VersionReq{} }
 func (m *VersionReq) String() string            { return proto.CompactTextString(m) }
 func (*VersionReq) ProtoMessage()               {}
-func (*VersionReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+func (*VersionReq) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
 
 // VersionResp holds the version info of components.
 type VersionResp struct {
@@ -251,10 +289,11 @@ type VersionResp struct {
 func (m *VersionResp) Reset()                    { *m = VersionResp{} }
 func (m *VersionResp) String() string            { return proto.CompactTextString(m) }
 func (*VersionResp) ProtoMessage()               {}
-func (*VersionResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+func (*VersionResp) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{16} }
 
 func init() {
 	proto.RegisterType((*Client)(nil), "api.Client")
+	proto.RegisterType((*ClaimMapping)(nil), "api.ClaimMapping")
 	proto.RegisterType((*CreateClientReq)(nil), "api.CreateClientReq")
 	proto.RegisterType((*CreateClientResp)(nil), "api.CreateClientResp")
 	proto.RegisterType((*DeleteClientReq)(nil), "api.DeleteClientReq")
@@ -559,45 +598,69 @@ var _Dex_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("api/api.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 625 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x55, 0x4f, 0x4f, 0xdb, 0x4e,
-	0x10, 0x4d, 0x62, 0x48, 0x9c, 0x49, 0x42, 0x92, 0x11, 0x3f, 0x30, 0xf9, 0x5d, 0x60, 0x51, 0x25,
-	0x50, 0x25, 0x10, 0x54, 0x6a, 0x0f, 0x55, 0xe9, 0x01, 0xfa, 0x4f, 0xea, 0x01, 0x59, 0x4a, 0x8f,
-	0xb5, 0x4c, 0x3c, 0x85, 0x95, 0x8c, 0xbd, 0xdd, 0xb5, 0x1b, 0xfa, 0xf1, 0x7a, 0xe8, 0xf7, 0xaa,
-	0x76, 0xbd, 0x09, 0xb6, 0x43, 0x95, 0xde, 0xfc, 0xde, 0xce, 0xbc, 0xd9, 0x79, 0x33, 0x9b, 0xc0,
-	0x20, 0x14, 0xfc, 0x34, 0x14, 0xfc, 0x44, 0xc8, 0x34, 0x4b, 0xd1, 0x09, 0x05, 0x67, 0xbf, 0x9a,
-	0xd0, 0xbe, 0x8c, 0x39, 0x25, 0x19, 0x6e, 0x41, 0x8b, 0x47, 0x5e, 0x73, 0xbf, 0x79, 0xd4, 0xf5,
-	0x5b, 0x3c, 0xc2, 0x1d, 0x68, 0x2b, 0x9a, 0x49, 0xca, 0xbc, 0x96, 0xe1, 0x2c, 0xc2, 0x43, 0x18,
-	0x48, 0x8a, 0xb8, 0xa4, 0x59, 0x16, 0xe4, 0x92, 0x2b, 0xcf, 0xd9, 0x77, 0x8e, 0xba, 0x7e, 0x7f,
-	0x41, 0x4e, 0x25, 0x57, 0x3a, 0x28, 0x93, 0xb9, 0xca, 0x28, 0x0a, 0x04, 0x91, 0x54, 0xde, 0x46,
-	0x11, 0x64, 0xc9, 0x6b, 0xcd, 0xe9, 0x0a, 0x22, 0xbf, 0x89, 0xf9, 0xcc, 0xdb, 0xdc, 0x6f, 0x1e,
-	0xb9, 0xbe, 0x45, 0x88, 0xb0, 0x91, 0x84, 0xf7, 0xe4, 0xb5, 0x4d, 0x5d, 0xf3, 0x8d, 0x7b, 0xe0,
-	0xc6, 0xe9, 0x6d, 0x1a, 0xe4, 0x32, 0xf6, 0x3a, 0x86, 0xef, 0x68, 0x3c, 0x95, 0x31, 0x7b, 0x09,
-	0xc3, 0x4b, 0x49, 0x61, 0x46, 0x45, 0x23, 0x3e, 0x7d, 0xc7, 0x43, 0x68, 0xcf, 0x0c, 0x30, 0xfd,
-	0xf4, 0xce, 0x7b, 0x27, 0xba, 0x6f, 0x7b, 0x6e, 0x8f, 0xd8, 0x57, 0x18, 0x55, 0xf3, 0x94, 0xc0,
-	0x67, 0xb0, 0x15, 0xc6, 0x92, 0xc2, 0xe8, 0x67, 0x40, 0x0f, 0x5c, 0x65, 0xca, 0x08, 0xb8, 0xfe,
-	0xc0, 0xb2, 0xef, 0x0c, 0x59, 0xd2, 0x6f, 0xfd, 0x5d, 0xff, 0x00, 0x86, 0x57, 0x14, 0x53, 0xf9,
-	0x5e, 0x35, 0x8f, 0xd9, 0x29, 0x8c, 0xaa, 0x21, 0x4a, 0xe0, 0xff, 0xd0, 0x4d, 0xd2, 0x2c, 0xf8,
-	0x96, 0xe6, 0x49, 0x64, 0xab, 0xbb, 0x49, 0x9a, 0xbd, 0xd7, 0x98, 0x71, 0x70, 0xaf, 0x43, 0xa5,
-	0xe6, 0xa9, 0x8c, 0x70, 0x1b, 0x36, 0xe9, 0x3e, 0xe4, 0xb1, 0xd5, 0x2b, 0x80, 0x36, 0xef, 0x2e,
-	0x54, 0x77, 0xe6, 0x62, 0x7d, 0xdf, 0x7c, 0xe3, 0x04, 0xdc, 0x5c, 0x91, 0x34, 0xa6, 0x3a, 0x26,
-	0x78, 0x89, 0x71, 0x17, 0x3a, 0xfa, 0x3b, 0xe0, 0x91, 0xb7, 0x51, 0xcc, 0x59, 0xc3, 0x4f, 0x11,
-	0xbb, 0x80, 0x71, 0x61, 0xcf, 0xa2, 0xa0, 0x6e, 0xe0, 0x18, 0x5c, 0x61, 0xa1, 0xb5, 0x76, 0x60,
-	0x5a, 0x5f, 0xc6, 0x2c, 0x8f, 0xd9, 0x6b, 0xc0, 0x7a, 0xfe, 0x3f, 0x1b, 0xcc, 0x6e, 0x61, 0x3c,
-	0x15, 0x51, 0xad, 0xf8, 0xd3, 0x0d, 0xef, 0x81, 0x9b, 0xd0, 0x3c, 0x28, 0x35, 0xdd, 0x49, 0x68,
-	0xfe, 0x51, 0xf7, 0x7d, 0x00, 0x7d, 0x7d, 0x54, 0xeb, 0xbd, 0x97, 0xd0, 0x7c, 0x6a, 0x29, 0x76,
-	0x06, 0x58, 0x2f, 0xb4, 0x6e, 0x06, 0xc7, 0x30, 0x2e, 0x86, 0xb6, 0xf6, 0x6e, 0x5a, 0xbd, 0x1e,
-	0xba, 0x4e, 0x7d, 0x0c, 0xc3, 0xcf, 0x5c, 0x65, 0x25, 0x6d, 0xf6, 0x16, 0x46, 0x55, 0x4a, 0x09,
-	0x7c, 0x0e, 0xdd, 0x85, 0xd3, 0xda, 0x42, 0x67, 0x75, 0x12, 0x8f, 0xe7, 0xac, 0x0f, 0xf0, 0x85,
-	0xa4, 0xe2, 0x69, 0xa2, 0xe5, 0x5e, 0x41, 0x6f, 0x89, 0x94, 0x28, 0xde, 0xb9, 0xfc, 0x41, 0xd2,
-	0x5e, 0xdd, 0x22, 0x1c, 0x81, 0xfe, 0x85, 0x30, 0x96, 0x6e, 0xfa, 0xfa, 0xf3, 0xfc, 0xb7, 0x03,
-	0xce, 0x15, 0x3d, 0xe0, 0x1b, 0xe8, 0x97, 0x1f, 0x0e, 0x6e, 0x17, 0xdb, 0x5f, 0x7d, 0x83, 0x93,
-	0xff, 0x9e, 0x60, 0x95, 0x60, 0x0d, 0x9d, 0x5e, 0x5e, 0x7a, 0x9b, 0x5e, 0x7b, 0x2a, 0x36, 0xbd,
-	0xfe, 0x3a, 0x58, 0x03, 0x2f, 0x61, 0xab, 0xba, 0x57, 0xb8, 0x53, 0xaa, 0x54, 0xf2, 0x6d, 0xb2,
-	0xfb, 0x24, 0xbf, 0x10, 0xa9, 0x8e, 0xdd, 0x8a, 0xac, 0x2c, 0x9d, 0x15, 0x59, 0xdd, 0x91, 0x42,
-	0xa4, 0x3a, 0x5d, 0x2b, 0xb2, 0xb2, 0x1d, 0x56, 0x64, 0x75, 0x15, 0x58, 0x03, 0x2f, 0x60, 0x50,
-	0x1e, 0xae, 0xb2, 0x76, 0xd4, 0x76, 0xc0, 0xda, 0x51, 0x5f, 0x03, 0xd6, 0xc0, 0x33, 0x80, 0x0f,
-	0x94, 0xd9, 0x81, 0xe2, 0xd0, 0x84, 0x3d, 0x0e, 0x7b, 0x32, 0xaa, 0x12, 0x3a, 0xe5, 0xa6, 0x6d,
-	0xfe, 0x00, 0x5e, 0xfc, 0x09, 0x00, 0x00, 0xff, 0xff, 0x34, 0x14, 0x6b, 0x5d, 0x11, 0x06, 0x00,
-	0x00,
+	// 1018 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x8c, 0x56, 0xe1, 0x4e, 0x1b, 0x47,
+	0x10, 0x2e, 0x18, 0x8c, 0x19, 0xdb, 0x60, 0x6f, 0xc1, 0x2c, 0x6e, 0xd5, 0xc2, 0x45, 0x95, 0x88,
+	0x22, 0x25, 0x0d, 0x95, 0xda, 0xb4, 0x51, 0xa9, 0x22, 0x93, 0xa6, 0x48, 0x89, 0x14, 0x19, 0xe8,
+	0xcf, 0xae, 0x8e, 0xbb, 0xc1, 0x5e, 0x72, 0xbe, 0xdb, 0xec, 0xee, 0xd5, 0xe1, 0x2d, 0xfa, 0x52,
+	0x7d, 0xaf, 0x6a, 0xe7, 0xf6, 0xcc, 0xd9, 0xb8, 0x22, 0xff, 0x76, 0xbe, 0x99, 0xf9, 0x66, 0xe7,
+	0x9b, 0xd9, 0xb3, 0xa1, 0x1d, 0x2a, 0xf9, 0x2c, 0x54, 0xf2, 0xa9, 0xd2, 0x99, 0xcd, 0x58, 0x2d,
+	0x54, 0x32, 0xf8, 0x67, 0x03, 0xea, 0x83, 0x44, 0x62, 0x6a, 0xd9, 0x16, 0xac, 0xca, 0x98, 0xaf,
+	0x1c, 0xac, 0x1c, 0x6d, 0x0e, 0x57, 0x65, 0xcc, 0x7a, 0x50, 0x37, 0x18, 0x69, 0xb4, 0x7c, 0x95,
+	0x30, 0x6f, 0xb1, 0x47, 0xd0, 0xd6, 0x18, 0x4b, 0x8d, 0x91, 0x15, 0xb9, 0x96, 0x86, 0xd7, 0x0e,
+	0x6a, 0x47, 0x9b, 0xc3, 0x56, 0x09, 0x5e, 0x6a, 0x69, 0x5c, 0x90, 0xd5, 0xb9, 0xb1, 0x18, 0x0b,
+	0x85, 0xa8, 0x0d, 0x5f, 0x2b, 0x82, 0x3c, 0xf8, 0xde, 0x61, 0xae, 0x82, 0xca, 0xaf, 0x12, 0x19,
+	0xf1, 0xf5, 0x83, 0x95, 0xa3, 0xc6, 0xd0, 0x5b, 0x8c, 0xc1, 0x5a, 0x1a, 0x4e, 0x90, 0xd7, 0xa9,
+	0x2e, 0x9d, 0xd9, 0x3e, 0x34, 0x92, 0x6c, 0x94, 0x89, 0x5c, 0x27, 0x7c, 0x83, 0xf0, 0x0d, 0x67,
+	0x5f, 0xea, 0x84, 0xfd, 0x0c, 0xfb, 0x2a, 0x33, 0x56, 0x38, 0x3b, 0xb7, 0x62, 0xfe, 0x72, 0x0d,
+	0xaa, 0xdb, 0x73, 0x01, 0x6f, 0xc9, 0x3f, 0xac, 0x5e, 0xf3, 0x05, 0xf0, 0x30, 0x49, 0xb2, 0xa9,
+	0x88, 0x48, 0x03, 0x11, 0x69, 0x8c, 0x31, 0xb5, 0x32, 0x4c, 0x0c, 0xdf, 0xa4, 0x3b, 0xf5, 0xc8,
+	0x5f, 0x48, 0x34, 0xb8, 0xf3, 0xb2, 0xef, 0x60, 0x8b, 0x3c, 0x18, 0x0b, 0x13, 0x65, 0x0a, 0x0d,
+	0x07, 0xaa, 0xd4, 0xf6, 0xe8, 0x39, 0x81, 0xec, 0x7b, 0xd8, 0x29, 0x0a, 0xa8, 0xd0, 0x98, 0x69,
+	0xa6, 0x63, 0x31, 0xd2, 0x61, 0x6a, 0x79, 0x93, 0xc8, 0x19, 0xf9, 0xde, 0x7b, 0xd7, 0x1b, 0xe7,
+	0x71, 0xcd, 0xdf, 0x4c, 0x3f, 0x18, 0xde, 0x3a, 0x58, 0x39, 0x6a, 0x0d, 0xe9, 0xcc, 0x4e, 0xe0,
+	0x6b, 0x19, 0x0b, 0x9b, 0x7d, 0xc0, 0x54, 0x18, 0x39, 0x4a, 0x31, 0x16, 0x1a, 0x8d, 0xca, 0x52,
+	0x83, 0x22, 0x4c, 0x46, 0xbc, 0x4d, 0x82, 0x70, 0x19, 0x5f, 0xb8, 0x90, 0x73, 0x8a, 0x18, 0xfa,
+	0x80, 0x57, 0xc9, 0x88, 0x1d, 0x42, 0xcb, 0xe4, 0x57, 0x37, 0x4e, 0x14, 0x7b, 0xab, 0x90, 0x6f,
+	0x51, 0x7c, 0xd3, 0x63, 0x17, 0xb7, 0x0a, 0xd9, 0x13, 0xe8, 0x1a, 0x8c, 0x6c, 0xa6, 0x85, 0xa4,
+	0x1e, 0xaf, 0x25, 0x6a, 0xbe, 0x4d, 0x71, 0x9d, 0xc2, 0x71, 0x36, 0xc3, 0xd9, 0x0b, 0xd8, 0x8a,
+	0x92, 0x50, 0x4e, 0xc4, 0x24, 0x54, 0x4a, 0xa6, 0x23, 0xc3, 0x3b, 0x07, 0xb5, 0xa3, 0xe6, 0x71,
+	0xf7, 0xa9, 0x5b, 0xaf, 0x81, 0x73, 0xbd, 0x2b, 0x3c, 0xc3, 0x76, 0x54, 0xb1, 0x8c, 0x1b, 0xa3,
+	0xeb, 0xc8, 0xcd, 0x86, 0x77, 0x8b, 0x31, 0x3a, 0xfb, 0x52, 0x4b, 0xf6, 0x12, 0xfa, 0x45, 0x87,
+	0x98, 0xc6, 0x2a, 0x93, 0xa9, 0x15, 0x61, 0x6e, 0xc7, 0x62, 0x82, 0x76, 0x9c, 0xc5, 0x9c, 0x51,
+	0xf0, 0x1e, 0x45, 0xbc, 0xf6, 0x01, 0xaf, 0x72, 0x3b, 0x7e, 0x47, 0x6e, 0xf6, 0x0b, 0xf4, 0x6d,
+	0x62, 0xca, 0x31, 0x52, 0x62, 0xd9, 0x71, 0x9c, 0xf2, 0x2f, 0x29, 0xb9, 0x67, 0x13, 0x53, 0x0c,
+	0xd2, 0x25, 0x9e, 0x17, 0xee, 0xd3, 0x94, 0x9d, 0xc1, 0x61, 0x25, 0x37, 0x42, 0xed, 0xba, 0x8c,
+	0x42, 0x8b, 0xc2, 0x8e, 0xf3, 0xc9, 0x95, 0xd2, 0x32, 0xb5, 0x7c, 0x87, 0x28, 0xbe, 0x99, 0x51,
+	0x0c, 0xee, 0xc2, 0x2e, 0x66, 0x51, 0xec, 0x5b, 0x68, 0x16, 0xaf, 0x44, 0x8c, 0x43, 0x33, 0xe6,
+	0xbb, 0x94, 0x04, 0x05, 0xf4, 0x47, 0x68, 0xc6, 0x6e, 0x12, 0x1a, 0x3f, 0xe6, 0x68, 0xfc, 0x7a,
+	0xf6, 0x68, 0x69, 0x9a, 0x1e, 0x73, 0x3b, 0x19, 0xdc, 0x40, 0xab, 0xaa, 0x20, 0xdb, 0x81, 0x75,
+	0xd2, 0xd0, 0x3f, 0xcd, 0xc2, 0x70, 0x6b, 0x72, 0xad, 0xb3, 0x89, 0x7f, 0x9b, 0x74, 0x66, 0x7d,
+	0x68, 0x58, 0x9c, 0xa8, 0x24, 0xb4, 0xc8, 0x6b, 0x84, 0xcf, 0x6c, 0xc7, 0x42, 0x7b, 0xca, 0xd7,
+	0x0a, 0x16, 0x32, 0x82, 0x1f, 0x61, 0x7b, 0xa0, 0x31, 0xb4, 0x58, 0x34, 0x35, 0xc4, 0x8f, 0xec,
+	0x11, 0xd4, 0x0b, 0x25, 0xa8, 0x5e, 0xf3, 0xb8, 0xe9, 0x67, 0x4a, 0x7e, 0xef, 0x0a, 0xfe, 0x82,
+	0xce, 0x7c, 0x9e, 0x51, 0xc5, 0x8b, 0xd0, 0x18, 0xc6, 0xb7, 0x02, 0x3f, 0x49, 0x63, 0x0d, 0x11,
+	0x34, 0x86, 0x6d, 0x8f, 0xbe, 0x26, 0xb0, 0xc2, 0xbf, 0xfa, 0xff, 0xfc, 0x87, 0xb0, 0x7d, 0x8a,
+	0x09, 0x56, 0xef, 0xb5, 0xf0, 0x79, 0x0a, 0x9e, 0x41, 0x67, 0x3e, 0xc4, 0x28, 0xf6, 0x15, 0x6c,
+	0xa6, 0x99, 0x15, 0xd7, 0x59, 0x9e, 0xc6, 0xbe, 0x7a, 0x23, 0xcd, 0xec, 0xef, 0xce, 0x0e, 0x24,
+	0x34, 0xca, 0x97, 0xe6, 0xd4, 0xc0, 0x49, 0x28, 0x93, 0x52, 0x53, 0x32, 0x9c, 0xa6, 0x34, 0xb6,
+	0xd5, 0xe2, 0xe9, 0xb9, 0xb3, 0xd3, 0x34, 0x37, 0xa8, 0xe9, 0x7b, 0xe4, 0x35, 0x2d, 0x6d, 0xb6,
+	0x07, 0x1b, 0xee, 0x2c, 0x64, 0xec, 0x55, 0xad, 0x3b, 0xf3, 0x2c, 0x0e, 0x4e, 0xa0, 0x5b, 0xc8,
+	0x53, 0x16, 0x74, 0x0d, 0x3c, 0x86, 0x46, 0xf9, 0x11, 0xf0, 0xd2, 0xb6, 0xa9, 0xf5, 0x59, 0xcc,
+	0xcc, 0x1d, 0xbc, 0x04, 0xb6, 0x98, 0xff, 0xd9, 0x02, 0x07, 0x23, 0xe8, 0x5e, 0xaa, 0x78, 0xa1,
+	0xf8, 0xf2, 0x86, 0xf7, 0xa1, 0x91, 0xe2, 0x54, 0x54, 0x9a, 0xde, 0x48, 0x71, 0x5a, 0x2e, 0xaa,
+	0x73, 0x2d, 0xf4, 0xde, 0x4c, 0x71, 0x7a, 0xe9, 0xa1, 0xe0, 0x39, 0xb0, 0xc5, 0x42, 0x0f, 0xcd,
+	0xe0, 0x31, 0x74, 0x8b, 0xa1, 0x3d, 0x78, 0x37, 0xc7, 0xbe, 0x18, 0xfa, 0x10, 0x7b, 0x17, 0xb6,
+	0xdf, 0x4a, 0x63, 0x2b, 0xdc, 0xc1, 0x6f, 0xd0, 0x99, 0x87, 0x8c, 0x62, 0x4f, 0x60, 0xb3, 0x54,
+	0xda, 0x49, 0x58, 0xbb, 0x3f, 0x89, 0x3b, 0x7f, 0xd0, 0x02, 0xf8, 0x13, 0xb5, 0x91, 0x59, 0xea,
+	0xe8, 0x7e, 0x82, 0xe6, 0xcc, 0x32, 0xaa, 0xf8, 0x89, 0xd4, 0x7f, 0xa3, 0xf6, 0x57, 0xf7, 0x16,
+	0xeb, 0x80, 0xfb, 0x71, 0x25, 0x49, 0xd7, 0x87, 0xee, 0x78, 0xfc, 0x6f, 0x0d, 0x6a, 0xa7, 0xf8,
+	0x89, 0xfd, 0x0a, 0xad, 0xea, 0xc3, 0x61, 0x3b, 0xc5, 0xf6, 0xcf, 0xbf, 0xc1, 0xfe, 0xee, 0x12,
+	0xd4, 0xa8, 0xe0, 0x0b, 0x97, 0x5e, 0x5d, 0x7a, 0x9f, 0xbe, 0xf0, 0x54, 0xfa, 0xbb, 0x4b, 0x50,
+	0x4a, 0x1f, 0xc0, 0xd6, 0xfc, 0x5e, 0xb1, 0x5e, 0xa5, 0x52, 0x45, 0xb7, 0xfe, 0xde, 0x52, 0xbc,
+	0x24, 0x99, 0x1f, 0xbb, 0x27, 0xb9, 0xb7, 0x74, 0xfd, 0xbd, 0xa5, 0x78, 0x49, 0x32, 0x3f, 0x5d,
+	0x4f, 0x72, 0x6f, 0x3b, 0xfa, 0x7b, 0x4b, 0x71, 0x22, 0x39, 0x81, 0x76, 0x75, 0xb8, 0xc6, 0xcb,
+	0xb1, 0xb0, 0x03, 0xfd, 0xdd, 0x25, 0x28, 0xe5, 0x3f, 0x07, 0x78, 0x83, 0xd6, 0x0f, 0x94, 0x6d,
+	0x53, 0xd8, 0xdd, 0xb0, 0xfb, 0x9d, 0x79, 0xc0, 0xa5, 0x5c, 0xd5, 0xe9, 0xbf, 0xd3, 0x0f, 0xff,
+	0x0d, 0x00, 0xfd, 0x2e, 0xc6, 0x4e, 0x4c, 0x09, 0x00, 0x00,
 }
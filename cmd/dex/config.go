@@ -30,6 +30,7 @@ type Config struct {
 	OAuth2     OAuth2      `json:"oauth2"`
 	GRPC       GRPC        `json:"grpc"`
 	Expiry     Expiry      `json:"expiry"`
+	Signing    Signing     `json:"signing"`
 	Logger     Logger      `json:"logger"`
 
 	Frontend server.WebConfig `json:"frontend"`
@@ -94,6 +95,20 @@ type OAuth2 struct {
 	// If specified, do not prompt the user to approve client authorization. The
 	// act of logging in implies authorization.
 	SkipApprovalScreen bool `json:"skipApprovalScreen"`
+	// If specified, logging out through the end session endpoint revokes the
+	// refresh tokens the client holds for the user. Each logout then reads every
+	// refresh token in the storage.
+	RevokeRefreshTokensOnLogout bool `json:"revokeRefreshTokensOnLogout"`
+	// Secret keying pairwise subject identifiers, required by clients with the
+	// "pairwise" subject type. Changing it changes the identifiers of all end users.
+	PairwiseSubjectSecret string `json:"pairwiseSubjectSecret"`
+	// If specified, clients can register themselves by presenting one of these
+	// tokens to the registration endpoint.
+	InitialAccessTokens []string `json:"initialAccessTokens"`
+	// Hosts the JWKS and request URIs of clients may point to even though they're
+	// private addresses or resolve to them. By default dex only fetches documents
+	// published by clients from public addresses.
+	AllowedFetchHosts []string `json:"allowedFetchHosts"`
 }
 
 // Web is the config format for the HTTP server.
@@ -102,6 +117,12 @@ type Web struct {
 	HTTPS   string `json:"https"`
 	TLSCert string `json:"tlsCert"`
 	TLSKey  string `json:"tlsKey"`
+
+	// If enabled, the HTTPS listener requests client certificates, which clients
+	// may authenticate with and have their tokens bound to.
+	TLSClientAuth bool `json:"tlsClientAuth"`
+	// CAs issuing the certificates of clients using "tls_client_auth".
+	TLSClientCA string `json:"tlsClientCA"`
 }
 
 // GRPC is the config for the gRPC API.
@@ -224,6 +245,41 @@ type Expiry struct {
 
 	// IdTokens defines the duration of time for which the IdTokens will be valid.
 	IDTokens string `json:"idTokens"`
+
+	// RefreshTokens defines the duration of time after the end user logged in for
+	// which refresh tokens will be valid. If empty, they don't expire.
+	RefreshTokens string `json:"refreshTokens"`
+
+	// RefreshTokensIdle defines the duration of time after which refresh tokens
+	// which haven't been used expire. If empty, they don't expire.
+	RefreshTokensIdle string `json:"refreshTokensIdle"`
+}
+
+// Signing holds configuration for the keys used to sign tokens.
+type Signing struct {
+	// Algorithms lists the algorithms tokens can be signed with, such as "RS256" or
+	// "ES256". The first is used unless a client asks for another. Defaults to "RS256".
+	// RSA and ECDSA algorithms are supported, but not EdDSA.
+	Algorithms []string `json:"algorithms"`
+
+	// RSAKeySize is the size in bits of generated RSA keys. Defaults to 2048.
+	RSAKeySize int `json:"rsaKeySize"`
+
+	// KeyFiles lists private keys used to sign tokens instead of keys generated
+	// by dex. Storage then only holds their public keys. If set, Algorithms and
+	// RSAKeySize are ignored.
+	KeyFiles []SigningKeyFile `json:"keyFiles"`
+}
+
+// SigningKeyFile is a private key held in a file.
+type SigningKeyFile struct {
+	// Path of the PEM encoded PKCS #8 private key. The file is reloaded when it
+	// changes, so the key can be replaced without restarting dex.
+	Path string `json:"path"`
+
+	// Algorithm the key signs with. Defaults to "RS256" for RSA keys, and the
+	// algorithm for the curve of ECDSA keys.
+	Algorithm string `json:"algorithm"`
 }
 
 // Logger holds configuration required to customize logging for dex.
@@ -59,6 +59,15 @@ staticPasswords:
 expiry:
   signingKeys: "6h"
   idTokens: "24h"
+  refreshTokens: "720h"
+  refreshTokensIdle: "168h"
+
+signing:
+  algorithms: ["ES256", "RS256"]
+  rsaKeySize: 3072
+  keyFiles:
+  - path: /etc/dex/signing-key.pem
+    algorithm: ES256
 
 logger:
   level: "debug"
@@ -121,8 +130,17 @@ logger:
 			},
 		},
 		Expiry: Expiry{
-			SigningKeys: "6h",
-			IDTokens:    "24h",
+			SigningKeys:       "6h",
+			IDTokens:          "24h",
+			RefreshTokens:     "720h",
+			RefreshTokensIdle: "168h",
+		},
+		Signing: Signing{
+			Algorithms: []string{"ES256", "RS256"},
+			RSAKeySize: 3072,
+			KeyFiles: []SigningKeyFile{
+				{Path: "/etc/dex/signing-key.pem", Algorithm: "ES256"},
+			},
 		},
 		Logger: Logger{
 			Level:  "debug",
@@ -18,9 +18,11 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	jose "gopkg.in/square/go-jose.v2"
 
 	"github.com/coreos/dex/api"
 	"github.com/coreos/dex/server"
+	"github.com/coreos/dex/server/signer"
 	"github.com/coreos/dex/storage"
 )
 
@@ -80,10 +82,13 @@ func serve(cmd *cobra.Command, args []string) error {
 		{c.Web.HTTP == "" && c.Web.HTTPS == "", "must supply a HTTP/HTTPS  address to listen on"},
 		{c.Web.HTTPS != "" && c.Web.TLSCert == "", "no cert specified for HTTPS"},
 		{c.Web.HTTPS != "" && c.Web.TLSKey == "", "no private key specified for HTTPS"},
+		{c.Web.HTTPS == "" && c.Web.TLSClientAuth, "cannot request TLS client certificates without HTTPS"},
+		{!c.Web.TLSClientAuth && c.Web.TLSClientCA != "", "cannot specify web TLS client CA without enabling TLS client auth"},
 		{c.GRPC.TLSCert != "" && c.GRPC.Addr == "", "no address specified for gRPC"},
 		{c.GRPC.TLSKey != "" && c.GRPC.Addr == "", "no address specified for gRPC"},
 		{(c.GRPC.TLSCert == "") != (c.GRPC.TLSKey == ""), "must specific both a gRPC TLS cert and key"},
 		{c.GRPC.TLSCert == "" && c.GRPC.TLSClientCA != "", "cannot specify gRPC TLS client CA without a gRPC TLS cert"},
+		{len(c.OAuth2.InitialAccessTokens) != 0 && len(c.StaticClients) != 0, "cannot enable dynamic client registration with static clients"},
 	}
 
 	for _, check := range checks {
@@ -179,20 +184,40 @@ func serve(cmd *cobra.Command, args []string) error {
 	if c.OAuth2.SkipApprovalScreen {
 		logger.Infof("config skipping approval screen")
 	}
+	if len(c.OAuth2.InitialAccessTokens) > 0 {
+		logger.Infof("config dynamic client registration enabled")
+	}
 
 	// explicitly convert to UTC.
 	now := func() time.Time { return time.Now().UTC() }
 
 	serverConfig := server.Config{
-		SupportedResponseTypes: c.OAuth2.ResponseTypes,
-		SkipApprovalScreen:     c.OAuth2.SkipApprovalScreen,
-		Issuer:                 c.Issuer,
-		Connectors:             connectors,
-		Storage:                s,
-		Web:                    c.Frontend,
-		EnablePasswordDB:       c.EnablePasswordDB,
-		Logger:                 logger,
-		Now:                    now,
+		SupportedResponseTypes:      c.OAuth2.ResponseTypes,
+		SkipApprovalScreen:          c.OAuth2.SkipApprovalScreen,
+		RevokeRefreshTokensOnLogout: c.OAuth2.RevokeRefreshTokensOnLogout,
+		PairwiseSubjectSecret:       c.OAuth2.PairwiseSubjectSecret,
+		InitialAccessTokens:         c.OAuth2.InitialAccessTokens,
+		AllowedFetchHosts:           c.OAuth2.AllowedFetchHosts,
+		Issuer:                      c.Issuer,
+		Connectors:                  connectors,
+		Storage:                     s,
+		Web:                         c.Frontend,
+		EnablePasswordDB:            c.EnablePasswordDB,
+		SigningAlgorithms:           c.Signing.Algorithms,
+		RSAKeySize:                  c.Signing.RSAKeySize,
+		Logger:                      logger,
+		Now:                         now,
+	}
+	if len(c.Signing.Algorithms) > 0 {
+		logger.Infof("config signing algorithms: %s", c.Signing.Algorithms)
+	}
+	for _, keyFile := range c.Signing.KeyFiles {
+		fileSigner, err := signer.NewFileSigner(keyFile.Path, jose.SignatureAlgorithm(keyFile.Algorithm), logger)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %v", err)
+		}
+		logger.Infof("config signing key: %s (%s)", keyFile.Path, fileSigner.Algorithm())
+		serverConfig.Signers = append(serverConfig.Signers, fileSigner)
 	}
 	if c.Expiry.SigningKeys != "" {
 		signingKeys, err := time.ParseDuration(c.Expiry.SigningKeys)
@@ -210,6 +235,38 @@ func serve(cmd *cobra.Command, args []string) error {
 		logger.Infof("config id tokens valid for: %v", idTokens)
 		serverConfig.IDTokensValidFor = idTokens
 	}
+	if c.Expiry.RefreshTokens != "" {
+		refreshTokens, err := time.ParseDuration(c.Expiry.RefreshTokens)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for refresh token expiry: %v", c.Expiry.RefreshTokens, err)
+		}
+		logger.Infof("config refresh tokens valid for: %v", refreshTokens)
+		serverConfig.RefreshTokensValidFor = refreshTokens
+	}
+	if c.Expiry.RefreshTokensIdle != "" {
+		refreshTokensIdle, err := time.ParseDuration(c.Expiry.RefreshTokensIdle)
+		if err != nil {
+			return fmt.Errorf("invalid config value %q for refresh token idle expiry: %v", c.Expiry.RefreshTokensIdle, err)
+		}
+		logger.Infof("config refresh tokens expire if unused for: %v", refreshTokensIdle)
+		serverConfig.RefreshTokensIdleTimeout = refreshTokensIdle
+	}
+
+	if c.Web.TLSClientAuth {
+		logger.Infof("config requesting TLS client certificates")
+		serverConfig.TLSClientAuth = true
+	}
+	if c.Web.TLSClientCA != "" {
+		clientCAs := x509.NewCertPool()
+		clientCA, err := ioutil.ReadFile(c.Web.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("invalid config: reading from web client CA file: %v", err)
+		}
+		if !clientCAs.AppendCertsFromPEM(clientCA) {
+			return errors.New("invalid config: failed to parse web client CA")
+		}
+		serverConfig.TLSClientCAs = clientCAs
+	}
 
 	serv, err := server.NewServer(context.Background(), serverConfig)
 	if err != nil {
@@ -226,8 +283,14 @@ func serve(cmd *cobra.Command, args []string) error {
 	}
 	if c.Web.HTTPS != "" {
 		logger.Infof("listening (https) on %s", c.Web.HTTPS)
+		httpsServer := &http.Server{Addr: c.Web.HTTPS, Handler: serv}
+		if c.Web.TLSClientAuth {
+			// Certificates aren't verified during the handshake. The server verifies
+			// them against the client, which may use a self-signed certificate.
+			httpsServer.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+		}
 		go func() {
-			err := http.ListenAndServeTLS(c.Web.HTTPS, c.Web.TLSCert, c.Web.TLSKey, serv)
+			err := httpsServer.ListenAndServeTLS(c.Web.TLSCert, c.Web.TLSKey)
 			errc <- fmt.Errorf("listening on %s failed: %v", c.Web.HTTPS, err)
 		}()
 	}
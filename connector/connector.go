@@ -31,6 +31,11 @@ type Identity struct {
 
 	Groups []string
 
+	// CustomClaims holds claims beyond the ones above, such as LDAP attributes or
+	// the claims of an upstream provider. Values must be JSON serializable. They're
+	// only released to clients which map them into their tokens.
+	CustomClaims map[string]interface{}
+
 	// ConnectorData holds data used by the connector for subsequent requests after initial
 	// authentication, such as access tokens for upstream provides.
 	//
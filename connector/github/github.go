@@ -124,6 +124,7 @@ func (c *githubConnector) HandleCallback(s connector.Scopes, r *http.Request) (i
 		Username:      username,
 		Email:         user.Email,
 		EmailVerified: true,
+		CustomClaims:  map[string]interface{}{"login": user.Login},
 	}
 
 	if s.Groups && c.org != "" {
@@ -168,6 +169,7 @@ func (c *githubConnector) Refresh(ctx context.Context, s connector.Scopes, ident
 	}
 	ident.Username = username
 	ident.Email = user.Email
+	ident.CustomClaims = map[string]interface{}{"login": user.Login}
 
 	if s.Groups && c.org != "" {
 		groups, err := c.teams(ctx, client, c.org)
@@ -39,6 +39,8 @@ import (
 //         idAttr: uid
 //         emailAttr: mail
 //         nameAttr: name
+//         # Attributes released as custom claims of the same name.
+//         claimAttrs: ["employeeNumber"]
 //       groupSearch:
 //         # Would translate to the query "(&(objectClass=group)(member=<user uid>))"
 //         baseDN: cn=groups,dc=example,dc=com
@@ -94,6 +96,10 @@ type Config struct {
 		EmailAttr string `json:"emailAttr"` // Defaults to "mail"
 		NameAttr  string `json:"nameAttr"`  // No default.
 
+		// Other attributes of the user entry kept as custom claims, named after the
+		// attribute. For example "employeeNumber". Attributes with several values
+		// become lists, missing attributes are left out.
+		ClaimAttrs []string `json:"claimAttrs"`
 	} `json:"userSearch"`
 
 	// Group search configuration.
@@ -293,6 +299,21 @@ func (c *ldapConnector) identityFromEntry(user ldap.Entry) (ident connector.Iden
 		err := fmt.Errorf("ldap: entry %q missing following required attribute(s): %q", user.DN, missing)
 		return connector.Identity{}, err
 	}
+
+	for _, attr := range c.UserSearch.ClaimAttrs {
+		values := user.GetAttributeValues(attr)
+		if len(values) == 0 {
+			continue
+		}
+		if ident.CustomClaims == nil {
+			ident.CustomClaims = make(map[string]interface{})
+		}
+		if len(values) == 1 {
+			ident.CustomClaims[attr] = values[0]
+		} else {
+			ident.CustomClaims[attr] = values
+		}
+	}
 	return ident, nil
 }
 
@@ -320,6 +341,7 @@ func (c *ldapConnector) userEntry(conn *ldap.Conn, username string) (user ldap.E
 	if c.UserSearch.NameAttr != "" {
 		req.Attributes = append(req.Attributes, c.UserSearch.NameAttr)
 	}
+	req.Attributes = append(req.Attributes, c.UserSearch.ClaimAttrs...)
 	resp, err := conn.Search(req)
 	if err != nil {
 		return ldap.Entry{}, false, fmt.Errorf("ldap: search with filter %q failed: %v", req.Filter, err)
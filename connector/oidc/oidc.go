@@ -125,11 +125,28 @@ func (c *oidcConnector) HandleCallback(s connector.Scopes, r *http.Request) (ide
 		return identity, fmt.Errorf("oidc: failed to decode claims: %v", err)
 	}
 
+	// Keep the provider's other claims so clients can map them into their tokens.
+	var customClaims map[string]interface{}
+	if err := idToken.Claims(&customClaims); err != nil {
+		return identity, fmt.Errorf("oidc: failed to decode claims: %v", err)
+	}
+	for _, claim := range tokenClaims {
+		delete(customClaims, claim)
+	}
+
 	identity = connector.Identity{
 		UserID:        idToken.Subject,
 		Username:      claims.Username,
 		Email:         claims.Email,
 		EmailVerified: claims.EmailVerified,
+		CustomClaims:  customClaims,
 	}
 	return identity, nil
 }
+
+// tokenClaims describe the upstream ID token rather than the end user, so they
+// aren't kept as custom claims.
+var tokenClaims = []string{
+	"iss", "sub", "aud", "exp", "iat", "nbf", "jti",
+	"azp", "nonce", "auth_time", "at_hash", "c_hash",
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
+	jose "gopkg.in/square/go-jose.v2"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/coreos/dex/api"
@@ -38,18 +40,74 @@ func (d dexAPI) CreateClient(ctx context.Context, req *api.CreateClientReq) (*ap
 	if req.Client.Id == "" {
 		req.Client.Id = storage.NewID()
 	}
-	if req.Client.Secret == "" {
+	if req.Client.SecretHash != "" {
+		if req.Client.Secret != "" {
+			return nil, errors.New("secret and secret_hash can't be used together")
+		}
+		if err := checkCost([]byte(req.Client.SecretHash)); err != nil {
+			return nil, err
+		}
+	} else if req.Client.Secret == "" {
 		req.Client.Secret = storage.NewID() + storage.NewID()
 	}
 
 	c := storage.Client{
-		ID:           req.Client.Id,
-		Secret:       req.Client.Secret,
-		RedirectURIs: req.Client.RedirectUris,
-		TrustedPeers: req.Client.TrustedPeers,
-		Public:       req.Client.Public,
-		Name:         req.Client.Name,
-		LogoURL:      req.Client.LogoUrl,
+		ID:                       req.Client.Id,
+		Secret:                   req.Client.Secret,
+		SecretHash:               req.Client.SecretHash,
+		RedirectURIs:             req.Client.RedirectUris,
+		TrustedPeers:             req.Client.TrustedPeers,
+		PostLogoutRedirectURIs:   req.Client.PostLogoutRedirectUris,
+		Public:                   req.Client.Public,
+		AllowClientCredentials:   req.Client.AllowClientCredentials,
+		AllowedScopes:            req.Client.AllowedScopes,
+		AllowPasswordGrant:       req.Client.AllowPasswordGrant,
+		IDTokenSignedResponseAlg: req.Client.IdTokenSignedResponseAlg,
+		SubjectType:              req.Client.SubjectType,
+		SectorIdentifier:         req.Client.SectorIdentifier,
+		JWKSURI:                  req.Client.JwksUri,
+		RequestURIs:              req.Client.RequestUris,
+		TokenEndpointAuthMethod:  req.Client.TokenEndpointAuthMethod,
+		Name:                     req.Client.Name,
+		LogoURL:                  req.Client.LogoUrl,
+
+		TLSClientAuthSubjectDN:         req.Client.TlsClientAuthSubjectDn,
+		TLSClientCertificateThumbprint: req.Client.TlsClientCertificateThumbprint,
+	}
+	for _, m := range req.Client.ClaimMappings {
+		c.ClaimMappings = append(c.ClaimMappings, storage.ClaimMapping{
+			Claim:    m.Claim,
+			From:     m.From,
+			Template: m.Template,
+			Scope:    m.Scope,
+		})
+	}
+	if err := validateClaimMappings(c.ClaimMappings); err != nil {
+		return nil, fmt.Errorf("invalid claim mappings: %v", err)
+	}
+	switch c.SubjectType {
+	case "", subjectTypePublic, subjectTypePairwise:
+	default:
+		return nil, fmt.Errorf("invalid subject type %q", c.SubjectType)
+	}
+	if len(req.Client.Jwks) > 0 {
+		c.JWKS = new(jose.JSONWebKeySet)
+		if err := json.Unmarshal(req.Client.Jwks, c.JWKS); err != nil {
+			return nil, fmt.Errorf("invalid jwks: %v", err)
+		}
+	}
+	if err := validateClientKeys(c); err != nil {
+		return nil, err
+	}
+	// Only the hash of the secret is stored. The response is the only time the
+	// caller sees a generated secret.
+	if c.SecretHash == "" && c.TokenEndpointAuthMethod != authMethodClientSecretJWT {
+		hash, err := hashClientSecret(c.Secret)
+		if err != nil {
+			d.logger.Errorf("api: failed to hash client secret: %v", err)
+			return nil, fmt.Errorf("hash client secret: %v", err)
+		}
+		c.Secret, c.SecretHash = "", hash
 	}
 	if err := d.s.CreateClient(c); err != nil {
 		d.logger.Errorf("api: failed to create client: %v", err)
@@ -65,3 +65,69 @@ func TestPassword(t *testing.T) {
 	}
 
 }
+
+// Ensures client secrets are only stored hashed.
+func TestCreateClientSecret(t *testing.T) {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+		Level:     logrus.DebugLevel,
+	}
+
+	s := memory.New(logger)
+	serv := NewAPI(s, logger)
+	ctx := context.Background()
+
+	resp, err := serv.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: "generated"}})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	if resp.Client.Secret == "" {
+		t.Fatalf("Expected a generated secret to be returned")
+	}
+	client, err := s.GetClient("generated")
+	if err != nil {
+		t.Fatalf("Unable to retrieve client: %v", err)
+	}
+	if client.Secret != "" {
+		t.Errorf("Expected secret not to be stored in plaintext")
+	}
+	if !verifyClientSecret(client, resp.Client.Secret) {
+		t.Errorf("Expected stored hash to match the returned secret")
+	}
+
+	// bcrypt hash of the value "test1" with cost 10
+	hash := "$2a$10$XVMN/Fid.Ks4CXgzo8fpR.iU1khOMsP5g9xQeXuBm1wXjRX8pjUtO"
+	if _, err := serv.CreateClient(ctx, &api.CreateClientReq{Client: &api.Client{Id: "hashed", SecretHash: hash}}); err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	if client, err = s.GetClient("hashed"); err != nil {
+		t.Fatalf("Unable to retrieve client: %v", err)
+	}
+	if client.SecretHash != hash || !verifyClientSecret(client, "test1") {
+		t.Errorf("Expected given secret hash to be stored, got %q", client.SecretHash)
+	}
+
+	// Clients signing JWTs with their secret keep it in plaintext.
+	jwtClient := &api.Client{Id: "jwt", Secret: "jwtsecret", TokenEndpointAuthMethod: authMethodClientSecretJWT}
+	if _, err := serv.CreateClient(ctx, &api.CreateClientReq{Client: jwtClient}); err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	if client, err = s.GetClient("jwt"); err != nil {
+		t.Fatalf("Unable to retrieve client: %v", err)
+	}
+	if client.Secret != "jwtsecret" || client.SecretHash != "" {
+		t.Errorf("Expected client_secret_jwt client to keep its plaintext secret")
+	}
+
+	badClients := []*api.Client{
+		{Id: "both", Secret: "secret", SecretHash: hash},
+		{Id: "lowcost", SecretHash: "$2a$04$tJwLlIyXyeRRFxtBC5Bk4eEjdb87UOJA1EGiyM9/HSOafKEiArkKK"},
+		{Id: "jwthashed", SecretHash: hash, TokenEndpointAuthMethod: authMethodClientSecretJWT},
+	}
+	for _, c := range badClients {
+		if _, err := serv.CreateClient(ctx, &api.CreateClientReq{Client: c}); err == nil {
+			t.Errorf("Expected client %q to be rejected", c.Id)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/dex/storage"
+)
+
+// The device authorization grant lets devices without a browser, such as CLIs,
+// obtain tokens. The device displays a short user code which the end user enters
+// at the verification page on another device, then logs in as they normally would.
+// Meanwhile the device polls the token endpoint until the login completes.
+//
+// See: https://tools.ietf.org/html/rfc8628
+
+const (
+	// deviceCallbackURI is the redirect URI used when the end user completes the
+	// authorization request started from the verification page.
+	deviceCallbackURI = "/device/callback"
+
+	deviceCodeValidFor = 5 * time.Minute
+
+	// Minimum number of seconds the device must wait between polling requests.
+	devicePollInterval = 5
+
+	// Number of seconds added to the polling interval each time the device is
+	// told to slow down.
+	deviceSlowDownIncrease = 5
+)
+
+// Characters used for user codes. Vowels are omitted to avoid spelling words, and
+// the remaining characters are hard to confuse with each other.
+//
+// See: https://tools.ietf.org/html/rfc8628#section-6.1
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+
+// newUserCode returns a random user code of the form "XXXX-XXXX".
+func newUserCode() (string, error) {
+	max := big.NewInt(int64(len(userCodeCharset)))
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeCharset[n.Int64()]
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// normalizeUserCode accepts user codes as end users are likely to type them: in
+// lower case, with spaces, or without the dash.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.Join(strings.Fields(userCode), ""))
+	userCode = strings.Replace(userCode, "-", "", -1)
+	if len(userCode) != 8 {
+		return userCode
+	}
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+// isUserCode reports whether a normalized user code is of the form "XXXX-XXXX"
+// with characters of the user code charset.
+func isUserCode(userCode string) bool {
+	if len(userCode) != 9 || userCode[4] != '-' {
+		return false
+	}
+	for i, c := range userCode {
+		if i != 4 && !strings.ContainsRune(userCodeCharset, c) {
+			return false
+		}
+	}
+	return true
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// handleDeviceCode starts a device authorization request.
+//
+// See: https://tools.ietf.org/html/rfc8628#section-3.1
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.tokenErrHelper(w, errInvalidRequest, "Device authorization requests must use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Devices are typically public clients and can't keep a secret. The device code
+	// can only be redeemed by the client it was issued to.
+	client, _, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	scopes := strings.Fields(r.PostFormValue("scope"))
+	if !hasScope(scopes, scopeOpenID) {
+		s.tokenErrHelper(w, errInvalidScope, `Missing required scope(s) ["openid"].`, http.StatusBadRequest)
+		return
+	}
+
+	userCode, err := newUserCode()
+	if err != nil {
+		s.logger.Errorf("failed to generate user code: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	now := s.now()
+	expiry := now.Add(deviceCodeValidFor)
+	req := storage.DeviceRequest{
+		UserCode:   userCode,
+		DeviceCode: storage.NewID(),
+		ClientID:   client.ID,
+		Scopes:     scopes,
+		Expiry:     expiry,
+	}
+	if err := s.storage.CreateDeviceRequest(req); err != nil {
+		s.logger.Errorf("failed to create device request: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	token := storage.DeviceToken{
+		DeviceCode:          req.DeviceCode,
+		ClientID:            client.ID,
+		Status:              storage.DeviceTokenPending,
+		Expiry:              expiry,
+		LastRequestTime:     now,
+		PollIntervalSeconds: devicePollInterval,
+	}
+	if err := s.storage.CreateDeviceToken(token); err != nil {
+		s.logger.Errorf("failed to create device token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	resp := deviceCodeResponse{
+		DeviceCode:              req.DeviceCode,
+		UserCode:                userCode,
+		VerificationURI:         s.absURL("/device"),
+		VerificationURIComplete: s.absURL("/device") + "?" + url.Values{"user_code": {userCode}}.Encode(),
+		ExpiresIn:               int(deviceCodeValidFor.Seconds()),
+		Interval:                devicePollInterval,
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Errorf("failed to marshal device code response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenData(w, data)
+}
+
+// handleDeviceVerification is the page where the end user enters the user code
+// displayed by the device. A valid code starts a regular authorization request on
+// behalf of the device.
+func (s *Server) handleDeviceVerification(w http.ResponseWriter, r *http.Request) {
+	postURL := s.absPath("/device")
+
+	switch r.Method {
+	case "GET":
+		// The user code is present if the end user followed verification_uri_complete.
+		// Still have them submit it so they can compare it with the device. Values
+		// which can't be user codes aren't reflected on the page.
+		userCode := normalizeUserCode(r.FormValue("user_code"))
+		if !isUserCode(userCode) {
+			userCode = ""
+		}
+		if err := s.templates.device(w, postURL, userCode, false); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+	case "POST":
+		userCode := normalizeUserCode(r.PostFormValue("user_code"))
+		req, err := s.storage.GetDeviceRequest(userCode)
+		if err != nil || s.now().After(req.Expiry) {
+			if err != nil && err != storage.ErrNotFound {
+				s.logger.Errorf("Failed to get device request: %v", err)
+				s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+				return
+			}
+			if !isUserCode(userCode) {
+				userCode = ""
+			}
+			if err := s.templates.device(w, postURL, userCode, true); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
+			}
+			return
+		}
+
+		q := url.Values{}
+		q.Set("client_id", req.ClientID)
+		q.Set("scope", strings.Join(req.Scopes, " "))
+		q.Set("response_type", responseTypeCode)
+		q.Set("redirect_uri", s.absURL(deviceCallbackURI))
+		q.Set("state", req.UserCode)
+		http.Redirect(w, r, s.absPath("/auth")+"?"+q.Encode(), http.StatusSeeOther)
+	default:
+		s.renderError(w, http.StatusBadRequest, "Unsupported request method.")
+	}
+}
+
+var errDeviceTokenNotPending = errors.New("device token is not pending")
+
+// handleDeviceCallback redeems the code issued at the end of the authorization
+// request started by the verification page, and stores the tokens for the device
+// to pick up.
+func (s *Server) handleDeviceCallback(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	userCode := r.FormValue("state")
+
+	authCode, err := s.storage.GetAuthCode(code)
+	if err != nil || s.now().After(authCode.Expiry) || authCode.RedirectURI != s.absURL(deviceCallbackURI) {
+		if err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to get auth code: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		s.renderError(w, http.StatusBadRequest, "Invalid or expired code parameter.")
+		return
+	}
+
+	req, err := s.storage.GetDeviceRequest(userCode)
+	if err != nil || s.now().After(req.Expiry) || req.ClientID != authCode.ClientID {
+		if err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to get device request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		s.renderError(w, http.StatusBadRequest, "Invalid or expired user code.")
+		return
+	}
+
+	// Scopes could have been added to the authorization request by hand. Only grant
+	// the ones the device asked for.
+	for _, scope := range authCode.Scopes {
+		if !hasScope(req.Scopes, scope) {
+			s.renderError(w, http.StatusBadRequest, fmt.Sprintf("Scope %q was not requested by the device.", scope))
+			return
+		}
+	}
+
+	client, err := s.storage.GetClient(req.ClientID)
+	if err != nil {
+		s.logger.Errorf("Failed to get client: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+
+	if err := s.storage.DeleteAuthCode(code); err != nil {
+		s.logger.Errorf("Failed to delete auth code: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+
+	resp, err := s.newTokenResponse(authCode, "")
+	if err != nil {
+		s.logger.Errorf("Failed to issue tokens: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Errorf("Failed to marshal access token response: %v", err)
+		s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+
+	updater := func(old storage.DeviceToken) (storage.DeviceToken, error) {
+		if old.Status != storage.DeviceTokenPending {
+			return old, errDeviceTokenNotPending
+		}
+		old.Status = storage.DeviceTokenComplete
+		old.Token = data
+		return old, nil
+	}
+	if err := s.storage.UpdateDeviceToken(req.DeviceCode, updater); err != nil {
+		if err != storage.ErrNotFound && err != errDeviceTokenNotPending {
+			s.logger.Errorf("Failed to update device token: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		s.renderError(w, http.StatusBadRequest, "Invalid or expired user code.")
+		return
+	}
+
+	if err := s.templates.deviceSuccess(w, client.Name); err != nil {
+		s.logger.Errorf("Server template error: %v", err)
+	}
+}
+
+// handleDeviceToken handles the device polling the token endpoint.
+//
+// See: https://tools.ietf.org/html/rfc8628#section-3.4
+func (s *Server) handleDeviceToken(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "No device_code in request.", http.StatusBadRequest)
+		return
+	}
+
+	now := s.now()
+
+	// Record the time of this request, and hand out the tokens at most once by
+	// expiring the device code as soon as they're picked up. Devices polling too
+	// often are told to slow down, and must wait longer from then on.
+	//
+	// See: https://tools.ietf.org/html/rfc8628#section-3.5
+	var (
+		token    storage.DeviceToken
+		slowDown bool
+	)
+	updater := func(old storage.DeviceToken) (storage.DeviceToken, error) {
+		token = old
+		if old.ClientID != client.ID {
+			return old, nil
+		}
+		interval := time.Duration(old.PollIntervalSeconds) * time.Second
+		if !now.After(old.Expiry) && old.Status != storage.DeviceTokenComplete && now.Before(old.LastRequestTime.Add(interval)) {
+			slowDown = true
+			old.PollIntervalSeconds += deviceSlowDownIncrease
+		}
+		old.LastRequestTime = now
+		if old.Status == storage.DeviceTokenComplete && !now.After(old.Expiry) {
+			old.Token = nil
+			old.Expiry = now
+		}
+		return old, nil
+	}
+	if err := s.storage.UpdateDeviceToken(deviceCode, updater); err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("failed to update device token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			s.tokenErrHelper(w, errInvalidGrant, "Invalid device code.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	switch {
+	case token.ClientID != client.ID:
+		s.tokenErrHelper(w, errInvalidGrant, "Invalid device code.", http.StatusBadRequest)
+	case now.After(token.Expiry):
+		s.tokenErrHelper(w, errExpiredToken, "", http.StatusBadRequest)
+	case token.Status == storage.DeviceTokenComplete:
+		s.writeTokenData(w, token.Token)
+	case slowDown:
+		s.tokenErrHelper(w, errSlowDown, "", http.StatusBadRequest)
+	default:
+		s.tokenErrHelper(w, errAuthorizationPending, "", http.StatusBadRequest)
+	}
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -63,12 +65,12 @@ func (s *Server) handlePublicKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	pubKeys := keys.PublicKeys()
 	jwks := jose.JSONWebKeySet{
-		Keys: make([]jose.JSONWebKey, len(keys.VerificationKeys)+1),
+		Keys: make([]jose.JSONWebKey, len(pubKeys)),
 	}
-	jwks.Keys[0] = *keys.SigningKeyPub
-	for i, verificationKey := range keys.VerificationKeys {
-		jwks.Keys[i+1] = *verificationKey.PublicKey
+	for i, key := range pubKeys {
+		jwks.Keys[i] = *key
 	}
 
 	data, err := json.MarshalIndent(jwks, "", "  ")
@@ -92,36 +94,125 @@ type discovery struct {
 	Issuer        string   `json:"issuer"`
 	Auth          string   `json:"authorization_endpoint"`
 	Token         string   `json:"token_endpoint"`
+	UserInfo      string   `json:"userinfo_endpoint"`
+	Revocation    string   `json:"revocation_endpoint"`
+	Introspection string   `json:"introspection_endpoint"`
+	EndSession    string   `json:"end_session_endpoint"`
+	DeviceAuth    string   `json:"device_authorization_endpoint"`
+	PushedAuth    string   `json:"pushed_authorization_request_endpoint"`
+	Registration  string   `json:"registration_endpoint,omitempty"`
 	Keys          string   `json:"jwks_uri"`
 	ResponseTypes []string `json:"response_types_supported"`
+	ResponseModes []string `json:"response_modes_supported"`
+	GrantTypes    []string `json:"grant_types_supported"`
 	Subjects      []string `json:"subject_types_supported"`
 	IDTokenAlgs   []string `json:"id_token_signing_alg_values_supported"`
 	Scopes        []string `json:"scopes_supported"`
 	AuthMethods   []string `json:"token_endpoint_auth_methods_supported"`
-	Claims        []string `json:"claims_supported"`
+
+	AuthSigningAlgs []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+
+	Claims []string `json:"claims_supported"`
+
+	ClaimsParameter bool `json:"claims_parameter_supported"`
+
+	CodeChallengeAlgs []string `json:"code_challenge_methods_supported"`
+
+	RequestParameter    bool     `json:"request_parameter_supported"`
+	RequestURIParameter bool     `json:"request_uri_parameter_supported"`
+	RequestObjectAlgs   []string `json:"request_object_signing_alg_values_supported"`
+
+	CertBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens,omitempty"`
 }
 
 func (s *Server) discoveryHandler() (http.HandlerFunc, error) {
 	d := discovery{
-		Issuer:      s.issuerURL.String(),
-		Auth:        s.absURL("/auth"),
-		Token:       s.absURL("/token"),
-		Keys:        s.absURL("/keys"),
-		Subjects:    []string{"public"},
-		IDTokenAlgs: []string{string(jose.RS256)},
-		Scopes:      []string{"openid", "email", "groups", "profile", "offline_access"},
-		AuthMethods: []string{"client_secret_basic"},
+		Issuer:        s.issuerURL.String(),
+		Auth:          s.absURL("/auth"),
+		Token:         s.absURL("/token"),
+		UserInfo:      s.absURL("/userinfo"),
+		Revocation:    s.absURL("/revoke"),
+		Introspection: s.absURL("/introspect"),
+		EndSession:    s.absURL("/end_session"),
+		DeviceAuth:    s.absURL("/device/code"),
+		PushedAuth:    s.absURL("/par"),
+		Keys:          s.absURL("/keys"),
+		GrantTypes: []string{
+			grantTypeAuthorizationCode,
+			grantTypeRefreshToken,
+			grantTypeClientCredentials,
+			grantTypeDeviceCode,
+			grantTypePassword,
+			grantTypeTokenExchange,
+		},
+		Subjects: []string{subjectTypePublic},
+		Scopes:   []string{"openid", "email", "groups", "profile", "offline_access"},
+		AuthMethods: []string{
+			authMethodClientSecretBasic,
+			authMethodClientSecretPost,
+			authMethodClientSecretJWT,
+			authMethodPrivateKeyJWT,
+		},
+		AuthSigningAlgs: []string{
+			string(jose.HS256), string(jose.HS384), string(jose.HS512),
+			string(jose.RS256), string(jose.RS384), string(jose.RS512),
+			string(jose.ES256), string(jose.ES384), string(jose.ES512),
+			string(jose.PS256), string(jose.PS384), string(jose.PS512),
+		},
 		Claims: []string{
-			"aud", "email", "email_verified", "exp",
-			"iat", "iss", "locale", "name", "sub",
+			"at_hash", "aud", "auth_time", "azp", "c_hash", "email", "email_verified",
+			"exp", "groups", "iat", "iss", "name", "nonce", "sub",
+		},
+		ClaimsParameter:   true,
+		CodeChallengeAlgs: []string{codeChallengeMethodS256, codeChallengeMethodPlain},
+		ResponseModes:     []string{responseModeQuery, responseModeFragment, responseModeFormPost},
+
+		RequestParameter:    true,
+		RequestURIParameter: true,
+		RequestObjectAlgs: []string{
+			string(jose.RS256), string(jose.RS384), string(jose.RS512),
+			string(jose.ES256), string(jose.ES384), string(jose.ES512),
+			string(jose.PS256), string(jose.PS384), string(jose.PS512),
 		},
 	}
 
-	for responseType := range s.supportedResponseTypes {
-		d.ResponseTypes = append(d.ResponseTypes, responseType)
+	// Response types can be combined for the hybrid flow. Advertise every
+	// combination made up of supported response types.
+	combinations := []string{
+		"code", "token", "id_token",
+		"code id_token", "code token", "id_token token",
+		"code id_token token",
+	}
+	for _, combination := range combinations {
+		supported := true
+		for _, responseType := range strings.Fields(combination) {
+			if !s.supportedResponseTypes[responseType] {
+				supported = false
+			}
+		}
+		if supported {
+			d.ResponseTypes = append(d.ResponseTypes, combination)
+		}
 	}
 	sort.Strings(d.ResponseTypes)
 
+	for _, alg := range s.signingAlgs {
+		d.IDTokenAlgs = append(d.IDTokenAlgs, string(alg))
+	}
+	if len(s.pairwiseSubjectSecret) > 0 {
+		d.Subjects = append(d.Subjects, subjectTypePairwise)
+	}
+	if s.tlsClientAuth {
+		if s.tlsClientCAs != nil {
+			d.AuthMethods = append(d.AuthMethods, authMethodTLSClientAuth)
+		}
+		d.AuthMethods = append(d.AuthMethods, authMethodSelfSignedTLSClientAuth)
+		d.CertBoundAccessTokens = true
+	}
+	if len(s.initialAccessTokens) > 0 {
+		d.Registration = s.absURL("/register")
+	}
+
 	data, err := json.MarshalIndent(d, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal discovery data: %v", err)
@@ -136,11 +227,28 @@ func (s *Server) discoveryHandler() (http.HandlerFunc, error) {
 
 // handleAuthorization handles the OAuth2 auth endpoint.
 func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
-	authReq, err := s.parseAuthorizationRequest(s.supportedResponseTypes, r)
-	if err != nil {
-		s.logger.Errorf("Failed to parse authorization request: %v", err)
-		s.renderError(w, http.StatusInternalServerError, "Failed to connect to the database.")
-		return
+	var authReq storage.AuthRequest
+	if requestURI := r.FormValue("request_uri"); strings.HasPrefix(requestURI, parRequestURIPrefix) {
+		// The request was pushed by the client, and has already been validated.
+		var ok bool
+		if authReq, ok = s.redeemPushedAuthRequest(w, r.FormValue("client_id"), requestURI); !ok {
+			return
+		}
+	} else {
+		var err *authErr
+		if authReq, err = s.parseAuthorizationRequest(s.supportedResponseTypes, r); err != nil {
+			s.logger.Errorf("Failed to parse authorization request: %v", err)
+			switch {
+			case err.RedirectURI != "":
+				// The redirect URI has been validated, report the error to the client.
+				s.writeAuthResponse(w, r, err.RedirectURI, err.ResponseMode, err.values())
+			case err.Type == errServerError:
+				s.renderError(w, http.StatusInternalServerError, "Failed to connect to the database.")
+			default:
+				s.renderError(w, http.StatusBadRequest, err.Description)
+			}
+			return
+		}
 	}
 	authReq.Expiry = s.now().Add(time.Minute * 30)
 	if err := s.storage.CreateAuthRequest(authReq); err != nil {
@@ -171,6 +279,106 @@ func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Pushed authorization requests are stored like any other authorization request
+// until the end user is sent to the authorization endpoint. The client refers to
+// them using a request URI made from the request's ID.
+const (
+	parRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	parRequestValidFor  = time.Minute
+)
+
+type pushedAuthResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// handlePushedAuthRequest validates the parameters of an authorization request
+// posted by the client, and returns a request URI to send the end user to the
+// authorization endpoint with instead. This keeps the parameters out of the
+// browser.
+//
+// See: https://tools.ietf.org/html/rfc9126
+func (s *Server) handlePushedAuthRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.tokenErrHelper(w, errInvalidRequest, "Pushed authorization requests must use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Public clients may push requests too, they're checked like any other request.
+	client, _, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if r.PostFormValue("request_uri") != "" {
+		s.tokenErrHelper(w, errInvalidRequest, "Pushed requests can't include a request_uri.", http.StatusBadRequest)
+		return
+	}
+	// The client may have authenticated using HTTP basic auth.
+	r.Form.Set("client_id", client.ID)
+
+	authReq, parseErr := s.parseAuthorizationRequest(s.supportedResponseTypes, r)
+	if parseErr != nil {
+		if parseErr.Type == errServerError {
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		s.tokenErrHelper(w, parseErr.Type, parseErr.Description, http.StatusBadRequest)
+		return
+	}
+	authReq.Expiry = s.now().Add(parRequestValidFor)
+	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		s.logger.Errorf("failed to create authorization request: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(pushedAuthResponse{
+		RequestURI: parRequestURIPrefix + authReq.ID,
+		ExpiresIn:  int(parRequestValidFor.Seconds()),
+	})
+	if err != nil {
+		s.logger.Errorf("failed to marshal pushed authorization response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// redeemPushedAuthRequest looks up the authorization request referred to by a
+// request URI from the pushed authorization request endpoint. Request URIs can
+// only be used once, so the request is removed and returned with a new ID.
+func (s *Server) redeemPushedAuthRequest(w http.ResponseWriter, clientID, requestURI string) (storage.AuthRequest, bool) {
+	id := strings.TrimPrefix(requestURI, parRequestURIPrefix)
+	authReq, err := s.storage.GetAuthRequest(id)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to get auth request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Failed to connect to the database.")
+			return authReq, false
+		}
+		s.renderError(w, http.StatusBadRequest, "Invalid or expired request_uri.")
+		return authReq, false
+	}
+	if authReq.ClientID != clientID || authReq.LoggedIn || s.now().After(authReq.Expiry) {
+		s.renderError(w, http.StatusBadRequest, "Invalid or expired request_uri.")
+		return authReq, false
+	}
+	if err := s.storage.DeleteAuthRequest(id); err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to delete auth request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Failed to connect to the database.")
+			return authReq, false
+		}
+		s.renderError(w, http.StatusBadRequest, "Invalid or expired request_uri.")
+		return authReq, false
+	}
+	authReq.ID = storage.NewID()
+	return authReq, true
+}
+
 func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 	connID := mux.Vars(r)["connector"]
 	conn, ok := s.connectors[connID]
@@ -216,7 +424,7 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 			}
 			http.Redirect(w, r, callbackURL, http.StatusFound)
 		case connector.PasswordConnector:
-			if err := s.templates.password(w, authReqID, r.URL.String(), "", false); err != nil {
+			if err := s.templates.password(w, authReqID, r.URL.String(), authReq.LoginHint, false); err != nil {
 				s.logger.Errorf("Server template error: %v", err)
 			}
 		default:
@@ -318,12 +526,14 @@ func (s *Server) finalizeLogin(identity connector.Identity, authReq storage.Auth
 		Email:         identity.Email,
 		EmailVerified: identity.EmailVerified,
 		Groups:        identity.Groups,
+		CustomClaims:  identity.CustomClaims,
 	}
 
 	updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
 		a.LoggedIn = true
 		a.Claims = claims
 		a.ConnectorData = identity.ConnectorData
+		a.AuthTime = s.now()
 		return a, nil
 	}
 	if err := s.storage.UpdateAuthRequest(authReq.ID, updater); err != nil {
@@ -347,7 +557,7 @@ func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		if s.skipApproval {
+		if s.skipApproval && !authReq.ForceApprovalPrompt {
 			s.sendCodeResponse(w, r, authReq)
 			return
 		}
@@ -357,7 +567,7 @@ func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
 			s.renderError(w, http.StatusInternalServerError, "Failed to retrieve client.")
 			return
 		}
-		if err := s.templates.approval(w, authReq.ID, authReq.Claims.Username, client.Name, authReq.Scopes); err != nil {
+		if err := s.templates.approval(w, authReq.ID, authReq.Claims.Username, client.Name, approvalScopes(authReq.Scopes, authReq.ClaimsRequest)); err != nil {
 			s.logger.Errorf("Server template error: %v", err)
 		}
 	case "POST":
@@ -384,75 +594,140 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		}
 		return
 	}
-	u, err := url.Parse(authReq.RedirectURI)
-	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, "Invalid redirect URI.")
-		return
-	}
-	q := u.Query()
 
+	var hasCode, hasToken, hasIDToken bool
 	for _, responseType := range authReq.ResponseTypes {
 		switch responseType {
 		case responseTypeCode:
-			code := storage.AuthCode{
-				ID:            storage.NewID(),
-				ClientID:      authReq.ClientID,
-				ConnectorID:   authReq.ConnectorID,
-				Nonce:         authReq.Nonce,
-				Scopes:        authReq.Scopes,
-				Claims:        authReq.Claims,
-				Expiry:        s.now().Add(time.Minute * 30),
-				RedirectURI:   authReq.RedirectURI,
-				ConnectorData: authReq.ConnectorData,
-			}
-			if err := s.storage.CreateAuthCode(code); err != nil {
-				s.logger.Errorf("Failed to create auth code: %v", err)
-				s.renderError(w, http.StatusInternalServerError, "Internal server error.")
-				return
-			}
-
-			if authReq.RedirectURI == redirectURIOOB {
-				if err := s.templates.oob(w, code.ID); err != nil {
-					s.logger.Errorf("Server template error: %v", err)
-				}
-				return
-			}
-			q.Set("code", code.ID)
+			hasCode = true
 		case responseTypeToken:
-			idToken, expiry, err := s.newIDToken(authReq.ClientID, authReq.Claims, authReq.Scopes, authReq.Nonce)
-			if err != nil {
-				s.logger.Errorf("failed to create ID token: %v", err)
-				s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
-				return
+			hasToken = true
+		case responseTypeIDToken:
+			hasIDToken = true
+		}
+	}
+
+	var code string
+	if hasCode {
+		authCode := storage.AuthCode{
+			ID:            storage.NewID(),
+			ClientID:      authReq.ClientID,
+			ConnectorID:   authReq.ConnectorID,
+			Nonce:         authReq.Nonce,
+			Scopes:        authReq.Scopes,
+			Claims:        authReq.Claims,
+			AuthTime:      authReq.AuthTime,
+			Expiry:        s.now().Add(time.Minute * 30),
+			RedirectURI:   authReq.RedirectURI,
+			ConnectorData: authReq.ConnectorData,
+			PKCE:          authReq.PKCE,
+			ClaimsRequest: authReq.ClaimsRequest,
+		}
+		if err := s.storage.CreateAuthCode(authCode); err != nil {
+			s.logger.Errorf("Failed to create auth code: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+
+		if authReq.RedirectURI == redirectURIOOB {
+			if err := s.templates.oob(w, authCode.ID); err != nil {
+				s.logger.Errorf("Server template error: %v", err)
 			}
-			v := url.Values{}
-			v.Set("access_token", storage.NewID())
-			v.Set("token_type", "bearer")
-			v.Set("id_token", idToken)
-			v.Set("state", authReq.State)
-			v.Set("expires_in", strconv.Itoa(int(expiry.Sub(s.now()).Seconds())))
-			u.Fragment = v.Encode()
+			return
 		}
+		code = authCode.ID
 	}
 
-	q.Set("state", authReq.State)
-	u.RawQuery = q.Encode()
+	v := url.Values{}
+	if hasCode {
+		v.Set("code", code)
+	}
+
+	var accessToken string
+	if hasToken {
+		token, expiry, err := s.newAccessToken(authReq.ClientID, authReq.Claims, authReq.Scopes, authReq.ConnectorID, authReq.ClaimsRequest, "")
+		if err != nil {
+			s.logger.Errorf("failed to create access token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		accessToken = token
+		v.Set("access_token", accessToken)
+		v.Set("token_type", "bearer")
+		v.Set("expires_in", strconv.Itoa(int(expiry.Sub(s.now()).Seconds())))
+	}
+
+	// For backwards compatibility, the implicit flow also returns an ID token when
+	// only "token" is requested. The ID token is minted last so it can include the
+	// hashes of the code and access token issued alongside it.
+	if hasIDToken || !hasCode {
+		idToken, _, err := s.newIDToken(authReq.ClientID, authReq.Claims, authReq.Scopes, authReq.Nonce, accessToken, code, authReq.AuthTime, authReq.ConnectorID, authReq.ClaimsRequest)
+		if err != nil {
+			s.logger.Errorf("failed to create ID token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		v.Set("id_token", idToken)
+	}
+
+	v.Set("state", authReq.State)
+	s.writeAuthResponse(w, r, authReq.RedirectURI, responseModeOrDefault(authReq.ResponseMode, authReq.ResponseTypes), v)
+}
+
+// writeAuthResponse returns the results of an authorization request, or an error,
+// to the client's redirect URI using the given response mode.
+func (s *Server) writeAuthResponse(w http.ResponseWriter, r *http.Request, redirectURI, responseMode string, v url.Values) {
+	if responseMode == responseModeFormPost {
+		if err := s.templates.formPost(w, redirectURI, v); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+		return
+	}
+
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		s.renderError(w, http.StatusInternalServerError, "Invalid redirect URI.")
+		return
+	}
+	if responseMode == responseModeFragment {
+		u.Fragment = v.Encode()
+	} else {
+		q := u.Query()
+		for k, values := range v {
+			q[k] = values
+		}
+		u.RawQuery = q.Encode()
+	}
 	http.Redirect(w, r, u.String(), http.StatusSeeOther)
 }
 
-func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+// authenticateClient identifies the client making a request to the token,
+// revocation or introspection endpoints, using either HTTP basic auth, the
+// "client_id" and "client_secret" form values, a client assertion, or the
+// certificate presented over mutual TLS.
+//
+// Public clients can't keep a secret and may omit it, in which case authenticated
+// is false and it's up to the caller to decide whether to allow the request. If the
+// client can't be identified, an error response is written and ok is false.
+func (s *Server) authenticateClient(w http.ResponseWriter, r *http.Request) (client storage.Client, authenticated, ok bool) {
+	if r.PostFormValue("client_assertion_type") != "" || r.PostFormValue("client_assertion") != "" {
+		return s.authenticateClientAssertion(w, r)
+	}
+
+	method := authMethodClientSecretBasic
 	clientID, clientSecret, ok := r.BasicAuth()
 	if ok {
 		var err error
 		if clientID, err = url.QueryUnescape(clientID); err != nil {
 			s.tokenErrHelper(w, errInvalidRequest, "client_id improperly encoded", http.StatusBadRequest)
-			return
+			return client, false, false
 		}
 		if clientSecret, err = url.QueryUnescape(clientSecret); err != nil {
 			s.tokenErrHelper(w, errInvalidRequest, "client_secret improperly encoded", http.StatusBadRequest)
-			return
+			return client, false, false
 		}
 	} else {
+		method = authMethodClientSecretPost
 		clientID = r.PostFormValue("client_id")
 		clientSecret = r.PostFormValue("client_secret")
 	}
@@ -465,28 +740,299 @@ func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
 		} else {
 			s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
 		}
+		return client, false, false
+	}
+
+	switch {
+	case clientSecret == "" && (client.TLSClientAuthSubjectDN != "" || client.TLSClientCertificateThumbprint != ""):
+		// Clients registered for mutual TLS authenticate with their certificate.
+		if method, err = s.verifyClientCertificate(client, r); err != nil {
+			s.tokenErrHelper(w, errInvalidClient, fmt.Sprintf("Invalid client certificate: %v.", err), http.StatusUnauthorized)
+			return client, false, false
+		}
+	case clientSecret == "" || !verifyClientSecret(client, clientSecret):
+		// An omitted secret never authenticates the client, even one which has no
+		// secret, as is usual for public clients.
+		if !client.Public || clientSecret != "" {
+			s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+			return client, false, false
+		}
+		return client, false, true
+	}
+	if client.TokenEndpointAuthMethod != "" && client.TokenEndpointAuthMethod != method {
+		s.tokenErrHelper(w, errInvalidClient, fmt.Sprintf("Client must authenticate with %s.", client.TokenEndpointAuthMethod), http.StatusUnauthorized)
+		return client, false, false
+	}
+	return client, true, true
+}
+
+// authenticateClientAssertion authenticates a client with a JWT signed with its
+// secret, "client_secret_jwt", or its private key, "private_key_jwt". Each JWT is
+// remembered until it expires so it can only be used once.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+func (s *Server) authenticateClientAssertion(w http.ResponseWriter, r *http.Request) (client storage.Client, authenticated, ok bool) {
+	invalidClient := func(description string) (storage.Client, bool, bool) {
+		s.tokenErrHelper(w, errInvalidClient, description, http.StatusUnauthorized)
+		return client, false, false
+	}
+
+	if r.PostFormValue("client_assertion_type") != clientAssertionTypeJWTBearer {
+		s.tokenErrHelper(w, errInvalidRequest, "Unsupported client_assertion_type.", http.StatusBadRequest)
+		return client, false, false
+	}
+	assertion := r.PostFormValue("client_assertion")
+
+	// The client is identified by the JWT, whose claims are only trusted once it's
+	// verified with the client's credentials.
+	clientID, err := clientAssertionSubject(assertion)
+	if err != nil {
+		return invalidClient(fmt.Sprintf("Invalid client assertion: %v.", err))
+	}
+	if id := r.PostFormValue("client_id"); id != "" && id != clientID {
+		return invalidClient("Client assertion doesn't match client_id.")
+	}
+	client, err = s.storage.GetClient(clientID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("failed to get client: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return client, false, false
+		}
+		return invalidClient("Invalid client credentials.")
+	}
+
+	claims, method, err := s.verifyClientAssertion(client, assertion)
+	if err != nil {
+		return invalidClient(fmt.Sprintf("Invalid client assertion: %v.", err))
+	}
+	if client.TokenEndpointAuthMethod != "" && client.TokenEndpointAuthMethod != method {
+		return invalidClient(fmt.Sprintf("Client must authenticate with %s.", client.TokenEndpointAuthMethod))
+	}
+	endpoint := s.issuerURL
+	endpoint.Path = r.URL.Path
+	if err := s.validateClientAssertion(client, claims, endpoint.String()); err != nil {
+		return invalidClient(fmt.Sprintf("Invalid client assertion: %v.", err))
+	}
+
+	err = s.storage.CreateClientAssertion(storage.ClientAssertion{
+		ID:       clientAssertionID(client.ID, claims.JWTID),
+		ClientID: client.ID,
+		Expiry:   time.Unix(claims.Expiry, 0),
+	})
+	if err != nil {
+		if err == storage.ErrAlreadyExists {
+			return invalidClient("Client assertion has already been used.")
+		}
+		s.logger.Errorf("failed to create client assertion: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return client, false, false
+	}
+	return client, true, true
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	client, authenticated, ok := s.authenticateClient(w, r)
+	if !ok {
 		return
 	}
-	if client.Secret != clientSecret {
+
+	grantType := r.PostFormValue("grant_type")
+
+	// Public clients may omit their secret when redeeming a code, in which case
+	// the code must have been requested with a PKCE challenge, or when polling for
+	// a device code since the device code itself is the secret.
+	if !authenticated && grantType != grantTypeAuthorizationCode && grantType != grantTypeDeviceCode {
 		s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
 		return
 	}
 
-	grantType := r.PostFormValue("grant_type")
 	switch grantType {
 	case grantTypeAuthorizationCode:
-		s.handleAuthCode(w, r, client)
+		s.handleAuthCode(w, r, client, !authenticated)
 	case grantTypeRefreshToken:
 		s.handleRefreshToken(w, r, client)
+	case grantTypeClientCredentials:
+		s.handleClientCredentials(w, r, client)
+	case grantTypeDeviceCode:
+		s.handleDeviceToken(w, r, client)
+	case grantTypePassword:
+		s.handlePasswordGrant(w, r, client)
+	case grantTypeTokenExchange:
+		s.handleTokenExchange(w, r, client)
 	default:
 		s.tokenErrHelper(w, errInvalidGrant, "", http.StatusBadRequest)
 	}
 }
 
+// handleRevocation revokes a refresh token issued to the calling client.
+//
+// See: https://tools.ietf.org/html/rfc7009
+func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.tokenErrHelper(w, errInvalidRequest, "Revocation requests must use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Public clients may revoke their own tokens without a secret. Knowing the
+	// token is proof enough since it can't be used by any other client.
+	client, _, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "No token in request.", http.StatusBadRequest)
+		return
+	}
+
+	// Access tokens are self-contained and can't be revoked, they're only valid
+	// until they expire.
+	if r.PostFormValue("token_type_hint") == tokenTypeAccessToken {
+		s.tokenErrHelper(w, errUnsupportedTokenType, "Access tokens can't be revoked.", http.StatusBadRequest)
+		return
+	}
+
+	refresh, err := s.storage.GetRefresh(token)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("failed to get refresh token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		if _, err := s.verifyAccessToken(token); err == nil {
+			s.tokenErrHelper(w, errUnsupportedTokenType, "Access tokens can't be revoked.", http.StatusBadRequest)
+			return
+		}
+		// Invalid tokens, including ones which have already been revoked, don't
+		// cause an error response.
+		//
+		// https://tools.ietf.org/html/rfc7009#section-2.2
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if refresh.ClientID != client.ID {
+		s.tokenErrHelper(w, errInvalidRequest, "Token was not issued to this client.", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storage.DeleteRefresh(token); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("failed to delete refresh token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// introspectionResponse is the response of the token introspection endpoint.
+//
+// See: https://tools.ietf.org/html/rfc7662#section-2.2
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Subject  string `json:"sub,omitempty"`
+	Expiry   int64  `json:"exp,omitempty"`
+	Issuer   string `json:"iss,omitempty"`
+
+	Confirmation *confirmation `json:"cnf,omitempty"`
+}
+
+// handleIntrospection lets resource servers determine if an access or refresh
+// token is still active.
+//
+// See: https://tools.ietf.org/html/rfc7662
+func (s *Server) handleIntrospection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.tokenErrHelper(w, errInvalidRequest, "Introspection requests must use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Only clients which can authenticate may introspect tokens. Public clients
+	// which omit their secret only identify themselves, and are rejected.
+	_, authenticated, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if !authenticated {
+		s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "No token in request.", http.StatusBadRequest)
+		return
+	}
+
+	var resp introspectionResponse
+	if tok, err := s.verifyAccessToken(token); err == nil {
+		resp = introspectionResponse{
+			Active:   true,
+			Scope:    tok.Scope,
+			ClientID: tok.Audience,
+			Subject:  tok.Subject,
+			Expiry:   tok.Expiry,
+			Issuer:   tok.Issuer,
+
+			Confirmation: tok.Confirmation,
+		}
+	} else {
+		refresh, err := s.storage.GetRefresh(token)
+		switch err {
+		case nil:
+			_, _, expiry := s.refreshTokenLifetime(refresh)
+			if refresh.Rotated || (!expiry.IsZero() && s.now().After(expiry)) {
+				// Rotated tokens are only kept to detect reuse.
+				break
+			}
+			sub, err := s.refreshTokenSubject(refresh)
+			if err != nil {
+				s.logger.Errorf("failed to get refresh token subject: %v", err)
+				s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+				return
+			}
+			resp = introspectionResponse{
+				Active:   true,
+				Scope:    strings.Join(refresh.Scopes, " "),
+				ClientID: refresh.ClientID,
+				Subject:  sub,
+				Issuer:   s.issuerURL.String(),
+
+				Confirmation: newConfirmation(refresh.CertThumbprint),
+			}
+			if !expiry.IsZero() {
+				resp.Expiry = expiry.Unix()
+			}
+		case storage.ErrNotFound:
+			// Unknown, expired and revoked tokens are all reported as inactive.
+		default:
+			s.logger.Errorf("failed to get refresh token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Errorf("failed to marshal introspection response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
 // handle an access token request https://tools.ietf.org/html/rfc6749#section-4.1.3
-func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client storage.Client) {
+//
+// If requirePKCE is true, the client didn't authenticate and the code must be bound
+// to a PKCE challenge.
+func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client storage.Client, requirePKCE bool) {
 	code := r.PostFormValue("code")
 	redirectURI := r.PostFormValue("redirect_uri")
+	codeVerifier := r.PostFormValue("code_verifier")
 
 	authCode, err := s.storage.GetAuthCode(code)
 	if err != nil || s.now().After(authCode.Expiry) || authCode.ClientID != client.ID {
@@ -504,48 +1050,83 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 		return
 	}
 
-	idToken, expiry, err := s.newIDToken(client.ID, authCode.Claims, authCode.Scopes, authCode.Nonce)
-	if err != nil {
-		s.logger.Errorf("failed to create ID token: %v", err)
-		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+	switch {
+	case authCode.PKCE.CodeChallenge != "":
+		if !verifyCodeVerifier(authCode.PKCE, codeVerifier) {
+			s.tokenErrHelper(w, errInvalidGrant, "Invalid code_verifier.", http.StatusBadRequest)
+			return
+		}
+	case requirePKCE:
+		s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		return
+	case codeVerifier != "":
+		s.tokenErrHelper(w, errInvalidRequest, "No PKCE challenge was sent in the initial request.", http.StatusBadRequest)
 		return
 	}
 
+	// Delete the code before issuing tokens so it can't be redeemed twice.
 	if err := s.storage.DeleteAuthCode(code); err != nil {
 		s.logger.Errorf("failed to delete auth code: %v", err)
 		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
 
-	reqRefresh := func() bool {
-		for _, scope := range authCode.Scopes {
-			if scope == scopeOfflineAccess {
-				return true
-			}
-		}
-		return false
-	}()
+	resp, err := s.newTokenResponse(authCode, requestCertThumbprint(r))
+	if err != nil {
+		s.logger.Errorf("failed to issue tokens: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenResponse(w, resp)
+}
+
+// newTokenResponse mints the ID and access tokens for a redeemed authorization code,
+// along with a refresh token if the "offline_access" scope was granted. Grants that
+// log the end user in directly describe the login with an unsaved code.
+//
+// If certThumbprint is set, the access and refresh tokens are bound to the client
+// certificate with that thumbprint.
+func (s *Server) newTokenResponse(authCode storage.AuthCode, certThumbprint string) (tokenResponse, error) {
+	accessToken, _, err := s.newAccessToken(authCode.ClientID, authCode.Claims, authCode.Scopes, authCode.ConnectorID, authCode.ClaimsRequest, certThumbprint)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("create access token: %v", err)
+	}
+	idToken, expiry, err := s.newIDToken(authCode.ClientID, authCode.Claims, authCode.Scopes, authCode.Nonce, accessToken, "", authCode.AuthTime, authCode.ConnectorID, authCode.ClaimsRequest)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("create ID token: %v", err)
+	}
+
 	var refreshToken string
-	if reqRefresh {
+	if hasScope(authCode.Scopes, scopeOfflineAccess) {
+		now := s.now()
 		refresh := storage.RefreshToken{
-			RefreshToken:  storage.NewID(),
-			ClientID:      authCode.ClientID,
-			ConnectorID:   authCode.ConnectorID,
-			Scopes:        authCode.Scopes,
-			Claims:        authCode.Claims,
-			Nonce:         authCode.Nonce,
-			ConnectorData: authCode.ConnectorData,
+			RefreshToken:   storage.NewID(),
+			ClientID:       authCode.ClientID,
+			ConnectorID:    authCode.ConnectorID,
+			Scopes:         authCode.Scopes,
+			Claims:         authCode.Claims,
+			Nonce:          authCode.Nonce,
+			ConnectorData:  authCode.ConnectorData,
+			AuthTime:       authCode.AuthTime,
+			ClaimsRequest:  authCode.ClaimsRequest,
+			CertThumbprint: certThumbprint,
+			FamilyID:       storage.NewID(),
+			CreatedAt:      now,
+			LastUsed:       now,
+			Expiry:         s.refreshTokenExpiry(now, now),
 		}
 		if err := s.storage.CreateRefresh(refresh); err != nil {
-			s.logger.Errorf("failed to create refresh token: %v", err)
-			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
-			return
+			return tokenResponse{}, fmt.Errorf("create refresh token: %v", err)
 		}
 		refreshToken = refresh.RefreshToken
 	}
-	s.writeAccessToken(w, idToken, refreshToken, expiry)
+	return s.toTokenResponse(idToken, accessToken, refreshToken, expiry), nil
 }
 
+// errRefreshTokenRotated is returned by the updater rotating a refresh token if
+// another request rotated it first.
+var errRefreshTokenRotated = errors.New("refresh token has already been rotated")
+
 // handle a refresh token request https://tools.ietf.org/html/rfc6749#section-6
 func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, client storage.Client) {
 	code := r.PostFormValue("refresh_token")
@@ -561,8 +1142,39 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 			s.logger.Errorf("failed to get auth code: %v", err)
 			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		} else {
-			s.tokenErrHelper(w, errInvalidRequest, "Refresh token is invalid or has already been claimed by another client.", http.StatusBadRequest)
+			s.tokenErrHelper(w, errInvalidGrant, "Refresh token is invalid or has already been claimed by another client.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	// A rotated token is only presented again if it leaked, since the client
+	// holding the family would use the token which replaced it. The holder can't
+	// be told apart from the thief, so the whole family is revoked.
+	if refresh.Rotated {
+		s.logger.Warnf("refresh token of client %q was reused, revoking its family", client.ID)
+		if err := s.revokeRefreshTokenFamily(refresh); err != nil {
+			s.logger.Errorf("failed to revoke refresh tokens: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
 		}
+		s.tokenErrHelper(w, errInvalidGrant, "Refresh token has already been used.", http.StatusBadRequest)
+		return
+	}
+
+	now := s.now()
+	createdAt, _, refreshExpiry := s.refreshTokenLifetime(refresh)
+	if !refreshExpiry.IsZero() && now.After(refreshExpiry) {
+		if err := s.storage.DeleteRefresh(code); err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("failed to delete refresh token: %v", err)
+		}
+		s.tokenErrHelper(w, errInvalidGrant, "Refresh token has expired.", http.StatusBadRequest)
+		return
+	}
+
+	// Refresh tokens bound to a certificate can only be used by the client holding it.
+	certThumbprint := requestCertThumbprint(r)
+	if refresh.CertThumbprint != "" && subtle.ConstantTimeCompare([]byte(refresh.CertThumbprint), []byte(certThumbprint)) != 1 {
+		s.tokenErrHelper(w, errInvalidGrant, "Refresh token is bound to another client certificate.", http.StatusBadRequest)
 		return
 	}
 
@@ -616,6 +1228,7 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 			Email:         refresh.Claims.Email,
 			EmailVerified: refresh.Claims.EmailVerified,
 			Groups:        refresh.Claims.Groups,
+			CustomClaims:  refresh.Claims.CustomClaims,
 			ConnectorData: refresh.ConnectorData,
 		}
 		ident, err := refreshConn.Refresh(r.Context(), parseScopes(scopes), ident)
@@ -632,61 +1245,613 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		refresh.Claims.Email = ident.Email
 		refresh.Claims.EmailVerified = ident.EmailVerified
 		refresh.Claims.Groups = ident.Groups
+		refresh.Claims.CustomClaims = ident.CustomClaims
 		refresh.ConnectorData = ident.ConnectorData
 	}
 
-	idToken, expiry, err := s.newIDToken(client.ID, refresh.Claims, scopes, refresh.Nonce)
+	accessToken, _, err := s.newAccessToken(client.ID, refresh.Claims, scopes, refresh.ConnectorID, refresh.ClaimsRequest, certThumbprint)
+	if err != nil {
+		s.logger.Errorf("failed to create access token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	idToken, expiry, err := s.newIDToken(client.ID, refresh.Claims, scopes, refresh.Nonce, accessToken, "", refresh.AuthTime, refresh.ConnectorID, refresh.ClaimsRequest)
 	if err != nil {
 		s.logger.Errorf("failed to create ID token: %v", err)
 		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
 
-	// Refresh tokens are claimed exactly once. Delete the current token and
-	// create a new one.
-	if err := s.storage.DeleteRefresh(code); err != nil {
-		s.logger.Errorf("failed to delete auth code: %v", err)
+	if refresh.FamilyID == "" {
+		refresh.FamilyID = storage.NewID()
+	}
+	next := refresh
+	next.RefreshToken = storage.NewID()
+	next.CreatedAt = createdAt
+	next.LastUsed = now
+	next.Expiry = s.refreshTokenExpiry(createdAt, now)
+
+	// The new token is stored before the current one points to it, so following
+	// the tokens of a family always leads to one which exists.
+	if err := s.storage.CreateRefresh(next); err != nil {
+		s.logger.Errorf("failed to create refresh token: %v", err)
 		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
-	refresh.RefreshToken = storage.NewID()
-	if err := s.storage.CreateRefresh(refresh); err != nil {
-		s.logger.Errorf("failed to create refresh token: %v", err)
+
+	// Refresh tokens are claimed exactly once. The current token is marked rotated
+	// in a single update, so only one of several requests presenting it at once
+	// succeeds and the family can't fork. The rotated token is kept to detect
+	// reuse until the family is gone.
+	err = s.storage.UpdateRefreshToken(code, func(old storage.RefreshToken) (storage.RefreshToken, error) {
+		if old.Rotated {
+			return old, errRefreshTokenRotated
+		}
+		rotated := rotatedRefreshToken(old, next.RefreshToken)
+		rotated.FamilyID = refresh.FamilyID
+		return rotated, nil
+	})
+	if err != nil {
+		if err := s.storage.DeleteRefresh(next.RefreshToken); err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("failed to delete refresh token: %v", err)
+		}
+		if err == storage.ErrNotFound || err == errRefreshTokenRotated {
+			s.tokenErrHelper(w, errInvalidGrant, "Refresh token has already been used.", http.StatusBadRequest)
+			return
+		}
+		s.logger.Errorf("failed to rotate refresh token: %v", err)
 		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
-	s.writeAccessToken(w, idToken, refresh.RefreshToken, expiry)
+	s.writeAccessToken(w, idToken, accessToken, next.RefreshToken, expiry)
 }
 
-func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, refreshToken string, expiry time.Time) {
-	// TODO(ericchiang): figure out an access token story and support the user info
-	// endpoint. For now use a random value so no one depends on the access_token
-	// holding a specific structure.
-	resp := struct {
-		AccessToken  string `json:"access_token"`
-		TokenType    string `json:"token_type"`
-		ExpiresIn    int    `json:"expires_in"`
-		RefreshToken string `json:"refresh_token,omitempty"`
-		IDToken      string `json:"id_token"`
-	}{
-		storage.NewID(),
-		"bearer",
-		int(expiry.Sub(s.now()).Seconds()),
-		refreshToken,
-		idToken,
+// rotatedRefreshToken returns what's kept of a refresh token once it has been
+// exchanged for the next token, or revoked if next is empty. It only holds what's
+// needed to detect reuse and to revoke it along with the end user's other tokens.
+// Rotated tokens never expire on their own. They're garbage collected once no
+// token of their family is left.
+func rotatedRefreshToken(token storage.RefreshToken, next string) storage.RefreshToken {
+	return storage.RefreshToken{
+		RefreshToken: token.RefreshToken,
+		ClientID:     token.ClientID,
+		ConnectorID:  token.ConnectorID,
+		Claims:       storage.Claims{UserID: token.Claims.UserID},
+		FamilyID:     token.FamilyID,
+		Rotated:      true,
+		NextToken:    next,
+		CreatedAt:    token.CreatedAt,
+		LastUsed:     token.LastUsed,
+	}
+}
+
+// handle a client credentials request https://tools.ietf.org/html/rfc6749#section-4.4
+func (s *Server) handleClientCredentials(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	if !client.AllowClientCredentials {
+		s.tokenErrHelper(w, errUnauthorizedClient, "Client is not allowed to use the client_credentials grant.", http.StatusBadRequest)
+		return
+	}
+
+	scopes := strings.Fields(r.PostFormValue("scope"))
+	var unauthorizedScopes []string
+	for _, scope := range scopes {
+		if !hasScope(client.AllowedScopes, scope) {
+			unauthorizedScopes = append(unauthorizedScopes, scope)
+		}
+	}
+	if len(unauthorizedScopes) > 0 {
+		msg := fmt.Sprintf("Requested scopes contain unauthorized scope(s): %q.", unauthorizedScopes)
+		s.tokenErrHelper(w, errInvalidScope, msg, http.StatusBadRequest)
+		return
+	}
+
+	// The client is acting on its own behalf, so it's the subject of the tokens.
+	claims := storage.Claims{
+		UserID:   client.ID,
+		Username: client.Name,
+	}
+
+	accessToken, expiry, err := s.newAccessToken(client.ID, claims, scopes, "", storage.ClaimsRequest{}, requestCertThumbprint(r))
+	if err != nil {
+		s.logger.Errorf("failed to create access token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	var idToken string
+	if hasScope(scopes, scopeOpenID) {
+		if idToken, _, err = s.newIDToken(client.ID, claims, scopes, "", accessToken, "", time.Time{}, "", storage.ClaimsRequest{}); err != nil {
+			s.logger.Errorf("failed to create ID token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Refresh tokens aren't issued since the client can always request new tokens.
+	//
+	// https://tools.ietf.org/html/rfc6749#section-4.4.3
+	s.writeAccessToken(w, idToken, accessToken, "", expiry)
+}
+
+// handle a resource owner password credentials request https://tools.ietf.org/html/rfc6749#section-4.3
+//
+// The "connector_id" parameter selects the connector that checks the credentials. It
+// may be omitted if only one connector supports password logins.
+func (s *Server) handlePasswordGrant(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	if !client.AllowPasswordGrant {
+		s.tokenErrHelper(w, errUnauthorizedClient, "Client is not allowed to use the password grant.", http.StatusBadRequest)
+		return
+	}
+
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+	if username == "" || password == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "Missing username or password.", http.StatusBadRequest)
+		return
+	}
+
+	scopes := strings.Fields(r.PostFormValue("scope"))
+	if err := s.validateScopes(client.ID, scopes); err != nil {
+		if err.Type == errServerError {
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			s.tokenErrHelper(w, err.Type, err.Description, http.StatusBadRequest)
+		}
+		return
+	}
+
+	connID := r.PostFormValue("connector_id")
+	if connID == "" {
+		var passwordConnIDs []string
+		for id, conn := range s.connectors {
+			if _, ok := conn.Connector.(connector.PasswordConnector); ok {
+				passwordConnIDs = append(passwordConnIDs, id)
+			}
+		}
+		if len(passwordConnIDs) != 1 {
+			s.tokenErrHelper(w, errInvalidRequest, "Missing connector_id parameter.", http.StatusBadRequest)
+			return
+		}
+		connID = passwordConnIDs[0]
+	}
+	conn, ok := s.connectors[connID]
+	passwordConn, isPasswordConn := conn.Connector.(connector.PasswordConnector)
+	if !ok || !isPasswordConn {
+		msg := fmt.Sprintf("Connector %q doesn't support password logins.", connID)
+		s.tokenErrHelper(w, errInvalidRequest, msg, http.StatusBadRequest)
+		return
+	}
+
+	identity, ok, err := passwordConn.Login(r.Context(), parseScopes(scopes), username, password)
+	if err != nil {
+		s.logger.Errorf("failed to login user: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.tokenErrHelper(w, errInvalidGrant, "Invalid username or password.", http.StatusBadRequest)
+		return
+	}
+
+	authCode := storage.AuthCode{
+		ClientID:    client.ID,
+		ConnectorID: connID,
+		Scopes:      scopes,
+		Claims: storage.Claims{
+			UserID:        identity.UserID,
+			Username:      identity.Username,
+			Email:         identity.Email,
+			EmailVerified: identity.EmailVerified,
+			Groups:        identity.Groups,
+			CustomClaims:  identity.CustomClaims,
+		},
+		ConnectorData: identity.ConnectorData,
+		AuthTime:      s.now(),
+	}
+	resp, err := s.newTokenResponse(authCode, requestCertThumbprint(r))
+	if err != nil {
+		s.logger.Errorf("failed to issue tokens: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenResponse(w, resp)
+}
+
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// handle a token exchange request https://tools.ietf.org/html/rfc8693
+//
+// A client trades an end user's ID or access token, issued to the client, for a token
+// aimed at the peer named by the "audience" parameter. Like cross-client scopes, the
+// peer must list the client as a trusted peer. The issued token never outlives the
+// subject token, so exchanges can't be used to extend a session.
+func (s *Server) handleTokenExchange(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	subjectToken := r.PostFormValue("subject_token")
+	if subjectToken == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "No subject_token in request.", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		claims    storage.Claims
+		scopes    []string
+		authTime  time.Time
+		notAfter  time.Time // Expiry of the subject token.
+		issuedTo  bool      // Was the subject token issued to the client?
+		tokenType = r.PostFormValue("subject_token_type")
+	)
+	switch tokenType {
+	case exchangeTokenTypeIDToken:
+		tok, clientID, err := s.verifyIDToken(subjectToken)
+		if err != nil {
+			s.tokenErrHelper(w, errInvalidGrant, "Invalid subject_token.", http.StatusBadRequest)
+			return
+		}
+		claims, scopes = tok.userClaims.toStorageClaims(tok.Subject)
+		if tok.AuthTime != 0 {
+			authTime = time.Unix(tok.AuthTime, 0)
+		}
+		notAfter = time.Unix(tok.Expiry, 0)
+		issuedTo = clientID == client.ID || tok.Audience.contains(client.ID)
+	case exchangeTokenTypeAccessToken:
+		tok, err := s.verifyAccessToken(subjectToken)
+		if err != nil {
+			s.tokenErrHelper(w, errInvalidGrant, "Invalid subject_token.", http.StatusBadRequest)
+			return
+		}
+		claims, scopes = tok.userClaims.toStorageClaims(tok.Subject)
+		notAfter = time.Unix(tok.Expiry, 0)
+		issuedTo = tok.Audience == client.ID
+	default:
+		msg := fmt.Sprintf("Unsupported subject_token_type %q.", tokenType)
+		s.tokenErrHelper(w, errInvalidRequest, msg, http.StatusBadRequest)
+		return
+	}
+	if !issuedTo {
+		s.tokenErrHelper(w, errInvalidGrant, "subject_token was not issued to the client.", http.StatusBadRequest)
+		return
+	}
+
+	// Clients can't exchange tokens for themselves, which would let them extend
+	// tokens they already hold.
+	peerID := r.PostFormValue("audience")
+	if peerID == "" {
+		s.tokenErrHelper(w, errInvalidRequest, "No audience in request.", http.StatusBadRequest)
+		return
+	}
+	if peerID == client.ID {
+		s.tokenErrHelper(w, errInvalidTarget, "audience must be another client.", http.StatusBadRequest)
+		return
+	}
+	isTrusted, err := s.validateCrossClientTrust(client.ID, peerID)
+	if err != nil {
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if !isTrusted {
+		msg := fmt.Sprintf("Client can't request tokens for audience %q.", peerID)
+		s.tokenErrHelper(w, errInvalidTarget, msg, http.StatusBadRequest)
+		return
+	}
+
+	// The subject token was issued to the client, so its subject is already the
+	// client's identifier for the end user.
+	var resp tokenExchangeResponse
+	switch requestedType := r.PostFormValue("requested_token_type"); requestedType {
+	case "", exchangeTokenTypeIDToken:
+		scopes = append(scopes, scopeCrossClientPrefix+peerID)
+		idToken, expiry, err := s.newIDTokenNotAfter(notAfter, client.ID, claims, scopes, "", "", "", authTime, "", storage.ClaimsRequest{})
+		if err != nil {
+			s.logger.Errorf("failed to create ID token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		resp = tokenExchangeResponse{
+			AccessToken:     idToken,
+			IssuedTokenType: exchangeTokenTypeIDToken,
+			TokenType:       "N_A", // The issued token isn't an access token.
+			ExpiresIn:       int(expiry.Sub(s.now()).Seconds()),
+		}
+	case exchangeTokenTypeAccessToken:
+		accessToken, expiry, err := s.newAccessTokenNotAfter(notAfter, peerID, claims, scopes, "", storage.ClaimsRequest{}, requestCertThumbprint(r))
+		if err != nil {
+			s.logger.Errorf("failed to create access token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		resp = tokenExchangeResponse{
+			AccessToken:     accessToken,
+			IssuedTokenType: exchangeTokenTypeAccessToken,
+			TokenType:       "bearer",
+			ExpiresIn:       int(expiry.Sub(s.now()).Seconds()),
+		}
+	default:
+		msg := fmt.Sprintf("Unsupported requested_token_type %q.", requestedType)
+		s.tokenErrHelper(w, errInvalidRequest, msg, http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Errorf("failed to marshal token exchange response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenData(w, data)
+}
+
+// tokenResponse is the body of a successful response from the token endpoint.
+//
+// See: https://tools.ietf.org/html/rfc6749#section-5.1
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+func (s *Server) toTokenResponse(idToken, accessToken, refreshToken string, expiry time.Time) tokenResponse {
+	return tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "bearer",
+		ExpiresIn:    int(expiry.Sub(s.now()).Seconds()),
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
 	}
+}
+
+func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, accessToken, refreshToken string, expiry time.Time) {
+	s.writeTokenResponse(w, s.toTokenResponse(idToken, accessToken, refreshToken, expiry))
+}
+
+func (s *Server) writeTokenResponse(w http.ResponseWriter, resp tokenResponse) {
 	data, err := json.Marshal(resp)
 	if err != nil {
 		s.logger.Errorf("failed to marshal access token response: %v", err)
 		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
+	s.writeTokenData(w, data)
+}
+
+func (s *Server) writeTokenData(w http.ResponseWriter, data []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 	w.Write(data)
 }
 
+// handleUserInfo returns the claims about the end user bound to an access token.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	var accessToken string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		parts := strings.SplitN(auth, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+			s.userInfoErr(w, errInvalidRequest, "Malformed Authorization header.", http.StatusBadRequest)
+			return
+		}
+		accessToken = parts[1]
+	} else if r.Method == "POST" {
+		accessToken = r.PostFormValue("access_token")
+	}
+	if accessToken == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	tok, err := s.verifyAccessToken(accessToken)
+	if err != nil {
+		s.logger.Errorf("userinfo: invalid access token: %v", err)
+		s.userInfoErr(w, "invalid_token", "Invalid or expired access token.", http.StatusUnauthorized)
+		return
+	}
+	if tok.Confirmation != nil && subtle.ConstantTimeCompare([]byte(tok.Confirmation.CertThumbprint), []byte(requestCertThumbprint(r))) != 1 {
+		s.userInfoErr(w, "invalid_token", "Access token is bound to another client certificate.", http.StatusUnauthorized)
+		return
+	}
+	if !hasScope(strings.Fields(tok.Scope), scopeOpenID) {
+		s.userInfoErr(w, "insufficient_scope", `Access token wasn't granted the "openid" scope.`, http.StatusForbidden)
+		return
+	}
+
+	resp := struct {
+		Subject string `json:"sub"`
+		userClaims
+	}{tok.Subject, tok.userClaims}
+	data, err := marshalClaims(resp, tok.Custom)
+	if err != nil {
+		s.logger.Errorf("failed to marshal userinfo response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// userInfoErr writes a bearer token error response.
+//
+// See: https://tools.ietf.org/html/rfc6750#section-3
+func (s *Server) userInfoErr(w http.ResponseWriter, typ, description string, statusCode int) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q`, typ, description))
+	s.tokenErrHelper(w, typ, description, statusCode)
+}
+
+// handleEndSession implements RP-initiated logout, optionally revoking the refresh
+// tokens held by the client on behalf of the end user.
+//
+// See: https://openid.net/specs/openid-connect-session-1_0.html#RPLogout
+func (s *Server) handleEndSession(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.renderError(w, http.StatusBadRequest, "Failed to parse request.")
+		return
+	}
+	idTokenHint := r.Form.Get("id_token_hint")
+	postLogoutRedirectURI := r.Form.Get("post_logout_redirect_uri")
+
+	if idTokenHint == "" {
+		// Without a hint there's no way to determine which client the redirect URI
+		// is registered to.
+		if postLogoutRedirectURI != "" {
+			s.renderError(w, http.StatusBadRequest, "Parameter post_logout_redirect_uri requires an id_token_hint.")
+			return
+		}
+		if err := s.templates.logout(w); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+		return
+	}
+
+	tok, clientID, err := s.verifyIDTokenHint(idTokenHint)
+	if err != nil {
+		s.logger.Errorf("end session: invalid id_token_hint: %v", err)
+		s.renderError(w, http.StatusBadRequest, "Invalid id_token_hint.")
+		return
+	}
+
+	client, err := s.storage.GetClient(clientID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to get client: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+		} else {
+			s.renderError(w, http.StatusBadRequest, "Invalid id_token_hint.")
+		}
+		return
+	}
+
+	if postLogoutRedirectURI != "" && !validatePostLogoutRedirectURI(client, postLogoutRedirectURI) {
+		s.renderError(w, http.StatusBadRequest, "Unregistered post_logout_redirect_uri.")
+		return
+	}
+
+	if s.revokeRefreshTokensOnLogout {
+		if err := s.revokeRefreshTokens(client, tok.Subject); err != nil {
+			s.logger.Errorf("Failed to revoke refresh tokens: %v", err)
+			s.renderError(w, http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+	}
+
+	if postLogoutRedirectURI == "" {
+		if err := s.templates.logout(w); err != nil {
+			s.logger.Errorf("Server template error: %v", err)
+		}
+		return
+	}
+
+	u, err := url.Parse(postLogoutRedirectURI)
+	if err != nil {
+		s.renderError(w, http.StatusBadRequest, "Invalid post_logout_redirect_uri.")
+		return
+	}
+	if state := r.Form.Get("state"); state != "" {
+		q := u.Query()
+		q.Set("state", state)
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// revokeRefreshTokens deletes the refresh tokens issued to a client for the end
+// user with the subject identifier.
+//
+// This reads every refresh token. Storages have no index of refresh tokens by end
+// user, and the subject may be pairwise, so it has to be computed for each token
+// rather than looked up. It only runs if the operator enabled revocation on
+// logout, and for requests carrying an ID token issued by this server. Revoking a
+// family on reuse doesn't need this, see revokeRefreshTokenFamily.
+func (s *Server) revokeRefreshTokens(client storage.Client, subject string) error {
+	tokens, err := s.storage.ListRefreshTokens()
+	if err != nil {
+		return fmt.Errorf("list refresh tokens: %v", err)
+	}
+	for _, token := range tokens {
+		if token.ClientID != client.ID {
+			continue
+		}
+		sub, err := s.subject(client, token.ConnectorID, token.Claims.UserID)
+		if err != nil {
+			return err
+		}
+		if sub != subject {
+			continue
+		}
+		// Tokens may have been claimed or revoked concurrently.
+		if err := s.storage.DeleteRefresh(token.RefreshToken); err != nil && err != storage.ErrNotFound {
+			return fmt.Errorf("delete refresh token: %v", err)
+		}
+	}
+	return nil
+}
+
+// revokeRefreshTokenFamily revokes the token in use of the family a rotated token
+// belongs to. It's found by following the tokens each rotated token was exchanged
+// for, so only the tokens rotated since are read. The revoked token is marked
+// rotated rather than deleted, so a request rotating it at the same time fails.
+// Garbage collection deletes the family once no token of it is left.
+func (s *Server) revokeRefreshTokenFamily(rotated storage.RefreshToken) error {
+	for id := rotated.NextToken; id != ""; {
+		var next string
+		err := s.storage.UpdateRefreshToken(id, func(old storage.RefreshToken) (storage.RefreshToken, error) {
+			if old.Rotated {
+				next = old.NextToken
+				return old, errRefreshTokenRotated
+			}
+			return rotatedRefreshToken(old, ""), nil
+		})
+		switch err {
+		case errRefreshTokenRotated:
+			id = next
+		case nil, storage.ErrNotFound:
+			// The family was revoked, or its last token expired or was revoked at
+			// logout.
+			return nil
+		default:
+			return fmt.Errorf("revoke refresh token: %v", err)
+		}
+	}
+	return nil
+}
+
+// refreshTokenLifetime returns when the end user logged in, when the family of a
+// refresh token was last refreshed, and when the token expires with the current
+// lifetimes. Tokens issued before lifetimes were tracked start them now.
+func (s *Server) refreshTokenLifetime(refresh storage.RefreshToken) (createdAt, lastUsed, expiry time.Time) {
+	createdAt, lastUsed = refresh.CreatedAt, refresh.LastUsed
+	if createdAt.IsZero() {
+		now := s.now()
+		createdAt, lastUsed = now, now
+	}
+	return createdAt, lastUsed, s.refreshTokenExpiry(createdAt, lastUsed)
+}
+
+// refreshTokenExpiry returns when a refresh token expires, given when the end user
+// logged in and when its family was last refreshed. It's zero if the token never
+// expires.
+func (s *Server) refreshTokenExpiry(createdAt, lastUsed time.Time) time.Time {
+	var expiry time.Time
+	if s.refreshTokensValidFor > 0 {
+		expiry = createdAt.Add(s.refreshTokensValidFor)
+	}
+	if s.refreshTokensIdleTimeout > 0 {
+		if idle := lastUsed.Add(s.refreshTokensIdleTimeout); expiry.IsZero() || idle.Before(expiry) {
+			expiry = idle
+		}
+	}
+	return expiry
+}
+
 func (s *Server) renderError(w http.ResponseWriter, status int, description string) {
+	w.WriteHeader(status)
 	if err := s.templates.err(w, http.StatusText(status), description); err != nil {
 		s.logger.Errorf("Server template error: %v", err)
 	}
@@ -1,15 +1,34 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+	jose "gopkg.in/square/go-jose.v2"
+
 	"github.com/coreos/dex/connector"
+	"github.com/coreos/dex/server/signer"
 	"github.com/coreos/dex/storage"
 )
 
@@ -18,26 +37,22 @@ import (
 // authErr is an error response to an authorization request.
 // See: https://tools.ietf.org/html/rfc6749#section-4.1.2.1
 type authErr struct {
-	State       string
-	RedirectURI string
-	Type        string
-	Description string
+	State        string
+	RedirectURI  string
+	ResponseMode string
+	Type         string
+	Description  string
 }
 
-func (err *authErr) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// values returns the parameters used to report the error to the redirect URI.
+func (err *authErr) values() url.Values {
 	v := url.Values{}
 	v.Add("state", err.State)
 	v.Add("error", err.Type)
 	if err.Description != "" {
 		v.Add("error_description", err.Description)
 	}
-	var redirectURI string
-	if strings.Contains(err.RedirectURI, "?") {
-		redirectURI = err.RedirectURI + "&" + v.Encode()
-	} else {
-		redirectURI = err.RedirectURI + "?" + v.Encode()
-	}
-	http.Redirect(w, r, redirectURI, http.StatusSeeOther)
+	return v
 }
 
 func tokenErr(w http.ResponseWriter, typ, description string, statusCode int) error {
@@ -67,6 +82,20 @@ const (
 	errUnsupportedGrantType    = "unsupported_grant_type"
 	errInvalidGrant            = "invalid_grant"
 	errInvalidClient           = "invalid_client"
+	errUnsupportedTokenType    = "unsupported_token_type"
+
+	// Device flow errors, see https://tools.ietf.org/html/rfc8628#section-3.5
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errExpiredToken         = "expired_token"
+
+	// Token exchange errors, see https://tools.ietf.org/html/rfc8693#section-2.2.2
+	errInvalidTarget = "invalid_target"
+
+	// OpenID Connect errors, see https://openid.net/specs/openid-connect-core-1_0.html#AuthError
+	errLoginRequired        = "login_required"
+	errInvalidRequestURI    = "invalid_request_uri"
+	errInvalidRequestObject = "invalid_request_object"
 )
 
 const (
@@ -85,6 +114,52 @@ const (
 const (
 	grantTypeAuthorizationCode = "authorization_code"
 	grantTypeRefreshToken      = "refresh_token"
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	grantTypePassword          = "password"
+	grantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// Token type identifiers used by token exchange requests and responses.
+//
+// See: https://tools.ietf.org/html/rfc8693#section-3
+const (
+	exchangeTokenTypeIDToken     = "urn:ietf:params:oauth:token-type:id_token"
+	exchangeTokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+const (
+	tokenTypeAccessToken  = "access_token"
+	tokenTypeRefreshToken = "refresh_token"
+)
+
+// accessTokenType is the "typ" header of access tokens, which keeps them from
+// being mistaken for ID tokens.
+//
+// See: https://tools.ietf.org/html/rfc9068#section-2.1
+const accessTokenType = "at+jwt"
+
+const (
+	codeChallengeMethodPlain = "plain"
+	codeChallengeMethodS256  = "S256"
+)
+
+// Values of the "prompt" parameter.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+const (
+	promptNone          = "none"
+	promptLogin         = "login"
+	promptConsent       = "consent"
+	promptSelectAccount = "select_account"
+)
+
+// Kinds of subject identifiers issued to clients.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes
+const (
+	subjectTypePublic   = "public"
+	subjectTypePairwise = "pairwise"
 )
 
 const (
@@ -93,6 +168,51 @@ const (
 	responseTypeIDToken = "id_token" // ID Token in url fragment
 )
 
+// Methods clients use to authenticate to the token endpoint.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+const (
+	authMethodClientSecretBasic = "client_secret_basic"
+	authMethodClientSecretPost  = "client_secret_post"
+	authMethodClientSecretJWT   = "client_secret_jwt"
+	authMethodPrivateKeyJWT     = "private_key_jwt"
+
+	// Mutual TLS methods, see: https://tools.ietf.org/html/rfc8705#section-2
+	authMethodTLSClientAuth           = "tls_client_auth"
+	authMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+)
+
+// clientAssertionTypeJWTBearer is the type of JWTs clients authenticate with.
+//
+// See: https://tools.ietf.org/html/rfc7523#section-2.2
+const clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Response modes describe how the results of an authorization request are
+// returned to the redirect URI.
+//
+// See: https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+// and https://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html
+const (
+	responseModeQuery    = "query"
+	responseModeFragment = "fragment"
+	responseModeFormPost = "form_post"
+)
+
+// responseModeOrDefault returns the response mode requested by the client, or the
+// default mode of the response types. Only the code flow returns results in the
+// query by default.
+func responseModeOrDefault(responseMode string, responseTypes []string) string {
+	if responseMode != "" {
+		return responseMode
+	}
+	for _, responseType := range responseTypes {
+		if responseType != responseTypeCode {
+			return responseModeFragment
+		}
+	}
+	return responseModeQuery
+}
+
 func parseScopes(scopes []string) connector.Scopes {
 	var s connector.Scopes
 	for _, scope := range scopes {
@@ -106,8 +226,26 @@ func parseScopes(scopes []string) connector.Scopes {
 	return s
 }
 
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 type audience []string
 
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
 func (a audience) MarshalJSON() ([]byte, error) {
 	if len(a) == 1 {
 		return json.Marshal(a[0])
@@ -115,235 +253,1579 @@ func (a audience) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]string(a))
 }
 
-type idTokenClaims struct {
-	Issuer           string   `json:"iss"`
-	Subject          string   `json:"sub"`
-	Audience         audience `json:"aud"`
-	Expiry           int64    `json:"exp"`
-	IssuedAt         int64    `json:"iat"`
-	AuthorizingParty string   `json:"azp,omitempty"`
-	Nonce            string   `json:"nonce,omitempty"`
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var auds []string
+	if err := json.Unmarshal(b, &auds); err != nil {
+		return err
+	}
+	*a = audience(auds)
+	return nil
+}
 
+// userClaims are the claims about the end user which are released according to
+// the "email", "groups" and "profile" scopes. They're shared by ID tokens, access
+// tokens and the UserInfo endpoint.
+type userClaims struct {
 	Email         string `json:"email,omitempty"`
 	EmailVerified *bool  `json:"email_verified,omitempty"`
 
 	Groups []string `json:"groups,omitempty"`
 
 	Name string `json:"name,omitempty"`
+
+	// Custom claims released to the client by its claim mappings. They're
+	// serialized alongside the other claims by marshalClaims.
+	Custom map[string]interface{} `json:"-"`
 }
 
-func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []string, nonce string) (idToken string, expiry time.Time, err error) {
-	issuedAt := s.now()
-	expiry = issuedAt.Add(s.idTokensValidFor)
+// claimScopes maps the user claims to the scopes which release them. Claims can
+// also be requested individually through the "claims" parameter.
+var claimScopes = map[string]string{
+	"email":          scopeEmail,
+	"email_verified": scopeEmail,
+	"groups":         scopeGroups,
+	"name":           scopeProfile,
+}
 
-	tok := idTokenClaims{
-		Issuer:   s.issuerURL.String(),
-		Subject:  claims.UserID,
-		Nonce:    nonce,
-		Expiry:   expiry.Unix(),
-		IssuedAt: issuedAt.Unix(),
+// newUserClaims returns the user claims released by the scopes, or requested
+// individually. Essential and voluntary claims are treated alike.
+func newUserClaims(claims storage.Claims, scopes []string, requested map[string]*storage.ClaimRequest) userClaims {
+	released := func(claim string) bool {
+		_, ok := requested[claim]
+		return ok || hasScope(scopes, claimScopes[claim])
 	}
 
-	for _, scope := range scopes {
-		switch {
-		case scope == scopeEmail:
-			tok.Email = claims.Email
-			tok.EmailVerified = &claims.EmailVerified
-		case scope == scopeGroups:
-			tok.Groups = claims.Groups
-		case scope == scopeProfile:
-			tok.Name = claims.Username
-		default:
-			peerID, ok := parseCrossClientScope(scope)
-			if !ok {
-				continue
-			}
-			isTrusted, err := s.validateCrossClientTrust(clientID, peerID)
-			if err != nil {
-				return "", expiry, err
-			}
-			if !isTrusted {
-				// TODO(ericchiang): propagate this error to the client.
-				return "", expiry, fmt.Errorf("peer (%s) does not trust client", peerID)
-			}
-			tok.Audience = append(tok.Audience, peerID)
-		}
+	var c userClaims
+	if released("email") {
+		c.Email = claims.Email
 	}
-	if len(tok.Audience) == 0 {
-		tok.Audience = audience{clientID}
-	} else {
-		tok.AuthorizingParty = clientID
+	if released("email_verified") {
+		emailVerified := claims.EmailVerified
+		c.EmailVerified = &emailVerified
 	}
-
-	payload, err := json.Marshal(tok)
-	if err != nil {
-		return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
+	if released("groups") {
+		c.Groups = claims.Groups
+	}
+	if released("name") {
+		c.Name = claims.Username
 	}
+	return c
+}
 
-	keys, err := s.storage.GetKeys()
-	if err != nil {
-		s.logger.Errorf("Failed to get keys: %v", err)
-		return "", expiry, err
+// parseClaimsRequest parses the "claims" request parameter. Members other than
+// "id_token" and "userinfo" are ignored, as are claims the server doesn't know.
+func parseClaimsRequest(claims string) (storage.ClaimsRequest, error) {
+	var req storage.ClaimsRequest
+	if claims == "" {
+		return req, nil
 	}
-	if idToken, err = keys.Sign(payload); err != nil {
-		return "", expiry, fmt.Errorf("failed to sign payload: %v", err)
+	if err := json.Unmarshal([]byte(claims), &req); err != nil {
+		return req, err
 	}
-	return idToken, expiry, nil
+	return req, nil
 }
 
-// parse the initial request from the OAuth2 client.
-//
-// For correctness the logic is largely copied from https://github.com/RangelReale/osin.
-func (s *Server) parseAuthorizationRequest(supportedResponseTypes map[string]bool, r *http.Request) (req storage.AuthRequest, oauth2Err *authErr) {
-	if err := r.ParseForm(); err != nil {
-		return req, &authErr{"", "", errInvalidRequest, "Failed to parse request."}
+// approvalScopes returns the scopes shown to the end user on the approval page,
+// including the ones releasing claims requested individually.
+func approvalScopes(scopes []string, claimsRequest storage.ClaimsRequest) []string {
+	approval := append([]string(nil), scopes...)
+	for _, requested := range []map[string]*storage.ClaimRequest{claimsRequest.IDToken, claimsRequest.UserInfo} {
+		for claim := range requested {
+			if scope, ok := claimScopes[claim]; ok && !hasScope(approval, scope) {
+				approval = append(approval, scope)
+			}
+		}
 	}
+	return approval
+}
 
-	redirectURI, err := url.QueryUnescape(r.Form.Get("redirect_uri"))
-	if err != nil {
-		return req, &authErr{"", "", errInvalidRequest, "No redirect_uri provided."}
+// toStorageClaims reverses newUserClaims, returning the end user's claims along with
+// the scopes that released them.
+func (c userClaims) toStorageClaims(subject string) (storage.Claims, []string) {
+	claims := storage.Claims{UserID: subject}
+	scopes := []string{scopeOpenID}
+	if c.Email != "" {
+		claims.Email = c.Email
+		claims.EmailVerified = c.EmailVerified != nil && *c.EmailVerified
+		scopes = append(scopes, scopeEmail)
 	}
-	state := r.FormValue("state")
+	if c.Groups != nil {
+		claims.Groups = c.Groups
+		scopes = append(scopes, scopeGroups)
+	}
+	if c.Name != "" {
+		claims.Username = c.Name
+		scopes = append(scopes, scopeProfile)
+	}
+	claims.CustomClaims = c.Custom
+	return claims, scopes
+}
 
-	clientID := r.Form.Get("client_id")
+// reservedClaims are set by the server and can't be released as custom claims.
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true,
+	"jti": true, "azp": true, "nonce": true, "auth_time": true, "at_hash": true,
+	"c_hash": true, "scope": true, "email": true, "email_verified": true,
+	"groups": true, "name": true, "cnf": true,
+}
 
-	client, err := s.storage.GetClient(clientID)
-	if err != nil {
-		if err == storage.ErrNotFound {
-			description := fmt.Sprintf("Invalid client_id (%q).", clientID)
-			return req, &authErr{"", "", errUnauthorizedClient, description}
+// validateClaimMappings returns an error if a client's claim mappings are invalid.
+func validateClaimMappings(mappings []storage.ClaimMapping) error {
+	for _, m := range mappings {
+		switch {
+		case m.Claim == "":
+			return errors.New("claim mapping has no claim name")
+		case reservedClaims[m.Claim]:
+			return fmt.Errorf("claim %q is set by the server and can't be mapped", m.Claim)
+		case (m.From == "") == (m.Template == ""):
+			return fmt.Errorf("claim %q must be mapped from either a custom claim or a template", m.Claim)
+		}
+		if m.Template != "" {
+			if _, err := template.New(m.Claim).Parse(m.Template); err != nil {
+				return fmt.Errorf("claim %q has invalid template: %v", m.Claim, err)
+			}
 		}
-		s.logger.Errorf("Failed to get client: %v", err)
-		return req, &authErr{"", "", errServerError, ""}
-	}
-
-	if !validateRedirectURI(client, redirectURI) {
-		description := fmt.Sprintf("Unregistered redirect_uri (%q).", redirectURI)
-		return req, &authErr{"", "", errInvalidRequest, description}
 	}
+	return nil
+}
 
-	newErr := func(typ, format string, a ...interface{}) *authErr {
-		return &authErr{state, redirectURI, typ, fmt.Sprintf(format, a...)}
+// customClaims returns the end user's custom claims released to the client by its
+// claim mappings. Claims limited to a scope are only released if the scope was
+// granted, even if they're requested individually, since the approval page only
+// lists the scopes.
+//
+// If connectorID is empty the claims were released to the client before, e.g. by
+// a token passed to the token exchange, and are returned as is.
+func (s *Server) customClaims(client storage.Client, connectorID string, claims storage.Claims, scopes []string) map[string]interface{} {
+	if connectorID == "" {
+		return claims.CustomClaims
 	}
 
-	scopes := strings.Fields(r.Form.Get("scope"))
+	var custom map[string]interface{}
+	for _, m := range client.ClaimMappings {
+		if reservedClaims[m.Claim] {
+			continue
+		}
+		if m.Scope != "" && !hasScope(scopes, m.Scope) {
+			continue
+		}
 
-	var (
-		unrecognized  []string
-		invalidScopes []string
-	)
-	hasOpenIDScope := false
-	for _, scope := range scopes {
-		switch scope {
-		case scopeOpenID:
-			hasOpenIDScope = true
-		case scopeOfflineAccess, scopeEmail, scopeProfile, scopeGroups:
-		default:
-			peerID, ok := parseCrossClientScope(scope)
+		var value interface{}
+		if m.Template == "" {
+			v, ok := claims.CustomClaims[m.From]
 			if !ok {
-				unrecognized = append(unrecognized, scope)
 				continue
 			}
-
-			isTrusted, err := s.validateCrossClientTrust(clientID, peerID)
+			value = v
+		} else {
+			// Templates are validated when clients are created through the API, but
+			// static clients may still hold invalid ones.
+			t, err := template.New(m.Claim).Option("missingkey=error").Parse(m.Template)
 			if err != nil {
-				return req, newErr(errServerError, "")
+				s.logger.Errorf("client %q has invalid template for claim %q: %v", client.ID, m.Claim, err)
+				continue
 			}
-			if !isTrusted {
-				invalidScopes = append(invalidScopes, scope)
+			buf := new(bytes.Buffer)
+			if err := t.Execute(buf, claims.CustomClaims); err != nil {
+				// The end user is missing a custom claim used by the template.
+				continue
 			}
+			value = buf.String()
+		}
+
+		if custom == nil {
+			custom = make(map[string]interface{})
 		}
+		custom[m.Claim] = value
 	}
-	if !hasOpenIDScope {
-		return req, newErr("invalid_scope", `Missing required scope(s) ["openid"].`)
+	return custom
+}
+
+// marshalClaims serializes the claims of a token or UserInfo response along with
+// the custom claims. Custom claims never replace the claims set by the server.
+func marshalClaims(claims interface{}, custom map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(claims)
+	if err != nil || len(custom) == 0 {
+		return data, err
 	}
-	if len(unrecognized) > 0 {
-		return req, newErr("invalid_scope", "Unrecognized scope(s) %q", unrecognized)
+	var merged map[string]interface{}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
 	}
-	if len(invalidScopes) > 0 {
-		return req, newErr("invalid_scope", "Client can't request scope(s) %q", invalidScopes)
+	for claim, value := range custom {
+		if _, ok := merged[claim]; !ok && !reservedClaims[claim] {
+			merged[claim] = value
+		}
 	}
+	return json.Marshal(merged)
+}
 
-	nonce := r.Form.Get("nonce")
-	responseTypes := strings.Split(r.Form.Get("response_type"), " ")
-	for _, responseType := range responseTypes {
-		if !supportedResponseTypes[responseType] {
-			return req, newErr("invalid_request", "Invalid response type %q", responseType)
+// parseCustomClaims returns the custom claims of a token payload, reversing
+// marshalClaims.
+func parseCustomClaims(payload []byte) (map[string]interface{}, error) {
+	var custom map[string]interface{}
+	if err := json.Unmarshal(payload, &custom); err != nil {
+		return nil, err
+	}
+	for claim := range custom {
+		if reservedClaims[claim] {
+			delete(custom, claim)
 		}
+	}
+	if len(custom) == 0 {
+		return nil, nil
+	}
+	return custom, nil
+}
 
-		switch responseType {
-		case responseTypeCode:
-		case responseTypeToken:
-			// Implicit flow requires a nonce value.
-			// https://openid.net/specs/openid-connect-core-1_0.html#ImplicitAuthRequest
-			if nonce == "" {
-				return req, newErr("invalid_request", "Response type 'token' requires a 'nonce' value.")
-			}
+type idTokenClaims struct {
+	Issuer           string   `json:"iss"`
+	Subject          string   `json:"sub"`
+	Audience         audience `json:"aud"`
+	Expiry           int64    `json:"exp"`
+	IssuedAt         int64    `json:"iat"`
+	AuthorizingParty string   `json:"azp,omitempty"`
+	Nonce            string   `json:"nonce,omitempty"`
+	AuthTime         int64    `json:"auth_time,omitempty"`
+	AccessTokenHash  string   `json:"at_hash,omitempty"`
+	CodeHash         string   `json:"c_hash,omitempty"`
 
-			if redirectURI == redirectURIOOB {
-				err := fmt.Sprintf("Cannot use response type 'token' with redirect_uri '%s'.", redirectURIOOB)
-				return req, newErr("invalid_request", err)
-			}
-		default:
-			return req, newErr("invalid_request", "Invalid response type %q", responseType)
-		}
+	userClaims
+}
+
+// tokenHash computes the at_hash or c_hash value of an access token or code: the
+// left-most half of its hash, using the hash function of the algorithm the ID
+// token is signed with.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+func tokenHash(alg jose.SignatureAlgorithm, value string) (string, error) {
+	var h hash.Hash
+	switch alg {
+	case jose.RS256, jose.ES256, jose.PS256, jose.HS256:
+		h = sha256.New()
+	case jose.RS384, jose.ES384, jose.PS384, jose.HS384:
+		h = sha512.New384()
+	case jose.RS512, jose.ES512, jose.PS512, jose.HS512:
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm: %s", alg)
 	}
+	h.Write([]byte(value))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
 
-	return storage.AuthRequest{
-		ID:                  storage.NewID(),
-		ClientID:            client.ID,
-		State:               r.Form.Get("state"),
-		Nonce:               nonce,
-		ForceApprovalPrompt: r.Form.Get("approval_prompt") == "force",
-		Scopes:              scopes,
-		RedirectURI:         redirectURI,
-		ResponseTypes:       responseTypes,
-	}, nil
+// newIDToken signs an ID token for the end user. If authTime isn't zero, it's
+// reported as the time the end user authenticated. If an access token or code is
+// issued alongside the ID token, the token embeds their hashes so the client can
+// check they belong together.
+//
+// The subject is derived from the user ID and connector ID, see subject. Claims
+// requested individually for the ID token are released along with the scopes'.
+func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []string, nonce, accessToken, code string, authTime time.Time, connectorID string, claimsRequest storage.ClaimsRequest) (idToken string, expiry time.Time, err error) {
+	return s.newIDTokenNotAfter(time.Time{}, clientID, claims, scopes, nonce, accessToken, code, authTime, connectorID, claimsRequest)
 }
 
-func parseCrossClientScope(scope string) (peerID string, ok bool) {
-	if ok = strings.HasPrefix(scope, scopeCrossClientPrefix); ok {
-		peerID = scope[len(scopeCrossClientPrefix):]
+// newIDTokenNotAfter is like newIDToken, but if notAfter isn't zero the token
+// expires no later than it.
+func (s *Server) newIDTokenNotAfter(notAfter time.Time, clientID string, claims storage.Claims, scopes []string, nonce, accessToken, code string, authTime time.Time, connectorID string, claimsRequest storage.ClaimsRequest) (idToken string, expiry time.Time, err error) {
+	issuedAt := s.now()
+	expiry = issuedAt.Add(s.idTokensValidFor)
+	if !notAfter.IsZero() && notAfter.Before(expiry) {
+		expiry = notAfter
 	}
-	return
-}
 
-func (s *Server) validateCrossClientTrust(clientID, peerID string) (trusted bool, err error) {
-	if peerID == clientID {
-		return true, nil
+	client, err := s.storage.GetClient(clientID)
+	if err != nil {
+		return "", expiry, fmt.Errorf("get client: %v", err)
 	}
-	peer, err := s.storage.GetClient(peerID)
+	sub, err := s.subject(client, connectorID, claims.UserID)
 	if err != nil {
-		if err != storage.ErrNotFound {
-			s.logger.Errorf("Failed to get client: %v", err)
-			return false, err
+		return "", expiry, err
+	}
+
+	tok := idTokenClaims{
+		Issuer:     s.issuerURL.String(),
+		Subject:    sub,
+		Nonce:      nonce,
+		Expiry:     expiry.Unix(),
+		IssuedAt:   issuedAt.Unix(),
+		userClaims: newUserClaims(claims, scopes, claimsRequest.IDToken),
+	}
+	tok.Custom = s.customClaims(client, connectorID, claims, scopes)
+	if !authTime.IsZero() {
+		tok.AuthTime = authTime.Unix()
+	}
+
+	alg, err := s.idTokenSigningAlg(client)
+	if err != nil {
+		return "", expiry, err
+	}
+	if accessToken != "" {
+		if tok.AccessTokenHash, err = tokenHash(alg, accessToken); err != nil {
+			return "", expiry, err
 		}
-		return false, nil
 	}
-	for _, id := range peer.TrustedPeers {
-		if id == clientID {
-			return true, nil
+	if code != "" {
+		if tok.CodeHash, err = tokenHash(alg, code); err != nil {
+			return "", expiry, err
 		}
 	}
-	return false, nil
+
+	for _, scope := range scopes {
+		peerID, ok := parseCrossClientScope(scope)
+		if !ok {
+			continue
+		}
+		isTrusted, err := s.validateCrossClientTrust(clientID, peerID)
+		if err != nil {
+			return "", expiry, err
+		}
+		if !isTrusted {
+			// TODO(ericchiang): propagate this error to the client.
+			return "", expiry, fmt.Errorf("peer (%s) does not trust client", peerID)
+		}
+		tok.Audience = append(tok.Audience, peerID)
+	}
+	if len(tok.Audience) == 0 {
+		tok.Audience = audience{clientID}
+	} else {
+		tok.AuthorizingParty = clientID
+	}
+
+	if idToken, err = s.signClaims(alg, "", tok, tok.Custom); err != nil {
+		return "", expiry, err
+	}
+	return idToken, expiry, nil
 }
 
-func validateRedirectURI(client storage.Client, redirectURI string) bool {
-	if !client.Public {
-		for _, uri := range client.RedirectURIs {
-			if redirectURI == uri {
-				return true
-			}
+// idTokenSigningAlg returns the algorithm used to sign ID tokens issued to the
+// client: the one it registered, or else the server's default.
+func (s *Server) idTokenSigningAlg(client storage.Client) (jose.SignatureAlgorithm, error) {
+	if client.IDTokenSignedResponseAlg == "" {
+		return s.signingAlgs[0], nil
+	}
+	for _, alg := range s.signingAlgs {
+		if string(alg) == client.IDTokenSignedResponseAlg {
+			return alg, nil
 		}
-		return false
 	}
+	return "", fmt.Errorf("client %q uses unsupported ID token signing algorithm %q", client.ID, client.IDTokenSignedResponseAlg)
+}
 
-	if redirectURI == redirectURIOOB {
-		return true
+// subject returns the end user's subject identifier for the client. Public
+// identifiers are the user ID. Pairwise identifiers are a keyed hash of the client's
+// sector identifier, the connector ID and the user ID, so they're stable within the
+// sector but can't be correlated across sectors.
+//
+// If connectorID is empty the user ID is used as is, because it's already the
+// client's identifier for the subject. Either it comes from a token issued to the
+// client, or the client is the subject.
+func (s *Server) subject(client storage.Client, connectorID, userID string) (string, error) {
+	if connectorID == "" {
+		return userID, nil
 	}
-	if !strings.HasPrefix(redirectURI, "http://localhost:") {
-		return false
+	switch client.SubjectType {
+	case "", subjectTypePublic:
+		return userID, nil
+	case subjectTypePairwise:
+	default:
+		return "", fmt.Errorf("client %q uses unsupported subject type %q", client.ID, client.SubjectType)
+	}
+	if len(s.pairwiseSubjectSecret) == 0 {
+		return "", fmt.Errorf("client %q uses pairwise subjects but no pairwise subject secret is configured", client.ID)
+	}
+	sector, err := sectorIdentifier(client)
+	if err != nil {
+		return "", err
+	}
+
+	h := hmac.New(sha256.New, s.pairwiseSubjectSecret)
+	for _, value := range []string{sector, connectorID, userID} {
+		// Prefix values with their length so they can't run into each other.
+		fmt.Fprintf(h, "%d:%s", len(value), value)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// refreshTokenSubject returns the subject identifier of the end user a refresh
+// token was issued for, as seen by the client holding it.
+func (s *Server) refreshTokenSubject(refresh storage.RefreshToken) (string, error) {
+	client, err := s.storage.GetClient(refresh.ClientID)
+	if err != nil {
+		return "", fmt.Errorf("get client: %v", err)
+	}
+	return s.subject(client, refresh.ConnectorID, refresh.Claims.UserID)
+}
+
+// sectorIdentifier returns the client's sector identifier. Clients which don't
+// register one must redirect to a single host, which is used instead.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg
+func sectorIdentifier(client storage.Client) (string, error) {
+	if client.SectorIdentifier != "" {
+		return client.SectorIdentifier, nil
+	}
+	var sector string
+	for _, redirectURI := range client.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil {
+			return "", fmt.Errorf("client %q has invalid redirect URI %q: %v", client.ID, redirectURI, err)
+		}
+		host := u.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if sector != "" && host != sector {
+			return "", fmt.Errorf("client %q redirects to several hosts and needs a sector identifier", client.ID)
+		}
+		sector = host
+	}
+	if sector == "" {
+		return "", fmt.Errorf("client %q has no redirect URI hosts and needs a sector identifier", client.ID)
+	}
+	return sector, nil
+}
+
+// accessTokenClaims are the claims of the access tokens issued by the server.
+//
+// Access tokens are JWTs signed with the same keys as ID tokens. They're bound to
+// the client they were issued to and carry the granted scopes, so the UserInfo
+// endpoint can release the same claims as the corresponding ID token.
+type accessTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	Expiry   int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	Scope    string `json:"scope"`
+
+	// Set if the token is bound to the certificate of the client.
+	Confirmation *confirmation `json:"cnf,omitempty"`
+
+	userClaims
+}
+
+// confirmation binds a token to the certificate the client presented when it was
+// issued. Only the client holding the certificate's private key can use the token.
+//
+// See: https://tools.ietf.org/html/rfc8705#section-3.1
+type confirmation struct {
+	CertThumbprint string `json:"x5t#S256"`
+}
+
+// newConfirmation returns the confirmation claim for a certificate thumbprint, or
+// nil if the token isn't bound to a certificate.
+func newConfirmation(certThumbprint string) *confirmation {
+	if certThumbprint == "" {
+		return nil
+	}
+	return &confirmation{CertThumbprint: certThumbprint}
+}
+
+// newAccessToken signs an access token for the client. The subject is derived
+// from the user ID and connector ID like newIDToken's. The token carries the
+// claims returned by the UserInfo endpoint, including the ones requested
+// individually for it.
+//
+// If certThumbprint is set, the token is bound to the client certificate with
+// that thumbprint.
+func (s *Server) newAccessToken(clientID string, claims storage.Claims, scopes []string, connectorID string, claimsRequest storage.ClaimsRequest, certThumbprint string) (accessToken string, expiry time.Time, err error) {
+	return s.newAccessTokenNotAfter(time.Time{}, clientID, claims, scopes, connectorID, claimsRequest, certThumbprint)
+}
+
+// newAccessTokenNotAfter is like newAccessToken, but if notAfter isn't zero the
+// token expires no later than it.
+func (s *Server) newAccessTokenNotAfter(notAfter time.Time, clientID string, claims storage.Claims, scopes []string, connectorID string, claimsRequest storage.ClaimsRequest, certThumbprint string) (accessToken string, expiry time.Time, err error) {
+	issuedAt := s.now()
+	expiry = issuedAt.Add(s.idTokensValidFor)
+	if !notAfter.IsZero() && notAfter.Before(expiry) {
+		expiry = notAfter
+	}
+
+	client, err := s.storage.GetClient(clientID)
+	if err != nil {
+		return "", expiry, fmt.Errorf("get client: %v", err)
+	}
+	sub, err := s.subject(client, connectorID, claims.UserID)
+	if err != nil {
+		return "", expiry, err
+	}
+
+	tok := accessTokenClaims{
+		Issuer:       s.issuerURL.String(),
+		Subject:      sub,
+		Audience:     clientID,
+		Expiry:       expiry.Unix(),
+		IssuedAt:     issuedAt.Unix(),
+		Scope:        strings.Join(scopes, " "),
+		Confirmation: newConfirmation(certThumbprint),
+		userClaims:   newUserClaims(claims, scopes, claimsRequest.UserInfo),
+	}
+	tok.Custom = s.customClaims(client, connectorID, claims, scopes)
+	if accessToken, err = s.signClaims(s.signingAlgs[0], accessTokenType, tok, tok.Custom); err != nil {
+		return "", expiry, err
+	}
+	return accessToken, expiry, nil
+}
+
+// signClaims serializes the claims along with the custom claims, and signs them
+// with the signer, or the current key, for the algorithm. A non-empty typ is set
+// as the "typ" header of the token.
+func (s *Server) signClaims(alg jose.SignatureAlgorithm, typ string, claims interface{}, custom map[string]interface{}) (string, error) {
+	payload, err := marshalClaims(claims, custom)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize claims: %v", err)
+	}
+
+	if len(s.signers) > 0 {
+		for _, sig := range s.signers {
+			if sig.Algorithm() != alg {
+				continue
+			}
+			jwt, err := sig.Sign(typ, payload)
+			if err != nil {
+				return "", fmt.Errorf("failed to sign payload: %v", err)
+			}
+			return jwt, nil
+		}
+		return "", fmt.Errorf("no signer for %s", alg)
+	}
+
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		s.logger.Errorf("Failed to get keys: %v", err)
+		return "", err
+	}
+	key, err := keys.SigningKeyFor(alg)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign payload: %v", err)
+	}
+	sig, err := signer.NewJWKSigner(key, alg)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign payload: %v", err)
+	}
+	jwt, err := sig.Sign(typ, payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign payload: %v", err)
+	}
+	return jwt, nil
+}
+
+// verifySignature verifies a JWT against the current signing keys and the
+// verification keys of previous rotations, returning its payload.
+func (s *Server) verifySignature(jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		return nil, fmt.Errorf("get keys: %v", err)
+	}
+
+	pubKeys := keys.PublicKeys()
+	// A signer's key may have been replaced since its public key was last stored.
+	for _, sig := range s.signers {
+		if pub, err := sig.PublicKey(); err == nil {
+			pubKeys = append(pubKeys, pub)
+		}
+	}
+	for _, key := range pubKeys {
+		if payload, err := jws.Verify(key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("failed to verify token signature")
+}
+
+// verifyAccessToken validates an access token issued by this server.
+func (s *Server) verifyAccessToken(accessToken string) (accessTokenClaims, error) {
+	var tok accessTokenClaims
+	payload, err := s.verifySignature(accessToken)
+	if err != nil {
+		return tok, err
+	}
+	if err := json.Unmarshal(payload, &tok); err != nil {
+		return tok, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if tok.Custom, err = parseCustomClaims(payload); err != nil {
+		return tok, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if tok.Issuer != s.issuerURL.String() {
+		return tok, fmt.Errorf("token issued by %q", tok.Issuer)
+	}
+	if s.now().After(time.Unix(tok.Expiry, 0)) {
+		return tok, errors.New("token has expired")
+	}
+
+	if typ := jwtType(accessToken); typ != "" && !isAccessTokenType(typ) {
+		return tok, fmt.Errorf("token has type %q", typ)
+	}
+	if !isAccessToken(payload) {
+		return tok, errors.New("token is not an access token")
+	}
+	return tok, nil
+}
+
+// jwtType returns the "typ" header of a JWT, or an empty string if it has none.
+func jwtType(jwt string) string {
+	parts := strings.SplitN(jwt, ".", 2)
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ""
+	}
+	var h struct {
+		Type string `json:"typ"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return ""
+	}
+	return h.Type
+}
+
+// isAccessTokenType reports if a "typ" header marks a JWT access token. The
+// "application/" prefix may be omitted and the comparison ignores case.
+func isAccessTokenType(typ string) bool {
+	return strings.EqualFold(typ, accessTokenType) || strings.EqualFold(typ, "application/"+accessTokenType)
+}
+
+// isAccessToken determines if the payload of a token signed by this server belongs
+// to an access token. ID tokens are signed with the same keys but never carry a
+// scope claim, while access tokens always do, even if no scopes were granted.
+func isAccessToken(payload []byte) bool {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return false
+	}
+	_, ok := claims["scope"]
+	return ok
+}
+
+// verifyIDTokenHint validates an ID token previously issued by this server and
+// returns its claims along with the ID of the client it was issued to.
+//
+// Expired ID tokens are accepted since the hint is only used to identify the end
+// user and client, not to authenticate them.
+func (s *Server) verifyIDTokenHint(idTokenHint string) (tok idTokenClaims, clientID string, err error) {
+	payload, err := s.verifySignature(idTokenHint)
+	if err != nil {
+		return tok, "", err
+	}
+
+	if err := json.Unmarshal(payload, &tok); err != nil {
+		return tok, "", fmt.Errorf("malformed token claims: %v", err)
+	}
+	if tok.Custom, err = parseCustomClaims(payload); err != nil {
+		return tok, "", fmt.Errorf("malformed token claims: %v", err)
+	}
+	if isAccessTokenType(jwtType(idTokenHint)) || isAccessToken(payload) {
+		return tok, "", errors.New("token is not an ID token")
+	}
+	if tok.Issuer != s.issuerURL.String() {
+		return tok, "", fmt.Errorf("token issued by %q", tok.Issuer)
+	}
+
+	switch {
+	case tok.AuthorizingParty != "":
+		clientID = tok.AuthorizingParty
+	case len(tok.Audience) == 1:
+		clientID = tok.Audience[0]
+	default:
+		return tok, "", errors.New("token has no authorizing party")
+	}
+	return tok, clientID, nil
+}
+
+// verifyIDToken validates an unexpired ID token issued by this server and returns
+// its claims along with the ID of the client it was issued to.
+func (s *Server) verifyIDToken(idToken string) (tok idTokenClaims, clientID string, err error) {
+	if tok, clientID, err = s.verifyIDTokenHint(idToken); err != nil {
+		return tok, "", err
+	}
+	if s.now().After(time.Unix(tok.Expiry, 0)) {
+		return tok, "", errors.New("token has expired")
+	}
+	return tok, clientID, nil
+}
+
+// parse the initial request from the OAuth2 client.
+//
+// For correctness the logic is largely copied from https://github.com/RangelReale/osin.
+func (s *Server) parseAuthorizationRequest(supportedResponseTypes map[string]bool, r *http.Request) (req storage.AuthRequest, oauth2Err *authErr) {
+	if err := r.ParseForm(); err != nil {
+		return req, &authErr{"", "", "", errInvalidRequest, "Failed to parse request."}
+	}
+
+	clientID := r.Form.Get("client_id")
+
+	client, err := s.storage.GetClient(clientID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			description := fmt.Sprintf("Invalid client_id (%q).", clientID)
+			return req, &authErr{"", "", "", errUnauthorizedClient, description}
+		}
+		s.logger.Errorf("Failed to get client: %v", err)
+		return req, &authErr{"", "", "", errServerError, ""}
+	}
+
+	if r.Form.Get("request") != "" || r.Form.Get("request_uri") != "" {
+		if err := s.mergeRequestObject(client, r.Form); err != nil {
+			return req, err
+		}
+	}
+
+	redirectURI, err := url.QueryUnescape(r.Form.Get("redirect_uri"))
+	if err != nil {
+		return req, &authErr{"", "", "", errInvalidRequest, "No redirect_uri provided."}
+	}
+	state := r.Form.Get("state")
+
+	// The device flow completes the authorization through dex's own callback.
+	isDeviceCallback := redirectURI == s.absURL(deviceCallbackURI)
+	if !isDeviceCallback && !validateRedirectURI(client, redirectURI) {
+		description := fmt.Sprintf("Unregistered redirect_uri (%q).", redirectURI)
+		return req, &authErr{"", "", "", errInvalidRequest, description}
+	}
+
+	responseTypes := strings.Split(r.Form.Get("response_type"), " ")
+
+	// Errors are reported using the requested response mode if it's valid.
+	responseMode := r.Form.Get("response_mode")
+	switch responseMode {
+	case "", responseModeQuery, responseModeFragment, responseModeFormPost:
+	default:
+		description := fmt.Sprintf("Unsupported response_mode %q", responseMode)
+		return req, &authErr{state, redirectURI, responseModeOrDefault("", responseTypes), errInvalidRequest, description}
+	}
+
+	newErr := func(typ, format string, a ...interface{}) *authErr {
+		return &authErr{state, redirectURI, responseModeOrDefault(responseMode, responseTypes), typ, fmt.Sprintf(format, a...)}
+	}
+
+	scopes := strings.Fields(r.Form.Get("scope"))
+	if err := s.validateScopes(clientID, scopes); err != nil {
+		err.State, err.RedirectURI = state, redirectURI
+		err.ResponseMode = responseModeOrDefault(responseMode, responseTypes)
+		return req, err
+	}
+
+	nonce := r.Form.Get("nonce")
+	for _, responseType := range responseTypes {
+		if !supportedResponseTypes[responseType] {
+			return req, newErr("invalid_request", "Invalid response type %q", responseType)
+		}
+
+		switch responseType {
+		case responseTypeCode:
+		case responseTypeToken, responseTypeIDToken:
+			// The implicit and hybrid flows require a nonce value.
+			// https://openid.net/specs/openid-connect-core-1_0.html#ImplicitAuthRequest
+			if nonce == "" {
+				return req, newErr("invalid_request", "Response type '%s' requires a 'nonce' value.", responseType)
+			}
+
+			if redirectURI == redirectURIOOB || isDeviceCallback {
+				err := fmt.Sprintf("Cannot use response type '%s' with redirect_uri '%s'.", responseType, redirectURI)
+				return req, newErr("invalid_request", err)
+			}
+
+			// Tokens must never be encoded in the query.
+			// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#Security
+			if responseMode == responseModeQuery {
+				return req, newErr("invalid_request", "Cannot use response type '%s' with response_mode 'query'.", responseType)
+			}
+		default:
+			return req, newErr("invalid_request", "Invalid response type %q", responseType)
+		}
+	}
+
+	// Dex doesn't keep sessions, so end users log in for every authorization request.
+	// That satisfies "login", "select_account" and any "max_age", but means requests
+	// with "none" always fail. Authentication context classes aren't supported, and
+	// "acr_values" is ignored since it only requests voluntary claims.
+	forceApprovalPrompt := r.Form.Get("approval_prompt") == "force"
+	prompts := strings.Fields(r.Form.Get("prompt"))
+	for _, prompt := range prompts {
+		switch prompt {
+		case promptNone:
+			if len(prompts) > 1 {
+				return req, newErr("invalid_request", "Prompt value 'none' can't be combined with other values.")
+			}
+			return req, newErr(errLoginRequired, "End user must log in.")
+		case promptConsent:
+			forceApprovalPrompt = true
+		case promptLogin, promptSelectAccount:
+		default:
+			return req, newErr("invalid_request", "Invalid prompt value %q", prompt)
+		}
+	}
+	if maxAge := r.Form.Get("max_age"); maxAge != "" {
+		if n, err := strconv.Atoi(maxAge); err != nil || n < 0 {
+			return req, newErr("invalid_request", "Invalid max_age value %q", maxAge)
+		}
+	}
+
+	claimsRequest, err := parseClaimsRequest(r.Form.Get("claims"))
+	if err != nil {
+		return req, newErr("invalid_request", "Invalid claims parameter: %v", err)
+	}
+
+	codeChallenge := r.Form.Get("code_challenge")
+	codeChallengeMethod := r.Form.Get("code_challenge_method")
+	if codeChallenge == "" {
+		if codeChallengeMethod != "" {
+			return req, newErr("invalid_request", "Parameter code_challenge_method requires a code_challenge.")
+		}
+	} else {
+		switch codeChallengeMethod {
+		case "":
+			// Defaults to "plain" if not present in the request.
+			// https://tools.ietf.org/html/rfc7636#section-4.3
+			codeChallengeMethod = codeChallengeMethodPlain
+		case codeChallengeMethodPlain, codeChallengeMethodS256:
+		default:
+			return req, newErr("invalid_request", "Unsupported code_challenge_method %q", codeChallengeMethod)
+		}
+	}
+
+	return storage.AuthRequest{
+		ID:                  storage.NewID(),
+		ClientID:            client.ID,
+		State:               r.Form.Get("state"),
+		Nonce:               nonce,
+		ForceApprovalPrompt: forceApprovalPrompt,
+		LoginHint:           r.Form.Get("login_hint"),
+		Scopes:              scopes,
+		RedirectURI:         redirectURI,
+		ResponseTypes:       responseTypes,
+		ResponseMode:        responseMode,
+		PKCE: storage.PKCE{
+			CodeChallenge:       codeChallenge,
+			CodeChallengeMethod: codeChallengeMethod,
+		},
+		ClaimsRequest: claimsRequest,
+	}, nil
+}
+
+// maxFetchSize limits the size of documents fetched from URLs published by
+// clients, such as request objects and key sets.
+const maxFetchSize = 1 << 16
+
+// mergeRequestObject verifies the request object passed by value or by reference
+// in an authorization request, and copies its parameters over the ones in the
+// query. Request objects must be signed with one of the client's registered keys.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#JWTRequests
+func (s *Server) mergeRequestObject(client storage.Client, form url.Values) *authErr {
+	// Check the client can sign request objects before fetching anything on its
+	// behalf.
+	jwks, err := s.clientKeys(client)
+	if err != nil {
+		s.logger.Errorf("Failed to get keys of client %q: %v", client.ID, err)
+		return &authErr{"", "", "", errInvalidRequestObject, "Failed to fetch client keys from jwks_uri."}
+	}
+	if jwks == nil || len(jwks.Keys) == 0 {
+		return &authErr{"", "", "", errInvalidRequestObject, "Client has no registered keys to verify request objects."}
+	}
+
+	requestObject := form.Get("request")
+	if requestURI := form.Get("request_uri"); requestURI != "" {
+		if requestObject != "" {
+			return &authErr{"", "", "", errInvalidRequest, "Parameters 'request' and 'request_uri' can't be used together."}
+		}
+		// Only fetch URLs registered by the client, so the server can't be used
+		// to make requests to arbitrary hosts.
+		registered := false
+		for _, uri := range client.RequestURIs {
+			registered = registered || uri == requestURI
+		}
+		if !registered {
+			return &authErr{"", "", "", errInvalidRequestURI, "Unregistered request_uri."}
+		}
+		if requestObject, err = s.fetchRequestObject(requestURI); err != nil {
+			s.logger.Errorf("Failed to fetch request object: %v", err)
+			return &authErr{"", "", "", errInvalidRequestURI, "Failed to fetch request object from request_uri."}
+		}
+	}
+
+	payload, err := verifyClientJWT(jwks, requestObject)
+	if err != nil {
+		return &authErr{"", "", "", errInvalidRequestObject, fmt.Sprintf("Invalid request object: %v.", err)}
+	}
+
+	// Keep numbers, such as "max_age", as they were written.
+	var claims map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&claims); err != nil {
+		return &authErr{"", "", "", errInvalidRequestObject, "Request object is not a JSON object."}
+	}
+
+	// Request objects must name the client as their issuer, this server as their
+	// audience, and expire, so they can't be replayed elsewhere or indefinitely.
+	if claims["iss"] != client.ID {
+		return &authErr{"", "", "", errInvalidRequestObject, "Request object wasn't issued by the client."}
+	}
+	if clientID, ok := claims["client_id"]; ok && clientID != client.ID {
+		return &authErr{"", "", "", errInvalidRequestObject, "Request object client_id doesn't match the client."}
+	}
+	var audiences []interface{}
+	switch aud := claims["aud"].(type) {
+	case []interface{}:
+		audiences = aud
+	case nil:
+	default:
+		audiences = []interface{}{aud}
+	}
+	found := false
+	for _, a := range audiences {
+		if a == s.issuerURL.String() {
+			found = true
+		}
+	}
+	if !found {
+		return &authErr{"", "", "", errInvalidRequestObject, "Request object isn't intended for this server."}
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return &authErr{"", "", "", errInvalidRequestObject, "Request object has no expiry."}
+	}
+	if expiry, err := exp.Int64(); err != nil || s.now().After(time.Unix(expiry, 0)) {
+		return &authErr{"", "", "", errInvalidRequestObject, "Request object has expired."}
+	}
+
+	form.Del("request")
+	form.Del("request_uri")
+	for name, value := range claims {
+		switch name {
+		case "iss", "aud", "exp", "iat", "nbf", "jti", "request", "request_uri":
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			form.Set(name, value)
+		case json.Number:
+			form.Set(name, value.String())
+		default:
+			// Structured parameters, such as "claims", are passed on as JSON.
+			data, err := json.Marshal(value)
+			if err != nil {
+				return &authErr{"", "", "", errInvalidRequestObject, fmt.Sprintf("Invalid request object parameter %q.", name)}
+			}
+			form.Set(name, string(data))
+		}
+	}
+	return nil
+}
+
+// fetchRequestObject retrieves a request object passed by reference.
+func (s *Server) fetchRequestObject(requestURI string) (string, error) {
+	body, err := s.fetch(requestURI)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// clientKeySetTTL is how long key sets fetched from JWKS URIs are cached. Clients
+// rotating their keys must publish new keys this long before using them.
+const clientKeySetTTL = 5 * time.Minute
+
+// cachedKeySet is a key set fetched from a JWKS URI, and when it must be fetched
+// again.
+type cachedKeySet struct {
+	jwks   *jose.JSONWebKeySet
+	expiry time.Time
+}
+
+// clientKeys returns the public keys of the client, either registered with the
+// client or fetched from its JWKS URI. If the client has no keys, it returns nil.
+func (s *Server) clientKeys(client storage.Client) (*jose.JSONWebKeySet, error) {
+	if client.JWKSURI == "" {
+		return client.JWKS, nil
+	}
+
+	now := s.now()
+	s.clientKeySetsMu.Lock()
+	cached, ok := s.clientKeySets[client.JWKSURI]
+	s.clientKeySetsMu.Unlock()
+	if ok && now.Before(cached.expiry) {
+		return cached.jwks, nil
+	}
+
+	body, err := s.fetch(client.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	jwks := new(jose.JSONWebKeySet)
+	if err := json.Unmarshal(body, jwks); err != nil {
+		return nil, fmt.Errorf("%q returned invalid key set: %v", client.JWKSURI, err)
+	}
+
+	s.clientKeySetsMu.Lock()
+	defer s.clientKeySetsMu.Unlock()
+	if s.clientKeySets == nil {
+		s.clientKeySets = make(map[string]cachedKeySet)
+	}
+	for uri, cached := range s.clientKeySets {
+		if !now.Before(cached.expiry) {
+			delete(s.clientKeySets, uri)
+		}
+	}
+	s.clientKeySets[client.JWKSURI] = cachedKeySet{jwks: jwks, expiry: now.Add(clientKeySetTTL)}
+	return jwks, nil
+}
+
+// maxFetchRedirects limits the redirects followed when fetching documents from
+// URLs published by clients.
+const maxFetchRedirects = 3
+
+// checkFetchRedirect is the redirect policy of the client fetching documents
+// from URLs published by clients. Redirects must keep using https.
+func checkFetchRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxFetchRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+	}
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to %q must use https", req.URL)
+	}
+	return nil
+}
+
+// privateNetworks are the address ranges documents published by clients aren't
+// fetched from: the local network, loopback and link-local addresses, which also
+// hold the metadata services of cloud providers.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// isPrivateIP reports whether the address is one clients can't make the server
+// connect to.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateHost reports whether the host of a URL published by a client is
+// "localhost" or a private address, unless the operator allowed it. Host names
+// resolving to private addresses are only caught when they're fetched.
+func (s *Server) isPrivateHost(u *url.URL) bool {
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = strings.Trim(u.Host, "[]")
+	}
+	if s.allowedFetchHosts[strings.ToLower(host)] {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isPrivateIP(ip)
+}
+
+// newFetchClient returns the client fetching documents from URLs published by
+// clients. So clients can't make the server send requests to internal services,
+// it refuses to connect to private addresses, unless the host is one of the
+// allowed hosts. It doesn't use a proxy, which would hide the address connected to.
+func newFetchClient(allowedHosts map[string]bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Timeout:       10 * time.Second,
+		CheckRedirect: checkFetchRedirect,
+		Transport: &http.Transport{
+			DialContext:         fetchDialer(dialer, allowedHosts),
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// fetchDialer returns a dial function which checks the addresses a host resolves
+// to, and connects to the address it checked so another lookup can't swap it.
+func fetchDialer(dialer *net.Dialer, allowedHosts map[string]bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if allowedHosts[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+		for _, a := range addrs {
+			if isPrivateIP(a.IP) {
+				return nil, fmt.Errorf("refusing to connect to %s, which has the private address %s", host, a.IP)
+			}
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0].IP.String(), port))
+	}
+}
+
+// fetch retrieves a document from a URL published by a client. Only https URLs
+// are allowed.
+func (s *Server) fetch(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("%q must use https", rawURL)
+	}
+	resp, err := s.httpClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%q returned %s", rawURL, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchSize))
+}
+
+// verifyClientJWT checks the signature of a JWT signed by a client, such as a
+// request object or client assertion, against the client's keys and returns its
+// payload. Unsigned JWTs are rejected.
+func verifyClientJWT(jwks *jose.JSONWebKeySet, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, errors.New("malformed JWT")
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("expected exactly one signature")
+	}
+	keys := jwks.Keys
+	if keyID := jws.Signatures[0].Header.KeyID; keyID != "" {
+		keys = jwks.Key(keyID)
+	}
+	for _, key := range keys {
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("failed to verify signature")
+}
+
+// validateClientKeys returns an error if the keys of a client, the URLs it
+// publishes keys and request objects at, or the method it authenticates to the
+// token endpoint with, are invalid.
+func validateClientKeys(c storage.Client) error {
+	if c.JWKS != nil && c.JWKSURI != "" {
+		return errors.New("jwks and jwks_uri can't be used together")
+	}
+	if c.JWKSURI != "" {
+		if u, err := url.Parse(c.JWKSURI); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("jwks_uri %q must be an https URL", c.JWKSURI)
+		}
+	}
+	for _, requestURI := range c.RequestURIs {
+		if u, err := url.Parse(requestURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("request_uri %q must be an https URL", requestURI)
+		}
+	}
+	switch c.TokenEndpointAuthMethod {
+	case "", authMethodClientSecretBasic, authMethodClientSecretPost:
+	case authMethodClientSecretJWT:
+		if c.Secret == "" {
+			return fmt.Errorf("token endpoint auth method %q requires a plaintext secret", c.TokenEndpointAuthMethod)
+		}
+	case authMethodPrivateKeyJWT:
+		if c.JWKS == nil && c.JWKSURI == "" {
+			return fmt.Errorf("token endpoint auth method %q requires jwks or jwks_uri", c.TokenEndpointAuthMethod)
+		}
+	case authMethodTLSClientAuth:
+		if c.TLSClientAuthSubjectDN == "" {
+			return fmt.Errorf("token endpoint auth method %q requires tls_client_auth_subject_dn", c.TokenEndpointAuthMethod)
+		}
+	case authMethodSelfSignedTLSClientAuth:
+		if c.TLSClientCertificateThumbprint == "" {
+			return fmt.Errorf("token endpoint auth method %q requires tls_client_certificate_thumbprint", c.TokenEndpointAuthMethod)
+		}
+	default:
+		return fmt.Errorf("invalid token endpoint auth method %q", c.TokenEndpointAuthMethod)
+	}
+	return nil
+}
+
+// hashClientSecret returns the bcrypt hash of a client secret.
+func hashClientSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// verifyClientSecret reports whether the secret is the client's. Secrets stored
+// before they were hashed, and the ones of "client_secret_jwt" clients, are
+// compared in plaintext. An empty secret never matches, even for clients which
+// have none.
+func verifyClientSecret(client storage.Client, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if client.SecretHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) == 1
+}
+
+// certThumbprint returns the base64url encoded SHA-256 thumbprint of a certificate.
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// requestCertThumbprint returns the thumbprint of the certificate the client
+// presented over mutual TLS, or an empty string if it didn't present one. Tokens
+// issued in response to the request are bound to the certificate.
+func requestCertThumbprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return certThumbprint(r.TLS.PeerCertificates[0])
+}
+
+// verifyClientCertificate authenticates a client with the certificate it presented
+// over mutual TLS, returning the method it used. With "tls_client_auth" the
+// certificate is issued by one of the server's client CAs to the client's subject
+// DN. With "self_signed_tls_client_auth" it's the certificate the client
+// registered.
+//
+// See: https://tools.ietf.org/html/rfc8705#section-2
+func (s *Server) verifyClientCertificate(client storage.Client, r *http.Request) (method string, err error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	cert := r.TLS.PeerCertificates[0]
+
+	method = client.TokenEndpointAuthMethod
+	if method != authMethodTLSClientAuth && method != authMethodSelfSignedTLSClientAuth {
+		method = authMethodTLSClientAuth
+		if client.TLSClientAuthSubjectDN == "" {
+			method = authMethodSelfSignedTLSClientAuth
+		}
+	}
+
+	if method == authMethodTLSClientAuth {
+		if s.tlsClientCAs == nil {
+			return "", errors.New("no CAs are configured to verify client certificates")
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         s.tlsClientCAs,
+			Intermediates: intermediates,
+			CurrentTime:   s.now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if _, err := cert.Verify(opts); err != nil {
+			return "", fmt.Errorf("verify certificate: %v", err)
+		}
+		if cert.Subject.String() != client.TLSClientAuthSubjectDN {
+			return "", fmt.Errorf("certificate subject %q doesn't match", cert.Subject)
+		}
+		return method, nil
+	}
+
+	if now := s.now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", errors.New("certificate is expired or not yet valid")
+	}
+	thumbprint := certThumbprint(cert)
+	if client.TLSClientCertificateThumbprint == "" || subtle.ConstantTimeCompare([]byte(thumbprint), []byte(client.TLSClientCertificateThumbprint)) != 1 {
+		return "", errors.New("certificate doesn't match the registered certificate")
+	}
+	return method, nil
+}
+
+// maxClientAssertionLifetime bounds how long client assertions are valid for, and
+// so how long they're kept to detect replays.
+const maxClientAssertionLifetime = time.Hour
+
+// clientAssertionClaims are the claims of a JWT a client authenticates with.
+//
+// See: https://tools.ietf.org/html/rfc7523#section-3
+type clientAssertionClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	JWTID     string   `json:"jti"`
+}
+
+// clientAssertionSubject returns the client a JWT claims to authenticate, before
+// its signature has been checked.
+func clientAssertionSubject(assertion string) (string, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed JWT")
+	}
+	var claims clientAssertionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("malformed claims: %v", err)
+	}
+	if claims.Subject == "" {
+		return "", errors.New("no subject")
+	}
+	return claims.Subject, nil
+}
+
+// verifyClientAssertion checks the signature of a JWT the client authenticates
+// with, and returns its claims along with the authentication method it used. JWTs
+// signed with HMAC algorithms are verified with the client's secret, others with
+// the client's keys.
+//
+// Only clients registered with "client_secret_jwt" may sign JWTs with their
+// secret, since the secrets of other clients are stored hashed.
+func (s *Server) verifyClientAssertion(client storage.Client, assertion string) (claims clientAssertionClaims, method string, err error) {
+	jws, err := jose.ParseSigned(assertion)
+	if err != nil {
+		return claims, "", errors.New("malformed JWT")
+	}
+	if len(jws.Signatures) != 1 {
+		return claims, "", errors.New("expected exactly one signature")
+	}
+
+	var payload []byte
+	switch jose.SignatureAlgorithm(jws.Signatures[0].Header.Algorithm) {
+	case jose.HS256, jose.HS384, jose.HS512:
+		// Public clients can't keep a secret, so it can't authenticate them. Clients
+		// whose secret is only stored hashed can't use it to sign JWTs either.
+		if client.Public || client.TokenEndpointAuthMethod != authMethodClientSecretJWT || client.Secret == "" {
+			return claims, "", errors.New("client can't authenticate with its secret")
+		}
+		if payload, err = jws.Verify([]byte(client.Secret)); err != nil {
+			return claims, "", errors.New("failed to verify signature")
+		}
+		method = authMethodClientSecretJWT
+	default:
+		jwks, err := s.clientKeys(client)
+		if err != nil {
+			s.logger.Errorf("Failed to get keys of client %q: %v", client.ID, err)
+			return claims, "", errors.New("failed to fetch client keys from jwks_uri")
+		}
+		if jwks == nil || len(jwks.Keys) == 0 {
+			return claims, "", errors.New("client has no registered keys")
+		}
+		if payload, err = verifyClientJWT(jwks, assertion); err != nil {
+			return claims, "", err
+		}
+		method = authMethodPrivateKeyJWT
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, "", fmt.Errorf("malformed claims: %v", err)
+	}
+	return claims, method, nil
+}
+
+// validateClientAssertion checks the claims of a JWT the client authenticates
+// with to the endpoint. The JWT must be intended for this server, and expire soon
+// so it can be remembered until then to detect replays.
+func (s *Server) validateClientAssertion(client storage.Client, claims clientAssertionClaims, endpoint string) error {
+	if claims.Issuer != client.ID || claims.Subject != client.ID {
+		return errors.New("issuer and subject must be the client ID")
+	}
+	if !claims.Audience.contains(s.issuerURL.String()) && !claims.Audience.contains(s.absURL("/token")) && !claims.Audience.contains(endpoint) {
+		return errors.New("not intended for this server")
+	}
+	if claims.JWTID == "" {
+		return errors.New("no jti claim")
+	}
+
+	now := s.now()
+	if claims.Expiry == 0 {
+		return errors.New("no exp claim")
+	}
+	expiry := time.Unix(claims.Expiry, 0)
+	if now.After(expiry) {
+		return errors.New("expired")
+	}
+	if expiry.After(now.Add(maxClientAssertionLifetime)) {
+		return fmt.Errorf("expires in more than %s", maxClientAssertionLifetime)
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("not valid yet")
+	}
+	return nil
+}
+
+// clientAssertionID returns the ID a client assertion is stored under. It's
+// derived from the client and the "jti" claim, since clients pick the latter.
+func clientAssertionID(clientID, jti string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s%s", len(clientID), clientID, jti)
+	return strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString(h.Sum(nil)), "="))
+}
+
+// validateScopes checks that the scopes requested by an end user login include "openid"
+// and are all recognized, and that the client is trusted by the peers of any cross-client
+// scopes. The returned error doesn't hold a state or redirect URI.
+func (s *Server) validateScopes(clientID string, scopes []string) *authErr {
+	var (
+		unrecognized  []string
+		invalidScopes []string
+	)
+	hasOpenIDScope := false
+	for _, scope := range scopes {
+		switch scope {
+		case scopeOpenID:
+			hasOpenIDScope = true
+		case scopeOfflineAccess, scopeEmail, scopeProfile, scopeGroups:
+		default:
+			peerID, ok := parseCrossClientScope(scope)
+			if !ok {
+				unrecognized = append(unrecognized, scope)
+				continue
+			}
+
+			isTrusted, err := s.validateCrossClientTrust(clientID, peerID)
+			if err != nil {
+				return &authErr{Type: errServerError}
+			}
+			if !isTrusted {
+				invalidScopes = append(invalidScopes, scope)
+			}
+		}
+	}
+	if !hasOpenIDScope {
+		return &authErr{Type: errInvalidScope, Description: `Missing required scope(s) ["openid"].`}
+	}
+	if len(unrecognized) > 0 {
+		return &authErr{Type: errInvalidScope, Description: fmt.Sprintf("Unrecognized scope(s) %q", unrecognized)}
+	}
+	if len(invalidScopes) > 0 {
+		return &authErr{Type: errInvalidScope, Description: fmt.Sprintf("Client can't request scope(s) %q", invalidScopes)}
+	}
+	return nil
+}
+
+// verifyCodeVerifier determines if the code_verifier presented at the token endpoint
+// matches the challenge of the initial authorization request.
+//
+// See: https://tools.ietf.org/html/rfc7636#section-4.6
+func verifyCodeVerifier(pkce storage.PKCE, codeVerifier string) bool {
+	// https://tools.ietf.org/html/rfc7636#section-4.1
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return false
+	}
+
+	var challenge string
+	switch pkce.CodeChallengeMethod {
+	case codeChallengeMethodS256:
+		sum := sha256.Sum256([]byte(codeVerifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	case codeChallengeMethodPlain:
+		challenge = codeVerifier
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(pkce.CodeChallenge)) == 1
+}
+
+func parseCrossClientScope(scope string) (peerID string, ok bool) {
+	if ok = strings.HasPrefix(scope, scopeCrossClientPrefix); ok {
+		peerID = scope[len(scopeCrossClientPrefix):]
+	}
+	return
+}
+
+func (s *Server) validateCrossClientTrust(clientID, peerID string) (trusted bool, err error) {
+	if peerID == clientID {
+		return true, nil
+	}
+	peer, err := s.storage.GetClient(peerID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("Failed to get client: %v", err)
+			return false, err
+		}
+		return false, nil
+	}
+	for _, id := range peer.TrustedPeers {
+		if id == clientID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func validatePostLogoutRedirectURI(client storage.Client, redirectURI string) bool {
+	for _, uri := range client.PostLogoutRedirectURIs {
+		if redirectURI == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRedirectURI(client storage.Client, redirectURI string) bool {
+	for _, uri := range client.RedirectURIs {
+		if redirectURI == uri {
+			return true
+		}
+	}
+	if !client.Public {
+		return false
+	}
+
+	if redirectURI == redirectURIOOB {
+		return true
+	}
+
+	// Public clients may redirect to "http://localhost(:port)(path)".
+	u, err := url.Parse(redirectURI)
+	return err == nil && isLocalhostURL(u)
+}
+
+// isLocalhostURL reports whether the URL is of the form "http://localhost(:port)(path)".
+func isLocalhostURL(u *url.URL) bool {
+	if u.Scheme != "http" {
+		return false
+	}
+	if u.Host == "localhost" {
+		return true
 	}
-	n, err := strconv.Atoi(strings.TrimPrefix(redirectURI, "https://localhost:"))
-	return err == nil && n <= 0
+	host, _, err := net.SplitHostPort(u.Host)
+	return err == nil && host == "localhost"
 }
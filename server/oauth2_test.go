@@ -1 +1,119 @@
 package server
+
+import (
+	"testing"
+
+	"github.com/coreos/dex/storage"
+)
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	// Example values from https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	tests := []struct {
+		name     string
+		pkce     storage.PKCE
+		verifier string
+		want     bool
+	}{
+		{
+			name:     "valid S256",
+			pkce:     storage.PKCE{CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengeMethod: "S256"},
+			verifier: verifier,
+			want:     true,
+		},
+		{
+			name:     "invalid S256",
+			pkce:     storage.PKCE{CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", CodeChallengeMethod: "S256"},
+			verifier: verifier + "x",
+		},
+		{
+			name:     "valid plain",
+			pkce:     storage.PKCE{CodeChallenge: verifier, CodeChallengeMethod: "plain"},
+			verifier: verifier,
+			want:     true,
+		},
+		{
+			name:     "verifier too short",
+			pkce:     storage.PKCE{CodeChallenge: "foo", CodeChallengeMethod: "plain"},
+			verifier: "foo",
+		},
+		{
+			name:     "unknown method",
+			pkce:     storage.PKCE{CodeChallenge: verifier, CodeChallengeMethod: "S512"},
+			verifier: verifier,
+		},
+	}
+	for _, tc := range tests {
+		if got := verifyCodeVerifier(tc.pkce, tc.verifier); got != tc.want {
+			t.Errorf("%s: expected verifyCodeVerifier to return %t, got %t", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestVerifyClientSecret(t *testing.T) {
+	hash, err := hashClientSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client storage.Client
+		secret string
+		want   bool
+	}{
+		{
+			name:   "hashed secret",
+			client: storage.Client{SecretHash: hash},
+			secret: "secret",
+			want:   true,
+		},
+		{
+			name:   "wrong hashed secret",
+			client: storage.Client{SecretHash: hash},
+			secret: "other",
+		},
+		{
+			name:   "plaintext secret",
+			client: storage.Client{Secret: "secret"},
+			secret: "secret",
+			want:   true,
+		},
+		{
+			name:   "wrong plaintext secret",
+			client: storage.Client{Secret: "secret"},
+			secret: "other",
+		},
+		{
+			name:   "empty secret of client without secret",
+			client: storage.Client{Public: true},
+		},
+	}
+	for _, tc := range tests {
+		if got := verifyClientSecret(tc.client, tc.secret); got != tc.want {
+			t.Errorf("%s: expected verifyClientSecret to return %t, got %t", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestValidateClaimMappings(t *testing.T) {
+	tests := []struct {
+		mapping storage.ClaimMapping
+		wantErr bool
+	}{
+		{storage.ClaimMapping{Claim: "employee_id", From: "employeeNumber"}, false},
+		{storage.ClaimMapping{Claim: "login", Template: "{{.login}}", Scope: "profile"}, false},
+		{storage.ClaimMapping{From: "employeeNumber"}, true},
+		{storage.ClaimMapping{Claim: "email", From: "mail"}, true},
+		{storage.ClaimMapping{Claim: "employee_id"}, true},
+		{storage.ClaimMapping{Claim: "employee_id", From: "employeeNumber", Template: "{{.employeeNumber}}"}, true},
+		{storage.ClaimMapping{Claim: "login", Template: "{{.login"}, true},
+	}
+	for _, tc := range tests {
+		err := validateClaimMappings([]storage.ClaimMapping{tc.mapping})
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%+v: wanted error %t, got %v", tc.mapping, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/coreos/dex/storage"
+)
+
+// Dynamic client registration lets clients register themselves by posting their
+// metadata to the registration endpoint, authorized by one of the initial access
+// tokens configured by the operator. Each registered client is issued a
+// registration access token it can use to read, update and delete its own
+// registration at the client configuration endpoint.
+//
+// See: https://tools.ietf.org/html/rfc7591 and https://tools.ietf.org/html/rfc7592
+
+const (
+	// Registration errors, see https://tools.ietf.org/html/rfc7591#section-3.2.2
+	errInvalidRedirectURI    = "invalid_redirect_uri"
+	errInvalidClientMetadata = "invalid_client_metadata"
+
+	// authMethodNone is the token endpoint auth method of public clients.
+	authMethodNone = "none"
+
+	// grantTypeImplicit is registered by clients using the implicit flow. It's
+	// never passed to the token endpoint.
+	grantTypeImplicit = "implicit"
+)
+
+// clientMetadata is the metadata a client registers with.
+//
+// See: https://tools.ietf.org/html/rfc7591#section-2
+type clientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	PostLogoutRedirectURIs  []string `json:"post_logout_redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+
+	JWKSURI string              `json:"jwks_uri,omitempty"`
+	JWKS    *jose.JSONWebKeySet `json:"jwks,omitempty"`
+
+	RequestURIs []string `json:"request_uris,omitempty"`
+
+	IDTokenSignedResponseAlg string `json:"id_token_signed_response_alg,omitempty"`
+	SubjectType              string `json:"subject_type,omitempty"`
+
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+}
+
+// clientRegistrationResponse is the client information returned by the
+// registration and client configuration endpoints.
+//
+// See: https://tools.ietf.org/html/rfc7592#section-3
+type clientRegistrationResponse struct {
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+
+	clientMetadata
+}
+
+// registrationAccessTokenHash returns the base64url encoded SHA-256 hash of a
+// registration access token. Only the hash is stored.
+func registrationAccessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// bearerToken returns the bearer token of a request's Authorization header, or
+// an empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return ""
+	}
+	return parts[1]
+}
+
+// registrationErr is an error in the metadata of a registration request.
+type registrationErr struct {
+	typ         string
+	description string
+}
+
+func (err *registrationErr) Error() string { return err.description }
+
+func invalidClientMetadata(format string, a ...interface{}) *registrationErr {
+	return &registrationErr{errInvalidClientMetadata, fmt.Sprintf(format, a...)}
+}
+
+// applyClientMetadata validates the metadata and applies it to a client, replacing
+// any metadata the client was previously registered with.
+func (s *Server) applyClientMetadata(client *storage.Client, m clientMetadata) *registrationErr {
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = authMethodClientSecretBasic
+	}
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{grantTypeAuthorizationCode}
+	}
+
+	needsRedirect := false
+	client.AllowClientCredentials = false
+	for _, grantType := range m.GrantTypes {
+		switch grantType {
+		case grantTypeAuthorizationCode, grantTypeImplicit:
+			needsRedirect = true
+		case grantTypeClientCredentials:
+			if m.TokenEndpointAuthMethod == authMethodNone {
+				return invalidClientMetadata("Public clients can't use the %q grant type.", grantType)
+			}
+			client.AllowClientCredentials = true
+		case grantTypeRefreshToken, grantTypeDeviceCode:
+		default:
+			return invalidClientMetadata("Unsupported grant type %q.", grantType)
+		}
+	}
+	for _, responseType := range m.ResponseTypes {
+		for _, typ := range strings.Fields(responseType) {
+			if !s.supportedResponseTypes[typ] {
+				return invalidClientMetadata("Unsupported response type %q.", responseType)
+			}
+		}
+	}
+
+	if needsRedirect && len(m.RedirectURIs) == 0 {
+		return &registrationErr{errInvalidRedirectURI, "No redirect URIs provided."}
+	}
+	// Redirect URIs end up in the action of the form_post response mode's form, so
+	// schemes which run script, such as "javascript:", must never be registered.
+	public := m.TokenEndpointAuthMethod == authMethodNone
+	for _, redirectURI := range append(m.RedirectURIs, m.PostLogoutRedirectURIs...) {
+		u, err := url.Parse(redirectURI)
+		if err != nil || u.Host == "" || u.Fragment != "" {
+			return &registrationErr{errInvalidRedirectURI, fmt.Sprintf("Invalid redirect URI %q.", redirectURI)}
+		}
+		if u.Scheme != "https" && !(public && isLocalhostURL(u)) {
+			return &registrationErr{errInvalidRedirectURI, fmt.Sprintf("Redirect URI %q must use https, or http://localhost for public clients.", redirectURI)}
+		}
+	}
+
+	// The server fetches these itself, so they must not point at internal services.
+	for _, uri := range append([]string{m.JWKSURI}, m.RequestURIs...) {
+		if uri == "" {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			return invalidClientMetadata("Invalid URI %q.", uri)
+		}
+		if s.isPrivateHost(u) {
+			return invalidClientMetadata("URI %q must not point to a private address.", uri)
+		}
+	}
+
+	switch m.SubjectType {
+	case "", subjectTypePublic:
+	case subjectTypePairwise:
+		if len(s.pairwiseSubjectSecret) == 0 {
+			return invalidClientMetadata("Pairwise subject identifiers aren't supported.")
+		}
+	default:
+		return invalidClientMetadata("Unsupported subject type %q.", m.SubjectType)
+	}
+	if alg := m.IDTokenSignedResponseAlg; alg != "" {
+		supported := false
+		for _, signingAlg := range s.signingAlgs {
+			supported = supported || string(signingAlg) == alg
+		}
+		if !supported {
+			return invalidClientMetadata("Unsupported ID token signing algorithm %q.", alg)
+		}
+	}
+
+	client.RedirectURIs = m.RedirectURIs
+	client.PostLogoutRedirectURIs = m.PostLogoutRedirectURIs
+	client.Name = m.ClientName
+	client.LogoURL = m.LogoURI
+	client.AllowedScopes = strings.Fields(m.Scope)
+	client.JWKS = m.JWKS
+	client.JWKSURI = m.JWKSURI
+	client.RequestURIs = m.RequestURIs
+	client.IDTokenSignedResponseAlg = m.IDTokenSignedResponseAlg
+	client.SubjectType = m.SubjectType
+	client.TLSClientAuthSubjectDN = m.TLSClientAuthSubjectDN
+	client.TLSClientCertificateThumbprint = ""
+
+	client.Public = public
+	client.TokenEndpointAuthMethod = m.TokenEndpointAuthMethod
+	switch m.TokenEndpointAuthMethod {
+	case authMethodNone:
+		client.TokenEndpointAuthMethod = ""
+	case authMethodTLSClientAuth, authMethodSelfSignedTLSClientAuth:
+		if !s.tlsClientAuth || (m.TokenEndpointAuthMethod == authMethodTLSClientAuth && s.tlsClientCAs == nil) {
+			return invalidClientMetadata("Unsupported token endpoint auth method %q.", m.TokenEndpointAuthMethod)
+		}
+		if m.TokenEndpointAuthMethod == authMethodSelfSignedTLSClientAuth {
+			// Self-signed certificates are registered as keys in the client's
+			// key set, and only the first one is accepted.
+			if m.JWKS != nil {
+				for _, key := range m.JWKS.Keys {
+					if len(key.Certificates) > 0 {
+						client.TLSClientCertificateThumbprint = certThumbprint(key.Certificates[0])
+						break
+					}
+				}
+			}
+			if client.TLSClientCertificateThumbprint == "" {
+				return invalidClientMetadata("Token endpoint auth method %q requires a certificate in jwks.", m.TokenEndpointAuthMethod)
+			}
+		}
+	}
+	if err := validateClientKeys(*client); err != nil {
+		return invalidClientMetadata("%s.", err)
+	}
+	return nil
+}
+
+// clientMetadataFor returns the metadata of a registered client. Grant and response
+// types aren't stored, so they're the ones the client is able to use.
+func (s *Server) clientMetadataFor(client storage.Client) clientMetadata {
+	m := clientMetadata{
+		RedirectURIs:             client.RedirectURIs,
+		PostLogoutRedirectURIs:   client.PostLogoutRedirectURIs,
+		TokenEndpointAuthMethod:  client.TokenEndpointAuthMethod,
+		GrantTypes:               []string{grantTypeAuthorizationCode, grantTypeRefreshToken, grantTypeDeviceCode},
+		ClientName:               client.Name,
+		LogoURI:                  client.LogoURL,
+		Scope:                    strings.Join(client.AllowedScopes, " "),
+		JWKSURI:                  client.JWKSURI,
+		JWKS:                     client.JWKS,
+		RequestURIs:              client.RequestURIs,
+		IDTokenSignedResponseAlg: client.IDTokenSignedResponseAlg,
+		SubjectType:              client.SubjectType,
+		TLSClientAuthSubjectDN:   client.TLSClientAuthSubjectDN,
+	}
+	if client.Public {
+		m.TokenEndpointAuthMethod = authMethodNone
+	} else if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = authMethodClientSecretBasic
+	}
+	if s.supportedResponseTypes[responseTypeToken] || s.supportedResponseTypes[responseTypeIDToken] {
+		m.GrantTypes = append(m.GrantTypes, grantTypeImplicit)
+	}
+	if client.AllowClientCredentials {
+		m.GrantTypes = append(m.GrantTypes, grantTypeClientCredentials)
+	}
+	for _, responseType := range []string{responseTypeCode, responseTypeIDToken, responseTypeToken} {
+		if s.supportedResponseTypes[responseType] {
+			m.ResponseTypes = append(m.ResponseTypes, responseType)
+		}
+	}
+	return m
+}
+
+// parseClientMetadata decodes the metadata of a registration or update request.
+func (s *Server) parseClientMetadata(w http.ResponseWriter, r *http.Request) (m clientMetadata, clientID string, ok bool) {
+	var body struct {
+		clientMetadata
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.tokenErrHelper(w, errInvalidClientMetadata, "Request body must be a JSON object of client metadata.", http.StatusBadRequest)
+		return m, "", false
+	}
+	return body.clientMetadata, body.ClientID, true
+}
+
+// handleRegistration registers a new client. The request must be authorized by
+// one of the server's initial access tokens.
+//
+// See: https://tools.ietf.org/html/rfc7591#section-3
+func (s *Server) handleRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.tokenErrHelper(w, errInvalidRequest, "Registration requests must use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	token := bearerToken(r)
+	authorized := false
+	for _, initialAccessToken := range s.initialAccessTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(initialAccessToken)) == 1 {
+			authorized = true
+		}
+	}
+	if token == "" || !authorized {
+		s.userInfoErr(w, "invalid_token", "Invalid initial access token.", http.StatusUnauthorized)
+		return
+	}
+
+	m, _, ok := s.parseClientMetadata(w, r)
+	if !ok {
+		return
+	}
+	// Public clients can't keep a secret, but are given one nobody knows so they're
+	// never considered authenticated.
+	secret := storage.NewID() + storage.NewID()
+	client := storage.Client{ID: storage.NewID(), Secret: secret}
+	if err := s.applyClientMetadata(&client, m); err != nil {
+		s.writeRegistrationErr(w, err)
+		return
+	}
+	// Only the hash of the secret is stored, unless it's needed in plaintext to
+	// verify client assertions.
+	if client.TokenEndpointAuthMethod != authMethodClientSecretJWT {
+		hash, err := hashClientSecret(secret)
+		if err != nil {
+			s.logger.Errorf("failed to hash client secret: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		client.Secret, client.SecretHash = "", hash
+	}
+	registrationAccessToken := storage.NewID() + storage.NewID()
+	client.RegistrationAccessTokenHash = registrationAccessTokenHash(registrationAccessToken)
+
+	if err := s.storage.CreateClient(client); err != nil {
+		s.logger.Errorf("failed to create client: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	resp := s.clientRegistrationResponse(client)
+	resp.RegistrationAccessToken = registrationAccessToken
+	switch client.TokenEndpointAuthMethod {
+	case authMethodClientSecretBasic, authMethodClientSecretPost, authMethodClientSecretJWT:
+		resp.ClientSecret = secret
+	}
+	s.writeRegistrationResponse(w, http.StatusCreated, resp)
+}
+
+// handleClientConfiguration lets a registered client read, update and delete its
+// registration, authorized by the registration access token it was issued.
+//
+// See: https://tools.ietf.org/html/rfc7592#section-2
+func (s *Server) handleClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	// Unknown clients and invalid tokens get the same response, so clients can't be
+	// enumerated.
+	unauthorized := func() {
+		s.userInfoErr(w, "invalid_token", "Invalid registration access token.", http.StatusUnauthorized)
+	}
+
+	clientID := mux.Vars(r)["client_id"]
+	client, err := s.storage.GetClient(clientID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			s.logger.Errorf("failed to get client: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		unauthorized()
+		return
+	}
+	token := bearerToken(r)
+	if token == "" || client.RegistrationAccessTokenHash == "" ||
+		subtle.ConstantTimeCompare([]byte(registrationAccessTokenHash(token)), []byte(client.RegistrationAccessTokenHash)) != 1 {
+		unauthorized()
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.writeRegistrationResponse(w, http.StatusOK, s.clientRegistrationResponse(client))
+	case "PUT":
+		m, id, ok := s.parseClientMetadata(w, r)
+		if !ok {
+			return
+		}
+		if id != client.ID {
+			s.tokenErrHelper(w, errInvalidRequest, "client_id doesn't match the registration being updated.", http.StatusBadRequest)
+			return
+		}
+		method := m.TokenEndpointAuthMethod
+		if method == "" {
+			method = authMethodClientSecretBasic
+		}
+		if method != s.clientMetadataFor(client).TokenEndpointAuthMethod {
+			s.writeRegistrationErr(w, invalidClientMetadata("token_endpoint_auth_method can't be changed."))
+			return
+		}
+
+		if err := s.applyClientMetadata(&client, m); err != nil {
+			s.writeRegistrationErr(w, err)
+			return
+		}
+		var updated storage.Client
+		err := s.storage.UpdateClient(client.ID, func(old storage.Client) (storage.Client, error) {
+			// The metadata was validated above, but the client may have changed since.
+			if err := s.applyClientMetadata(&old, m); err != nil {
+				return old, err
+			}
+			updated = old
+			return old, nil
+		})
+		if err != nil {
+			s.logger.Errorf("failed to update client: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		s.writeRegistrationResponse(w, http.StatusOK, s.clientRegistrationResponse(updated))
+	case "DELETE":
+		if err := s.storage.DeleteClient(client.ID); err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("failed to delete client: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.tokenErrHelper(w, errInvalidRequest, "Client configuration requests must use GET, PUT or DELETE.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) clientRegistrationResponse(client storage.Client) clientRegistrationResponse {
+	return clientRegistrationResponse{
+		ClientID:              client.ID,
+		RegistrationClientURI: s.absURL("/register", client.ID),
+		clientMetadata:        s.clientMetadataFor(client),
+	}
+}
+
+func (s *Server) writeRegistrationResponse(w http.ResponseWriter, statusCode int, resp clientRegistrationResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Errorf("failed to marshal registration response: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+func (s *Server) writeRegistrationErr(w http.ResponseWriter, err *registrationErr) {
+	s.tokenErrHelper(w, err.typ, err.description, http.StatusBadRequest)
+}
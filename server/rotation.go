@@ -1,6 +1,9 @@
 package server
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/hex"
@@ -13,6 +16,7 @@ import (
 	"gopkg.in/square/go-jose.v2"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/coreos/dex/server/signer"
 	"github.com/coreos/dex/storage"
 )
 
@@ -25,9 +29,10 @@ type rotationStrategy struct {
 	// After being rotated how long can a key validate signatues?
 	verifyFor time.Duration
 
-	// Keys are always RSA keys. Though cryptopasta recommends ECDSA keys, not every
-	// client may support these (e.g. github.com/coreos/go-oidc/oidc).
-	key func() (*rsa.PrivateKey, error)
+	// Generates a key for signing with the given algorithm. RS256 remains the default
+	// algorithm since not every client supports ECDSA keys (e.g.
+	// github.com/coreos/go-oidc/oidc).
+	key func(alg jose.SignatureAlgorithm) (crypto.Signer, error)
 }
 
 // staticRotationStrategy returns a strategy which never rotates keys.
@@ -36,26 +41,59 @@ func staticRotationStrategy(key *rsa.PrivateKey) rotationStrategy {
 		// Setting these values to 100 years is easier than having a flag indicating no rotation.
 		rotationFrequency: time.Hour * 8760 * 100,
 		verifyFor:         time.Hour * 8760 * 100,
-		key:               func() (*rsa.PrivateKey, error) { return key, nil },
+		key: func(alg jose.SignatureAlgorithm) (crypto.Signer, error) {
+			if isRSAAlgorithm(alg) {
+				return key, nil
+			}
+			return newSigningKey(alg, 0)
+		},
 	}
 }
 
 // defaultRotationStrategy returns a strategy which rotates keys every provided period,
 // holding onto the public parts for some specified amount of time.
-func defaultRotationStrategy(rotationFrequency, verifyFor time.Duration) rotationStrategy {
+func defaultRotationStrategy(rotationFrequency, verifyFor time.Duration, rsaKeySize int) rotationStrategy {
 	return rotationStrategy{
 		rotationFrequency: rotationFrequency,
 		verifyFor:         verifyFor,
-		key: func() (*rsa.PrivateKey, error) {
-			return rsa.GenerateKey(rand.Reader, 2048)
+		key: func(alg jose.SignatureAlgorithm) (crypto.Signer, error) {
+			return newSigningKey(alg, rsaKeySize)
 		},
 	}
 }
 
+func isRSAAlgorithm(alg jose.SignatureAlgorithm) bool {
+	switch alg {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		return true
+	}
+	return false
+}
+
+// newSigningKey generates a private key which can sign with the algorithm.
+func newSigningKey(alg jose.SignatureAlgorithm, rsaKeySize int) (crypto.Signer, error) {
+	switch alg {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		if rsaKeySize == 0 {
+			rsaKeySize = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, rsaKeySize)
+	case jose.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.ES384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jose.ES512:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
 type keyRotater struct {
 	storage.Storage
 
 	strategy rotationStrategy
+	algs     []jose.SignatureAlgorithm
+	signers  []signer.Signer
 	now      func() time.Time
 
 	logger logrus.FieldLogger
@@ -66,7 +104,7 @@ type keyRotater struct {
 // The method blocks until after the first attempt to rotate keys has completed. That way
 // healthy storages will return from this call with valid keys.
 func (s *Server) startKeyRotation(ctx context.Context, strategy rotationStrategy, now func() time.Time) {
-	rotater := keyRotater{s.storage, strategy, now, s.logger}
+	rotater := keyRotater{s.storage, strategy, s.signingAlgs, s.signers, now, s.logger}
 
 	// Try to rotate immediately so properly configured storages will have keys.
 	if err := rotater.rotate(); err != nil {
@@ -89,42 +127,52 @@ func (s *Server) startKeyRotation(ctx context.Context, strategy rotationStrategy
 }
 
 func (k keyRotater) rotate() error {
+	if len(k.signers) > 0 {
+		return k.publishSignerKeys()
+	}
+
 	keys, err := k.GetKeys()
 	if err != nil && err != storage.ErrNotFound {
 		return fmt.Errorf("get keys: %v", err)
 	}
-	if k.now().Before(keys.NextRotation) {
+	// Rotate early if the configured signing algorithms have changed.
+	if k.now().Before(keys.NextRotation) && k.hasAlgorithms(keys) {
 		return nil
 	}
 	k.logger.Infof("keys expired, rotating")
 
-	// Generate the key outside of a storage transaction.
-	key, err := k.strategy.key()
-	if err != nil {
-		return fmt.Errorf("generate key: %v", err)
-	}
-	b := make([]byte, 20)
-	if _, err := io.ReadFull(rand.Reader, b); err != nil {
-		panic(err)
-	}
-	keyID := hex.EncodeToString(b)
-	priv := &jose.JSONWebKey{
-		Key:       key,
-		KeyID:     keyID,
-		Algorithm: "RS256",
-		Use:       "sig",
-	}
-	pub := &jose.JSONWebKey{
-		Key:       key.Public(),
-		KeyID:     keyID,
-		Algorithm: "RS256",
-		Use:       "sig",
+	// Generate the keys outside of a storage transaction.
+	pairs := make([]storage.SigningKeyPair, len(k.algs))
+	for i, alg := range k.algs {
+		key, err := k.strategy.key(alg)
+		if err != nil {
+			return fmt.Errorf("generate %s key: %v", alg, err)
+		}
+		b := make([]byte, 20)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			panic(err)
+		}
+		keyID := hex.EncodeToString(b)
+		pairs[i] = storage.SigningKeyPair{
+			PrivateKey: &jose.JSONWebKey{
+				Key:       key,
+				KeyID:     keyID,
+				Algorithm: string(alg),
+				Use:       "sig",
+			},
+			PublicKey: &jose.JSONWebKey{
+				Key:       key.Public(),
+				KeyID:     keyID,
+				Algorithm: string(alg),
+				Use:       "sig",
+			},
+		}
 	}
 
 	var nextRotation time.Time
 	err = k.Storage.UpdateKeys(func(keys storage.Keys) (storage.Keys, error) {
 		tNow := k.now()
-		if tNow.Before(keys.NextRotation) {
+		if tNow.Before(keys.NextRotation) && k.hasAlgorithms(keys) {
 			return storage.Keys{}, errors.New("keys already rotated")
 		}
 
@@ -138,18 +186,26 @@ func (k keyRotater) rotate() error {
 		}
 		keys.VerificationKeys = keys.VerificationKeys[:i]
 
+		// Move current signing keys to verification only keys.
+		oldKeys := make([]*jose.JSONWebKey, 0, len(keys.AdditionalSigningKeys)+1)
 		if keys.SigningKeyPub != nil {
-			// Move current signing key to a verification only key.
+			oldKeys = append(oldKeys, keys.SigningKeyPub)
+		}
+		for _, pair := range keys.AdditionalSigningKeys {
+			oldKeys = append(oldKeys, pair.PublicKey)
+		}
+		for _, pub := range oldKeys {
 			verificationKey := storage.VerificationKey{
-				PublicKey: keys.SigningKeyPub,
+				PublicKey: pub,
 				Expiry:    tNow.Add(k.strategy.verifyFor),
 			}
 			keys.VerificationKeys = append(keys.VerificationKeys, verificationKey)
 		}
 
 		nextRotation = k.now().Add(k.strategy.rotationFrequency)
-		keys.SigningKey = priv
-		keys.SigningKeyPub = pub
+		keys.SigningKey = pairs[0].PrivateKey
+		keys.SigningKeyPub = pairs[0].PublicKey
+		keys.AdditionalSigningKeys = pairs[1:]
 		keys.NextRotation = nextRotation
 		return keys, nil
 	})
@@ -159,3 +215,123 @@ func (k keyRotater) rotate() error {
 	k.logger.Infof("keys rotated, next rotation: %s", nextRotation)
 	return nil
 }
+
+// How often public keys of external signers are republished. Keys are cached until
+// they're republished, so this bounds how long other servers take to notice a
+// signer's key was replaced.
+const signerKeysRefresh = time.Minute
+
+var errKeysPublished = errors.New("keys already published")
+
+// publishSignerKeys stores the public keys of the external signers. Unlike rotate,
+// no private keys are generated or stored. Public keys of replaced signer keys are
+// kept as verification keys so existing signatures remain valid.
+func (k keyRotater) publishSignerKeys() error {
+	pubs := make([]*jose.JSONWebKey, len(k.signers))
+	for i, s := range k.signers {
+		pub, err := s.PublicKey()
+		if err != nil {
+			return fmt.Errorf("get %s signer public key: %v", s.Algorithm(), err)
+		}
+		pubs[i] = pub
+	}
+
+	keys, err := k.GetKeys()
+	if err != nil && err != storage.ErrNotFound {
+		return fmt.Errorf("get keys: %v", err)
+	}
+	if k.now().Before(keys.NextRotation) && hasPublicKeys(keys, pubs) {
+		return nil
+	}
+
+	var changed bool
+	err = k.Storage.UpdateKeys(func(keys storage.Keys) (storage.Keys, error) {
+		tNow := k.now()
+		changed = !hasPublicKeys(keys, pubs)
+		if tNow.Before(keys.NextRotation) && !changed {
+			return storage.Keys{}, errKeysPublished
+		}
+
+		// Remove expired verification keys.
+		i := 0
+		for _, key := range keys.VerificationKeys {
+			if key.Expiry.After(tNow) {
+				keys.VerificationKeys[i] = key
+				i++
+			}
+		}
+		keys.VerificationKeys = keys.VerificationKeys[:i]
+
+		current := make(map[string]bool)
+		for _, pub := range pubs {
+			current[pub.KeyID] = true
+		}
+		oldKeys := make([]*jose.JSONWebKey, 0, len(keys.AdditionalSigningKeys)+1)
+		if keys.SigningKeyPub != nil {
+			oldKeys = append(oldKeys, keys.SigningKeyPub)
+		}
+		for _, pair := range keys.AdditionalSigningKeys {
+			oldKeys = append(oldKeys, pair.PublicKey)
+		}
+		for _, pub := range oldKeys {
+			if !current[pub.KeyID] {
+				verificationKey := storage.VerificationKey{
+					PublicKey: pub,
+					Expiry:    tNow.Add(k.strategy.verifyFor),
+				}
+				keys.VerificationKeys = append(keys.VerificationKeys, verificationKey)
+			}
+		}
+
+		// Drop any private keys generated before signing was delegated.
+		keys.SigningKey = nil
+		keys.SigningKeyPub = pubs[0]
+		keys.AdditionalSigningKeys = make([]storage.SigningKeyPair, len(pubs)-1)
+		for i, pub := range pubs[1:] {
+			keys.AdditionalSigningKeys[i] = storage.SigningKeyPair{PublicKey: pub}
+		}
+		keys.NextRotation = tNow.Add(signerKeysRefresh)
+		return keys, nil
+	})
+	if err != nil {
+		if err == errKeysPublished {
+			return nil
+		}
+		return err
+	}
+	if changed {
+		k.logger.Infof("published signer keys")
+	}
+	return nil
+}
+
+// hasPublicKeys reports whether the keys hold exactly the public keys, and no
+// private keys.
+func hasPublicKeys(keys storage.Keys, pubs []*jose.JSONWebKey) bool {
+	if keys.SigningKey != nil || keys.SigningKeyPub == nil || len(keys.AdditionalSigningKeys) != len(pubs)-1 {
+		return false
+	}
+	if keys.SigningKeyPub.KeyID != pubs[0].KeyID {
+		return false
+	}
+	for i, pair := range keys.AdditionalSigningKeys {
+		if pair.PrivateKey != nil || pair.PublicKey.KeyID != pubs[i+1].KeyID {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAlgorithms reports whether the keys sign with exactly the configured algorithms.
+func (k keyRotater) hasAlgorithms(keys storage.Keys) bool {
+	algs := keys.SigningAlgorithms()
+	if len(algs) != len(k.algs) {
+		return false
+	}
+	for i, alg := range algs {
+		if alg != k.algs[i] {
+			return false
+		}
+	}
+	return true
+}
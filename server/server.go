@@ -1,11 +1,14 @@
 package server
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,8 +17,10 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	jose "gopkg.in/square/go-jose.v2"
 
 	"github.com/coreos/dex/connector"
+	"github.com/coreos/dex/server/signer"
 	"github.com/coreos/dex/storage"
 )
 
@@ -38,19 +43,66 @@ type Config struct {
 	// Strategies for federated identity.
 	Connectors []Connector
 
-	// Valid values are "code" to enable the code flow and "token" to enable the implicit
-	// flow. If no response types are supplied this value defaults to "code".
+	// Valid values are "code" to enable the code flow, and "token" and "id_token" to
+	// enable the implicit flow. Enabling "code" along with either of the others enables
+	// the hybrid flow. If no response types are supplied this value defaults to "code".
 	SupportedResponseTypes []string
 
 	// If enabled, the server won't prompt the user to approve authorization requests.
 	// Logging in implies approval.
 	SkipApprovalScreen bool
 
+	// If enabled, logging out through the end session endpoint revokes the refresh
+	// tokens held by the client on behalf of the end user.
+	RevokeRefreshTokensOnLogout bool
+
+	// Secret keying the hash which computes pairwise subject identifiers. It must
+	// stay the same across restarts and be shared by all instances of the server,
+	// or clients will see different identifiers for the same end users. If empty,
+	// pairwise subject identifiers aren't supported.
+	PairwiseSubjectSecret string
+
+	// Algorithms used to sign tokens, e.g. "RS256" or "ES256". A key is generated for
+	// each of them. The first is the default and the others are available to clients
+	// which ask for them. Defaults to "RS256".
+	SigningAlgorithms []string
+
+	RSAKeySize int // Size in bits of generated RSA keys. Defaults to 2048.
+
+	// If specified, tokens are signed by these signers instead of keys generated by
+	// the server, and storage only holds their public keys. The first signer's
+	// algorithm is the default. SigningAlgorithms and RSAKeySize are ignored.
+	Signers []signer.Signer
+
 	RotateKeysAfter  time.Duration // Defaults to 6 hours.
 	IDTokensValidFor time.Duration // Defaults to 24 hours
 
+	// Refresh tokens expire once RefreshTokensValidFor has passed since the end
+	// user logged in, or once they haven't been used for RefreshTokensIdleTimeout.
+	// If zero, refresh tokens don't expire for that reason.
+	RefreshTokensValidFor    time.Duration
+	RefreshTokensIdleTimeout time.Duration
+
 	GCFrequency time.Duration // Defaults to 5 minutes
 
+	// If enabled, the HTTPS listener requests client certificates. Clients may
+	// authenticate with them, and tokens issued to a client presenting one are
+	// bound to it. See RFC 8705.
+	TLSClientAuth bool
+
+	// CAs which issue the certificates of clients using "tls_client_auth". If nil,
+	// clients can only authenticate with self-signed certificates.
+	TLSClientCAs *x509.CertPool
+
+	// If specified, clients can register themselves dynamically by presenting one
+	// of these initial access tokens. See RFC 7591.
+	InitialAccessTokens []string
+
+	// Hosts the JWKS and request URIs of clients may point to even though they're
+	// private addresses or resolve to them. Documents published by clients are
+	// otherwise only fetched from public addresses.
+	AllowedFetchHosts []string
+
 	// If specified, the server will use this function for determining time.
 	Now func() time.Time
 
@@ -109,12 +161,47 @@ type Server struct {
 	// If enabled, don't prompt user for approval after logging in through connector.
 	skipApproval bool
 
+	// If enabled, revoke the client's refresh tokens for the user when they log out.
+	revokeRefreshTokensOnLogout bool
+
+	// Secret keying pairwise subject identifiers. If empty, they aren't supported.
+	pairwiseSubjectSecret []byte
+
 	supportedResponseTypes map[string]bool
 
+	// Algorithms used to sign tokens. The first is the default.
+	signingAlgs []jose.SignatureAlgorithm
+
+	// If set, tokens are signed by these signers rather than with keys from storage.
+	signers []signer.Signer
+
 	now func() time.Time
 
 	idTokensValidFor time.Duration
 
+	// Lifetimes of refresh tokens. If zero, they don't expire for that reason.
+	refreshTokensValidFor    time.Duration
+	refreshTokensIdleTimeout time.Duration
+
+	// If enabled, clients may present certificates. tlsClientCAs verifies the ones
+	// used for "tls_client_auth".
+	tlsClientAuth bool
+	tlsClientCAs  *x509.CertPool
+
+	// Tokens authorizing dynamic client registration. If empty, it's disabled.
+	initialAccessTokens []string
+
+	// Client used to fetch request objects passed by reference and client key sets.
+	httpClient *http.Client
+
+	// Hosts, in lower case, which documents are fetched from even though they're
+	// private addresses.
+	allowedFetchHosts map[string]bool
+
+	// Key sets fetched from the JWKS URIs of clients, by URI.
+	clientKeySetsMu sync.Mutex
+	clientKeySets   map[string]cachedKeySet
+
 	logger logrus.FieldLogger
 }
 
@@ -123,6 +210,7 @@ func NewServer(ctx context.Context, c Config) (*Server, error) {
 	return newServer(ctx, c, defaultRotationStrategy(
 		value(c.RotateKeysAfter, 6*time.Hour),
 		value(c.IDTokensValidFor, 24*time.Hour),
+		c.RSAKeySize,
 	))
 }
 
@@ -152,13 +240,46 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 	supported := make(map[string]bool)
 	for _, respType := range c.SupportedResponseTypes {
 		switch respType {
-		case responseTypeCode, responseTypeToken:
+		case responseTypeCode, responseTypeToken, responseTypeIDToken:
 		default:
 			return nil, fmt.Errorf("unsupported response_type %q", respType)
 		}
 		supported[respType] = true
 	}
 
+	if len(c.Signers) > 0 {
+		c.SigningAlgorithms = make([]string, len(c.Signers))
+		for i, sig := range c.Signers {
+			c.SigningAlgorithms[i] = string(sig.Algorithm())
+		}
+	}
+	if len(c.SigningAlgorithms) == 0 {
+		c.SigningAlgorithms = []string{string(jose.RS256)}
+	}
+
+	var signingAlgs []jose.SignatureAlgorithm
+	for _, alg := range c.SigningAlgorithms {
+		switch jose.SignatureAlgorithm(alg) {
+		case jose.RS256, jose.RS384, jose.RS512,
+			jose.PS256, jose.PS384, jose.PS512,
+			jose.ES256, jose.ES384, jose.ES512:
+		case "EdDSA":
+			// The vendored go-jose predates Ed25519 support.
+			return nil, errors.New("server: signing algorithm \"EdDSA\" is not supported, the JOSE library can't sign or verify Ed25519 keys")
+		default:
+			return nil, fmt.Errorf("server: unsupported signing algorithm %q", alg)
+		}
+		for _, a := range signingAlgs {
+			if a == jose.SignatureAlgorithm(alg) {
+				return nil, fmt.Errorf("server: duplicate signing algorithm %q", alg)
+			}
+		}
+		signingAlgs = append(signingAlgs, jose.SignatureAlgorithm(alg))
+	}
+	if c.RSAKeySize != 0 && c.RSAKeySize < 2048 {
+		return nil, fmt.Errorf("server: RSA key size must be at least 2048 bits, got %d", c.RSAKeySize)
+	}
+
 	web := webConfig{
 		dir:       c.Web.Dir,
 		logoURL:   c.Web.LogoURL,
@@ -172,21 +293,37 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 		return nil, fmt.Errorf("server: failed to load web static: %v", err)
 	}
 
+	allowedFetchHosts := make(map[string]bool)
+	for _, host := range c.AllowedFetchHosts {
+		allowedFetchHosts[strings.ToLower(host)] = true
+	}
+
 	now := c.Now
 	if now == nil {
 		now = time.Now
 	}
 
 	s := &Server{
-		issuerURL:              *issuerURL,
-		connectors:             make(map[string]Connector),
-		storage:                newKeyCacher(c.Storage, now),
-		supportedResponseTypes: supported,
-		idTokensValidFor:       value(c.IDTokensValidFor, 24*time.Hour),
-		skipApproval:           c.SkipApprovalScreen,
-		now:                    now,
-		templates:              tmpls,
-		logger:                 c.Logger,
+		issuerURL:                   *issuerURL,
+		connectors:                  make(map[string]Connector),
+		storage:                     newKeyCacher(c.Storage, now),
+		supportedResponseTypes:      supported,
+		signingAlgs:                 signingAlgs,
+		signers:                     c.Signers,
+		idTokensValidFor:            value(c.IDTokensValidFor, 24*time.Hour),
+		refreshTokensValidFor:       c.RefreshTokensValidFor,
+		refreshTokensIdleTimeout:    c.RefreshTokensIdleTimeout,
+		httpClient:                  newFetchClient(allowedFetchHosts),
+		allowedFetchHosts:           allowedFetchHosts,
+		skipApproval:                c.SkipApprovalScreen,
+		revokeRefreshTokensOnLogout: c.RevokeRefreshTokensOnLogout,
+		pairwiseSubjectSecret:       []byte(c.PairwiseSubjectSecret),
+		tlsClientAuth:               c.TLSClientAuth,
+		tlsClientCAs:                c.TLSClientCAs,
+		initialAccessTokens:         c.InitialAccessTokens,
+		now:                         now,
+		templates:                   tmpls,
+		logger:                      c.Logger,
 	}
 
 	for _, conn := range c.Connectors {
@@ -211,22 +348,68 @@ func newServer(ctx context.Context, c Config, rotationStrategy rotationStrategy)
 
 	// TODO(ericchiang): rate limit certain paths based on IP.
 	handleFunc("/token", s.handleToken)
+	handleFunc("/revoke", s.handleRevocation)
+	handleFunc("/introspect", s.handleIntrospection)
 	handleFunc("/keys", s.handlePublicKeys)
+	handleFunc("/userinfo", s.handleUserInfo)
 	handleFunc("/auth", s.handleAuthorization)
+	handleFunc("/par", s.handlePushedAuthRequest)
 	handleFunc("/auth/{connector}", s.handleConnectorLogin)
 	handleFunc("/callback", s.handleConnectorCallback)
 	handleFunc("/approval", s.handleApproval)
+	handleFunc("/end_session", s.handleEndSession)
+	handleFunc("/device", s.handleDeviceVerification)
+	handleFunc("/device/code", s.handleDeviceCode)
+	handleFunc(deviceCallbackURI, s.handleDeviceCallback)
+	if len(s.initialAccessTokens) > 0 {
+		handleFunc("/register", s.handleRegistration)
+	}
+	handleFunc("/register/{client_id}", s.handleClientConfiguration)
 	handleFunc("/healthz", s.handleHealth)
 	handlePrefix("/static", static)
 	handlePrefix("/theme", theme)
 	s.mux = r
 
+	s.hashClientSecrets()
 	s.startKeyRotation(ctx, rotationStrategy, now)
 	s.startGarbageCollection(ctx, value(c.GCFrequency, 5*time.Minute), now)
 
 	return s, nil
 }
 
+// hashClientSecrets replaces the plaintext secrets of clients stored before secrets
+// were hashed. Clients using "client_secret_jwt" keep theirs.
+func (s *Server) hashClientSecrets() {
+	clients, err := s.storage.ListClients()
+	if err != nil {
+		s.logger.Errorf("failed to list clients: %v", err)
+		return
+	}
+	for _, client := range clients {
+		if client.Secret == "" || client.SecretHash != "" || client.TokenEndpointAuthMethod == authMethodClientSecretJWT {
+			continue
+		}
+		hash, err := hashClientSecret(client.Secret)
+		if err != nil {
+			s.logger.Errorf("failed to hash secret of client %q: %v", client.ID, err)
+			continue
+		}
+		err = s.storage.UpdateClient(client.ID, func(old storage.Client) (storage.Client, error) {
+			// Leave secrets which changed in the meantime alone.
+			if old.Secret == client.Secret {
+				old.Secret, old.SecretHash = "", hash
+			}
+			return old, nil
+		})
+		if err != nil {
+			// Static clients can't be updated, and need a secretHash in the config.
+			s.logger.Warnf("client %q has a plaintext secret which can't be hashed: %v", client.ID, err)
+			continue
+		}
+		s.logger.Infof("hashed plaintext secret of client %q", client.ID)
+	}
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
@@ -314,6 +497,12 @@ type keyCacher struct {
 	keys atomic.Value // Always holds nil or type *storage.Keys.
 }
 
+// UpdateKeys drops the cached keys so this server sees the update immediately.
+func (k *keyCacher) UpdateKeys(updater func(old storage.Keys) (storage.Keys, error)) error {
+	k.keys.Store((*storage.Keys)(nil))
+	return k.Storage.UpdateKeys(updater)
+}
+
 func (k *keyCacher) GetKeys() (storage.Keys, error) {
 	keys, ok := k.keys.Load().(*storage.Keys)
 	if ok && keys != nil && k.now().Before(keys.NextRotation) {
@@ -340,8 +529,9 @@ func (s *Server) startGarbageCollection(ctx context.Context, frequency time.Dura
 			case <-time.After(frequency):
 				if r, err := s.storage.GarbageCollect(now()); err != nil {
 					s.logger.Errorf("garbage collection failed: %v", err)
-				} else if r.AuthRequests > 0 || r.AuthCodes > 0 {
-					s.logger.Errorf("garbage collection run, delete auth requests=%d, auth codes=%d", r.AuthRequests, r.AuthCodes)
+				} else if r != (storage.GCResult{}) {
+					s.logger.Errorf("garbage collection run, delete auth requests=%d, auth codes=%d, device requests=%d, device tokens=%d, client assertions=%d, refresh tokens=%d",
+						r.AuthRequests, r.AuthCodes, r.DeviceRequests, r.DeviceTokens, r.ClientAssertions, r.RefreshTokens)
 				}
 			}
 		}
@@ -1,12 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
@@ -26,9 +37,11 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
 
 	"github.com/coreos/dex/connector"
 	"github.com/coreos/dex/connector/mock"
+	"github.com/coreos/dex/server/signer"
 	"github.com/coreos/dex/storage"
 	"github.com/coreos/dex/storage/memory"
 )
@@ -194,6 +207,57 @@ func TestOAuth2CodeFlow(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "fetch userinfo",
+			handleToken: func(ctx context.Context, p *oidc.Provider, config *oauth2.Config, token *oauth2.Token) error {
+				ui, err := p.UserInfo(ctx, config.TokenSource(ctx, token))
+				if err != nil {
+					return fmt.Errorf("failed to fetch userinfo: %v", err)
+				}
+				if conn.Identity.Email != ui.Email {
+					return fmt.Errorf("expected email to be %v, got %v", conn.Identity.Email, ui.Email)
+				}
+				if conn.Identity.UserID != ui.Subject {
+					return fmt.Errorf("expected subject to be %v, got %v", conn.Identity.UserID, ui.Subject)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "userinfo filtered by scopes",
+			scopes: []string{oidc.ScopeOpenID, "profile"},
+			handleToken: func(ctx context.Context, p *oidc.Provider, config *oauth2.Config, token *oauth2.Token) error {
+				ui, err := p.UserInfo(ctx, config.TokenSource(ctx, token))
+				if err != nil {
+					return fmt.Errorf("failed to fetch userinfo: %v", err)
+				}
+				var claims map[string]interface{}
+				if err := ui.Claims(&claims); err != nil {
+					return fmt.Errorf("failed to unmarshal claims: %v", err)
+				}
+				if _, ok := claims["email"]; ok {
+					return fmt.Errorf("email claim released without the email scope: %v", claims)
+				}
+				if claims["name"] != conn.Identity.Username {
+					return fmt.Errorf("expected name to be %v, got %v", conn.Identity.Username, claims["name"])
+				}
+				return nil
+			},
+		},
+		{
+			name: "userinfo rejects id token",
+			handleToken: func(ctx context.Context, p *oidc.Provider, config *oauth2.Config, token *oauth2.Token) error {
+				idToken, ok := token.Extra("id_token").(string)
+				if !ok {
+					return fmt.Errorf("no id token found")
+				}
+				ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: idToken, TokenType: "Bearer"})
+				if _, err := p.UserInfo(ctx, ts); err == nil {
+					return errors.New("expected userinfo request with an id token to fail")
+				}
+				return nil
+			},
+		},
 		{
 			name: "verify id token and oauth2 token expiry",
 			handleToken: func(ctx context.Context, p *oidc.Provider, config *oauth2.Config, token *oauth2.Token) error {
@@ -487,6 +551,170 @@ func TestOAuth2CodeFlow(t *testing.T) {
 	}
 }
 
+// requestAuthorization drives an authorization request through the test server's mock
+// connector and returns the URL the server finally redirected to. The redirect URI
+// itself is never requested.
+func requestAuthorization(t *testing.T, httpServer *httptest.Server, redirectURI string, params url.Values) *url.URL {
+	var final *url.URL
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > 10 {
+				return errors.New("too many redirects")
+			}
+			if strings.HasPrefix(req.URL.String(), redirectURI) {
+				final = req.URL
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := httpClient.Get(httpServer.URL + "/auth?" + params.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if final == nil {
+		dump, _ := httputil.DumpResponse(resp, true)
+		t.Fatalf("never redirected to %s: %s", redirectURI, dump)
+	}
+	return final
+}
+
+func TestPKCE(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	// Example values from https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	// Public clients can only redirect to localhost.
+	redirectURI := "http://localhost:5555/callback"
+	client := storage.Client{
+		ID:     "testclient",
+		Secret: "testclientsecret",
+		Public: true,
+	}
+	// Public clients usually have no secret at all.
+	secretless := storage.Client{
+		ID:     "secretless",
+		Public: true,
+	}
+	for _, c := range []storage.Client{client, secretless} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		clientID   string
+		challenge  string
+		method     string
+		verifier   string
+		secret     string
+		wantStatus int
+	}{
+		{
+			name:       "valid S256 verifier",
+			challenge:  challenge,
+			method:     "S256",
+			verifier:   verifier,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "valid plain verifier",
+			challenge:  verifier,
+			verifier:   verifier,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid verifier",
+			challenge:  challenge,
+			method:     "S256",
+			verifier:   "not-the-verifier-used-to-create-the-challenge",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing verifier",
+			challenge:  challenge,
+			method:     "S256",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no challenge and no secret",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no challenge with secret",
+			secret:     client.Secret,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "secretless client with verifier",
+			clientID:   secretless.ID,
+			challenge:  challenge,
+			method:     "S256",
+			verifier:   verifier,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "secretless client without challenge",
+			clientID:   secretless.ID,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		clientID := client.ID
+		if tc.clientID != "" {
+			clientID = tc.clientID
+		}
+		params := url.Values{
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"a_state"},
+		}
+		if tc.challenge != "" {
+			params.Set("code_challenge", tc.challenge)
+		}
+		if tc.method != "" {
+			params.Set("code_challenge_method", tc.method)
+		}
+		code := requestAuthorization(t, httpServer, redirectURI, params).Query().Get("code")
+		if code == "" {
+			t.Errorf("%s: no code in redirect", tc.name)
+			continue
+		}
+
+		v := url.Values{
+			"client_id":    {clientID},
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {redirectURI},
+		}
+		if tc.secret != "" {
+			v.Set("client_secret", tc.secret)
+		}
+		if tc.verifier != "" {
+			v.Set("code_verifier", tc.verifier)
+		}
+		resp, err := http.PostForm(httpServer.URL+"/token", v)
+		if err != nil {
+			t.Fatalf("%s: post failed: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+		}
+	}
+}
+
 type nonceSource struct {
 	nonce string
 	once  sync.Once
@@ -910,3 +1138,3272 @@ func TestKeyCacher(t *testing.T) {
 		}
 	}
 }
+
+func TestRevokeRefreshToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	clients := []storage.Client{
+		{ID: "testclient", Secret: "testclientsecret"},
+		{ID: "otherclient", Secret: "otherclientsecret"},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+		// If true, the token is replaced with one not known to the storage.
+		unknownToken bool
+		wantStatus   int
+		wantRevoked  bool
+	}{
+		{
+			name:         "revoke token",
+			clientID:     "testclient",
+			clientSecret: "testclientsecret",
+			wantStatus:   http.StatusOK,
+			wantRevoked:  true,
+		},
+		{
+			name:         "unknown token",
+			clientID:     "testclient",
+			clientSecret: "testclientsecret",
+			unknownToken: true,
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "invalid client credentials",
+			clientID:     "testclient",
+			clientSecret: "wrongsecret",
+			wantStatus:   http.StatusUnauthorized,
+		},
+		{
+			name:         "token issued to another client",
+			clientID:     "otherclient",
+			clientSecret: "otherclientsecret",
+			wantStatus:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		refresh := storage.RefreshToken{
+			RefreshToken: storage.NewID(),
+			ClientID:     "testclient",
+			ConnectorID:  "mock",
+			Scopes:       []string{"openid", "offline_access"},
+			Claims:       storage.Claims{UserID: "1", Email: "jane.doe@example.com"},
+		}
+		if err := s.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("failed to create refresh token: %v", err)
+		}
+
+		token := refresh.RefreshToken
+		if tc.unknownToken {
+			token = storage.NewID()
+		}
+
+		req, err := http.NewRequest("POST", httpServer.URL+"/revoke", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(tc.clientID, tc.clientSecret)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: revocation request failed: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+		}
+
+		_, err = s.storage.GetRefresh(refresh.RefreshToken)
+		if revoked := err == storage.ErrNotFound; revoked != tc.wantRevoked {
+			t.Errorf("%s: expected token revoked=%t, got %t (%v)", tc.name, tc.wantRevoked, revoked, err)
+		}
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret"}
+	publicClient := storage.Client{ID: "publicclient", Public: true}
+	for _, c := range []storage.Client{client, publicClient} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	claims := storage.Claims{UserID: "1", Email: "jane.doe@example.com"}
+	scopes := []string{"openid", "email", "offline_access"}
+
+	refresh := storage.RefreshToken{
+		RefreshToken: storage.NewID(),
+		ClientID:     client.ID,
+		ConnectorID:  "mock",
+		Scopes:       scopes,
+		Claims:       claims,
+	}
+	if err := s.storage.CreateRefresh(refresh); err != nil {
+		t.Fatalf("failed to create refresh token: %v", err)
+	}
+	accessToken, expiry, err := s.newAccessToken(client.ID, claims, scopes, "", storage.ClaimsRequest{}, "")
+	if err != nil {
+		t.Fatalf("failed to create access token: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		clientID     string
+		clientSecret string
+		wantStatus   int
+		want         introspectionResponse
+	}{
+		{
+			name:         "refresh token",
+			token:        refresh.RefreshToken,
+			clientSecret: client.Secret,
+			wantStatus:   http.StatusOK,
+			want: introspectionResponse{
+				Active:   true,
+				Scope:    "openid email offline_access",
+				ClientID: client.ID,
+				Subject:  claims.UserID,
+				Issuer:   httpServer.URL,
+			},
+		},
+		{
+			name:         "access token",
+			token:        accessToken,
+			clientSecret: client.Secret,
+			wantStatus:   http.StatusOK,
+			want: introspectionResponse{
+				Active:   true,
+				Scope:    "openid email offline_access",
+				ClientID: client.ID,
+				Subject:  claims.UserID,
+				Expiry:   expiry.Unix(),
+				Issuer:   httpServer.URL,
+			},
+		},
+		{
+			name:         "unknown token",
+			token:        storage.NewID(),
+			clientSecret: client.Secret,
+			wantStatus:   http.StatusOK,
+			want:         introspectionResponse{Active: false},
+		},
+		{
+			name:         "invalid client credentials",
+			token:        refresh.RefreshToken,
+			clientSecret: "wrongsecret",
+			wantStatus:   http.StatusUnauthorized,
+		},
+		{
+			name:       "public client without secret",
+			token:      refresh.RefreshToken,
+			clientID:   publicClient.ID,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		v := url.Values{"token": {tc.token}}
+		if tc.clientID != "" {
+			v.Set("client_id", tc.clientID)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/introspect", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.clientID == "" {
+			req.SetBasicAuth(client.ID, tc.clientSecret)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: introspection request failed: %v", tc.name, err)
+		}
+		func() {
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var got introspectionResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Errorf("%s: failed to decode response: %v", tc.name, err)
+				return
+			}
+			if diff := pretty.Compare(tc.want, got); diff != "" {
+				t.Errorf("%s: unexpected introspection response: %s", tc.name, diff)
+			}
+		}()
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.RevokeRefreshTokensOnLogout = true
+	})
+	defer httpServer.Close()
+
+	postLogoutRedirectURI := "https://example.com/logged-out"
+	client := storage.Client{
+		ID:                     "testclient",
+		Secret:                 "testclientsecret",
+		PostLogoutRedirectURIs: []string{postLogoutRedirectURI},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	claims := storage.Claims{UserID: "1", Email: "jane.doe@example.com"}
+	idToken, _, err := s.newIDToken(client.ID, claims, []string{"openid"}, "", "", "", time.Time{}, "", storage.ClaimsRequest{})
+	if err != nil {
+		t.Fatalf("failed to create id token: %v", err)
+	}
+	accessToken, _, err := s.newAccessToken(client.ID, claims, []string{"openid"}, "", storage.ClaimsRequest{}, "")
+	if err != nil {
+		t.Fatalf("failed to create access token: %v", err)
+	}
+	if typ := jwtType(idToken); typ != "" {
+		t.Errorf("expected id token without a typ header, got %q", typ)
+	}
+	if typ := jwtType(accessToken); typ != accessTokenType {
+		t.Errorf("expected access token typ header %q, got %q", accessTokenType, typ)
+	}
+	// ID token claims typed as an access token.
+	typedToken, err := s.signClaims(s.signingAlgs[0], accessTokenType, idTokenClaims{
+		Issuer:   s.issuerURL.String(),
+		Subject:  "1",
+		Audience: audience{client.ID},
+		Expiry:   time.Now().Add(time.Hour).Unix(),
+		IssuedAt: time.Now().Unix(),
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to sign typed token: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		params       url.Values
+		wantStatus   int
+		wantLocation string
+		wantRevoked  bool
+	}{
+		{
+			name:       "no id_token_hint",
+			params:     url.Values{},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "redirect without id_token_hint",
+			params:     url.Values{"post_logout_redirect_uri": {postLogoutRedirectURI}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid id_token_hint",
+			params:     url.Values{"id_token_hint": {"not.a.token"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "access token as id_token_hint",
+			params:     url.Values{"id_token_hint": {accessToken}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "access token typ as id_token_hint",
+			params:     url.Values{"id_token_hint": {typedToken}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "unregistered post_logout_redirect_uri",
+			params: url.Values{
+				"id_token_hint":            {idToken},
+				"post_logout_redirect_uri": {"https://evil.example.com"},
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "logout without redirect",
+			params:      url.Values{"id_token_hint": {idToken}},
+			wantStatus:  http.StatusOK,
+			wantRevoked: true,
+		},
+		{
+			name: "logout with redirect",
+			params: url.Values{
+				"id_token_hint":            {idToken},
+				"post_logout_redirect_uri": {postLogoutRedirectURI},
+				"state":                    {"a_state"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: postLogoutRedirectURI + "?state=a_state",
+			wantRevoked:  true,
+		},
+	}
+
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, tc := range tests {
+		refresh := storage.RefreshToken{
+			RefreshToken: storage.NewID(),
+			ClientID:     client.ID,
+			ConnectorID:  "mock",
+			Scopes:       []string{"openid", "offline_access"},
+			Claims:       claims,
+		}
+		if err := s.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("failed to create refresh token: %v", err)
+		}
+
+		resp, err := httpClient.Get(httpServer.URL + "/end_session?" + tc.params.Encode())
+		if err != nil {
+			t.Fatalf("%s: end session request failed: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != tc.wantLocation {
+			t.Errorf("%s: expected location %q, got %q", tc.name, tc.wantLocation, location)
+		}
+
+		_, err = s.storage.GetRefresh(refresh.RefreshToken)
+		if revoked := err == storage.ErrNotFound; revoked != tc.wantRevoked {
+			t.Errorf("%s: expected token revoked=%t, got %t (%v)", tc.name, tc.wantRevoked, revoked, err)
+		}
+		if !tc.wantRevoked {
+			s.storage.DeleteRefresh(refresh.RefreshToken)
+		}
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	clients := []storage.Client{
+		{
+			ID:                     "batchjob",
+			Secret:                 "batchjobsecret",
+			AllowClientCredentials: true,
+			AllowedScopes:          []string{"openid", "profile"},
+		},
+		{
+			ID:     "webapp",
+			Secret: "webappsecret",
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+		scope        string
+		wantStatus   int
+		wantIDToken  bool
+	}{
+		{
+			name:         "access token only",
+			clientID:     "batchjob",
+			clientSecret: "batchjobsecret",
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "with id token",
+			clientID:     "batchjob",
+			clientSecret: "batchjobsecret",
+			scope:        "openid profile",
+			wantStatus:   http.StatusOK,
+			wantIDToken:  true,
+		},
+		{
+			name:         "scope not allowed",
+			clientID:     "batchjob",
+			clientSecret: "batchjobsecret",
+			scope:        "openid email",
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "invalid secret",
+			clientID:     "batchjob",
+			clientSecret: "wrongsecret",
+			wantStatus:   http.StatusUnauthorized,
+		},
+		{
+			name:         "grant not allowed for client",
+			clientID:     "webapp",
+			clientSecret: "webappsecret",
+			wantStatus:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		v := url.Values{}
+		v.Set("grant_type", "client_credentials")
+		if tc.scope != "" {
+			v.Set("scope", tc.scope)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(tc.clientID, tc.clientSecret)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: token request failed: %v", tc.name, err)
+		}
+		func() {
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			var tokenResp struct {
+				AccessToken  string `json:"access_token"`
+				IDToken      string `json:"id_token"`
+				RefreshToken string `json:"refresh_token"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+				t.Errorf("%s: failed to decode response: %v", tc.name, err)
+				return
+			}
+			if tokenResp.RefreshToken != "" {
+				t.Errorf("%s: unexpected refresh token", tc.name)
+			}
+			if (tokenResp.IDToken != "") != tc.wantIDToken {
+				t.Errorf("%s: expected id token=%t, got %q", tc.name, tc.wantIDToken, tokenResp.IDToken)
+			}
+
+			tok, err := s.verifyAccessToken(tokenResp.AccessToken)
+			if err != nil {
+				t.Errorf("%s: failed to verify access token: %v", tc.name, err)
+				return
+			}
+			if tok.Subject != tc.clientID {
+				t.Errorf("%s: expected subject %q, got %q", tc.name, tc.clientID, tok.Subject)
+			}
+			if tok.Scope != tc.scope {
+				t.Errorf("%s: expected scope %q, got %q", tc.name, tc.scope, tok.Scope)
+			}
+		}()
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:     "cli",
+		Public: true,
+		Name:   "Example CLI",
+	}
+	otherClient := storage.Client{
+		ID:     "other-cli",
+		Public: true,
+	}
+	for _, c := range []storage.Client{client, otherClient} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	postForm := func(path string, v url.Values) *http.Response {
+		resp, err := http.PostForm(httpServer.URL+path, v)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		return resp
+	}
+
+	resp := postForm("/device/code", url.Values{
+		"client_id": {client.ID},
+		"scope":     {"openid offline_access"},
+	})
+	var codeResp deviceCodeResponse
+	err := json.NewDecoder(resp.Body).Decode(&codeResp)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode device code response: %v", err)
+	}
+	if codeResp.VerificationURI != httpServer.URL+"/device" {
+		t.Errorf("unexpected verification URI %q", codeResp.VerificationURI)
+	}
+
+	// poll returns the status code, error and body of a token request.
+	poll := func(clientID string) (int, string, []byte) {
+		resp := postForm("/token", url.Values{
+			"grant_type":  {grantTypeDeviceCode},
+			"client_id":   {clientID},
+			"device_code": {codeResp.DeviceCode},
+		})
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(resp.Body); err != nil {
+			t.Fatalf("failed to read token response: %v", err)
+		}
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body.Bytes(), &errResp)
+		return resp.StatusCode, errResp.Error, body.Bytes()
+	}
+
+	// Each time the device polls too often the interval grows by 5 seconds.
+	pollInterval := func() int {
+		token, err := s.storage.GetDeviceToken(codeResp.DeviceCode)
+		if err != nil {
+			t.Fatalf("failed to get device token: %v", err)
+		}
+		return token.PollIntervalSeconds
+	}
+	if _, gotErr, _ := poll(client.ID); gotErr != errSlowDown {
+		t.Errorf("polling too often: expected error %q, got %q", errSlowDown, gotErr)
+	}
+	if got := pollInterval(); got != devicePollInterval+5 {
+		t.Errorf("expected poll interval %d after slowing down, got %d", devicePollInterval+5, got)
+	}
+	now = now.Add(7 * time.Second)
+	if _, gotErr, _ := poll(client.ID); gotErr != errSlowDown {
+		t.Errorf("polling before the raised interval: expected error %q, got %q", errSlowDown, gotErr)
+	}
+	if got := pollInterval(); got != devicePollInterval+10 {
+		t.Errorf("expected poll interval %d after slowing down twice, got %d", devicePollInterval+10, got)
+	}
+	now = now.Add(16 * time.Second)
+	if _, gotErr, _ := poll(client.ID); gotErr != errAuthorizationPending {
+		t.Errorf("polling before login: expected error %q, got %q", errAuthorizationPending, gotErr)
+	}
+	if _, gotErr, _ := poll(otherClient.ID); gotErr != errInvalidGrant {
+		t.Errorf("polling as another client: expected error %q, got %q", errInvalidGrant, gotErr)
+	}
+
+	resp = postForm("/device", url.Values{"user_code": {"BCDF-GHJK"}})
+	body, _ := httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Invalid or expired user code.") {
+		t.Errorf("expected invalid user code to be rejected, got %s", body)
+	}
+
+	// Values that can't be user codes aren't reflected on the verification page.
+	resp, err = http.Get(httpServer.URL + "/device?user_code=" + url.QueryEscape(`"><script>alert(1)</script>`))
+	if err != nil {
+		t.Fatalf("GET /device failed: %v", err)
+	}
+	body, _ = httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if strings.Contains(string(body), "<script>") {
+		t.Errorf("expected invalid user code not to be reflected, got %s", body)
+	}
+
+	// End users might type the code in lower case without the dash.
+	userCode := strings.ToLower(strings.Replace(codeResp.UserCode, "-", "", -1))
+	resp = postForm("/device", url.Values{"user_code": {userCode}})
+	body, _ = httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "Example CLI has been granted access.") {
+		t.Fatalf("expected login to succeed, got %s", body)
+	}
+
+	now = now.Add(10 * time.Second)
+	status, _, data := poll(client.ID)
+	if status != http.StatusOK {
+		t.Fatalf("polling after login: expected status %d, got %d: %s", http.StatusOK, status, data)
+	}
+	var tokenResp tokenResponse
+	if err := json.Unmarshal(data, &tokenResp); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	if tokenResp.IDToken == "" || tokenResp.RefreshToken == "" {
+		t.Errorf("expected ID and refresh tokens, got %s", data)
+	}
+	if _, err := s.verifyAccessToken(tokenResp.AccessToken); err != nil {
+		t.Errorf("failed to verify access token: %v", err)
+	}
+
+	// Tokens are only handed out once.
+	now = now.Add(10 * time.Second)
+	if _, gotErr, _ := poll(client.ID); gotErr != errExpiredToken {
+		t.Errorf("polling after tokens were issued: expected error %q, got %q", errExpiredToken, gotErr)
+	}
+}
+
+func TestPasswordGrant(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.EnablePasswordDB = true
+	})
+	defer httpServer.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.storage.CreatePassword(storage.Password{
+		Email:    "jane@example.com",
+		Username: "jane",
+		UserID:   "foobar",
+		Hash:     hash,
+	}); err != nil {
+		t.Fatalf("failed to create password: %v", err)
+	}
+
+	clients := []storage.Client{
+		{
+			ID:                 "legacytool",
+			Secret:             "legacytoolsecret",
+			AllowPasswordGrant: true,
+		},
+		{
+			ID:     "webapp",
+			Secret: "webappsecret",
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+		connectorID  string
+		password     string
+		scope        string
+		wantStatus   int
+		wantRefresh  bool
+	}{
+		{
+			name:         "valid credentials",
+			clientID:     "legacytool",
+			clientSecret: "legacytoolsecret",
+			connectorID:  "local",
+			password:     "secret",
+			scope:        "openid email",
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "only password connector selected by default",
+			clientID:     "legacytool",
+			clientSecret: "legacytoolsecret",
+			password:     "secret",
+			scope:        "openid offline_access",
+			wantStatus:   http.StatusOK,
+			wantRefresh:  true,
+		},
+		{
+			name:         "invalid password",
+			clientID:     "legacytool",
+			clientSecret: "legacytoolsecret",
+			connectorID:  "local",
+			password:     "wrong",
+			scope:        "openid",
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "connector doesn't support passwords",
+			clientID:     "legacytool",
+			clientSecret: "legacytoolsecret",
+			connectorID:  "mock",
+			password:     "secret",
+			scope:        "openid",
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "missing openid scope",
+			clientID:     "legacytool",
+			clientSecret: "legacytoolsecret",
+			connectorID:  "local",
+			password:     "secret",
+			scope:        "email",
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "grant not allowed for client",
+			clientID:     "webapp",
+			clientSecret: "webappsecret",
+			connectorID:  "local",
+			password:     "secret",
+			scope:        "openid",
+			wantStatus:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		v := url.Values{}
+		v.Set("grant_type", "password")
+		v.Set("username", "jane@example.com")
+		v.Set("password", tc.password)
+		v.Set("scope", tc.scope)
+		if tc.connectorID != "" {
+			v.Set("connector_id", tc.connectorID)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(tc.clientID, tc.clientSecret)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: token request failed: %v", tc.name, err)
+		}
+		func() {
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			var tokenResp tokenResponse
+			if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+				t.Errorf("%s: failed to decode response: %v", tc.name, err)
+				return
+			}
+			if tokenResp.IDToken == "" {
+				t.Errorf("%s: expected id token", tc.name)
+			}
+			if (tokenResp.RefreshToken != "") != tc.wantRefresh {
+				t.Errorf("%s: expected refresh token=%t, got %q", tc.name, tc.wantRefresh, tokenResp.RefreshToken)
+			}
+
+			tok, err := s.verifyAccessToken(tokenResp.AccessToken)
+			if err != nil {
+				t.Errorf("%s: failed to verify access token: %v", tc.name, err)
+				return
+			}
+			if tok.Subject != "foobar" {
+				t.Errorf("%s: expected subject %q, got %q", tc.name, "foobar", tok.Subject)
+			}
+		}()
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	clients := []storage.Client{
+		{
+			ID:     "frontend",
+			Secret: "frontendsecret",
+		},
+		{
+			ID:           "backend",
+			Secret:       "backendsecret",
+			TrustedPeers: []string{"frontend"},
+		},
+		{
+			ID:     "billing",
+			Secret: "billingsecret",
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	claims := storage.Claims{
+		UserID:        "foobar",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+	}
+	authTime := time.Now().Add(-time.Hour)
+	scopes := []string{"openid", "email"}
+	idToken, _, err := s.newIDToken("frontend", claims, scopes, "", "", "", authTime, "", storage.ClaimsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, _, err := s.newAccessToken("frontend", claims, scopes, "", storage.ClaimsRequest{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIDToken, _, err := s.newIDToken("billing", claims, scopes, "", "", "", authTime, "", storage.ClaimsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Issued tokens expire along with the subject tokens, an hour from now.
+	now = now.Add(23 * time.Hour)
+
+	tests := []struct {
+		name               string
+		subjectToken       string
+		subjectTokenType   string
+		requestedTokenType string
+		audience           string
+		wantStatus         int
+		wantErr            string
+	}{
+		{
+			name:             "id token for peer",
+			subjectToken:     idToken,
+			subjectTokenType: exchangeTokenTypeIDToken,
+			audience:         "backend",
+			wantStatus:       http.StatusOK,
+		},
+		{
+			name:               "access token for peer",
+			subjectToken:       accessToken,
+			subjectTokenType:   exchangeTokenTypeAccessToken,
+			requestedTokenType: exchangeTokenTypeAccessToken,
+			audience:           "backend",
+			wantStatus:         http.StatusOK,
+		},
+		{
+			name:             "no audience",
+			subjectToken:     idToken,
+			subjectTokenType: exchangeTokenTypeIDToken,
+			wantStatus:       http.StatusBadRequest,
+			wantErr:          errInvalidRequest,
+		},
+		{
+			name:               "own audience",
+			subjectToken:       accessToken,
+			subjectTokenType:   exchangeTokenTypeAccessToken,
+			requestedTokenType: exchangeTokenTypeAccessToken,
+			audience:           "frontend",
+			wantStatus:         http.StatusBadRequest,
+			wantErr:            errInvalidTarget,
+		},
+		{
+			name:             "untrusted audience",
+			subjectToken:     idToken,
+			subjectTokenType: exchangeTokenTypeIDToken,
+			audience:         "billing",
+			wantStatus:       http.StatusBadRequest,
+			wantErr:          errInvalidTarget,
+		},
+		{
+			name:             "token issued to another client",
+			subjectToken:     otherIDToken,
+			subjectTokenType: exchangeTokenTypeIDToken,
+			audience:         "backend",
+			wantStatus:       http.StatusBadRequest,
+			wantErr:          errInvalidGrant,
+		},
+		{
+			name:             "wrong subject token type",
+			subjectToken:     idToken,
+			subjectTokenType: exchangeTokenTypeAccessToken,
+			audience:         "backend",
+			wantStatus:       http.StatusBadRequest,
+			wantErr:          errInvalidGrant,
+		},
+		{
+			name:             "access token as id token",
+			subjectToken:     accessToken,
+			subjectTokenType: exchangeTokenTypeIDToken,
+			audience:         "backend",
+			wantStatus:       http.StatusBadRequest,
+			wantErr:          errInvalidGrant,
+		},
+		{
+			name:             "invalid subject token",
+			subjectToken:     "not a token",
+			subjectTokenType: exchangeTokenTypeIDToken,
+			audience:         "backend",
+			wantStatus:       http.StatusBadRequest,
+			wantErr:          errInvalidGrant,
+		},
+	}
+
+	for _, tc := range tests {
+		v := url.Values{}
+		v.Set("grant_type", grantTypeTokenExchange)
+		v.Set("subject_token", tc.subjectToken)
+		v.Set("subject_token_type", tc.subjectTokenType)
+		v.Set("audience", tc.audience)
+		if tc.requestedTokenType != "" {
+			v.Set("requested_token_type", tc.requestedTokenType)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("frontend", "frontendsecret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: token request failed: %v", tc.name, err)
+		}
+		func() {
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, resp.StatusCode)
+				return
+			}
+
+			var body struct {
+				AccessToken     string `json:"access_token"`
+				IssuedTokenType string `json:"issued_token_type"`
+				ExpiresIn       int    `json:"expires_in"`
+				Error           string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Errorf("%s: failed to decode response: %v", tc.name, err)
+				return
+			}
+			if body.Error != tc.wantErr {
+				t.Errorf("%s: expected error %q, got %q", tc.name, tc.wantErr, body.Error)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if body.ExpiresIn > int(time.Hour.Seconds()) {
+				t.Errorf("%s: issued token outlives the subject token, expires in %ds", tc.name, body.ExpiresIn)
+			}
+
+			switch body.IssuedTokenType {
+			case exchangeTokenTypeIDToken:
+				tok, clientID, err := s.verifyIDToken(body.AccessToken)
+				if err != nil {
+					t.Errorf("%s: failed to verify issued ID token: %v", tc.name, err)
+					return
+				}
+				if clientID != "frontend" || !tok.Audience.contains(tc.audience) {
+					t.Errorf("%s: expected ID token for %q issued to %q, got aud=%q azp=%q",
+						tc.name, tc.audience, "frontend", tok.Audience, tok.AuthorizingParty)
+				}
+				if tok.Subject != claims.UserID || tok.Email != claims.Email || tok.AuthTime != authTime.Unix() {
+					t.Errorf("%s: claims of the subject token weren't preserved", tc.name)
+				}
+			case exchangeTokenTypeAccessToken:
+				tok, err := s.verifyAccessToken(body.AccessToken)
+				if err != nil {
+					t.Errorf("%s: failed to verify issued access token: %v", tc.name, err)
+					return
+				}
+				if tok.Audience != tc.audience {
+					t.Errorf("%s: expected access token for %q, got %q", tc.name, tc.audience, tok.Audience)
+				}
+			default:
+				t.Errorf("%s: unexpected issued token type %q", tc.name, body.IssuedTokenType)
+			}
+		}()
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	newParams := func(extra url.Values) url.Values {
+		params := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"a_state"},
+		}
+		for k, v := range extra {
+			params[k] = v
+		}
+		return params
+	}
+
+	errTests := []struct {
+		name    string
+		params  url.Values
+		wantErr string
+	}{
+		{"prompt none", url.Values{"prompt": {"none"}}, errLoginRequired},
+		{"prompt none with login", url.Values{"prompt": {"none login"}}, errInvalidRequest},
+		{"unknown prompt", url.Values{"prompt": {"popup"}}, errInvalidRequest},
+		{"invalid max_age", url.Values{"max_age": {"-1"}}, errInvalidRequest},
+	}
+	for _, tc := range errTests {
+		q := requestAuthorization(t, httpServer, redirectURI, newParams(tc.params)).Query()
+		if got := q.Get("error"); got != tc.wantErr {
+			t.Errorf("%s: expected error %q, got %q", tc.name, tc.wantErr, got)
+		}
+		if got := q.Get("state"); got != "a_state" {
+			t.Errorf("%s: expected state to be returned, got %q", tc.name, got)
+		}
+	}
+
+	// Requests with "max_age" report when the end user logged in.
+	start := time.Now()
+	q := requestAuthorization(t, httpServer, redirectURI, newParams(url.Values{
+		"prompt":  {"login"},
+		"max_age": {"0"},
+	})).Query()
+	if q.Get("error") != "" {
+		t.Fatalf("unexpected error %s: %s", q.Get("error"), q.Get("error_description"))
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", q.Get("code"))
+	v.Set("redirect_uri", redirectURI)
+	req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID, client.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("token request failed: %v", err)
+	}
+	var tokenResp tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	tok, _, err := s.verifyIDToken(tokenResp.IDToken)
+	if err != nil {
+		t.Fatalf("failed to verify ID token: %v", err)
+	}
+	if tok.AuthTime < start.Unix() || tok.AuthTime > time.Now().Unix() {
+		t.Errorf("expected auth_time of the login, got %d", tok.AuthTime)
+	}
+
+	// "prompt=consent" shows the approval screen even if it's normally skipped.
+	resp, err = http.Get(httpServer.URL + "/auth?" + newParams(url.Values{"prompt": {"consent"}}).Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, _ := httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Grant Access") {
+		t.Errorf("expected approval screen, got %s", body)
+	}
+}
+
+func TestLoginHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.EnablePasswordDB = true
+	})
+	defer httpServer.Close()
+
+	authReq := storage.AuthRequest{
+		ID:        storage.NewID(),
+		ClientID:  "testclient",
+		Scopes:    []string{"openid"},
+		LoginHint: "jane@example.com",
+		Expiry:    time.Now().Add(time.Minute),
+	}
+	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		t.Fatalf("failed to create auth request: %v", err)
+	}
+
+	resp, err := http.Get(httpServer.URL + "/auth/local?req=" + authReq.ID)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, _ := httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `value="jane@example.com"`) {
+		t.Errorf("expected login form prefilled with the login hint, got %s", body)
+	}
+
+	// The hint comes from the authorization request, so it must be escaped.
+	authReq.ID = storage.NewID()
+	authReq.LoginHint = `"><script>alert(1)</script>`
+	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		t.Fatalf("failed to create auth request: %v", err)
+	}
+	if resp, err = http.Get(httpServer.URL + "/auth/local?req=" + authReq.ID); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, _ = httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if strings.Contains(string(body), "<script>") {
+		t.Errorf("expected login hint to be escaped, got %s", body)
+	}
+}
+
+func TestHybridFlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.SupportedResponseTypes = []string{"code", "token", "id_token"}
+	})
+	defer httpServer.Close()
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	p, err := oidc.NewProvider(ctx, httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+	var discovery struct {
+		ResponseTypes []string `json:"response_types_supported"`
+	}
+	if err := p.Claims(&discovery); err != nil {
+		t.Fatalf("failed to decode discovery: %v", err)
+	}
+	wantResponseTypes := []string{
+		"code", "code id_token", "code id_token token", "code token",
+		"id_token", "id_token token", "token",
+	}
+	if diff := pretty.Compare(wantResponseTypes, discovery.ResponseTypes); diff != "" {
+		t.Errorf("unexpected response types in discovery: %s", diff)
+	}
+
+	// The left-most half of the SHA-256 hash, since keys are RSA keys signing with RS256.
+	halfHash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return base64.RawURLEncoding.EncodeToString(sum[:16])
+	}
+
+	tests := []struct {
+		responseType string
+
+		wantCode        bool
+		wantAccessToken bool
+		wantIDToken     bool
+	}{
+		{"token", false, true, true},
+		{"id_token", false, false, true},
+		{"id_token token", false, true, true},
+		{"code id_token", true, false, true},
+		{"code token", true, true, false},
+		{"code id_token token", true, true, true},
+	}
+	for _, tc := range tests {
+		params := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {tc.responseType},
+			"scope":         {"openid email"},
+			"state":         {"a_state"},
+			"nonce":         {"a_nonce"},
+		}
+		u := requestAuthorization(t, httpServer, redirectURI, params)
+		if u.RawQuery != "" {
+			t.Errorf("%s: expected results in the fragment, got query %q", tc.responseType, u.RawQuery)
+			continue
+		}
+		v, err := url.ParseQuery(u.Fragment)
+		if err != nil {
+			t.Errorf("%s: failed to parse fragment: %v", tc.responseType, err)
+			continue
+		}
+		if got := v.Get("state"); got != "a_state" {
+			t.Errorf("%s: expected state to be returned, got %q", tc.responseType, got)
+		}
+		code, accessToken, idToken := v.Get("code"), v.Get("access_token"), v.Get("id_token")
+		if (code != "") != tc.wantCode {
+			t.Errorf("%s: wanted code %t, got %q", tc.responseType, tc.wantCode, code)
+		}
+		if (accessToken != "") != tc.wantAccessToken {
+			t.Errorf("%s: wanted access token %t, got %q", tc.responseType, tc.wantAccessToken, accessToken)
+		}
+		if (idToken != "") != tc.wantIDToken {
+			t.Errorf("%s: wanted ID token %t, got %q", tc.responseType, tc.wantIDToken, idToken)
+		}
+		if idToken == "" {
+			continue
+		}
+
+		tok, _, err := s.verifyIDToken(idToken)
+		if err != nil {
+			t.Errorf("%s: failed to verify ID token: %v", tc.responseType, err)
+			continue
+		}
+		if tok.Nonce != "a_nonce" {
+			t.Errorf("%s: expected nonce in ID token, got %q", tc.responseType, tok.Nonce)
+		}
+		var wantCodeHash, wantAccessTokenHash string
+		if code != "" {
+			wantCodeHash = halfHash(code)
+		}
+		if accessToken != "" {
+			wantAccessTokenHash = halfHash(accessToken)
+		}
+		if tok.CodeHash != wantCodeHash {
+			t.Errorf("%s: expected c_hash %q, got %q", tc.responseType, wantCodeHash, tok.CodeHash)
+		}
+		if tok.AccessTokenHash != wantAccessTokenHash {
+			t.Errorf("%s: expected at_hash %q, got %q", tc.responseType, wantAccessTokenHash, tok.AccessTokenHash)
+		}
+	}
+
+	// ID tokens returned from the authorization endpoint require a nonce.
+	params := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code id_token"},
+		"scope":         {"openid"},
+		"state":         {"a_state"},
+	}
+	// Errors are returned in the fragment, like the results of the request.
+	u := requestAuthorization(t, httpServer, redirectURI, params)
+	v, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		t.Fatalf("failed to parse fragment: %v", err)
+	}
+	if got := v.Get("error"); got != errInvalidRequest {
+		t.Errorf("expected error %q for request without nonce, got %q", errInvalidRequest, got)
+	}
+}
+
+func TestResponseMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.SupportedResponseTypes = []string{"code", "id_token"}
+	})
+	defer httpServer.Close()
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	newParams := func(extra url.Values) url.Values {
+		params := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {`a"state`},
+			"nonce":         {"a_nonce"},
+		}
+		for k, v := range extra {
+			params[k] = v
+		}
+		return params
+	}
+
+	// Results are returned in the fragment if requested.
+	u := requestAuthorization(t, httpServer, redirectURI, newParams(url.Values{"response_mode": {"fragment"}}))
+	v, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		t.Fatalf("failed to parse fragment: %v", err)
+	}
+	if u.RawQuery != "" || v.Get("code") == "" {
+		t.Errorf("expected code in the fragment, got %s", u)
+	}
+
+	errTests := []struct {
+		name   string
+		params url.Values
+	}{
+		{"unknown response mode", url.Values{"response_mode": {"web_message"}}},
+		{"ID token in query", url.Values{"response_mode": {"query"}, "response_type": {"id_token"}}},
+	}
+	for _, tc := range errTests {
+		q := requestAuthorization(t, httpServer, redirectURI, newParams(tc.params)).Query()
+		if got := q.Get("error"); got != errInvalidRequest {
+			t.Errorf("%s: expected error %q, got %q", tc.name, errInvalidRequest, got)
+		}
+	}
+
+	// Form post responses render a page which posts the values to the client.
+	formPost := func(params url.Values) string {
+		resp, err := http.Get(httpServer.URL + "/auth?" + params.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body := new(bytes.Buffer)
+		if _, err := body.ReadFrom(resp.Body); err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+		}
+		if !strings.Contains(body.String(), `action="`+redirectURI+`"`) {
+			t.Errorf("expected form to post to %s, got %s", redirectURI, body)
+		}
+		if !strings.Contains(body.String(), `name="state" value="a&#34;state"`) {
+			t.Errorf("expected escaped state in form, got %s", body)
+		}
+		return body.String()
+	}
+
+	body := formPost(newParams(url.Values{"response_mode": {"form_post"}}))
+	if !strings.Contains(body, `name="code"`) {
+		t.Errorf("expected code in form, got %s", body)
+	}
+
+	// Errors are reported the same way.
+	body = formPost(newParams(url.Values{"response_mode": {"form_post"}, "prompt": {"none"}}))
+	if !strings.Contains(body, `name="error" value="login_required"`) {
+		t.Errorf("expected error in form, got %s", body)
+	}
+}
+
+func TestRequestObject(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+		JWKS: &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: clientKey.Public(), KeyID: "client-key", Algorithm: "ES256", Use: "sig"}},
+		},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	sign := func(key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestObject, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requestObject
+	}
+	newClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":           client.ID,
+			"aud":           s.issuerURL.String(),
+			"exp":           time.Now().Add(time.Minute).Unix(),
+			"client_id":     client.ID,
+			"redirect_uri":  redirectURI,
+			"response_type": "code",
+			"scope":         "openid",
+			"state":         "signed_state",
+		}
+	}
+	// Query parameters which don't match the request object are overridden.
+	newParams := func(extra url.Values) url.Values {
+		params := url.Values{
+			"client_id":     {client.ID},
+			"response_type": {"code"},
+			"scope":         {"openid email"},
+			"state":         {"tampered_state"},
+		}
+		for k, v := range extra {
+			params[k] = v
+		}
+		return params
+	}
+
+	q := requestAuthorization(t, httpServer, redirectURI, newParams(url.Values{
+		"request": {sign(clientKey, newClaims())},
+	})).Query()
+	if q.Get("code") == "" {
+		t.Errorf("expected code, got %s: %s", q.Get("error"), q.Get("error_description"))
+	}
+	if got := q.Get("state"); got != "signed_state" {
+		t.Errorf("expected state from request object, got %q", got)
+	}
+
+	// Request objects can also be passed by reference, from URLs registered by
+	// the client.
+	requestObject := sign(clientKey, newClaims())
+	fetches := 0
+	requestObjectServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "application/oauth-authz-req+jwt")
+		w.Write([]byte(requestObject))
+	}))
+	defer requestObjectServer.Close()
+	s.httpClient = requestObjectServer.Client()
+	err = s.storage.UpdateClient(client.ID, func(old storage.Client) (storage.Client, error) {
+		old.RequestURIs = []string{requestObjectServer.URL + "/request.jwt"}
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update client: %v", err)
+	}
+
+	q = requestAuthorization(t, httpServer, redirectURI, newParams(url.Values{
+		"request_uri": {requestObjectServer.URL + "/request.jwt"},
+	})).Query()
+	if q.Get("code") == "" {
+		t.Errorf("expected code, got %s: %s", q.Get("error"), q.Get("error_description"))
+	}
+	if got := q.Get("state"); got != "signed_state" {
+		t.Errorf("expected state from request object, got %q", got)
+	}
+
+	wrongAudience := newClaims()
+	wrongAudience["aud"] = "https://other.example.com"
+	expired := newClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	otherClient := newClaims()
+	otherClient["client_id"] = "otherclient"
+	noIssuer := newClaims()
+	delete(noIssuer, "iss")
+	noAudience := newClaims()
+	delete(noAudience, "aud")
+	noExpiry := newClaims()
+	delete(noExpiry, "exp")
+
+	errTests := []struct {
+		name   string
+		params url.Values
+	}{
+		{"signed by another key", url.Values{"request": {sign(otherKey, newClaims())}}},
+		{"wrong audience", url.Values{"request": {sign(clientKey, wrongAudience)}}},
+		{"expired", url.Values{"request": {sign(clientKey, expired)}}},
+		{"different client", url.Values{"request": {sign(clientKey, otherClient)}}},
+		{"no issuer", url.Values{"request": {sign(clientKey, noIssuer)}}},
+		{"no audience", url.Values{"request": {sign(clientKey, noAudience)}}},
+		{"no expiry", url.Values{"request": {sign(clientKey, noExpiry)}}},
+		{"malformed", url.Values{"request": {"not-a-jwt"}}},
+		{"insecure request_uri", url.Values{"request_uri": {httpServer.URL + "/request.jwt"}}},
+		{"unregistered request_uri", url.Values{"request_uri": {requestObjectServer.URL + "/other.jwt"}}},
+	}
+	fetches = 0
+	for _, tc := range errTests {
+		resp, err := http.Get(httpServer.URL + "/auth?" + newParams(tc.params).Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", tc.name, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+	if fetches != 0 {
+		t.Errorf("expected unregistered request_uris not to be fetched, got %d fetches", fetches)
+	}
+
+	// Request objects of clients without keys are never fetched.
+	keyless := storage.Client{
+		ID:           "keyless",
+		Secret:       "keylesssecret",
+		RedirectURIs: []string{redirectURI},
+		RequestURIs:  []string{requestObjectServer.URL + "/request.jwt"},
+	}
+	if err := s.storage.CreateClient(keyless); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	params := newParams(url.Values{"request_uri": {requestObjectServer.URL + "/request.jwt"}})
+	params.Set("client_id", keyless.ID)
+	resp, err := http.Get(httpServer.URL + "/auth?" + params.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("client without keys: expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if fetches != 0 {
+		t.Errorf("expected request_uri of a client without keys not to be fetched, got %d fetches", fetches)
+	}
+}
+
+func TestFetchDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dialer := &net.Dialer{Timeout: time.Second}
+	ctx := context.Background()
+
+	// Loopback and other private addresses aren't connected to.
+	dial := fetchDialer(dialer, nil)
+	if conn, err := dial(ctx, "tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("expected connecting to %s to be refused", l.Addr())
+	}
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dial(ctx, "tcp", net.JoinHostPort("localhost", port)); err == nil {
+		conn.Close()
+		t.Errorf("expected connecting to localhost to be refused")
+	}
+
+	// Unless the operator allowed the host.
+	dial = fetchDialer(dialer, map[string]bool{"127.0.0.1": true})
+	conn, err := dial(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("expected connecting to allowed host to succeed: %v", err)
+	}
+	conn.Close()
+
+	for _, tc := range []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	} {
+		if got := isPrivateIP(net.ParseIP(tc.ip)); got != tc.private {
+			t.Errorf("%s: expected private %t, got %t", tc.ip, tc.private, got)
+		}
+	}
+}
+
+func TestClientKeySetCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{Key: clientKey.Public(), KeyID: "client-key", Algorithm: "ES256", Use: "sig"}},
+	}
+	fetches := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(jwks)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/insecure", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, httpServer.URL+"/keys", http.StatusFound)
+	})
+	keyServer := httptest.NewTLSServer(mux)
+	defer keyServer.Close()
+	s.httpClient = keyServer.Client()
+	s.httpClient.CheckRedirect = checkFetchRedirect
+
+	// Key sets are only fetched again once they've been cached for a while.
+	client := storage.Client{ID: "testclient", JWKSURI: keyServer.URL + "/jwks.json"}
+	for i, step := range []struct {
+		elapsed     time.Duration
+		wantFetches int
+	}{
+		{0, 1},
+		{time.Minute, 1},
+		{clientKeySetTTL, 2},
+	} {
+		now = now.Add(step.elapsed)
+		got, err := s.clientKeys(client)
+		if err != nil {
+			t.Fatalf("step %d: failed to get client keys: %v", i, err)
+		}
+		if len(got.Keys) != 1 || got.Keys[0].KeyID != "client-key" {
+			t.Errorf("step %d: unexpected key set %+v", i, got)
+		}
+		if fetches != step.wantFetches {
+			t.Errorf("step %d: expected %d fetches, got %d", i, step.wantFetches, fetches)
+		}
+	}
+
+	// Redirects are limited, and must keep using https.
+	for _, path := range []string{"/loop", "/insecure"} {
+		client := storage.Client{ID: "testclient", JWKSURI: keyServer.URL + path}
+		if _, err := s.clientKeys(client); err == nil {
+			t.Errorf("%s: expected fetching the key set to fail", path)
+		}
+	}
+}
+
+func TestPushedAuthRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	push := func(secret string, params url.Values) (int, map[string]interface{}) {
+		req, err := http.NewRequest("POST", httpServer.URL+"/par", strings.NewReader(params.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("pushed authorization request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp.StatusCode, body
+	}
+	params := url.Values{
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+		"state":         {"a_state"},
+	}
+
+	status, body := push(client.Secret, params)
+	if status != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %v", http.StatusCreated, status, body)
+	}
+	requestURI, _ := body["request_uri"].(string)
+	if !strings.HasPrefix(requestURI, parRequestURIPrefix) {
+		t.Fatalf("unexpected request_uri %q", requestURI)
+	}
+	if body["expires_in"] != float64(60) {
+		t.Errorf("expected expires_in of 60 seconds, got %v", body["expires_in"])
+	}
+
+	authParams := url.Values{"client_id": {client.ID}, "request_uri": {requestURI}}
+	q := requestAuthorization(t, httpServer, redirectURI, authParams).Query()
+	if q.Get("code") == "" {
+		t.Errorf("expected code, got %s: %s", q.Get("error"), q.Get("error_description"))
+	}
+	if got := q.Get("state"); got != "a_state" {
+		t.Errorf("expected state of the pushed request, got %q", got)
+	}
+
+	// Request URIs can only be used once.
+	resp, err := http.Get(httpServer.URL + "/auth?" + authParams.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d reusing request_uri, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Request URIs can only be used by the client which pushed the request.
+	_, body = push(client.Secret, params)
+	requestURI, _ = body["request_uri"].(string)
+	resp, err = http.Get(httpServer.URL + "/auth?" + url.Values{"client_id": {"otherclient"}, "request_uri": {requestURI}}.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d using request_uri of another client, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Pushed requests are validated when they're pushed.
+	if status, body := push("wrongsecret", params); status != http.StatusUnauthorized {
+		t.Errorf("expected status %d with invalid credentials, got %d: %v", http.StatusUnauthorized, status, body)
+	}
+	invalidScope := url.Values{
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"email"},
+	}
+	status, body = push(client.Secret, invalidScope)
+	if status != http.StatusBadRequest || body["error"] != errInvalidScope {
+		t.Errorf("expected %s error, got %d: %v", errInvalidScope, status, body)
+	}
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.SupportedResponseTypes = []string{"code", "id_token"}
+		c.SigningAlgorithms = []string{"ES256", "RS256"}
+	})
+	defer httpServer.Close()
+
+	p, err := oidc.NewProvider(ctx, httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+	var discovery struct {
+		IDTokenAlgs []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := p.Claims(&discovery); err != nil {
+		t.Fatalf("failed to decode discovery: %v", err)
+	}
+	if diff := pretty.Compare([]string{"ES256", "RS256"}, discovery.IDTokenAlgs); diff != "" {
+		t.Errorf("unexpected signing algorithms in discovery: %s", diff)
+	}
+
+	// Both keys are published.
+	resp, err := http.Get(httpServer.URL + "/keys")
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	var jwks jose.JSONWebKeySet
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode keys: %v", err)
+	}
+	var gotAlgs []string
+	for _, key := range jwks.Keys {
+		gotAlgs = append(gotAlgs, key.Algorithm)
+	}
+	if diff := pretty.Compare([]string{"ES256", "RS256"}, gotAlgs); diff != "" {
+		t.Errorf("unexpected keys: %s", diff)
+	}
+
+	redirectURI := "https://client.example.com/callback"
+	tests := []struct {
+		client  storage.Client
+		wantAlg string
+	}{
+		{
+			client: storage.Client{
+				ID:           "defaultclient",
+				RedirectURIs: []string{redirectURI},
+			},
+			wantAlg: "ES256",
+		},
+		{
+			client: storage.Client{
+				ID:                       "rsaclient",
+				RedirectURIs:             []string{redirectURI},
+				IDTokenSignedResponseAlg: "RS256",
+			},
+			wantAlg: "RS256",
+		},
+	}
+	for _, tc := range tests {
+		if err := s.storage.CreateClient(tc.client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		params := url.Values{
+			"client_id":     {tc.client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"id_token"},
+			"scope":         {"openid"},
+			"state":         {"a_state"},
+			"nonce":         {"a_nonce"},
+		}
+		u := requestAuthorization(t, httpServer, redirectURI, params)
+		v, err := url.ParseQuery(u.Fragment)
+		if err != nil {
+			t.Fatalf("%s: failed to parse fragment: %v", tc.client.ID, err)
+		}
+		idToken := v.Get("id_token")
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Errorf("%s: failed to parse ID token %q: %v", tc.client.ID, idToken, err)
+			continue
+		}
+		if got := jws.Signatures[0].Header.Algorithm; got != tc.wantAlg {
+			t.Errorf("%s: expected ID token signed with %s, got %s", tc.client.ID, tc.wantAlg, got)
+		}
+		if _, _, err := s.verifyIDToken(idToken); err != nil {
+			t.Errorf("%s: failed to verify ID token: %v", tc.client.ID, err)
+		}
+	}
+
+	for _, alg := range []string{"EdDSA", "HS256"} {
+		c := Config{
+			Issuer:            httpServer.URL,
+			Storage:           memory.New(logger),
+			Connectors:        []Connector{{ID: "mock", Connector: mock.NewCallbackConnector(logger)}},
+			SigningAlgorithms: []string{alg},
+			Logger:            logger,
+		}
+		if _, err := newServer(ctx, c, staticRotationStrategy(testKey)); err == nil {
+			t.Errorf("expected signing algorithm %q to be rejected", alg)
+		}
+	}
+}
+
+// replaceableSigner lets tests replace the key of a signer.
+type replaceableSigner struct {
+	signer.Signer
+}
+
+func TestExternalSigner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newSigner := func() signer.Signer {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		sig, err := signer.NewSigner(key, jose.ES256)
+		if err != nil {
+			t.Fatalf("new signer: %v", err)
+		}
+		return sig
+	}
+	sig := &replaceableSigner{newSigner()}
+	pub1, _ := sig.PublicKey()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.SupportedResponseTypes = []string{"code", "id_token"}
+		c.Signers = []signer.Signer{sig}
+	})
+	defer httpServer.Close()
+
+	// Storage only holds the signer's public key.
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	if keys.SigningKey != nil {
+		t.Errorf("expected no private key in storage")
+	}
+	if keys.SigningKeyPub == nil || keys.SigningKeyPub.KeyID != pub1.KeyID {
+		t.Fatalf("expected signer public key in storage, got %v", keys.SigningKeyPub)
+	}
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		RedirectURIs: []string{redirectURI},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	params := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"id_token"},
+		"scope":         {"openid"},
+		"state":         {"a_state"},
+		"nonce":         {"a_nonce"},
+	}
+	u := requestAuthorization(t, httpServer, redirectURI, params)
+	v, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		t.Fatalf("failed to parse fragment: %v", err)
+	}
+	idToken := v.Get("id_token")
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		t.Fatalf("failed to parse ID token %q: %v", idToken, err)
+	}
+	if header := jws.Signatures[0].Header; header.Algorithm != "ES256" || header.KeyID != pub1.KeyID {
+		t.Errorf("expected ID token signed by the signer, got alg %s kid %s", header.Algorithm, header.KeyID)
+	}
+	if _, _, err := s.verifyIDToken(idToken); err != nil {
+		t.Errorf("failed to verify ID token: %v", err)
+	}
+
+	// Replacing the signer's key publishes the new public key, and keeps the old one
+	// to verify existing tokens.
+	sig.Signer = newSigner()
+	pub2, _ := sig.PublicKey()
+	rotater := keyRotater{s.storage, staticRotationStrategy(testKey), s.signingAlgs, s.signers, s.now, s.logger}
+	if err := rotater.rotate(); err != nil {
+		t.Fatalf("failed to publish keys: %v", err)
+	}
+	if keys, err = s.storage.GetKeys(); err != nil {
+		t.Fatalf("failed to get keys: %v", err)
+	}
+	if keys.SigningKeyPub.KeyID != pub2.KeyID {
+		t.Errorf("expected new signer public key in storage, got %s", keys.SigningKeyPub.KeyID)
+	}
+	if len(keys.VerificationKeys) != 1 || keys.VerificationKeys[0].PublicKey.KeyID != pub1.KeyID {
+		t.Errorf("expected old signer public key to be a verification key, got %v", keys.VerificationKeys)
+	}
+	if _, _, err := s.verifyIDToken(idToken); err != nil {
+		t.Errorf("failed to verify ID token signed by the old key: %v", err)
+	}
+}
+
+func TestPairwiseSubject(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.PairwiseSubjectSecret = "pairwise-secret"
+	})
+	defer httpServer.Close()
+
+	p, err := oidc.NewProvider(ctx, httpServer.URL)
+	if err != nil {
+		t.Fatalf("failed to get provider: %v", err)
+	}
+	var discovery struct {
+		Subjects []string `json:"subject_types_supported"`
+	}
+	if err := p.Claims(&discovery); err != nil {
+		t.Fatalf("failed to decode discovery: %v", err)
+	}
+	if diff := pretty.Compare([]string{"public", "pairwise"}, discovery.Subjects); diff != "" {
+		t.Errorf("unexpected subject types in discovery: %s", diff)
+	}
+
+	clients := []storage.Client{
+		{
+			ID:           "public",
+			Secret:       "secret",
+			RedirectURIs: []string{"https://a.example.com/callback"},
+		},
+		{
+			ID:           "pairwise-a",
+			Secret:       "secret",
+			RedirectURIs: []string{"https://a.example.com/callback"},
+			SubjectType:  "pairwise",
+		},
+		{
+			ID:           "pairwise-b",
+			Secret:       "secret",
+			RedirectURIs: []string{"https://b.example.com:8443/callback"},
+			SubjectType:  "pairwise",
+		},
+		{
+			// Shares the sector of the "a.example.com" redirect URI.
+			ID:               "pairwise-sector-a",
+			Secret:           "secret",
+			RedirectURIs:     []string{"https://c.example.com/callback"},
+			SubjectType:      "pairwise",
+			SectorIdentifier: "a.example.com",
+		},
+	}
+
+	// token requests a token from the token endpoint and returns the subject of
+	// the ID token, checking the access token has the same subject.
+	token := func(client storage.Client, v url.Values) (sub, refreshToken string) {
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: token request failed: %v", client.ID, err)
+		}
+		var tokenResp tokenResponse
+		err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to decode token response: %v", client.ID, err)
+		}
+		idToken, _, err := s.verifyIDToken(tokenResp.IDToken)
+		if err != nil {
+			t.Fatalf("%s: failed to verify ID token: %v", client.ID, err)
+		}
+		accessToken, err := s.verifyAccessToken(tokenResp.AccessToken)
+		if err != nil {
+			t.Fatalf("%s: failed to verify access token: %v", client.ID, err)
+		}
+		if accessToken.Subject != idToken.Subject {
+			t.Errorf("%s: expected access token subject %q, got %q", client.ID, idToken.Subject, accessToken.Subject)
+		}
+		return idToken.Subject, tokenResp.RefreshToken
+	}
+
+	subjects := make(map[string]string)
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		redirectURI := client.RedirectURIs[0]
+		q := requestAuthorization(t, httpServer, redirectURI, url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {"openid offline_access"},
+			"state":         {"a_state"},
+		}).Query()
+		if q.Get("error") != "" {
+			t.Fatalf("%s: unexpected error %s: %s", client.ID, q.Get("error"), q.Get("error_description"))
+		}
+		sub, refreshToken := token(client, url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {q.Get("code")},
+			"redirect_uri": {redirectURI},
+		})
+		subjects[client.ID] = sub
+
+		// Refreshing keeps the subject stable.
+		for i := 0; i < 2; i++ {
+			var refreshed string
+			refreshed, refreshToken = token(client, url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {refreshToken},
+			})
+			if refreshed != sub {
+				t.Errorf("%s: expected refreshed subject %q, got %q", client.ID, sub, refreshed)
+			}
+		}
+	}
+
+	if sub := subjects["public"]; sub != "0-385-28089-0" {
+		t.Errorf("expected public subject to be the user ID, got %q", sub)
+	}
+	if subjects["pairwise-a"] == subjects["public"] {
+		t.Errorf("expected pairwise subject to differ from the user ID")
+	}
+	if subjects["pairwise-a"] == subjects["pairwise-b"] {
+		t.Errorf("expected pairwise subjects to differ between sectors")
+	}
+	if subjects["pairwise-a"] != subjects["pairwise-sector-a"] {
+		t.Errorf("expected pairwise subjects to match within a sector, got %q and %q",
+			subjects["pairwise-a"], subjects["pairwise-sector-a"])
+	}
+
+	// Pairwise clients need a sector identifier if they redirect to several hosts.
+	ambiguous := storage.Client{
+		ID:           "ambiguous",
+		RedirectURIs: []string{"https://a.example.com/callback", "https://b.example.com/callback"},
+		SubjectType:  "pairwise",
+	}
+	if _, err := s.subject(ambiguous, "mock", "0-385-28089-0"); err == nil {
+		t.Errorf("expected pairwise subject without a sector identifier to be rejected")
+	}
+}
+
+func TestCustomClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := &mock.Callback{
+		Identity: connector.Identity{
+			UserID:        "0-385-28089-0",
+			Username:      "Kilgore Trout",
+			Email:         "kilgore@kilgore.trout",
+			EmailVerified: true,
+			CustomClaims: map[string]interface{}{
+				"employeeNumber": "12345",
+				"login":          "ktrout",
+				"secret":         "not for clients",
+			},
+		},
+		Logger: logger,
+	}
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.Connectors = []Connector{{ID: "mock", DisplayName: "Mock", Connector: conn}}
+	})
+	defer httpServer.Close()
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+		ClaimMappings: []storage.ClaimMapping{
+			{Claim: "employee_id", From: "employeeNumber", Scope: "profile"},
+			{Claim: "github_email", Template: "{{.login}}@users.noreply.github.com"},
+			{Claim: "missing", From: "doesNotExist"},
+			{Claim: "missing_template", Template: "{{.doesNotExist}}"},
+			{Claim: "sub", From: "login"},
+		},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	token := func(v url.Values) tokenResponse {
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("token request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			dump, _ := httputil.DumpResponse(resp, true)
+			t.Fatalf("token request failed: %s", dump)
+		}
+		var tokenResp tokenResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+			t.Fatalf("failed to decode token response: %v", err)
+		}
+		return tokenResp
+	}
+	login := func(scope string) tokenResponse {
+		q := requestAuthorization(t, httpServer, redirectURI, url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {scope},
+			"state":         {"a_state"},
+		}).Query()
+		if q.Get("error") != "" {
+			t.Fatalf("unexpected error %s: %s", q.Get("error"), q.Get("error_description"))
+		}
+		return token(url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {q.Get("code")},
+			"redirect_uri": {redirectURI},
+		})
+	}
+	checkClaims := func(name string, tokenResp tokenResponse, want map[string]interface{}) {
+		idToken, _, err := s.verifyIDToken(tokenResp.IDToken)
+		if err != nil {
+			t.Fatalf("%s: failed to verify ID token: %v", name, err)
+		}
+		if idToken.Subject != "0-385-28089-0" {
+			t.Errorf("%s: expected custom claims not to replace the subject, got %q", name, idToken.Subject)
+		}
+		if diff := pretty.Compare(want, idToken.Custom); diff != "" {
+			t.Errorf("%s: unexpected ID token custom claims: %s", name, diff)
+		}
+
+		req, err := http.NewRequest("GET", httpServer.URL+"/userinfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokenResp.AccessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: userinfo request failed: %v", name, err)
+		}
+		var userInfo map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&userInfo)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to decode userinfo: %v", name, err)
+		}
+		for claim, value := range want {
+			if userInfo[claim] != value {
+				t.Errorf("%s: expected userinfo claim %s=%v, got %v", name, claim, value, userInfo[claim])
+			}
+		}
+		for _, claim := range []string{"employee_id", "employeeNumber", "secret", "missing", "missing_template"} {
+			if _, ok := want[claim]; !ok && userInfo[claim] != nil {
+				t.Errorf("%s: expected userinfo claim %s to be left out, got %v", name, claim, userInfo[claim])
+			}
+		}
+	}
+
+	tokenResp := login("openid profile offline_access")
+	checkClaims("code", tokenResp, map[string]interface{}{
+		"employee_id":  "12345",
+		"github_email": "ktrout@users.noreply.github.com",
+	})
+
+	// Custom claims are refreshed from the connector.
+	conn.Identity.CustomClaims = map[string]interface{}{
+		"employeeNumber": "67890",
+		"login":          "ktrout",
+	}
+	refreshed := token(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokenResp.RefreshToken},
+	})
+	checkClaims("refresh", refreshed, map[string]interface{}{
+		"employee_id":  "67890",
+		"github_email": "ktrout@users.noreply.github.com",
+	})
+
+	// Claims limited to a scope aren't released without it.
+	checkClaims("without scope", login("openid"), map[string]interface{}{
+		"github_email": "ktrout@users.noreply.github.com",
+	})
+}
+
+func TestClaimsParameter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := &mock.Callback{
+		Identity: connector.Identity{
+			UserID:        "0-385-28089-0",
+			Username:      "Kilgore Trout",
+			Email:         "kilgore@kilgore.trout",
+			EmailVerified: true,
+			Groups:        []string{"authors"},
+			CustomClaims:  map[string]interface{}{"employeeNumber": "12345"},
+		},
+		Logger: logger,
+	}
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.Connectors = []Connector{{ID: "mock", DisplayName: "Mock", Connector: conn}}
+	})
+	defer httpServer.Close()
+
+	redirectURI := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURI},
+		ClaimMappings: []storage.ClaimMapping{
+			{Claim: "employee_id", From: "employeeNumber", Scope: "profile"},
+		},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	authorize := func(claims string) url.Values {
+		return requestAuthorization(t, httpServer, redirectURI, url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURI},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"a_state"},
+			"claims":        {claims},
+		}).Query()
+	}
+
+	if q := authorize(`{"id_token":{"email":{"essential":"yes"}}}`); q.Get("error") != errInvalidRequest {
+		t.Errorf("expected malformed claims parameter to fail with %s, got %q", errInvalidRequest, q.Get("error"))
+	}
+
+	q := authorize(`{"id_token":{"email":{"essential":true},"employee_id":null},"userinfo":{"groups":null}}`)
+	if q.Get("error") != "" {
+		t.Fatalf("unexpected error %s: %s", q.Get("error"), q.Get("error_description"))
+	}
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  httpServer.URL + "/auth",
+			TokenURL: httpServer.URL + "/token",
+		},
+		RedirectURL: redirectURI,
+	}
+	tok, err := oauth2Config.Exchange(ctx, q.Get("code"))
+	if err != nil {
+		t.Fatalf("failed to exchange code: %v", err)
+	}
+
+	// Claims requested for the ID token are released without their scopes.
+	rawIDToken, _ := tok.Extra("id_token").(string)
+	idToken, _, err := s.verifyIDToken(rawIDToken)
+	if err != nil {
+		t.Fatalf("failed to verify ID token: %v", err)
+	}
+	if idToken.Email != "kilgore@kilgore.trout" {
+		t.Errorf("expected requested email claim in ID token, got %q", idToken.Email)
+	}
+	if idToken.EmailVerified != nil || idToken.Groups != nil || idToken.Name != "" {
+		t.Errorf("expected claims which weren't requested to be left out of the ID token, got %+v", idToken.userClaims)
+	}
+	// Custom claims limited to a scope still require it.
+	if idToken.Custom != nil {
+		t.Errorf("expected custom claim limited to a scope to be left out of the ID token, got %v", idToken.Custom)
+	}
+
+	// Claims requested for the UserInfo endpoint are only released there.
+	req, err := http.NewRequest("GET", httpServer.URL+"/userinfo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("userinfo request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var userInfo map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		t.Fatalf("failed to decode userinfo: %v", err)
+	}
+	want := map[string]interface{}{
+		"sub":    "0-385-28089-0",
+		"groups": []interface{}{"authors"},
+	}
+	if diff := pretty.Compare(want, userInfo); diff != "" {
+		t.Errorf("unexpected userinfo response: %s", diff)
+	}
+}
+
+func TestClientAssertion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, nil)
+	defer httpServer.Close()
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := []storage.Client{
+		{
+			ID:                      "keyclient",
+			Secret:                  "keyclientsecret",
+			AllowClientCredentials:  true,
+			TokenEndpointAuthMethod: authMethodPrivateKeyJWT,
+			JWKS: &jose.JSONWebKeySet{
+				Keys: []jose.JSONWebKey{{Key: clientKey.Public(), KeyID: "client-key", Algorithm: "ES256", Use: "sig"}},
+			},
+		},
+		{
+			ID:                      "secretclient",
+			Secret:                  "secretclientsecret-which-is-long-enough",
+			AllowClientCredentials:  true,
+			TokenEndpointAuthMethod: authMethodClientSecretJWT,
+		},
+		{
+			ID:                     "plainclient",
+			Secret:                 "plainclientsecret-which-is-long-enough",
+			AllowClientCredentials: true,
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	sign := func(alg jose.SignatureAlgorithm, key interface{}, claims map[string]interface{}) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertion, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return assertion
+	}
+	jti := 0
+	newClaims := func(clientID string) map[string]interface{} {
+		jti++
+		return map[string]interface{}{
+			"iss": clientID,
+			"sub": clientID,
+			"aud": httpServer.URL + "/token",
+			"exp": time.Now().Add(time.Minute).Unix(),
+			"jti": fmt.Sprintf("assertion-%d", jti),
+		}
+	}
+	requestToken := func(v url.Values, basicAuth ...string) int {
+		v.Set("grant_type", "client_credentials")
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(basicAuth) == 2 {
+			req.SetBasicAuth(basicAuth[0], basicAuth[1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("token request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assertionParams := func(assertion string) url.Values {
+		return url.Values{
+			"client_assertion_type": {clientAssertionTypeJWTBearer},
+			"client_assertion":      {assertion},
+		}
+	}
+
+	keyAssertion := sign(jose.ES256, clientKey, newClaims("keyclient"))
+	if status := requestToken(assertionParams(keyAssertion)); status != http.StatusOK {
+		t.Errorf("private_key_jwt: expected status %d, got %d", http.StatusOK, status)
+	}
+	if status := requestToken(assertionParams(keyAssertion)); status != http.StatusUnauthorized {
+		t.Errorf("replayed assertion: expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	secretKey := []byte("secretclientsecret-which-is-long-enough")
+	secretAssertion := sign(jose.HS256, secretKey, newClaims("secretclient"))
+	if status := requestToken(assertionParams(secretAssertion)); status != http.StatusOK {
+		t.Errorf("client_secret_jwt: expected status %d, got %d", http.StatusOK, status)
+	}
+
+	// Clients restricted to private_key_jwt can't use their secret.
+	if status := requestToken(url.Values{}, "keyclient", "keyclientsecret"); status != http.StatusUnauthorized {
+		t.Errorf("restricted auth method: expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	wrongAudience := newClaims("keyclient")
+	wrongAudience["aud"] = "https://other.example.com"
+	expired := newClaims("keyclient")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	tooLong := newClaims("keyclient")
+	tooLong["exp"] = time.Now().Add(2 * time.Hour).Unix()
+	noJTI := newClaims("keyclient")
+	delete(noJTI, "jti")
+	wrongIssuer := newClaims("keyclient")
+	wrongIssuer["iss"] = "secretclient"
+
+	errTests := []struct {
+		name       string
+		params     url.Values
+		wantStatus int
+	}{
+		{"signed by another key", assertionParams(sign(jose.ES256, otherKey, newClaims("keyclient"))), http.StatusUnauthorized},
+		{"signed with secret", assertionParams(sign(jose.HS256, []byte("keyclientsecret"), newClaims("keyclient"))), http.StatusUnauthorized},
+		{"signed with secret without client_secret_jwt", assertionParams(sign(jose.HS256, []byte("plainclientsecret-which-is-long-enough"), newClaims("plainclient"))), http.StatusUnauthorized},
+		{"wrong audience", assertionParams(sign(jose.ES256, clientKey, wrongAudience)), http.StatusUnauthorized},
+		{"expired", assertionParams(sign(jose.ES256, clientKey, expired)), http.StatusUnauthorized},
+		{"lifetime too long", assertionParams(sign(jose.ES256, clientKey, tooLong)), http.StatusUnauthorized},
+		{"no jti", assertionParams(sign(jose.ES256, clientKey, noJTI)), http.StatusUnauthorized},
+		{"wrong issuer", assertionParams(sign(jose.ES256, clientKey, wrongIssuer)), http.StatusUnauthorized},
+		{"unknown client", assertionParams(sign(jose.ES256, clientKey, newClaims("unknown"))), http.StatusUnauthorized},
+		{"malformed", assertionParams("not-a-jwt"), http.StatusUnauthorized},
+		{"unsupported type", url.Values{
+			"client_assertion_type": {"urn:example:unsupported"},
+			"client_assertion":      {sign(jose.ES256, clientKey, newClaims("keyclient"))},
+		}, http.StatusBadRequest},
+	}
+	for _, tc := range errTests {
+		if status := requestToken(tc.params); status != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, status)
+		}
+	}
+
+	// Assertions are garbage collected once they expire.
+	r, err := s.storage.GarbageCollect(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("garbage collection failed: %v", err)
+	}
+	if r.ClientAssertions != 2 {
+		t.Errorf("expected 2 client assertions to be garbage collected, got %d", r.ClientAssertions)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type keyPair struct {
+		cert *x509.Certificate
+		key  *ecdsa.PrivateKey
+	}
+	// newKeyPair returns a certificate issued by the parent, or a self-signed one
+	// if parent is nil.
+	newKeyPair := func(cn string, parent *keyPair) *keyPair {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  parent == nil,
+		}
+		issuer, issuerKey := tmpl, key
+		if parent != nil {
+			issuer, issuerKey = parent.cert, parent.key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), issuerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &keyPair{cert, key}
+	}
+
+	ca := newKeyPair("Example CA", nil)
+	issued := newKeyPair("mtls-client", ca)
+	selfSigned := newKeyPair("mtls-client", nil)
+	other := newKeyPair("other", nil)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.TLSClientAuth = true
+		c.TLSClientCAs = clientCAs
+	})
+	defer httpServer.Close()
+
+	tlsServer := httptest.NewUnstartedServer(s)
+	tlsServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	// newClient returns an HTTP client presenting the certificate, if any.
+	newClient := func(kp *keyPair) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if kp != nil {
+			config.Certificates = []tls.Certificate{{Certificate: [][]byte{kp.cert.Raw}, PrivateKey: kp.key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	post := func(kp *keyPair, v url.Values) (int, []byte) {
+		resp, err := newClient(kp).PostForm(tlsServer.URL+"/token", v)
+		if err != nil {
+			t.Fatalf("token request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+	userInfo := func(kp *keyPair, accessToken string) int {
+		req, err := http.NewRequest("GET", tlsServer.URL+"/userinfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := newClient(kp).Do(req)
+		if err != nil {
+			t.Fatalf("userinfo request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	clients := []storage.Client{
+		{
+			ID:                      "caclient",
+			AllowClientCredentials:  true,
+			AllowedScopes:           []string{"openid"},
+			TokenEndpointAuthMethod: authMethodTLSClientAuth,
+			TLSClientAuthSubjectDN:  "CN=mtls-client",
+		},
+		{
+			ID:                             "selfsignedclient",
+			Secret:                         "selfsignedclientsecret",
+			AllowClientCredentials:         true,
+			AllowedScopes:                  []string{"openid"},
+			TLSClientCertificateThumbprint: certThumbprint(selfSigned.cert),
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		clientID   string
+		keyPair    *keyPair
+		wantStatus int
+	}{
+		{"issued by CA", "caclient", issued, http.StatusOK},
+		{"self-signed", "selfsignedclient", selfSigned, http.StatusOK},
+		{"not issued by CA", "caclient", selfSigned, http.StatusUnauthorized},
+		{"wrong subject", "caclient", other, http.StatusUnauthorized},
+		{"unregistered certificate", "selfsignedclient", other, http.StatusUnauthorized},
+		{"no certificate", "selfsignedclient", nil, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		status, body := post(tc.keyPair, url.Values{
+			"grant_type": {"client_credentials"},
+			"client_id":  {tc.clientID},
+			"scope":      {"openid"},
+		})
+		if status != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.wantStatus, status, body)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+
+		var tokenResp struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.Unmarshal(body, &tokenResp); err != nil {
+			t.Errorf("%s: failed to decode response: %v", tc.name, err)
+			continue
+		}
+		tok, err := s.verifyAccessToken(tokenResp.AccessToken)
+		if err != nil {
+			t.Errorf("%s: failed to verify access token: %v", tc.name, err)
+			continue
+		}
+		want := certThumbprint(tc.keyPair.cert)
+		if tok.Confirmation == nil || tok.Confirmation.CertThumbprint != want {
+			t.Errorf("%s: expected access token bound to %q, got %+v", tc.name, want, tok.Confirmation)
+		}
+
+		// The access token can only be used with the certificate it's bound to.
+		if status := userInfo(tc.keyPair, tokenResp.AccessToken); status != http.StatusOK {
+			t.Errorf("%s: expected userinfo status %d, got %d", tc.name, http.StatusOK, status)
+		}
+		if status := userInfo(other, tokenResp.AccessToken); status != http.StatusUnauthorized {
+			t.Errorf("%s: expected userinfo status %d with another certificate, got %d", tc.name, http.StatusUnauthorized, status)
+		}
+	}
+
+	// Refresh tokens bound to a certificate can't be used without it, even by a
+	// client which knows the secret.
+	refresh := storage.RefreshToken{
+		RefreshToken:   storage.NewID(),
+		ClientID:       "selfsignedclient",
+		ConnectorID:    "mock",
+		Scopes:         []string{"openid", "offline_access"},
+		Claims:         storage.Claims{UserID: "1", Username: "jane"},
+		CertThumbprint: certThumbprint(selfSigned.cert),
+	}
+	if err := s.storage.CreateRefresh(refresh); err != nil {
+		t.Fatalf("failed to create refresh token: %v", err)
+	}
+	params := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"selfsignedclient"},
+		"client_secret": {"selfsignedclientsecret"},
+		"refresh_token": {refresh.RefreshToken},
+	}
+	if status, body := post(nil, params); status != http.StatusBadRequest {
+		t.Errorf("refresh without certificate: expected status %d, got %d: %s", http.StatusBadRequest, status, body)
+	}
+	params.Del("client_secret")
+	if status, body := post(selfSigned, params); status != http.StatusOK {
+		t.Errorf("refresh with certificate: expected status %d, got %d: %s", http.StatusOK, status, body)
+	}
+}
+
+func TestHashClientSecrets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Clients stored before secrets were hashed have plaintext secrets.
+	clients := []storage.Client{
+		{ID: "plaintext", Secret: "plaintextsecret", AllowClientCredentials: true},
+		{ID: "jwt", Secret: "jwtsecret", TokenEndpointAuthMethod: authMethodClientSecretJWT},
+	}
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		for _, client := range clients {
+			if err := c.Storage.CreateClient(client); err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+		}
+	})
+	defer httpServer.Close()
+
+	client, err := s.storage.GetClient("plaintext")
+	if err != nil {
+		t.Fatalf("failed to get client: %v", err)
+	}
+	if client.Secret != "" || client.SecretHash == "" {
+		t.Errorf("expected plaintext secret to be replaced by a hash, got secret=%q hash=%q", client.Secret, client.SecretHash)
+	}
+	if client, err = s.storage.GetClient("jwt"); err != nil {
+		t.Fatalf("failed to get client: %v", err)
+	}
+	if client.Secret != "jwtsecret" {
+		t.Errorf("expected client_secret_jwt client to keep its plaintext secret")
+	}
+
+	// The client still authenticates with its secret.
+	for secret, wantStatus := range map[string]int{
+		"plaintextsecret": http.StatusOK,
+		"wrongsecret":     http.StatusUnauthorized,
+	} {
+		v := url.Values{"grant_type": {"client_credentials"}}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("plaintext", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("token request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Errorf("secret %q: expected status %d, got %d", secret, wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestClientRegistration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.InitialAccessTokens = []string{"initialtoken"}
+		c.AllowedFetchHosts = []string{"10.0.0.1"}
+	})
+	defer httpServer.Close()
+
+	do := func(method, path, token, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read response body: %v", err)
+		}
+		return resp, data
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		metadata   string
+		wantStatus int
+		wantErr    string
+	}{
+		{
+			name:       "no initial access token",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"]}`,
+			wantStatus: http.StatusUnauthorized,
+			wantErr:    "invalid_token",
+		},
+		{
+			name:       "wrong initial access token",
+			token:      "wrongtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"]}`,
+			wantStatus: http.StatusUnauthorized,
+			wantErr:    "invalid_token",
+		},
+		{
+			name:       "missing redirect URIs",
+			token:      "initialtoken",
+			metadata:   `{"client_name": "app"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidRedirectURI,
+		},
+		{
+			name:       "redirect URI with fragment",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback#frag"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidRedirectURI,
+		},
+		{
+			name:       "redirect URI running script",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["javascript://app.example.com/%0Aalert(1)"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidRedirectURI,
+		},
+		{
+			name:       "http redirect URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["http://app.example.com/callback"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidRedirectURI,
+		},
+		{
+			name:       "http post logout redirect URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "post_logout_redirect_uris": ["http://app.example.com/"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidRedirectURI,
+		},
+		{
+			name:       "http request URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "request_uris": ["http://app.example.com/request.jwt"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "loopback JWKS URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "jwks_uri": "https://127.0.0.1:8443/jwks.json"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "link-local JWKS URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "jwks_uri": "https://[fe80::1]/jwks.json"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "localhost request URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "request_uris": ["https://localhost/request.jwt"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "private request URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "request_uris": ["https://192.168.1.10/request.jwt"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "allowed private JWKS URI",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "jwks_uri": "https://10.0.0.1/jwks.json"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "public client redirecting to localhost",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["http://localhost:5555/callback"], "token_endpoint_auth_method": "none"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "unsupported grant type",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "grant_types": ["password"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "private_key_jwt without keys",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "token_endpoint_auth_method": "private_key_jwt"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErr:    errInvalidClientMetadata,
+		},
+		{
+			name:       "public client",
+			token:      "initialtoken",
+			metadata:   `{"redirect_uris": ["https://app.example.com/callback"], "token_endpoint_auth_method": "none"}`,
+			wantStatus: http.StatusCreated,
+		},
+	}
+	for _, tc := range tests {
+		resp, data := do("POST", "/register", tc.token, tc.metadata)
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.wantStatus, resp.StatusCode, data)
+			continue
+		}
+		if tc.wantErr != "" {
+			var errResp struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(data, &errResp); err != nil {
+				t.Errorf("%s: failed to unmarshal error response: %v", tc.name, err)
+			} else if errResp.Error != tc.wantErr {
+				t.Errorf("%s: expected error %q, got %q", tc.name, tc.wantErr, errResp.Error)
+			}
+		}
+	}
+
+	resp, data := do("POST", "/register", "initialtoken", `{
+		"redirect_uris": ["https://app.example.com/callback"],
+		"grant_types": ["authorization_code", "client_credentials"],
+		"client_name": "app",
+		"scope": "openid"
+	}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("failed to register client: %d %s", resp.StatusCode, data)
+	}
+	var reg clientRegistrationResponse
+	if err := json.Unmarshal(data, &reg); err != nil {
+		t.Fatalf("failed to unmarshal registration response: %v", err)
+	}
+	if reg.ClientID == "" || reg.ClientSecret == "" || reg.RegistrationAccessToken == "" {
+		t.Fatalf("expected client ID, secret and registration access token, got %s", data)
+	}
+	if want := httpServer.URL + "/register/" + reg.ClientID; reg.RegistrationClientURI != want {
+		t.Errorf("expected registration client URI %q, got %q", want, reg.RegistrationClientURI)
+	}
+	client, err := s.storage.GetClient(reg.ClientID)
+	if err != nil {
+		t.Fatalf("failed to get client: %v", err)
+	}
+	if client.Secret != "" || client.RegistrationAccessTokenHash == reg.RegistrationAccessToken {
+		t.Errorf("expected only hashes of the secret and registration access token to be stored")
+	}
+
+	// The client can use the secret it was issued.
+	v := url.Values{"grant_type": {"client_credentials"}, "scope": {"openid"}}
+	req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(reg.ClientID, reg.ClientSecret)
+	tokenResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("token request failed: %v", err)
+	}
+	tokenResp.Body.Close()
+	if tokenResp.StatusCode != http.StatusOK {
+		t.Errorf("expected registered client to get a token, got status %d", tokenResp.StatusCode)
+	}
+
+	path := "/register/" + reg.ClientID
+	if resp, _ := do("GET", path, "wrongtoken", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected wrong registration access token to be rejected, got status %d", resp.StatusCode)
+	}
+	if resp, _ := do("GET", "/register/unknown", reg.RegistrationAccessToken, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unknown client to be rejected, got status %d", resp.StatusCode)
+	}
+	resp, data = do("GET", path, reg.RegistrationAccessToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to read registration: %d %s", resp.StatusCode, data)
+	}
+	var read clientRegistrationResponse
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatalf("failed to unmarshal registration response: %v", err)
+	}
+	if read.ClientName != "app" || read.ClientSecret != "" || read.RegistrationAccessToken != "" {
+		t.Errorf("expected registration without credentials, got %s", data)
+	}
+
+	// Updates replace the metadata.
+	update := fmt.Sprintf(`{"client_id": %q, "redirect_uris": ["https://app.example.com/new"], "client_name": "new app"}`, reg.ClientID)
+	if resp, data := do("PUT", path, reg.RegistrationAccessToken, update); resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to update registration: %d %s", resp.StatusCode, data)
+	}
+	if client, err = s.storage.GetClient(reg.ClientID); err != nil {
+		t.Fatalf("failed to get client: %v", err)
+	}
+	if client.Name != "new app" || !reflect.DeepEqual(client.RedirectURIs, []string{"https://app.example.com/new"}) || client.AllowClientCredentials {
+		t.Errorf("expected metadata to be replaced, got %+v", client)
+	}
+	update = fmt.Sprintf(`{"client_id": %q, "redirect_uris": ["https://app.example.com/new"], "token_endpoint_auth_method": "none"}`, reg.ClientID)
+	if resp, _ := do("PUT", path, reg.RegistrationAccessToken, update); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected token endpoint auth method change to be rejected, got status %d", resp.StatusCode)
+	}
+
+	if resp, _ := do("DELETE", path, reg.RegistrationAccessToken, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("failed to delete registration: %d", resp.StatusCode)
+	}
+	if _, err := s.storage.GetClient(reg.ClientID); err != storage.ErrNotFound {
+		t.Errorf("expected client to be deleted, got %v", err)
+	}
+}
+
+func TestRefreshTokenLifetimes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	httpServer, s := newTestServer(ctx, t, func(c *Config) {
+		c.Now = func() time.Time { return now }
+		c.RefreshTokensValidFor = 2 * time.Hour
+		c.RefreshTokensIdleTimeout = time.Hour
+	})
+	defer httpServer.Close()
+
+	if err := s.storage.CreateClient(storage.Client{ID: "testclient", Secret: "testclientsecret"}); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	newRefresh := func() string {
+		refresh := storage.RefreshToken{
+			RefreshToken: storage.NewID(),
+			ClientID:     "testclient",
+			ConnectorID:  "mock",
+			Scopes:       []string{"openid", "offline_access"},
+			Claims:       storage.Claims{UserID: "1", Email: "jane.doe@example.com"},
+			FamilyID:     storage.NewID(),
+			CreatedAt:    now,
+			LastUsed:     now,
+		}
+		if err := s.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("failed to create refresh token: %v", err)
+		}
+		return refresh.RefreshToken
+	}
+	// refresh redeems a refresh token, returning the one which replaced it or the
+	// error code.
+	refresh := func(token string) (next, errCode string) {
+		v := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("testclient", "testclientsecret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("refresh request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode token response: %v", err)
+		}
+		return body.RefreshToken, body.Error
+	}
+
+	// Tokens expire once they haven't been used for the idle timeout, and once the
+	// absolute lifetime has passed even if they're used.
+	token, createdAt := newRefresh(), now
+	for i, step := range []struct {
+		elapsed time.Duration
+		wantErr string
+	}{
+		{50 * time.Minute, ""},
+		{50 * time.Minute, ""},
+		{50 * time.Minute, errInvalidGrant},
+	} {
+		now = now.Add(step.elapsed)
+		next, errCode := refresh(token)
+		if errCode != step.wantErr {
+			t.Fatalf("absolute lifetime step %d: expected error %q, got %q", i, step.wantErr, errCode)
+		}
+		if next != "" {
+			stored, err := s.storage.GetRefresh(next)
+			if err != nil {
+				t.Fatalf("failed to get refresh token: %v", err)
+			}
+			want := now.Add(time.Hour)
+			if absolute := createdAt.Add(2 * time.Hour); absolute.Before(want) {
+				want = absolute
+			}
+			if !stored.Expiry.Equal(want) {
+				t.Errorf("absolute lifetime step %d: expected expiry %s, got %s", i, want, stored.Expiry)
+			}
+			token = next
+		}
+	}
+
+	token = newRefresh()
+	now = now.Add(61 * time.Minute)
+	if _, errCode := refresh(token); errCode != errInvalidGrant {
+		t.Errorf("expected idle refresh token to be rejected, got error %q", errCode)
+	}
+	if _, err := s.storage.GetRefresh(token); err != storage.ErrNotFound {
+		t.Errorf("expected expired refresh token to be deleted, got %v", err)
+	}
+
+	// Rotated tokens are kept, and presenting any of them again revokes the token
+	// in use of the whole family.
+	first := newRefresh()
+	second, errCode := refresh(first)
+	if errCode != "" {
+		t.Fatalf("failed to refresh token: %s", errCode)
+	}
+	third, errCode := refresh(second)
+	if errCode != "" {
+		t.Fatalf("failed to refresh token: %s", errCode)
+	}
+	for _, token := range []string{first, second} {
+		if rotated, err := s.storage.GetRefresh(token); err != nil || !rotated.Rotated {
+			t.Errorf("expected rotated token to be kept, got %+v (%v)", rotated, err)
+		}
+	}
+	if _, errCode := refresh(first); errCode != errInvalidGrant {
+		t.Errorf("expected reused refresh token to be rejected, got error %q", errCode)
+	}
+	if _, errCode := refresh(third); errCode != errInvalidGrant {
+		t.Errorf("expected family to be revoked, got error %q", errCode)
+	}
+	if _, errCode := refresh(second); errCode != errInvalidGrant {
+		t.Errorf("expected reused refresh token to be rejected, got error %q", errCode)
+	}
+
+	// Once the family is revoked, garbage collection deletes all of its tokens.
+	if _, err := s.storage.GarbageCollect(now); err != nil {
+		t.Fatalf("garbage collection failed: %v", err)
+	}
+	for _, token := range []string{first, second, third} {
+		if _, err := s.storage.GetRefresh(token); err != storage.ErrNotFound {
+			t.Errorf("expected revoked family to be garbage collected, got %v", err)
+		}
+	}
+
+	// Of several requests presenting the same token at once, only one is granted
+	// a new token.
+	token = newRefresh()
+	results := make(chan string)
+	for i := 0; i < 5; i++ {
+		go func() {
+			next, _ := refresh(token)
+			results <- next
+		}()
+	}
+	granted := 0
+	for i := 0; i < 5; i++ {
+		if next := <-results; next != "" {
+			granted++
+		}
+	}
+	if granted != 1 {
+		t.Errorf("expected one of the concurrent refresh requests to be granted, got %d", granted)
+	}
+}
+
+func TestRegisteredPublicClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, _ := newTestServer(ctx, t, func(c *Config) {
+		c.InitialAccessTokens = []string{"initialtoken"}
+	})
+	defer httpServer.Close()
+
+	redirectURI := "https://app.example.com/callback"
+	metadata := fmt.Sprintf(`{"redirect_uris": [%q], "token_endpoint_auth_method": "none"}`, redirectURI)
+	req, err := http.NewRequest("POST", httpServer.URL+"/register", strings.NewReader(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer initialtoken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("registration request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("failed to register client: %d", resp.StatusCode)
+	}
+	var reg clientRegistrationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reg); err != nil {
+		t.Fatalf("failed to decode registration response: %v", err)
+	}
+	if reg.ClientSecret != "" {
+		t.Errorf("expected public client not to be issued a secret")
+	}
+
+	// Public clients may redirect to the URIs they registered.
+	u := requestAuthorization(t, httpServer, redirectURI, url.Values{
+		"client_id":     {reg.ClientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"state":         {"state"},
+	})
+	if u.Query().Get("code") == "" {
+		t.Errorf("expected authorization code, got redirect to %s", u)
+	}
+}
@@ -0,0 +1,137 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// NewFileSigner returns a signer using the PEM encoded private key held in a file.
+// PKCS #8 keys are expected, though PKCS #1 RSA keys and SEC 1 EC keys are also
+// accepted.
+//
+// The file is reloaded when its modification time changes, so the key can be
+// replaced without restarting the server. If the new key can't be loaded the
+// previous one is used until the file is fixed. The algorithm can't change
+// across reloads. If alg is empty it's inferred from the first key loaded.
+func NewFileSigner(path string, alg jose.SignatureAlgorithm, logger logrus.FieldLogger) (Signer, error) {
+	f := &fileSigner{path: path, alg: alg, logger: logger}
+	if _, err := f.current(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type fileSigner struct {
+	path string
+	alg  jose.SignatureAlgorithm
+
+	logger logrus.FieldLogger
+
+	mu      sync.Mutex
+	modTime time.Time
+	signer  *cryptoSigner
+}
+
+func (f *fileSigner) Algorithm() jose.SignatureAlgorithm {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.alg
+}
+
+func (f *fileSigner) PublicKey() (*jose.JSONWebKey, error) {
+	signer, err := f.current()
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey()
+}
+
+func (f *fileSigner) Sign(typ string, payload []byte) (string, error) {
+	signer, err := f.current()
+	if err != nil {
+		return "", err
+	}
+	return signer.Sign(typ, payload)
+}
+
+// current returns a signer for the key in the file, reloading it if the file has
+// been modified since it was last read.
+func (f *fileSigner) current() (*cryptoSigner, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.fallback(fmt.Errorf("stat signing key: %v", err))
+	}
+	if f.signer != nil && info.ModTime().Equal(f.modTime) {
+		return f.signer, nil
+	}
+
+	key, err := loadPrivateKey(f.path)
+	if err != nil {
+		return f.fallback(err)
+	}
+	signer, err := newCryptoSigner(key, f.alg)
+	if err != nil {
+		return f.fallback(fmt.Errorf("signing key %s: %v", f.path, err))
+	}
+	if f.signer != nil {
+		f.logger.Infof("signer: reloaded signing key %s", f.path)
+	}
+	f.alg = signer.alg
+	f.modTime = info.ModTime()
+	f.signer = signer
+	return signer, nil
+}
+
+// fallback keeps using the previous key, if any, when the file can't be loaded.
+// The modification time isn't recorded so the file is tried again next time.
+func (f *fileSigner) fallback(err error) (*cryptoSigner, error) {
+	if f.signer == nil {
+		return nil, err
+	}
+	f.logger.Errorf("signer: keeping previous signing key: %v", err)
+	return f.signer, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("signing key %s has unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key %s: %v", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("signing key can't sign")
+	}
+	return signer, nil
+}
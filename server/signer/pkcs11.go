@@ -0,0 +1,99 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"fmt"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Mechanism is a PKCS #11 signing mechanism.
+type Mechanism uint
+
+// Mechanisms used to sign tokens. Values match the CKM_* constants of the PKCS #11
+// specification.
+const (
+	MechanismSHA256RSAPKCS    Mechanism = 0x40   // CKM_SHA256_RSA_PKCS
+	MechanismSHA384RSAPKCS    Mechanism = 0x41   // CKM_SHA384_RSA_PKCS
+	MechanismSHA512RSAPKCS    Mechanism = 0x42   // CKM_SHA512_RSA_PKCS
+	MechanismSHA256RSAPKCSPSS Mechanism = 0x43   // CKM_SHA256_RSA_PKCS_PSS
+	MechanismSHA384RSAPKCSPSS Mechanism = 0x44   // CKM_SHA384_RSA_PKCS_PSS
+	MechanismSHA512RSAPKCSPSS Mechanism = 0x45   // CKM_SHA512_RSA_PKCS_PSS
+	MechanismECDSA            Mechanism = 0x1041 // CKM_ECDSA
+)
+
+// PKCS11Session is the part of a PKCS #11 session used to sign with a private key
+// held by a hardware security module. Implementations usually wrap a binding of
+// the vendor's PKCS #11 library. PublicKey finds the CKO_PUBLIC_KEY object with the
+// label through C_FindObjects and reads its attributes. Sign finds the matching
+// CKO_PRIVATE_KEY object, then calls C_SignInit with the mechanism and C_Sign.
+//
+// Signatures are returned in the format of the mechanism. RSA PSS mechanisms use
+// MGF1 with the mechanism's hash and a salt as long as the hash. CKM_ECDSA is passed
+// the digest of the data and returns the concatenated values of r and s.
+type PKCS11Session interface {
+	PublicKey(label string) (crypto.PublicKey, error)
+	Sign(label string, mechanism Mechanism, data []byte) ([]byte, error)
+}
+
+// NewPKCS11Signer returns a signer using the private key with the label held by
+// a hardware security module.
+//
+// The public key is read once. To use a new key, give it a new label and create a
+// new signer. If alg is empty it's inferred from the key type.
+func NewPKCS11Signer(session PKCS11Session, label string, alg jose.SignatureAlgorithm) (Signer, error) {
+	pub, err := session.PublicKey(label)
+	if err != nil {
+		return nil, fmt.Errorf("get public key %q: %v", label, err)
+	}
+	if alg == "" {
+		if alg, err = defaultAlgorithm(pub); err != nil {
+			return nil, err
+		}
+	}
+	jwk, err := publicKey(pub, alg)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11Signer{session: session, label: label, alg: alg, pub: jwk}, nil
+}
+
+type pkcs11Signer struct {
+	session PKCS11Session
+	label   string
+	alg     jose.SignatureAlgorithm
+	pub     *jose.JSONWebKey
+}
+
+func (p *pkcs11Signer) Algorithm() jose.SignatureAlgorithm { return p.alg }
+
+func (p *pkcs11Signer) PublicKey() (*jose.JSONWebKey, error) { return p.pub, nil }
+
+func (p *pkcs11Signer) Sign(typ string, payload []byte) (string, error) {
+	return signJWS(p.alg, p.pub.KeyID, typ, payload, func(signingInput []byte) ([]byte, error) {
+		if _, ok := p.pub.Key.(*ecdsa.PublicKey); ok {
+			// CKM_ECDSA doesn't hash the data.
+			h := hashFor(p.alg).New()
+			h.Write(signingInput)
+			return p.session.Sign(p.label, MechanismECDSA, h.Sum(nil))
+		}
+		return p.session.Sign(p.label, rsaMechanism(p.alg), signingInput)
+	})
+}
+
+func rsaMechanism(alg jose.SignatureAlgorithm) Mechanism {
+	switch alg {
+	case jose.RS384:
+		return MechanismSHA384RSAPKCS
+	case jose.RS512:
+		return MechanismSHA512RSAPKCS
+	case jose.PS256:
+		return MechanismSHA256RSAPKCSPSS
+	case jose.PS384:
+		return MechanismSHA384RSAPKCSPSS
+	case jose.PS512:
+		return MechanismSHA512RSAPKCSPSS
+	}
+	return MechanismSHA256RSAPKCS
+}
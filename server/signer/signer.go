@@ -0,0 +1,204 @@
+// Package signer implements strategies for signing tokens with keys which aren't
+// generated by the server or held in its storage.
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Signer signs tokens on behalf of the server. The private key never leaves the
+// signer, the server only ever sees signatures and public keys.
+type Signer interface {
+	// Algorithm returns the algorithm of the signatures, e.g. "ES256".
+	Algorithm() jose.SignatureAlgorithm
+
+	// PublicKey returns the key which verifies the signer's current signatures.
+	// It changes if the signer's private key is replaced.
+	PublicKey() (*jose.JSONWebKey, error)
+
+	// Sign signs the payload, returning a JWS in compact serialization. If typ
+	// isn't empty it's set as the "typ" header, e.g. "at+jwt" for access tokens.
+	Sign(typ string, payload []byte) (string, error)
+}
+
+// NewSigner returns a signer which signs with the key. This can be used with any
+// key implementing crypto.Signer, such as keys held by a key management service.
+//
+// If alg is empty it's inferred from the key type.
+func NewSigner(key crypto.Signer, alg jose.SignatureAlgorithm) (Signer, error) {
+	return newCryptoSigner(key, alg)
+}
+
+// NewJWKSigner returns a signer which signs with a private JSON Web Key, such as
+// the keys the server generates and stores. The key ID of the key is kept.
+func NewJWKSigner(key *jose.JSONWebKey, alg jose.SignatureAlgorithm) (Signer, error) {
+	priv, ok := key.Key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key.Key)
+	}
+	pub, err := publicKey(priv.Public(), alg)
+	if err != nil {
+		return nil, err
+	}
+	pub.KeyID = key.KeyID
+	return &cryptoSigner{key: priv, alg: alg, pub: pub}, nil
+}
+
+type cryptoSigner struct {
+	key crypto.Signer
+	alg jose.SignatureAlgorithm
+	pub *jose.JSONWebKey
+}
+
+func newCryptoSigner(key crypto.Signer, alg jose.SignatureAlgorithm) (*cryptoSigner, error) {
+	if alg == "" {
+		var err error
+		if alg, err = defaultAlgorithm(key.Public()); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := publicKey(key.Public(), alg)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptoSigner{key: key, alg: alg, pub: pub}, nil
+}
+
+func (c *cryptoSigner) Algorithm() jose.SignatureAlgorithm { return c.alg }
+
+func (c *cryptoSigner) PublicKey() (*jose.JSONWebKey, error) { return c.pub, nil }
+
+func (c *cryptoSigner) Sign(typ string, payload []byte) (string, error) {
+	return signJWS(c.alg, c.pub.KeyID, typ, payload, func(signingInput []byte) ([]byte, error) {
+		hash := hashFor(c.alg)
+		h := hash.New()
+		h.Write(signingInput)
+		digest := h.Sum(nil)
+
+		var opts crypto.SignerOpts = hash
+		if isPSS(c.alg) {
+			opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+		}
+		signature, err := c.key.Sign(rand.Reader, digest, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// crypto.Signer returns ASN.1 encoded ECDSA signatures, JWS uses the
+		// concatenated values of r and s.
+		if pub, ok := c.key.Public().(*ecdsa.PublicKey); ok {
+			var sig struct{ R, S *big.Int }
+			if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+				return nil, fmt.Errorf("malformed ecdsa signature: %v", err)
+			}
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			r, s := sig.R.Bytes(), sig.S.Bytes()
+			copy(signature[size-len(r):size], r)
+			copy(signature[2*size-len(s):], s)
+		}
+		return signature, nil
+	})
+}
+
+// signJWS builds a JWS in compact serialization. The sign function is passed the
+// JWS signing input and returns the signature over it.
+func signJWS(alg jose.SignatureAlgorithm, keyID, typ string, payload []byte, sign func(signingInput []byte) ([]byte, error)) (string, error) {
+	header, err := json.Marshal(struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid,omitempty"`
+		Type      string `json:"typ,omitempty"`
+	}{string(alg), keyID, typ})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("signing payload: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// publicKey returns the JSON Web Key of a public key signing with the algorithm.
+// The key ID is the key's thumbprint, so all servers sharing a key agree on it.
+func publicKey(pub crypto.PublicKey, alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error) {
+	if err := checkKey(pub, alg); err != nil {
+		return nil, err
+	}
+	jwk := &jose.JSONWebKey{
+		Key:       pub,
+		Algorithm: string(alg),
+		Use:       "sig",
+	}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("computing key thumbprint: %v", err)
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return jwk, nil
+}
+
+// defaultAlgorithm returns the algorithm keys of this type usually sign with.
+func defaultAlgorithm(pub crypto.PublicKey) (jose.SignatureAlgorithm, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jose.RS256, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", errors.New("unsupported ecdsa curve")
+	}
+	return "", fmt.Errorf("unsupported key type %T", pub)
+}
+
+// checkKey returns an error if the key can't sign with the algorithm.
+func checkKey(pub crypto.PublicKey, alg jose.SignatureAlgorithm) error {
+	switch alg {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		if _, ok := pub.(*rsa.PublicKey); !ok {
+			return fmt.Errorf("%s requires an rsa key, got %T", alg, pub)
+		}
+		return nil
+	case jose.ES256, jose.ES384, jose.ES512:
+		if want, err := defaultAlgorithm(pub); err != nil || want != alg {
+			return fmt.Errorf("%s requires an ecdsa key on its curve", alg)
+		}
+		return nil
+	case "EdDSA":
+		return errors.New("EdDSA is not supported, the JOSE library can't sign or verify Ed25519 keys")
+	}
+	return fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+func hashFor(alg jose.SignatureAlgorithm) crypto.Hash {
+	switch alg {
+	case jose.RS384, jose.PS384, jose.ES384:
+		return crypto.SHA384
+	case jose.RS512, jose.PS512, jose.ES512:
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
+func isPSS(alg jose.SignatureAlgorithm) bool {
+	return alg == jose.PS256 || alg == jose.PS384 || alg == jose.PS512
+}
@@ -0,0 +1,303 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+var logger = &logrus.Logger{
+	Out:       os.Stderr,
+	Formatter: &logrus.TextFormatter{DisableColors: true},
+	Level:     logrus.DebugLevel,
+}
+
+func mustGenerate(t *testing.T, alg jose.SignatureAlgorithm) crypto.Signer {
+	var (
+		key crypto.Signer
+		err error
+	)
+	switch alg {
+	case jose.ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.ES384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jose.ES512:
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	default:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// checkSignature verifies a signature from the signer against its public key.
+func checkSignature(t *testing.T, s Signer) error {
+	payload := []byte(`{"sub":"foo"}`)
+	jwt, err := s.Sign("at+jwt", payload)
+	if err != nil {
+		return fmt.Errorf("sign: %v", err)
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(strings.SplitN(jwt, ".", 2)[0])
+	if err != nil {
+		return fmt.Errorf("decode header: %v", err)
+	}
+	var typHeader struct {
+		Type string `json:"typ"`
+	}
+	if err := json.Unmarshal(rawHeader, &typHeader); err != nil {
+		return fmt.Errorf("unmarshal header: %v", err)
+	}
+	if typHeader.Type != "at+jwt" {
+		return fmt.Errorf("expected typ at+jwt, got %q", typHeader.Type)
+	}
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return fmt.Errorf("parse signed payload: %v", err)
+	}
+	pub, err := s.PublicKey()
+	if err != nil {
+		return fmt.Errorf("get public key: %v", err)
+	}
+	header := jws.Signatures[0].Header
+	if header.Algorithm != string(s.Algorithm()) {
+		return fmt.Errorf("expected alg %s, got %s", s.Algorithm(), header.Algorithm)
+	}
+	if header.KeyID != pub.KeyID {
+		return fmt.Errorf("expected kid %s, got %s", pub.KeyID, header.KeyID)
+	}
+	got, err := jws.Verify(pub)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	if string(got) != string(payload) {
+		return fmt.Errorf("expected payload %s, got %s", payload, got)
+	}
+	return nil
+}
+
+var algorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+}
+
+func TestSigner(t *testing.T) {
+	for _, alg := range algorithms {
+		s, err := NewSigner(mustGenerate(t, alg), alg)
+		if err != nil {
+			t.Errorf("%s: new signer: %v", alg, err)
+			continue
+		}
+		if err := checkSignature(t, s); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+	}
+
+	// The algorithm defaults to the key's.
+	s, err := NewSigner(mustGenerate(t, jose.ES384), "")
+	if err != nil {
+		t.Fatalf("new signer: %v", err)
+	}
+	if alg := s.Algorithm(); alg != jose.ES384 {
+		t.Errorf("expected default algorithm ES384, got %s", alg)
+	}
+
+	if _, err := NewSigner(mustGenerate(t, jose.ES256), jose.ES384); err == nil {
+		t.Errorf("expected ES384 signer with a P-256 key to be rejected")
+	}
+	if _, err := NewSigner(mustGenerate(t, jose.RS256), jose.ES256); err == nil {
+		t.Errorf("expected ES256 signer with an RSA key to be rejected")
+	}
+	if _, err := NewSigner(mustGenerate(t, jose.ES256), "EdDSA"); err == nil {
+		t.Errorf("expected EdDSA signer to be rejected")
+	}
+}
+
+func TestJWKSigner(t *testing.T) {
+	for _, alg := range algorithms {
+		key := &jose.JSONWebKey{Key: mustGenerate(t, alg), KeyID: "foo", Algorithm: string(alg), Use: "sig"}
+		s, err := NewJWKSigner(key, alg)
+		if err != nil {
+			t.Errorf("%s: new signer: %v", alg, err)
+			continue
+		}
+		pub, err := s.PublicKey()
+		if err != nil {
+			t.Errorf("%s: get public key: %v", alg, err)
+			continue
+		}
+		if pub.KeyID != "foo" {
+			t.Errorf("%s: expected kid foo, got %s", alg, pub.KeyID)
+		}
+		if err := checkSignature(t, s); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+	}
+
+	pub := &jose.JSONWebKey{Key: mustGenerate(t, jose.RS256).Public(), KeyID: "foo"}
+	if _, err := NewJWKSigner(pub, jose.RS256); err == nil {
+		t.Errorf("expected a public key to be rejected")
+	}
+}
+
+func writeKey(t *testing.T, path string, key crypto.Signer, modTime time.Time) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	writeFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), modTime)
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("change file times: %v", err)
+	}
+}
+
+func TestFileSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.pem")
+
+	modTime := time.Now().Add(-time.Hour)
+	writeKey(t, path, mustGenerate(t, jose.ES256), modTime)
+
+	s, err := NewFileSigner(path, "", logger)
+	if err != nil {
+		t.Fatalf("new file signer: %v", err)
+	}
+	if alg := s.Algorithm(); alg != jose.ES256 {
+		t.Errorf("expected algorithm ES256, got %s", alg)
+	}
+	if err := checkSignature(t, s); err != nil {
+		t.Fatal(err)
+	}
+	pub1, _ := s.PublicKey()
+
+	// Replacing the key is picked up.
+	modTime = modTime.Add(time.Minute)
+	writeKey(t, path, mustGenerate(t, jose.ES256), modTime)
+	pub2, err := s.PublicKey()
+	if err != nil {
+		t.Fatalf("get public key: %v", err)
+	}
+	if pub1.KeyID == pub2.KeyID {
+		t.Errorf("expected new key to be loaded after the file changed")
+	}
+	if err := checkSignature(t, s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files which can't be loaded, or hold keys for another algorithm, are ignored.
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, path, []byte("not a key"), modTime)
+	if pub, _ := s.PublicKey(); pub.KeyID != pub2.KeyID {
+		t.Errorf("expected previous key to be kept when the file is invalid")
+	}
+	modTime = modTime.Add(time.Minute)
+	writeKey(t, path, mustGenerate(t, jose.RS256), modTime)
+	if pub, _ := s.PublicKey(); pub.KeyID != pub2.KeyID {
+		t.Errorf("expected previous key to be kept when the algorithm changes")
+	}
+	if err := checkSignature(t, s); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileSigner(filepath.Join(dir, "missing.pem"), "", logger); err == nil {
+		t.Errorf("expected missing key file to be rejected")
+	}
+}
+
+// pkcs11Session is a fake hardware security module holding keys in memory.
+type pkcs11Session map[string]crypto.Signer
+
+func (p pkcs11Session) PublicKey(label string) (crypto.PublicKey, error) {
+	key, ok := p[label]
+	if !ok {
+		return nil, fmt.Errorf("no object with label %q", label)
+	}
+	return key.Public(), nil
+}
+
+func (p pkcs11Session) Sign(label string, mechanism Mechanism, data []byte) ([]byte, error) {
+	hashes := map[Mechanism]crypto.Hash{
+		MechanismSHA256RSAPKCS: crypto.SHA256, MechanismSHA256RSAPKCSPSS: crypto.SHA256,
+		MechanismSHA384RSAPKCS: crypto.SHA384, MechanismSHA384RSAPKCSPSS: crypto.SHA384,
+		MechanismSHA512RSAPKCS: crypto.SHA512, MechanismSHA512RSAPKCSPSS: crypto.SHA512,
+	}
+
+	switch key := p[label].(type) {
+	case *ecdsa.PrivateKey:
+		if mechanism != MechanismECDSA {
+			return nil, fmt.Errorf("mechanism %#x invalid for ecdsa key", mechanism)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, data)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		copy(signature[size-len(r.Bytes()):size], r.Bytes())
+		copy(signature[2*size-len(s.Bytes()):], s.Bytes())
+		return signature, nil
+	case *rsa.PrivateKey:
+		hash, ok := hashes[mechanism]
+		if !ok {
+			return nil, fmt.Errorf("mechanism %#x invalid for rsa key", mechanism)
+		}
+		h := hash.New()
+		h.Write(data)
+		if mechanism >= MechanismSHA256RSAPKCSPSS {
+			return rsa.SignPSS(rand.Reader, key, hash, h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	}
+	return nil, fmt.Errorf("no object with label %q", label)
+}
+
+func TestPKCS11Signer(t *testing.T) {
+	session := make(pkcs11Session)
+	for _, alg := range algorithms {
+		session[string(alg)] = mustGenerate(t, alg)
+	}
+
+	for _, alg := range algorithms {
+		s, err := NewPKCS11Signer(session, string(alg), alg)
+		if err != nil {
+			t.Errorf("%s: new signer: %v", alg, err)
+			continue
+		}
+		if err := checkSignature(t, s); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+	}
+
+	if _, err := NewPKCS11Signer(session, "missing", jose.RS256); err == nil {
+		t.Errorf("expected missing key to be rejected")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -18,6 +19,12 @@ const (
 	tmplPassword = "password.html"
 	tmplOOB      = "oob.html"
 	tmplError    = "error.html"
+	tmplLogout   = "logout.html"
+
+	tmplDevice        = "device.html"
+	tmplDeviceSuccess = "device_success.html"
+
+	tmplFormPost = "form_post.html"
 )
 
 var requiredTmpls = []string{
@@ -28,12 +35,86 @@ var requiredTmpls = []string{
 	tmplError,
 }
 
+// defaultTmpls are used for templates missing from the templates directory, so
+// themes written before these pages existed keep working. They don't depend on
+// the theme's other templates.
+var defaultTmpls = map[string]string{
+	tmplLogout: `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>{{ issuer }}</title>
+  </head>
+  <body>
+    <h2>Logout Successful</h2>
+    <p>You have been logged out. You may now close this window.</p>
+  </body>
+</html>
+`,
+	tmplDevice: `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>{{ issuer }}</title>
+  </head>
+  <body>
+    <h2>Enter User Code</h2>
+    <p>Enter the code displayed on your device to continue logging in.</p>
+    <form method="post" action="{{ .PostURL }}">
+      <label for="user_code">User Code</label>
+      <input required id="user_code" name="user_code" type="text" placeholder="XXXX-XXXX" autocomplete="off" {{ if .UserCode }} value="{{ .UserCode | html }}" {{ end }} autofocus/>
+      {{ if .Invalid }}
+      <p>Invalid or expired user code.</p>
+      {{ end }}
+      <button type="submit">Submit</button>
+    </form>
+  </body>
+</html>
+`,
+	tmplDeviceSuccess: `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>{{ issuer }}</title>
+  </head>
+  <body>
+    <h2>Login Successful</h2>
+    <p>{{ .Client | html }} has been granted access. You may now close this window and return to your device.</p>
+  </body>
+</html>
+`,
+	tmplFormPost: `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Submit This Form</title>
+  </head>
+  <body onload="document.forms[0].submit()">
+    <form method="post" action="{{ .RedirectURI | html }}">
+      {{ range $name, $values := .Values }}{{ range $values }}
+      <input type="hidden" name="{{ $name | html }}" value="{{ . | html }}"/>
+      {{ end }}{{ end }}
+      <noscript>
+        <button type="submit">Continue</button>
+      </noscript>
+    </form>
+  </body>
+</html>
+`,
+}
+
 type templates struct {
 	loginTmpl    *template.Template
 	approvalTmpl *template.Template
 	passwordTmpl *template.Template
 	oobTmpl      *template.Template
 	errorTmpl    *template.Template
+	logoutTmpl   *template.Template
+
+	deviceTmpl        *template.Template
+	deviceSuccessTmpl *template.Template
+
+	formPostTmpl *template.Template
 }
 
 type webConfig struct {
@@ -117,7 +198,8 @@ func loadWebConfig(c webConfig) (static, theme http.Handler, templates *template
 	return
 }
 
-// loadTemplates parses the expected templates from the provided directory.
+// loadTemplates parses the expected templates from the provided directory, falling
+// back to the default templates for optional ones the directory doesn't have.
 func loadTemplates(c webConfig, templatesDir string) (*templates, error) {
 	files, err := ioutil.ReadDir(templatesDir)
 	if err != nil {
@@ -154,12 +236,26 @@ func loadTemplates(c webConfig, templatesDir string) (*templates, error) {
 	if len(missingTmpls) > 0 {
 		return nil, fmt.Errorf("missing template(s): %s", missingTmpls)
 	}
+	for tmplName, text := range defaultTmpls {
+		if tmpls.Lookup(tmplName) != nil {
+			continue
+		}
+		if _, err := tmpls.New(tmplName).Parse(text); err != nil {
+			return nil, fmt.Errorf("parse default template %s: %v", tmplName, err)
+		}
+	}
 	return &templates{
 		loginTmpl:    tmpls.Lookup(tmplLogin),
 		approvalTmpl: tmpls.Lookup(tmplApproval),
 		passwordTmpl: tmpls.Lookup(tmplPassword),
 		oobTmpl:      tmpls.Lookup(tmplOOB),
 		errorTmpl:    tmpls.Lookup(tmplError),
+		logoutTmpl:   tmpls.Lookup(tmplLogout),
+
+		deviceTmpl:        tmpls.Lookup(tmplDevice),
+		deviceSuccessTmpl: tmpls.Lookup(tmplDeviceSuccess),
+
+		formPostTmpl: tmpls.Lookup(tmplFormPost),
 	}, nil
 }
 
@@ -234,6 +330,35 @@ func (t *templates) err(w http.ResponseWriter, errType string, errMsg string) er
 	return renderTemplate(w, t.errorTmpl, data)
 }
 
+func (t *templates) logout(w http.ResponseWriter) error {
+	return renderTemplate(w, t.logoutTmpl, nil)
+}
+
+func (t *templates) device(w http.ResponseWriter, postURL, userCode string, lastWasInvalid bool) error {
+	data := struct {
+		PostURL  string
+		UserCode string
+		Invalid  bool
+	}{postURL, userCode, lastWasInvalid}
+	return renderTemplate(w, t.deviceTmpl, data)
+}
+
+func (t *templates) deviceSuccess(w http.ResponseWriter, clientName string) error {
+	data := struct {
+		Client string
+	}{clientName}
+	return renderTemplate(w, t.deviceSuccessTmpl, data)
+}
+
+// formPost renders a form which immediately posts the values to the redirect URI.
+func (t *templates) formPost(w http.ResponseWriter, redirectURI string, values url.Values) error {
+	data := struct {
+		RedirectURI string
+		Values      url.Values
+	}{redirectURI, values}
+	return renderTemplate(w, t.formPostTmpl, data)
+}
+
 // small io.Writer utility to determine if executing the template wrote to the underlying response writer.
 type writeRecorder struct {
 	wrote bool
@@ -1 +1,141 @@
 package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplatesEscape(t *testing.T) {
+	dir := filepath.Join(os.Getenv("GOPATH"), "src/github.com/coreos/dex/web/templates")
+	tmpls, err := loadTemplates(webConfig{issuerURL: "https://dex.example.com"}, dir)
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	// Values which may come from outside callers, such as client names set through
+	// dynamic registration, must be escaped.
+	const script = `"><script>alert(1)</script>`
+	tests := []struct {
+		name   string
+		render func(w *httptest.ResponseRecorder) error
+	}{
+		{
+			name: "approval client name",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.approval(w, "req", "jane", script, []string{"openid"})
+			},
+		},
+		{
+			name: "password login hint",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.password(w, "req", "/auth/local", script, false)
+			},
+		},
+		{
+			name: "error message",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.err(w, "Bad Request", "Invalid prompt value "+script)
+			},
+		},
+		{
+			name: "device user code",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.device(w, "/device", script, true)
+			},
+		},
+		{
+			name: "device success client name",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.deviceSuccess(w, script)
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		if err := tc.render(w); err != nil {
+			t.Errorf("%s: failed to render template: %v", tc.name, err)
+			continue
+		}
+		if body := w.Body.String(); strings.Contains(body, "<script>") {
+			t.Errorf("%s: expected value to be escaped, got %s", tc.name, body)
+		}
+	}
+}
+
+func TestTemplatesDefaults(t *testing.T) {
+	webDir := filepath.Join(os.Getenv("GOPATH"), "src/github.com/coreos/dex/web/templates")
+	dir, err := ioutil.TempDir("", "dex-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A theme which only has the templates required before the optional ones
+	// were added.
+	for _, name := range append([]string{"header.html", "footer.html"}, requiredTmpls...) {
+		data, err := ioutil.ReadFile(filepath.Join(webDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpls, err := loadTemplates(webConfig{issuerURL: "https://dex.example.com"}, dir)
+	if err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+
+	const script = `"><script>alert(1)</script>`
+	tests := []struct {
+		name   string
+		render func(w *httptest.ResponseRecorder) error
+	}{
+		{
+			name: "logout",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.logout(w)
+			},
+		},
+		{
+			name: "device",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.device(w, "/device", script, true)
+			},
+		},
+		{
+			name: "device success",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.deviceSuccess(w, script)
+			},
+		},
+		{
+			name: "form post",
+			render: func(w *httptest.ResponseRecorder) error {
+				return tmpls.formPost(w, "https://example.com/callback", url.Values{"state": {script}})
+			},
+		},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		if err := tc.render(w); err != nil {
+			t.Errorf("%s: failed to render template: %v", tc.name, err)
+			continue
+		}
+		if body := w.Body.String(); strings.Contains(body, "<script>") {
+			t.Errorf("%s: expected value to be escaped, got %s", tc.name, body)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, tmplLogin)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTemplates(webConfig{}, dir); err == nil {
+		t.Errorf("expected missing %s to be rejected", tmplLogin)
+	}
+}
@@ -1,3 +1,4 @@
+//go:build go1.7
 // +build go1.7
 
 // Package conformance provides conformance tests for storage implementations.
@@ -47,6 +48,9 @@ func RunTests(t *testing.T, newStorage func() storage.Storage) {
 		{"RefreshTokenCRUD", testRefreshTokenCRUD},
 		{"PasswordCRUD", testPasswordCRUD},
 		{"KeysCRUD", testKeysCRUD},
+		{"DeviceRequestCRUD", testDeviceRequestCRUD},
+		{"DeviceTokenCRUD", testDeviceTokenCRUD},
+		{"ClientAssertion", testClientAssertion},
 		{"GarbageCollection", testGC},
 		{"TimezoneSupport", testTimezones},
 	})
@@ -78,7 +82,9 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 		RedirectURI:         "https://localhost:80/callback",
 		Nonce:               "foo",
 		State:               "bar",
+		ResponseMode:        "form_post",
 		ForceApprovalPrompt: true,
+		LoginHint:           "jane.doe@example.com",
 		LoggedIn:            true,
 		Expiry:              neverExpire,
 		ConnectorID:         "ldap",
@@ -89,10 +95,28 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 			Email:         "jane.doe@example.com",
 			EmailVerified: true,
 			Groups:        []string{"a", "b"},
+			CustomClaims: map[string]interface{}{
+				"employeeNumber": "12345",
+				"roles":          []interface{}{"admin", "dev"},
+			},
+		},
+		PKCE: storage.PKCE{
+			CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+			CodeChallengeMethod: "S256",
+		},
+		ClaimsRequest: storage.ClaimsRequest{
+			IDToken: map[string]*storage.ClaimRequest{
+				"email":  nil,
+				"groups": {Essential: true},
+			},
+			UserInfo: map[string]*storage.ClaimRequest{
+				"name": {Values: []interface{}{"jane", "jdoe"}},
+			},
 		},
 	}
 
 	identity := storage.Claims{Email: "foobar"}
+	authTime := time.Now().UTC()
 
 	if err := s.CreateAuthRequest(a); err != nil {
 		t.Fatalf("failed creating auth request: %v", err)
@@ -100,6 +124,7 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 	if err := s.UpdateAuthRequest(a.ID, func(old storage.AuthRequest) (storage.AuthRequest, error) {
 		old.Claims = identity
 		old.ConnectorID = "connID"
+		old.AuthTime = authTime
 		return old, nil
 	}); err != nil {
 		t.Fatalf("failed to update auth request: %v", err)
@@ -112,6 +137,18 @@ func testAuthRequestCRUD(t *testing.T, s storage.Storage) {
 	if !reflect.DeepEqual(got.Claims, identity) {
 		t.Fatalf("update failed, wanted identity=%#v got %#v", identity, got.Claims)
 	}
+	if got.PKCE != a.PKCE {
+		t.Errorf("auth request PKCE did not match, wanted %#v got %#v", a.PKCE, got.PKCE)
+	}
+	if got.LoginHint != a.LoginHint {
+		t.Errorf("auth request login hint did not match, wanted %q got %q", a.LoginHint, got.LoginHint)
+	}
+	if got.ResponseMode != a.ResponseMode {
+		t.Errorf("auth request response mode did not match, wanted %q got %q", a.ResponseMode, got.ResponseMode)
+	}
+	if got.AuthTime.Unix() != authTime.Unix() {
+		t.Errorf("auth request auth time did not match, wanted %s got %s", authTime, got.AuthTime)
+	}
 }
 
 func testAuthCodeCRUD(t *testing.T, s storage.Storage) {
@@ -122,6 +159,7 @@ func testAuthCodeCRUD(t *testing.T, s storage.Storage) {
 		Nonce:         "foobar",
 		Scopes:        []string{"openid", "email"},
 		Expiry:        neverExpire,
+		AuthTime:      time.Now().UTC(),
 		ConnectorID:   "ldap",
 		ConnectorData: []byte(`{"some":"data"}`),
 		Claims: storage.Claims{
@@ -130,6 +168,23 @@ func testAuthCodeCRUD(t *testing.T, s storage.Storage) {
 			Email:         "jane.doe@example.com",
 			EmailVerified: true,
 			Groups:        []string{"a", "b"},
+			CustomClaims: map[string]interface{}{
+				"employeeNumber": "12345",
+				"roles":          []interface{}{"admin", "dev"},
+			},
+		},
+		PKCE: storage.PKCE{
+			CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+			CodeChallengeMethod: "S256",
+		},
+		ClaimsRequest: storage.ClaimsRequest{
+			IDToken: map[string]*storage.ClaimRequest{
+				"email":  nil,
+				"groups": {Essential: true},
+			},
+			UserInfo: map[string]*storage.ClaimRequest{
+				"name": {Values: []interface{}{"jane", "jdoe"}},
+			},
 		},
 	}
 
@@ -144,7 +199,11 @@ func testAuthCodeCRUD(t *testing.T, s storage.Storage) {
 	if a.Expiry.Unix() != got.Expiry.Unix() {
 		t.Errorf("auth code expiry did not match want=%s vs got=%s", a.Expiry, got.Expiry)
 	}
+	if a.AuthTime.Unix() != got.AuthTime.Unix() {
+		t.Errorf("auth code auth time did not match want=%s vs got=%s", a.AuthTime, got.AuthTime)
+	}
 	got.Expiry = a.Expiry // time fields do not compare well
+	got.AuthTime = a.AuthTime
 	if diff := pretty.Compare(a, got); diff != "" {
 		t.Errorf("auth code retrieved from storage did not match: %s", diff)
 	}
@@ -162,9 +221,31 @@ func testClientCRUD(t *testing.T, s storage.Storage) {
 	c := storage.Client{
 		ID:           id,
 		Secret:       "foobar",
+		SecretHash:   "$2a$10$33EMT0cVYVlPy6WAMCLsceLYjWhuHpbz5yuZxu/GAFj03J9Lytjuy",
 		RedirectURIs: []string{"foo://bar.com/", "https://auth.example.com"},
 		Name:         "dex client",
 		LogoURL:      "https://goo.gl/JIyzIC",
+
+		AllowClientCredentials: true,
+		AllowedScopes:          []string{"openid", "groups"},
+		AllowPasswordGrant:     true,
+
+		JWKS: &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{*jsonWebKeys[0].Public},
+		},
+		JWKSURI:                  "https://example.com/jwks.json",
+		RequestURIs:              []string{"https://example.com/request.jwt"},
+		TokenEndpointAuthMethod:  "private_key_jwt",
+		IDTokenSignedResponseAlg: "RS256",
+		SubjectType:              "pairwise",
+		SectorIdentifier:         "example.com",
+		ClaimMappings: []storage.ClaimMapping{
+			{Claim: "employee_id", From: "employeeNumber", Scope: "profile"},
+			{Claim: "github_email", Template: "{{.login}}@users.noreply.github.com"},
+		},
+		TLSClientAuthSubjectDN:         "CN=client,O=Example",
+		TLSClientCertificateThumbprint: "A4DtL2JmUMhAsvJj5tKyn64SqzmuXbMrJa0n761y5v0",
+		RegistrationAccessTokenHash:    "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU",
 	}
 	err := s.DeleteClient(id)
 	mustBeErrNotFound(t, "client", err)
@@ -197,6 +278,17 @@ func testClientCRUD(t *testing.T, s storage.Storage) {
 	c.Secret = newSecret
 	getAndCompare(id, c)
 
+	postLogoutRedirectURIs := []string{"https://auth.example.com/logged-out"}
+	err = s.UpdateClient(id, func(old storage.Client) (storage.Client, error) {
+		old.PostLogoutRedirectURIs = postLogoutRedirectURIs
+		return old, nil
+	})
+	if err != nil {
+		t.Errorf("update client: %v", err)
+	}
+	c.PostLogoutRedirectURIs = postLogoutRedirectURIs
+	getAndCompare(id, c)
+
 	if err := s.DeleteClient(id); err != nil {
 		t.Fatalf("delete client: %v", err)
 	}
@@ -218,7 +310,22 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 			Email:         "jane.doe@example.com",
 			EmailVerified: true,
 			Groups:        []string{"a", "b"},
+			CustomClaims: map[string]interface{}{
+				"employeeNumber": "12345",
+				"roles":          []interface{}{"admin", "dev"},
+			},
+		},
+		AuthTime: time.Now().UTC(),
+		ClaimsRequest: storage.ClaimsRequest{
+			IDToken: map[string]*storage.ClaimRequest{"email": nil},
 		},
+		CertThumbprint: "A4DtL2JmUMhAsvJj5tKyn64SqzmuXbMrJa0n761y5v0",
+		FamilyID:       storage.NewID(),
+		Rotated:        true,
+		NextToken:      storage.NewID(),
+		CreatedAt:      time.Now().UTC().Add(-time.Hour),
+		LastUsed:       time.Now().UTC(),
+		Expiry:         time.Now().UTC().Add(time.Hour),
 	}
 	if err := s.CreateRefresh(refresh); err != nil {
 		t.Fatalf("create refresh token: %v", err)
@@ -230,6 +337,21 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 			t.Errorf("get refresh: %v", err)
 			return
 		}
+		times := []struct {
+			name      string
+			want, got *time.Time
+		}{
+			{"auth time", &want.AuthTime, &gr.AuthTime},
+			{"created at", &want.CreatedAt, &gr.CreatedAt},
+			{"last used", &want.LastUsed, &gr.LastUsed},
+			{"expiry", &want.Expiry, &gr.Expiry},
+		}
+		for _, tt := range times {
+			if tt.want.Unix() != tt.got.Unix() {
+				t.Errorf("refresh token %s did not match want=%s vs got=%s", tt.name, *tt.want, *tt.got)
+			}
+			*tt.got = *tt.want // time fields do not compare well
+		}
 		if diff := pretty.Compare(want, gr); diff != "" {
 			t.Errorf("refresh token retrieved from storage did not match: %s", diff)
 		}
@@ -237,6 +359,32 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 
 	getAndCompare(id, refresh)
 
+	lastUsed := time.Now().UTC().Add(time.Minute)
+	err := s.UpdateRefreshToken(id, func(old storage.RefreshToken) (storage.RefreshToken, error) {
+		old.Rotated = false
+		old.LastUsed = lastUsed
+		return old, nil
+	})
+	if err != nil {
+		t.Errorf("update refresh token: %v", err)
+	}
+	refresh.Rotated = false
+	refresh.LastUsed = lastUsed
+	getAndCompare(id, refresh)
+
+	err = s.UpdateRefreshToken(storage.NewID(), func(old storage.RefreshToken) (storage.RefreshToken, error) {
+		return old, nil
+	})
+	mustBeErrNotFound(t, "refresh token", err)
+
+	tokens, err := s.ListRefreshTokens()
+	if err != nil {
+		t.Fatalf("list refresh tokens: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].RefreshToken != id {
+		t.Errorf("expected to list refresh token %q, got %v", id, tokens)
+	}
+
 	if err := s.DeleteRefresh(id); err != nil {
 		t.Fatalf("failed to delete refresh request: %v", err)
 	}
@@ -244,6 +392,129 @@ func testRefreshTokenCRUD(t *testing.T, s storage.Storage) {
 	if _, err := s.GetRefresh(id); err != storage.ErrNotFound {
 		t.Errorf("after deleting refresh expected storage.ErrNotFound, got %v", err)
 	}
+
+	// Revoking a token twice must be distinguishable from a storage failure.
+	err = s.DeleteRefresh(id)
+	mustBeErrNotFound(t, "refresh token", err)
+}
+
+func testDeviceRequestCRUD(t *testing.T, s storage.Storage) {
+	d := storage.DeviceRequest{
+		UserCode:   "BCDF-GHJK",
+		DeviceCode: storage.NewID(),
+		ClientID:   "client_id",
+		Scopes:     []string{"openid", "email"},
+		Expiry:     neverExpire,
+	}
+
+	if err := s.CreateDeviceRequest(d); err != nil {
+		t.Fatalf("failed creating device request: %v", err)
+	}
+
+	// A user code can't be issued twice while it's valid.
+	if err := s.CreateDeviceRequest(d); err == nil {
+		t.Errorf("expected error creating device request with existing user code")
+	}
+
+	got, err := s.GetDeviceRequest(d.UserCode)
+	if err != nil {
+		t.Fatalf("failed to get device request: %v", err)
+	}
+	if d.Expiry.Unix() != got.Expiry.Unix() {
+		t.Errorf("device request expiry did not match want=%s vs got=%s", d.Expiry, got.Expiry)
+	}
+	got.Expiry = d.Expiry // time fields do not compare well
+	if diff := pretty.Compare(d, got); diff != "" {
+		t.Errorf("device request retrieved from storage did not match: %s", diff)
+	}
+
+	_, err = s.GetDeviceRequest("CDFG-HJKL")
+	if err != storage.ErrNotFound {
+		t.Errorf("getting non-existent device request expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+func testDeviceTokenCRUD(t *testing.T, s storage.Storage) {
+	d := storage.DeviceToken{
+		DeviceCode:          storage.NewID(),
+		ClientID:            "client_id",
+		Status:              storage.DeviceTokenPending,
+		Expiry:              neverExpire,
+		LastRequestTime:     time.Now(),
+		PollIntervalSeconds: 5,
+	}
+
+	if err := s.CreateDeviceToken(d); err != nil {
+		t.Fatalf("failed creating device token: %v", err)
+	}
+
+	token := []byte(`{"access_token":"foo"}`)
+	if err := s.UpdateDeviceToken(d.DeviceCode, func(old storage.DeviceToken) (storage.DeviceToken, error) {
+		old.Status = storage.DeviceTokenComplete
+		old.Token = token
+		return old, nil
+	}); err != nil {
+		t.Fatalf("failed to update device token: %v", err)
+	}
+
+	got, err := s.GetDeviceToken(d.DeviceCode)
+	if err != nil {
+		t.Fatalf("failed to get device token: %v", err)
+	}
+	if got.Status != storage.DeviceTokenComplete {
+		t.Errorf("update failed, wanted status %q got %q", storage.DeviceTokenComplete, got.Status)
+	}
+	if string(got.Token) != string(token) {
+		t.Errorf("update failed, wanted token %s got %s", token, got.Token)
+	}
+	if got.ClientID != d.ClientID {
+		t.Errorf("device token client ID did not match want=%q vs got=%q", d.ClientID, got.ClientID)
+	}
+	if got.PollIntervalSeconds != d.PollIntervalSeconds {
+		t.Errorf("device token poll interval did not match want=%d vs got=%d", d.PollIntervalSeconds, got.PollIntervalSeconds)
+	}
+	if d.LastRequestTime.Unix() != got.LastRequestTime.Unix() {
+		t.Errorf("device token last request time did not match want=%s vs got=%s", d.LastRequestTime, got.LastRequestTime)
+	}
+
+	err = s.UpdateDeviceToken(storage.NewID(), func(old storage.DeviceToken) (storage.DeviceToken, error) {
+		return old, nil
+	})
+	if err != storage.ErrNotFound {
+		t.Errorf("updating non-existent device token expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+func testClientAssertion(t *testing.T, s storage.Storage) {
+	expiry := time.Now().UTC().Round(time.Millisecond)
+	a := storage.ClientAssertion{
+		ID:       storage.NewID(),
+		ClientID: "client_id",
+		Expiry:   expiry,
+	}
+	if err := s.CreateClientAssertion(a); err != nil {
+		t.Fatalf("failed creating client assertion: %v", err)
+	}
+	if err := s.CreateClientAssertion(a); err != storage.ErrAlreadyExists {
+		t.Errorf("creating existing client assertion expected storage.ErrAlreadyExists, got %v", err)
+	}
+
+	if r, err := s.GarbageCollect(expiry.Add(-time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.ClientAssertions != 0 {
+		t.Errorf("expected no client assertions to be garbage collected, got %#v", r)
+	}
+	if r, err := s.GarbageCollect(expiry.Add(time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.ClientAssertions != 1 {
+		t.Errorf("expected to garbage collect 1 client assertion, got %#v", r)
+	}
+
+	// Once the assertion has expired it's rejected by the server, so it's safe to
+	// forget it.
+	if err := s.CreateClientAssertion(a); err != nil {
+		t.Errorf("failed creating client assertion after GC: %v", err)
+	}
 }
 
 type byEmail []storage.Password
@@ -347,7 +618,13 @@ func testKeysCRUD(t *testing.T, s storage.Storage) {
 	keys1 := storage.Keys{
 		SigningKey:    jsonWebKeys[0].Private,
 		SigningKeyPub: jsonWebKeys[0].Public,
-		NextRotation:  n,
+		AdditionalSigningKeys: []storage.SigningKeyPair{
+			{
+				PrivateKey: jsonWebKeys[1].Private,
+				PublicKey:  jsonWebKeys[1].Public,
+			},
+		},
+		NextRotation: n,
 	}
 
 	keys2 := storage.Keys{
@@ -480,6 +757,125 @@ func testGC(t *testing.T, s storage.Storage) {
 	} else if err != storage.ErrNotFound {
 		t.Errorf("expected storage.ErrNotFound, got %v", err)
 	}
+
+	d := storage.DeviceRequest{
+		UserCode:   "BCDF-GHJK",
+		DeviceCode: storage.NewID(),
+		ClientID:   "foobar",
+		Scopes:     []string{"openid", "email"},
+		Expiry:     expiry,
+	}
+	if err := s.CreateDeviceRequest(d); err != nil {
+		t.Fatalf("failed creating device request: %v", err)
+	}
+	dt := storage.DeviceToken{
+		DeviceCode:          d.DeviceCode,
+		ClientID:            d.ClientID,
+		Status:              storage.DeviceTokenPending,
+		Expiry:              expiry,
+		LastRequestTime:     expiry,
+		PollIntervalSeconds: 5,
+	}
+	if err := s.CreateDeviceToken(dt); err != nil {
+		t.Fatalf("failed creating device token: %v", err)
+	}
+
+	for _, tz := range []*time.Location{time.UTC, est, pst} {
+		result, err := s.GarbageCollect(expiry.Add(-time.Hour).In(tz))
+		if err != nil {
+			t.Errorf("garbage collection failed: %v", err)
+		} else if result != (storage.GCResult{}) {
+			t.Errorf("expected no garbage collection results, got %#v", result)
+		}
+		if _, err := s.GetDeviceRequest(d.UserCode); err != nil {
+			t.Errorf("expected to be able to get device request after GC: %v", err)
+		}
+		if _, err := s.GetDeviceToken(dt.DeviceCode); err != nil {
+			t.Errorf("expected to be able to get device token after GC: %v", err)
+		}
+	}
+
+	if r, err := s.GarbageCollect(expiry.Add(time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.DeviceRequests != 1 || r.DeviceTokens != 1 {
+		t.Errorf("expected to garbage collect 1 device request and 1 device token, got %#v", r)
+	}
+
+	if _, err := s.GetDeviceRequest(d.UserCode); err != storage.ErrNotFound {
+		t.Errorf("expected device request to be GC'd, got %v", err)
+	}
+	if _, err := s.GetDeviceToken(dt.DeviceCode); err != storage.ErrNotFound {
+		t.Errorf("expected device token to be GC'd, got %v", err)
+	}
+
+	// Refresh tokens with a zero expiry never expire. Rotated tokens are
+	// collected along with the last token of their family.
+	refresh := storage.RefreshToken{
+		RefreshToken: storage.NewID(),
+		ClientID:     "foobar",
+		Scopes:       []string{"openid", "offline_access"},
+		FamilyID:     storage.NewID(),
+		Expiry:       expiry,
+	}
+	rotated := storage.RefreshToken{
+		RefreshToken: storage.NewID(),
+		ClientID:     "foobar",
+		FamilyID:     refresh.FamilyID,
+		Rotated:      true,
+		NextToken:    refresh.RefreshToken,
+	}
+	forever := storage.RefreshToken{
+		RefreshToken: storage.NewID(),
+		ClientID:     "foobar",
+		Scopes:       []string{"openid", "offline_access"},
+		FamilyID:     storage.NewID(),
+	}
+	foreverRotated := storage.RefreshToken{
+		RefreshToken: storage.NewID(),
+		ClientID:     "foobar",
+		FamilyID:     forever.FamilyID,
+		Rotated:      true,
+		NextToken:    forever.RefreshToken,
+	}
+	for _, r := range []storage.RefreshToken{refresh, rotated, forever, foreverRotated} {
+		if err := s.CreateRefresh(r); err != nil {
+			t.Fatalf("failed creating refresh token: %v", err)
+		}
+	}
+
+	for _, tz := range []*time.Location{time.UTC, est, pst} {
+		result, err := s.GarbageCollect(expiry.Add(-time.Hour).In(tz))
+		if err != nil {
+			t.Errorf("garbage collection failed: %v", err)
+		} else if result != (storage.GCResult{}) {
+			t.Errorf("expected no garbage collection results, got %#v", result)
+		}
+		if _, err := s.GetRefresh(refresh.RefreshToken); err != nil {
+			t.Errorf("expected to be able to get refresh token after GC: %v", err)
+		}
+		if _, err := s.GetRefresh(rotated.RefreshToken); err != nil {
+			t.Errorf("expected to be able to get rotated refresh token after GC: %v", err)
+		}
+	}
+
+	if r, err := s.GarbageCollect(expiry.Add(time.Hour)); err != nil {
+		t.Errorf("garbage collection failed: %v", err)
+	} else if r.RefreshTokens != 2 {
+		t.Errorf("expected to garbage collect 2 refresh tokens, got %#v", r)
+	}
+
+	if _, err := s.GetRefresh(refresh.RefreshToken); err != storage.ErrNotFound {
+		t.Errorf("expected refresh token to be GC'd, got %v", err)
+	}
+	if _, err := s.GetRefresh(rotated.RefreshToken); err != storage.ErrNotFound {
+		t.Errorf("expected rotated refresh token to be GC'd with its family, got %v", err)
+	}
+	if _, err := s.GetRefresh(forever.RefreshToken); err != nil {
+		t.Errorf("expected refresh token without expiry to survive GC: %v", err)
+	}
+	if _, err := s.GetRefresh(foreverRotated.RefreshToken); err != nil {
+		t.Errorf("expected rotated refresh token of a live family to survive GC: %v", err)
+	}
 }
 
 // testTimezones tests that backends either fully support timezones or
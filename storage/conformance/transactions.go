@@ -24,6 +24,7 @@ func RunTransactionTests(t *testing.T, newStorage func() storage.Storage) {
 		{"ClientConcurrentUpdate", testClientConcurrentUpdate},
 		{"PasswordConcurrentUpdate", testPasswordConcurrentUpdate},
 		{"KeysConcurrentUpdate", testKeysConcurrentUpdate},
+		{"RefreshTokenConcurrentUpdate", testRefreshTokenConcurrentUpdate},
 	})
 }
 
@@ -99,6 +100,35 @@ func testAuthRequestConcurrentUpdate(t *testing.T, s storage.Storage) {
 	}
 }
 
+func testRefreshTokenConcurrentUpdate(t *testing.T, s storage.Storage) {
+	r := storage.RefreshToken{
+		RefreshToken: storage.NewID(),
+		ClientID:     "client_id",
+		ConnectorID:  "mock",
+		Scopes:       []string{"openid", "offline_access"},
+		Claims:       storage.Claims{UserID: "1"},
+		FamilyID:     storage.NewID(),
+	}
+	if err := s.CreateRefresh(r); err != nil {
+		t.Fatalf("create refresh token: %v", err)
+	}
+
+	var err1, err2 error
+
+	err1 = s.UpdateRefreshToken(r.RefreshToken, func(old storage.RefreshToken) (storage.RefreshToken, error) {
+		old.Rotated = true
+		err2 = s.UpdateRefreshToken(r.RefreshToken, func(old storage.RefreshToken) (storage.RefreshToken, error) {
+			old.Rotated = true
+			return old, nil
+		})
+		return old, nil
+	})
+
+	if (err1 == nil) == (err2 == nil) {
+		t.Errorf("update refresh token:\nupdate1: %v\nupdate2: %v\n", err1, err2)
+	}
+}
+
 func testPasswordConcurrentUpdate(t *testing.T, s storage.Storage) {
 	// Use bcrypt.MinCost to keep the tests short.
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
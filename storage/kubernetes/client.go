@@ -51,6 +51,9 @@ type client struct {
 	// This is called once the client's Close method is called to signal goroutines,
 	// such as the one creating third party resources, to stop.
 	cancel context.CancelFunc
+
+	// Secrets encrypting private signing keys. If empty, keys aren't encrypted.
+	keySecrets storage.KeySecrets
 }
 
 // idToName maps an arbitrary ID, such as an email or client ID to a Kubernetes object name.
@@ -15,27 +15,40 @@ import (
 )
 
 const (
-	kindAuthCode     = "AuthCode"
-	kindAuthRequest  = "AuthRequest"
-	kindClient       = "OAuth2Client"
-	kindRefreshToken = "RefreshToken"
-	kindKeys         = "SigningKey"
-	kindPassword     = "Password"
+	kindAuthCode      = "AuthCode"
+	kindAuthRequest   = "AuthRequest"
+	kindClient        = "OAuth2Client"
+	kindRefreshToken  = "RefreshToken"
+	kindKeys          = "SigningKey"
+	kindPassword      = "Password"
+	kindDeviceRequest = "DeviceRequest"
+	kindDeviceToken   = "DeviceToken"
+
+	kindClientAssertion = "ClientAssertion"
 )
 
 const (
-	resourceAuthCode     = "authcodes"
-	resourceAuthRequest  = "authrequests"
-	resourceClient       = "oauth2clients"
-	resourceRefreshToken = "refreshtokens"
-	resourceKeys         = "signingkeies" // Kubernetes attempts to pluralize.
-	resourcePassword     = "passwords"
+	resourceAuthCode      = "authcodes"
+	resourceAuthRequest   = "authrequests"
+	resourceClient        = "oauth2clients"
+	resourceRefreshToken  = "refreshtokens"
+	resourceKeys          = "signingkeies" // Kubernetes attempts to pluralize.
+	resourcePassword      = "passwords"
+	resourceDeviceRequest = "devicerequests"
+	resourceDeviceToken   = "devicetokens"
+
+	resourceClientAssertion = "clientassertions"
 )
 
 // Config values for the Kubernetes storage type.
 type Config struct {
 	InCluster      bool   `json:"inCluster"`
 	KubeConfigFile string `json:"kubeConfigFile"`
+
+	// KeySecrets are base64 encoded 32 byte secrets used to encrypt private signing
+	// keys. The first secret encrypts, the others are only used to decrypt keys
+	// encrypted before the secrets were rotated.
+	KeySecrets []string `json:"keySecrets"`
 }
 
 // Open returns a storage using Kubernetes third party resource.
@@ -55,12 +68,15 @@ func (c *Config) open(logger logrus.FieldLogger) (*client, error) {
 	if !c.InCluster && (c.KubeConfigFile == "") {
 		return nil, errors.New("must specify either 'inCluster' or 'kubeConfigFile'")
 	}
+	secrets, err := storage.ParseKeySecrets(c.KeySecrets)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
 		cluster   k8sapi.Cluster
 		user      k8sapi.AuthInfo
 		namespace string
-		err       error
 	)
 	if c.InCluster {
 		cluster, user, namespace, err = inClusterConfig()
@@ -75,6 +91,11 @@ func (c *Config) open(logger logrus.FieldLogger) (*client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create client: %v", err)
 	}
+	cli.keySecrets = secrets
+
+	if err := cli.reencryptKeys(); err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt keys: %v", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -153,22 +174,23 @@ func (cli *client) CreatePassword(p storage.Password) error {
 }
 
 func (cli *client) CreateRefresh(r storage.RefreshToken) error {
-	refresh := RefreshToken{
-		TypeMeta: k8sapi.TypeMeta{
-			Kind:       kindRefreshToken,
-			APIVersion: cli.apiVersion,
-		},
-		ObjectMeta: k8sapi.ObjectMeta{
-			Name:      r.RefreshToken,
-			Namespace: cli.namespace,
-		},
-		ClientID:    r.ClientID,
-		ConnectorID: r.ConnectorID,
-		Scopes:      r.Scopes,
-		Nonce:       r.Nonce,
-		Claims:      fromStorageClaims(r.Claims),
-	}
-	return cli.post(resourceRefreshToken, refresh)
+	return cli.post(resourceRefreshToken, cli.fromStorageRefreshToken(r))
+}
+
+func (cli *client) CreateDeviceRequest(d storage.DeviceRequest) error {
+	return cli.post(resourceDeviceRequest, cli.fromStorageDeviceRequest(d))
+}
+
+func (cli *client) CreateDeviceToken(t storage.DeviceToken) error {
+	return cli.post(resourceDeviceToken, cli.fromStorageDeviceToken(t))
+}
+
+func (cli *client) CreateClientAssertion(a storage.ClientAssertion) error {
+	err := cli.post(resourceClientAssertion, cli.fromStorageClientAssertion(a))
+	if e, ok := err.(httpError); ok && e.StatusCode() == http.StatusConflict {
+		return storage.ErrAlreadyExists
+	}
+	return err
 }
 
 func (cli *client) GetAuthRequest(id string) (storage.AuthRequest, error) {
@@ -234,7 +256,25 @@ func (cli *client) GetKeys() (storage.Keys, error) {
 	if err := cli.get(resourceKeys, keysName, &keys); err != nil {
 		return storage.Keys{}, err
 	}
-	return toStorageKeys(keys), nil
+	k, _, err := cli.toStorageKeys(keys)
+	return k, err
+}
+
+// reencryptKeys encrypts the keys again if they aren't encrypted with the current
+// key secret, for instance after secrets were rotated.
+func (cli *client) reencryptKeys() error {
+	var keys Keys
+	if err := cli.get(resourceKeys, keysName, &keys); err != nil {
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if _, stale, err := cli.toStorageKeys(keys); err != nil || !stale {
+		return err
+	}
+	cli.logger.Infof("re-encrypting signing keys with the current key secret")
+	return cli.UpdateKeys(func(old storage.Keys) (storage.Keys, error) { return old, nil })
 }
 
 func (cli *client) GetRefresh(id string) (storage.RefreshToken, error) {
@@ -242,22 +282,42 @@ func (cli *client) GetRefresh(id string) (storage.RefreshToken, error) {
 	if err := cli.get(resourceRefreshToken, id, &r); err != nil {
 		return storage.RefreshToken{}, err
 	}
-	return storage.RefreshToken{
-		RefreshToken: r.ObjectMeta.Name,
-		ClientID:     r.ClientID,
-		ConnectorID:  r.ConnectorID,
-		Scopes:       r.Scopes,
-		Nonce:        r.Nonce,
-		Claims:       toStorageClaims(r.Claims),
-	}, nil
+	return toStorageRefreshToken(r), nil
+}
+
+func (cli *client) GetDeviceRequest(userCode string) (storage.DeviceRequest, error) {
+	var d DeviceRequest
+	if err := cli.get(resourceDeviceRequest, cli.idToName(userCode), &d); err != nil {
+		return storage.DeviceRequest{}, err
+	}
+	if d.UserCode != userCode {
+		return storage.DeviceRequest{}, fmt.Errorf("get device request: user code %q mapped to device request with user code %q", userCode, d.UserCode)
+	}
+	return toStorageDeviceRequest(d), nil
+}
+
+func (cli *client) GetDeviceToken(deviceCode string) (storage.DeviceToken, error) {
+	var t DeviceToken
+	if err := cli.get(resourceDeviceToken, deviceCode, &t); err != nil {
+		return storage.DeviceToken{}, err
+	}
+	return toStorageDeviceToken(t), nil
 }
 
 func (cli *client) ListClients() ([]storage.Client, error) {
 	return nil, errors.New("not implemented")
 }
 
-func (cli *client) ListRefreshTokens() ([]storage.RefreshToken, error) {
-	return nil, errors.New("not implemented")
+func (cli *client) ListRefreshTokens() (tokens []storage.RefreshToken, err error) {
+	var refreshList RefreshList
+	if err = cli.list(resourceRefreshToken, &refreshList); err != nil {
+		return tokens, fmt.Errorf("failed to list refresh tokens: %v", err)
+	}
+
+	for _, refresh := range refreshList.RefreshTokens {
+		tokens = append(tokens, toStorageRefreshToken(refresh))
+	}
+	return
 }
 
 func (cli *client) ListPasswords() (passwords []storage.Password, err error) {
@@ -354,14 +414,20 @@ func (cli *client) UpdateKeys(updater func(old storage.Keys) (storage.Keys, erro
 	}
 	var oldKeys storage.Keys
 	if !firstUpdate {
-		oldKeys = toStorageKeys(keys)
+		var err error
+		if oldKeys, _, err = cli.toStorageKeys(keys); err != nil {
+			return err
+		}
 	}
 
 	updated, err := updater(oldKeys)
 	if err != nil {
 		return err
 	}
-	newKeys := cli.fromStorageKeys(updated)
+	newKeys, err := cli.fromStorageKeys(updated)
+	if err != nil {
+		return err
+	}
 	if firstUpdate {
 		return cli.post(resourceKeys, newKeys)
 	}
@@ -386,6 +452,42 @@ func (cli *client) UpdateAuthRequest(id string, updater func(a storage.AuthReque
 	return cli.put(resourceAuthRequest, id, newReq)
 }
 
+// UpdateRefreshToken replaces the token with the object it was read as, so a
+// concurrent update fails with a conflict instead of being overwritten.
+func (cli *client) UpdateRefreshToken(id string, updater func(old storage.RefreshToken) (storage.RefreshToken, error)) error {
+	var r RefreshToken
+	if err := cli.get(resourceRefreshToken, id, &r); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageRefreshToken(r))
+	if err != nil {
+		return err
+	}
+	updated.RefreshToken = id
+
+	newToken := cli.fromStorageRefreshToken(updated)
+	newToken.ObjectMeta = r.ObjectMeta
+	return cli.put(resourceRefreshToken, id, newToken)
+}
+
+func (cli *client) UpdateDeviceToken(deviceCode string, updater func(t storage.DeviceToken) (storage.DeviceToken, error)) error {
+	var t DeviceToken
+	if err := cli.get(resourceDeviceToken, deviceCode, &t); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageDeviceToken(t))
+	if err != nil {
+		return err
+	}
+	updated.DeviceCode = deviceCode
+
+	newToken := cli.fromStorageDeviceToken(updated)
+	newToken.ObjectMeta = t.ObjectMeta
+	return cli.put(resourceDeviceToken, deviceCode, newToken)
+}
+
 func (cli *client) GarbageCollect(now time.Time) (result storage.GCResult, err error) {
 	var authRequests AuthRequestList
 	if err := cli.list(resourceAuthRequest, &authRequests); err != nil {
@@ -420,5 +522,85 @@ func (cli *client) GarbageCollect(now time.Time) (result storage.GCResult, err e
 			result.AuthCodes++
 		}
 	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var deviceRequests DeviceRequestList
+	if err := cli.list(resourceDeviceRequest, &deviceRequests); err != nil {
+		return result, fmt.Errorf("failed to list device requests: %v", err)
+	}
+
+	for _, deviceRequest := range deviceRequests.DeviceRequests {
+		if now.After(deviceRequest.Expiry) {
+			if err := cli.delete(resourceDeviceRequest, deviceRequest.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete device request: %v", err)
+				delErr = fmt.Errorf("failed to delete device request: %v", err)
+			}
+			result.DeviceRequests++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var deviceTokens DeviceTokenList
+	if err := cli.list(resourceDeviceToken, &deviceTokens); err != nil {
+		return result, fmt.Errorf("failed to list device tokens: %v", err)
+	}
+
+	for _, deviceToken := range deviceTokens.DeviceTokens {
+		if now.After(deviceToken.Expiry) {
+			if err := cli.delete(resourceDeviceToken, deviceToken.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete device token: %v", err)
+				delErr = fmt.Errorf("failed to delete device token: %v", err)
+			}
+			result.DeviceTokens++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var assertions ClientAssertionList
+	if err := cli.list(resourceClientAssertion, &assertions); err != nil {
+		return result, fmt.Errorf("failed to list client assertions: %v", err)
+	}
+
+	for _, assertion := range assertions.ClientAssertions {
+		if now.After(assertion.Expiry) {
+			if err := cli.delete(resourceClientAssertion, assertion.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete client assertion: %v", err)
+				delErr = fmt.Errorf("failed to delete client assertion: %v", err)
+			}
+			result.ClientAssertions++
+		}
+	}
+	if delErr != nil {
+		return result, delErr
+	}
+
+	var refreshTokens RefreshList
+	if err := cli.list(resourceRefreshToken, &refreshTokens); err != nil {
+		return result, fmt.Errorf("failed to list refresh tokens: %v", err)
+	}
+
+	// Rotated tokens are collected once their family has no other token left.
+	liveFamilies := make(map[string]bool)
+	for _, refreshToken := range refreshTokens.RefreshTokens {
+		if !refreshToken.Rotated && (refreshToken.Expiry.IsZero() || !now.After(refreshToken.Expiry)) {
+			liveFamilies[refreshToken.FamilyID] = true
+		}
+	}
+	for _, refreshToken := range refreshTokens.RefreshTokens {
+		expired := !refreshToken.Expiry.IsZero() && now.After(refreshToken.Expiry)
+		if expired || (refreshToken.Rotated && !liveFamilies[refreshToken.FamilyID]) {
+			if err := cli.delete(resourceRefreshToken, refreshToken.ObjectMeta.Name); err != nil {
+				cli.logger.Errorf("failed to delete refresh token: %v", err)
+				delErr = fmt.Errorf("failed to delete refresh token: %v", err)
+			}
+			result.RefreshTokens++
+		}
+	}
 	return result, delErr
 }
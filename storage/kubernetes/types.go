@@ -1,6 +1,8 @@
 package kubernetes
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 	"time"
 
@@ -66,6 +68,30 @@ var thirdPartyResources = []k8sapi.ThirdPartyResource{
 		Description: "Passwords managed by the OIDC server.",
 		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
 	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "device-request.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "A request from a device for an end user to authorize a client.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "device-token.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "A token response a device is polling for.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
+	{
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name: "client-assertion.oidc.coreos.com",
+		},
+		TypeMeta:    tprMeta,
+		Description: "A JWT a client authenticated with, kept so it can't be replayed.",
+		Versions:    []k8sapi.APIVersion{{Name: "v1"}},
+	},
 }
 
 // There will only ever be a single keys resource. Maintain this by setting a
@@ -83,11 +109,37 @@ type Client struct {
 	ID string `json:"id,omitempty"`
 
 	Secret       string   `json:"secret,omitempty"`
+	SecretHash   string   `json:"secretHash,omitempty"`
 	RedirectURIs []string `json:"redirectURIs,omitempty"`
 	TrustedPeers []string `json:"trustedPeers,omitempty"`
 
+	PostLogoutRedirectURIs []string `json:"postLogoutRedirectURIs,omitempty"`
+
 	Public bool `json:"public"`
 
+	AllowClientCredentials bool     `json:"allowClientCredentials,omitempty"`
+	AllowedScopes          []string `json:"allowedScopes,omitempty"`
+	AllowPasswordGrant     bool     `json:"allowPasswordGrant,omitempty"`
+
+	JWKS    *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	JWKSURI string              `json:"jwksURI,omitempty"`
+
+	RequestURIs []string `json:"requestURIs,omitempty"`
+
+	TokenEndpointAuthMethod string `json:"tokenEndpointAuthMethod,omitempty"`
+
+	TLSClientAuthSubjectDN         string `json:"tlsClientAuthSubjectDN,omitempty"`
+	TLSClientCertificateThumbprint string `json:"tlsClientCertificateThumbprint,omitempty"`
+
+	RegistrationAccessTokenHash string `json:"registrationAccessTokenHash,omitempty"`
+
+	IDTokenSignedResponseAlg string `json:"idTokenSignedResponseAlg,omitempty"`
+
+	SubjectType      string `json:"subjectType,omitempty"`
+	SectorIdentifier string `json:"sectorIdentifier,omitempty"`
+
+	ClaimMappings []storage.ClaimMapping `json:"claimMappings,omitempty"`
+
 	Name    string `json:"name,omitempty"`
 	LogoURL string `json:"logoURL,omitempty"`
 }
@@ -109,25 +161,59 @@ func (cli *client) fromStorageClient(c storage.Client) Client {
 			Name:      cli.idToName(c.ID),
 			Namespace: cli.namespace,
 		},
-		ID:           c.ID,
-		Secret:       c.Secret,
-		RedirectURIs: c.RedirectURIs,
-		TrustedPeers: c.TrustedPeers,
-		Public:       c.Public,
-		Name:         c.Name,
-		LogoURL:      c.LogoURL,
+		ID:                       c.ID,
+		Secret:                   c.Secret,
+		SecretHash:               c.SecretHash,
+		RedirectURIs:             c.RedirectURIs,
+		TrustedPeers:             c.TrustedPeers,
+		PostLogoutRedirectURIs:   c.PostLogoutRedirectURIs,
+		Public:                   c.Public,
+		AllowClientCredentials:   c.AllowClientCredentials,
+		AllowedScopes:            c.AllowedScopes,
+		AllowPasswordGrant:       c.AllowPasswordGrant,
+		JWKS:                     c.JWKS,
+		JWKSURI:                  c.JWKSURI,
+		RequestURIs:              c.RequestURIs,
+		TokenEndpointAuthMethod:  c.TokenEndpointAuthMethod,
+		IDTokenSignedResponseAlg: c.IDTokenSignedResponseAlg,
+		SubjectType:              c.SubjectType,
+		SectorIdentifier:         c.SectorIdentifier,
+		ClaimMappings:            c.ClaimMappings,
+		Name:                     c.Name,
+		LogoURL:                  c.LogoURL,
+
+		TLSClientAuthSubjectDN:         c.TLSClientAuthSubjectDN,
+		TLSClientCertificateThumbprint: c.TLSClientCertificateThumbprint,
+		RegistrationAccessTokenHash:    c.RegistrationAccessTokenHash,
 	}
 }
 
 func toStorageClient(c Client) storage.Client {
 	return storage.Client{
-		ID:           c.ID,
-		Secret:       c.Secret,
-		RedirectURIs: c.RedirectURIs,
-		TrustedPeers: c.TrustedPeers,
-		Public:       c.Public,
-		Name:         c.Name,
-		LogoURL:      c.LogoURL,
+		ID:                       c.ID,
+		Secret:                   c.Secret,
+		SecretHash:               c.SecretHash,
+		RedirectURIs:             c.RedirectURIs,
+		TrustedPeers:             c.TrustedPeers,
+		PostLogoutRedirectURIs:   c.PostLogoutRedirectURIs,
+		Public:                   c.Public,
+		AllowClientCredentials:   c.AllowClientCredentials,
+		AllowedScopes:            c.AllowedScopes,
+		AllowPasswordGrant:       c.AllowPasswordGrant,
+		JWKS:                     c.JWKS,
+		JWKSURI:                  c.JWKSURI,
+		RequestURIs:              c.RequestURIs,
+		TokenEndpointAuthMethod:  c.TokenEndpointAuthMethod,
+		IDTokenSignedResponseAlg: c.IDTokenSignedResponseAlg,
+		SubjectType:              c.SubjectType,
+		SectorIdentifier:         c.SectorIdentifier,
+		ClaimMappings:            c.ClaimMappings,
+		Name:                     c.Name,
+		LogoURL:                  c.LogoURL,
+
+		TLSClientAuthSubjectDN:         c.TLSClientAuthSubjectDN,
+		TLSClientCertificateThumbprint: c.TLSClientCertificateThumbprint,
+		RegistrationAccessTokenHash:    c.RegistrationAccessTokenHash,
 	}
 }
 
@@ -138,6 +224,8 @@ type Claims struct {
 	Email         string   `json:"email"`
 	EmailVerified bool     `json:"emailVerified"`
 	Groups        []string `json:"groups,omitempty"`
+
+	CustomClaims map[string]interface{} `json:"customClaims,omitempty"`
 }
 
 func fromStorageClaims(i storage.Claims) Claims {
@@ -147,6 +235,7 @@ func fromStorageClaims(i storage.Claims) Claims {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		CustomClaims:  i.CustomClaims,
 	}
 }
 
@@ -157,6 +246,7 @@ func toStorageClaims(i Claims) storage.Claims {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		CustomClaims:  i.CustomClaims,
 	}
 }
 
@@ -174,11 +264,15 @@ type AuthRequest struct {
 	Nonce string `json:"nonce,omitempty"`
 	State string `json:"state,omitempty"`
 
+	ResponseMode string `json:"responseMode,omitempty"`
+
 	// The client has indicated that the end user must be shown an approval prompt
 	// on all requests. The server cannot cache their initial action for subsequent
 	// attempts.
 	ForceApprovalPrompt bool `json:"forceApprovalPrompt,omitempty"`
 
+	LoginHint string `json:"loginHint,omitempty"`
+
 	LoggedIn bool `json:"loggedIn"`
 
 	// The identity of the end user. Generally nil until the user authenticates
@@ -188,6 +282,13 @@ type AuthRequest struct {
 	ConnectorID   string `json:"connectorID,omitempty"`
 	ConnectorData []byte `json:"connectorData,omitempty"`
 
+	AuthTime time.Time `json:"authTime,omitempty"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+
+	ClaimsRequest storage.ClaimsRequest `json:"claimsRequest,omitempty"`
+
 	Expiry time.Time `json:"expiry"`
 }
 
@@ -207,12 +308,20 @@ func toStorageAuthRequest(req AuthRequest) storage.AuthRequest {
 		RedirectURI:         req.RedirectURI,
 		Nonce:               req.Nonce,
 		State:               req.State,
+		ResponseMode:        req.ResponseMode,
 		ForceApprovalPrompt: req.ForceApprovalPrompt,
+		LoginHint:           req.LoginHint,
 		LoggedIn:            req.LoggedIn,
 		ConnectorID:         req.ConnectorID,
 		ConnectorData:       req.ConnectorData,
+		AuthTime:            req.AuthTime,
 		Expiry:              req.Expiry,
 		Claims:              toStorageClaims(req.Claims),
+		PKCE: storage.PKCE{
+			CodeChallenge:       req.CodeChallenge,
+			CodeChallengeMethod: req.CodeChallengeMethod,
+		},
+		ClaimsRequest: req.ClaimsRequest,
 	}
 	return a
 }
@@ -233,12 +342,18 @@ func (cli *client) fromStorageAuthRequest(a storage.AuthRequest) AuthRequest {
 		RedirectURI:         a.RedirectURI,
 		Nonce:               a.Nonce,
 		State:               a.State,
+		ResponseMode:        a.ResponseMode,
 		LoggedIn:            a.LoggedIn,
 		ForceApprovalPrompt: a.ForceApprovalPrompt,
+		LoginHint:           a.LoginHint,
 		ConnectorID:         a.ConnectorID,
 		ConnectorData:       a.ConnectorData,
+		AuthTime:            a.AuthTime,
 		Expiry:              a.Expiry,
 		Claims:              fromStorageClaims(a.Claims),
+		CodeChallenge:       a.PKCE.CodeChallenge,
+		CodeChallengeMethod: a.PKCE.CodeChallengeMethod,
+		ClaimsRequest:       a.ClaimsRequest,
 	}
 	return req
 }
@@ -311,6 +426,13 @@ type AuthCode struct {
 	ConnectorID   string `json:"connectorID,omitempty"`
 	ConnectorData []byte `json:"connectorData,omitempty"`
 
+	AuthTime time.Time `json:"authTime,omitempty"`
+
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+
+	ClaimsRequest storage.ClaimsRequest `json:"claimsRequest,omitempty"`
+
 	Expiry time.Time `json:"expiry"`
 }
 
@@ -338,7 +460,13 @@ func (cli *client) fromStorageAuthCode(a storage.AuthCode) AuthCode {
 		Nonce:         a.Nonce,
 		Scopes:        a.Scopes,
 		Claims:        fromStorageClaims(a.Claims),
+		AuthTime:      a.AuthTime,
 		Expiry:        a.Expiry,
+
+		CodeChallenge:       a.PKCE.CodeChallenge,
+		CodeChallengeMethod: a.PKCE.CodeChallengeMethod,
+
+		ClaimsRequest: a.ClaimsRequest,
 	}
 }
 
@@ -352,7 +480,13 @@ func toStorageAuthCode(a AuthCode) storage.AuthCode {
 		Nonce:         a.Nonce,
 		Scopes:        a.Scopes,
 		Claims:        toStorageClaims(a.Claims),
+		AuthTime:      a.AuthTime,
 		Expiry:        a.Expiry,
+		PKCE: storage.PKCE{
+			CodeChallenge:       a.CodeChallenge,
+			CodeChallengeMethod: a.CodeChallengeMethod,
+		},
+		ClaimsRequest: a.ClaimsRequest,
 	}
 }
 
@@ -369,6 +503,66 @@ type RefreshToken struct {
 
 	Claims      Claims `json:"claims,omitempty"`
 	ConnectorID string `json:"connectorID,omitempty"`
+
+	AuthTime time.Time `json:"authTime,omitempty"`
+
+	ClaimsRequest storage.ClaimsRequest `json:"claimsRequest,omitempty"`
+
+	CertThumbprint string `json:"certThumbprint,omitempty"`
+
+	FamilyID  string    `json:"familyID,omitempty"`
+	Rotated   bool      `json:"rotated,omitempty"`
+	NextToken string    `json:"nextToken,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	LastUsed  time.Time `json:"lastUsed,omitempty"`
+	Expiry    time.Time `json:"expiry,omitempty"`
+}
+
+func (cli *client) fromStorageRefreshToken(r storage.RefreshToken) RefreshToken {
+	return RefreshToken{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindRefreshToken,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      r.RefreshToken,
+			Namespace: cli.namespace,
+		},
+		ClientID:       r.ClientID,
+		ConnectorID:    r.ConnectorID,
+		Scopes:         r.Scopes,
+		Nonce:          r.Nonce,
+		Claims:         fromStorageClaims(r.Claims),
+		AuthTime:       r.AuthTime,
+		ClaimsRequest:  r.ClaimsRequest,
+		CertThumbprint: r.CertThumbprint,
+		FamilyID:       r.FamilyID,
+		Rotated:        r.Rotated,
+		NextToken:      r.NextToken,
+		CreatedAt:      r.CreatedAt,
+		LastUsed:       r.LastUsed,
+		Expiry:         r.Expiry,
+	}
+}
+
+func toStorageRefreshToken(r RefreshToken) storage.RefreshToken {
+	return storage.RefreshToken{
+		RefreshToken:   r.ObjectMeta.Name,
+		ClientID:       r.ClientID,
+		ConnectorID:    r.ConnectorID,
+		Scopes:         r.Scopes,
+		Nonce:          r.Nonce,
+		Claims:         toStorageClaims(r.Claims),
+		AuthTime:       r.AuthTime,
+		ClaimsRequest:  r.ClaimsRequest,
+		CertThumbprint: r.CertThumbprint,
+		FamilyID:       r.FamilyID,
+		Rotated:        r.Rotated,
+		NextToken:      r.NextToken,
+		CreatedAt:      r.CreatedAt,
+		LastUsed:       r.LastUsed,
+		Expiry:         r.Expiry,
+	}
 }
 
 // RefreshList is a list of refresh tokens.
@@ -384,9 +578,12 @@ type Keys struct {
 	k8sapi.TypeMeta   `json:",inline"`
 	k8sapi.ObjectMeta `json:"metadata,omitempty"`
 
-	// Key for creating and verifying signatures. These may be nil.
-	SigningKey    *jose.JSONWebKey `json:"signingKey,omitempty"`
+	// Key for creating and verifying signatures. These may be nil. The private key
+	// is encrypted if key secrets are configured.
+	SigningKey    json.RawMessage  `json:"signingKey,omitempty"`
 	SigningKeyPub *jose.JSONWebKey `json:"signingKeyPub,omitempty"`
+	// Keys for signing with algorithms other than the signing key's.
+	AdditionalSigningKeys []storage.EncryptedSigningKeyPair `json:"additionalSigningKeys,omitempty"`
 	// Old signing keys which have been rotated but can still be used to validate
 	// existing signatures.
 	VerificationKeys []storage.VerificationKey `json:"verificationKeys,omitempty"`
@@ -397,7 +594,15 @@ type Keys struct {
 	NextRotation time.Time `json:"nextRotation"`
 }
 
-func (cli *client) fromStorageKeys(keys storage.Keys) Keys {
+func (cli *client) fromStorageKeys(keys storage.Keys) (Keys, error) {
+	signingKey, err := cli.keySecrets.EncryptKey(keys.SigningKey)
+	if err != nil {
+		return Keys{}, err
+	}
+	additionalSigningKeys, err := cli.keySecrets.EncryptKeyPairs(keys.AdditionalSigningKeys)
+	if err != nil {
+		return Keys{}, err
+	}
 	return Keys{
 		TypeMeta: k8sapi.TypeMeta{
 			Kind:       kindKeys,
@@ -407,18 +612,166 @@ func (cli *client) fromStorageKeys(keys storage.Keys) Keys {
 			Name:      keysName,
 			Namespace: cli.namespace,
 		},
-		SigningKey:       keys.SigningKey,
-		SigningKeyPub:    keys.SigningKeyPub,
-		VerificationKeys: keys.VerificationKeys,
-		NextRotation:     keys.NextRotation,
+		SigningKey:            signingKey,
+		SigningKeyPub:         keys.SigningKeyPub,
+		AdditionalSigningKeys: additionalSigningKeys,
+		VerificationKeys:      keys.VerificationKeys,
+		NextRotation:          keys.NextRotation,
+	}, nil
+}
+
+// toStorageKeys decrypts the private keys. The keys are stale if they should be
+// encrypted again with the current key secret.
+func (cli *client) toStorageKeys(keys Keys) (k storage.Keys, stale bool, err error) {
+	signingKey, signingKeyStale, err := cli.keySecrets.DecryptKey(keys.SigningKey)
+	if err != nil {
+		return k, false, fmt.Errorf("decrypt signing key: %v", err)
+	}
+	additionalSigningKeys, pairsStale, err := cli.keySecrets.DecryptKeyPairs(keys.AdditionalSigningKeys)
+	if err != nil {
+		return k, false, fmt.Errorf("decrypt additional signing keys: %v", err)
+	}
+	k = storage.Keys{
+		SigningKey:            signingKey,
+		SigningKeyPub:         keys.SigningKeyPub,
+		AdditionalSigningKeys: additionalSigningKeys,
+		VerificationKeys:      keys.VerificationKeys,
+		NextRotation:          keys.NextRotation,
 	}
+	return k, signingKeyStale || pairsStale, nil
 }
 
-func toStorageKeys(keys Keys) storage.Keys {
-	return storage.Keys{
-		SigningKey:       keys.SigningKey,
-		SigningKeyPub:    keys.SigningKeyPub,
-		VerificationKeys: keys.VerificationKeys,
-		NextRotation:     keys.NextRotation,
+// DeviceRequest is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type DeviceRequest struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	// User codes contain upper case characters, so the object name is a hash.
+	UserCode   string   `json:"userCode"`
+	DeviceCode string   `json:"deviceCode"`
+	ClientID   string   `json:"clientID"`
+	Scopes     []string `json:"scopes,omitempty"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+// DeviceRequestList is a list of DeviceRequests.
+type DeviceRequestList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	DeviceRequests  []DeviceRequest `json:"items"`
+}
+
+func (cli *client) fromStorageDeviceRequest(d storage.DeviceRequest) DeviceRequest {
+	return DeviceRequest{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindDeviceRequest,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      cli.idToName(d.UserCode),
+			Namespace: cli.namespace,
+		},
+		UserCode:   d.UserCode,
+		DeviceCode: d.DeviceCode,
+		ClientID:   d.ClientID,
+		Scopes:     d.Scopes,
+		Expiry:     d.Expiry,
+	}
+}
+
+func toStorageDeviceRequest(d DeviceRequest) storage.DeviceRequest {
+	return storage.DeviceRequest{
+		UserCode:   d.UserCode,
+		DeviceCode: d.DeviceCode,
+		ClientID:   d.ClientID,
+		Scopes:     d.Scopes,
+		Expiry:     d.Expiry,
+	}
+}
+
+// DeviceToken is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type DeviceToken struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ClientID string `json:"clientID"`
+	Status   string `json:"status"`
+	Token    []byte `json:"token,omitempty"`
+
+	Expiry              time.Time `json:"expiry"`
+	LastRequestTime     time.Time `json:"lastRequestTime"`
+	PollIntervalSeconds int       `json:"pollIntervalSeconds"`
+}
+
+// DeviceTokenList is a list of DeviceTokens.
+type DeviceTokenList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	DeviceTokens    []DeviceToken `json:"items"`
+}
+
+func (cli *client) fromStorageDeviceToken(t storage.DeviceToken) DeviceToken {
+	return DeviceToken{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindDeviceToken,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      t.DeviceCode,
+			Namespace: cli.namespace,
+		},
+		ClientID:            t.ClientID,
+		Status:              t.Status,
+		Token:               t.Token,
+		Expiry:              t.Expiry,
+		LastRequestTime:     t.LastRequestTime,
+		PollIntervalSeconds: t.PollIntervalSeconds,
+	}
+}
+
+func toStorageDeviceToken(t DeviceToken) storage.DeviceToken {
+	return storage.DeviceToken{
+		DeviceCode:          t.ObjectMeta.Name,
+		ClientID:            t.ClientID,
+		Status:              t.Status,
+		Token:               t.Token,
+		Expiry:              t.Expiry,
+		LastRequestTime:     t.LastRequestTime,
+		PollIntervalSeconds: t.PollIntervalSeconds,
+	}
+}
+
+// ClientAssertion is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type ClientAssertion struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ClientID string    `json:"clientID"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// ClientAssertionList is a list of ClientAssertions.
+type ClientAssertionList struct {
+	k8sapi.TypeMeta  `json:",inline"`
+	k8sapi.ListMeta  `json:"metadata,omitempty"`
+	ClientAssertions []ClientAssertion `json:"items"`
+}
+
+func (cli *client) fromStorageClientAssertion(a storage.ClientAssertion) ClientAssertion {
+	return ClientAssertion{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindClientAssertion,
+			APIVersion: cli.apiVersion,
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      a.ID,
+			Namespace: cli.namespace,
+		},
+		ClientID: a.ClientID,
+		Expiry:   a.Expiry,
 	}
 }
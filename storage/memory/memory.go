@@ -18,6 +18,9 @@ func New(logger logrus.FieldLogger) storage.Storage {
 		refreshTokens: make(map[string]storage.RefreshToken),
 		authReqs:      make(map[string]storage.AuthRequest),
 		passwords:     make(map[string]storage.Password),
+		deviceReqs:    make(map[string]storage.DeviceRequest),
+		deviceTokens:  make(map[string]storage.DeviceToken),
+		assertions:    make(map[string]storage.ClientAssertion),
 		logger:        logger,
 	}
 }
@@ -42,6 +45,9 @@ type memStorage struct {
 	refreshTokens map[string]storage.RefreshToken
 	authReqs      map[string]storage.AuthRequest
 	passwords     map[string]storage.Password
+	deviceReqs    map[string]storage.DeviceRequest
+	deviceTokens  map[string]storage.DeviceToken
+	assertions    map[string]storage.ClientAssertion
 
 	keys storage.Keys
 
@@ -70,6 +76,42 @@ func (s *memStorage) GarbageCollect(now time.Time) (result storage.GCResult, err
 				result.AuthRequests++
 			}
 		}
+		for userCode, d := range s.deviceReqs {
+			if now.After(d.Expiry) {
+				delete(s.deviceReqs, userCode)
+				result.DeviceRequests++
+			}
+		}
+		for deviceCode, t := range s.deviceTokens {
+			if now.After(t.Expiry) {
+				delete(s.deviceTokens, deviceCode)
+				result.DeviceTokens++
+			}
+		}
+		for id, a := range s.assertions {
+			if now.After(a.Expiry) {
+				delete(s.assertions, id)
+				result.ClientAssertions++
+			}
+		}
+		for id, r := range s.refreshTokens {
+			if !r.Expiry.IsZero() && now.After(r.Expiry) {
+				delete(s.refreshTokens, id)
+				result.RefreshTokens++
+			}
+		}
+		liveFamilies := make(map[string]bool)
+		for _, r := range s.refreshTokens {
+			if !r.Rotated {
+				liveFamilies[r.FamilyID] = true
+			}
+		}
+		for id, r := range s.refreshTokens {
+			if r.Rotated && !liveFamilies[r.FamilyID] {
+				delete(s.refreshTokens, id)
+				result.RefreshTokens++
+			}
+		}
 	})
 	return result, nil
 }
@@ -130,6 +172,39 @@ func (s *memStorage) CreatePassword(p storage.Password) (err error) {
 	return
 }
 
+func (s *memStorage) CreateDeviceRequest(d storage.DeviceRequest) (err error) {
+	s.tx(func() {
+		if _, ok := s.deviceReqs[d.UserCode]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.deviceReqs[d.UserCode] = d
+		}
+	})
+	return
+}
+
+func (s *memStorage) CreateDeviceToken(t storage.DeviceToken) (err error) {
+	s.tx(func() {
+		if _, ok := s.deviceTokens[t.DeviceCode]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.deviceTokens[t.DeviceCode] = t
+		}
+	})
+	return
+}
+
+func (s *memStorage) CreateClientAssertion(a storage.ClientAssertion) (err error) {
+	s.tx(func() {
+		if _, ok := s.assertions[a.ID]; ok {
+			err = storage.ErrAlreadyExists
+		} else {
+			s.assertions[a.ID] = a
+		}
+	})
+	return
+}
+
 func (s *memStorage) GetPassword(email string) (p storage.Password, err error) {
 	email = strings.ToLower(email)
 	s.tx(func() {
@@ -178,6 +253,26 @@ func (s *memStorage) GetAuthRequest(id string) (req storage.AuthRequest, err err
 	return
 }
 
+func (s *memStorage) GetDeviceRequest(userCode string) (req storage.DeviceRequest, err error) {
+	s.tx(func() {
+		var ok bool
+		if req, ok = s.deviceReqs[userCode]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetDeviceToken(deviceCode string) (t storage.DeviceToken, err error) {
+	s.tx(func() {
+		var ok bool
+		if t, ok = s.deviceTokens[deviceCode]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
 func (s *memStorage) ListClients() (clients []storage.Client, err error) {
 	s.tx(func() {
 		for _, client := range s.clients {
@@ -324,3 +419,31 @@ func (s *memStorage) UpdatePassword(email string, updater func(p storage.Passwor
 	})
 	return
 }
+
+func (s *memStorage) UpdateRefreshToken(id string, updater func(old storage.RefreshToken) (storage.RefreshToken, error)) (err error) {
+	s.tx(func() {
+		r, ok := s.refreshTokens[id]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if r, err = updater(r); err == nil {
+			s.refreshTokens[id] = r
+		}
+	})
+	return
+}
+
+func (s *memStorage) UpdateDeviceToken(deviceCode string, updater func(t storage.DeviceToken) (storage.DeviceToken, error)) (err error) {
+	s.tx(func() {
+		t, ok := s.deviceTokens[deviceCode]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if t, err = updater(t); err == nil {
+			s.deviceTokens[deviceCode] = t
+		}
+	})
+	return
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	pcrypto "github.com/coreos/dex/pkg/crypto"
+)
+
+// Tests for this code are in the "sql" package, which persists encrypted keys.
+
+const (
+	// keySecretSize is the size of the AES-256 keys used as key secrets.
+	keySecretSize = 32
+
+	gcmNonceSize = 12
+)
+
+// KeySecrets are symmetric secrets used by storages to encrypt private signing keys
+// at rest, so read access to the backing store isn't enough to forge tokens. Keys
+// are encrypted with AES-GCM, like the v1 "--key-secrets" flag.
+//
+// The first secret encrypts, while every secret is tried when decrypting. To rotate
+// secrets, add a new one to the front of the list. Storages re-encrypt keys with it
+// when they're opened, after which the old secret can be removed.
+type KeySecrets [][]byte
+
+// ParseKeySecrets decodes base64 encoded 32 byte secrets.
+func ParseKeySecrets(encoded []string) (KeySecrets, error) {
+	secrets := make(KeySecrets, len(encoded))
+	for i, s := range encoded {
+		secret, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("key secret %d: invalid base64: %v", i, err)
+		}
+		if len(secret) != keySecretSize {
+			return nil, fmt.Errorf("key secret %d: expected %d byte secret, got %d bytes", i, keySecretSize, len(secret))
+		}
+		secrets[i] = secret
+	}
+	return secrets, nil
+}
+
+// encryptedKey is the persisted form of an encrypted private key.
+type encryptedKey struct {
+	Encrypted []byte `json:"encrypted"`
+}
+
+// EncryptKey returns the JSON form of a private key encrypted with the first secret.
+// Without secrets the key isn't encrypted. A nil key returns nil.
+func (s KeySecrets) EncryptKey(key *jose.JSONWebKey) (json.RawMessage, error) {
+	if key == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s) == 0 {
+		return data, nil
+	}
+	ciphertext, err := pcrypto.Encrypt(data, s[0])
+	if err != nil {
+		return nil, fmt.Errorf("encrypt key: %v", err)
+	}
+	return json.Marshal(encryptedKey{ciphertext})
+}
+
+// DecryptKey parses a key returned by EncryptKey. Keys which aren't encrypted are
+// accepted so secrets can be added to existing storages.
+//
+// The key is stale if it isn't encrypted with the first secret, and should be
+// encrypted again.
+func (s KeySecrets) DecryptKey(data json.RawMessage) (key *jose.JSONWebKey, stale bool, err error) {
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, false, nil
+	}
+
+	var enc encryptedKey
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return nil, false, fmt.Errorf("unmarshal key: %v", err)
+	}
+	if enc.Encrypted == nil {
+		key = new(jose.JSONWebKey)
+		if err := json.Unmarshal(data, key); err != nil {
+			return nil, false, fmt.Errorf("unmarshal key: %v", err)
+		}
+		return key, len(s) > 0, nil
+	}
+
+	if len(s) == 0 {
+		return nil, false, errors.New("key is encrypted but no key secrets are configured")
+	}
+	// Decrypt panics on ciphertexts shorter than the AES-GCM nonce.
+	if len(enc.Encrypted) < gcmNonceSize {
+		return nil, false, errors.New("encrypted key is too short")
+	}
+	for i, secret := range s {
+		plaintext, err := pcrypto.Decrypt(enc.Encrypted, secret)
+		if err != nil {
+			continue
+		}
+		key = new(jose.JSONWebKey)
+		if err := json.Unmarshal(plaintext, key); err != nil {
+			return nil, false, fmt.Errorf("unmarshal key: %v", err)
+		}
+		return key, i > 0, nil
+	}
+	return nil, false, errors.New("cannot decrypt key with any key secret")
+}
+
+// EncryptedSigningKeyPair is the persisted form of a SigningKeyPair. The private
+// key is encrypted by KeySecrets.
+type EncryptedSigningKeyPair struct {
+	PrivateKey json.RawMessage  `json:"privateKey"`
+	PublicKey  *jose.JSONWebKey `json:"publicKey"`
+}
+
+// EncryptKeyPairs encrypts the private keys of the pairs.
+func (s KeySecrets) EncryptKeyPairs(pairs []SigningKeyPair) ([]EncryptedSigningKeyPair, error) {
+	if pairs == nil {
+		return nil, nil
+	}
+	encrypted := make([]EncryptedSigningKeyPair, len(pairs))
+	for i, pair := range pairs {
+		privateKey, err := s.EncryptKey(pair.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		encrypted[i] = EncryptedSigningKeyPair{PrivateKey: privateKey, PublicKey: pair.PublicKey}
+	}
+	return encrypted, nil
+}
+
+// DecryptKeyPairs decrypts pairs returned by EncryptKeyPairs. The pairs are stale
+// if any private key is.
+func (s KeySecrets) DecryptKeyPairs(encrypted []EncryptedSigningKeyPair) (pairs []SigningKeyPair, stale bool, err error) {
+	if encrypted == nil {
+		return nil, false, nil
+	}
+	pairs = make([]SigningKeyPair, len(encrypted))
+	for i, pair := range encrypted {
+		privateKey, keyStale, err := s.DecryptKey(pair.PrivateKey)
+		if err != nil {
+			return nil, false, err
+		}
+		stale = stale || keyStale
+		pairs[i] = SigningKeyPair{PrivateKey: privateKey, PublicKey: pair.PublicKey}
+	}
+	return pairs, stale, nil
+}
@@ -14,6 +14,11 @@ import (
 type SQLite3 struct {
 	// File to
 	File string `json:"file"`
+
+	// KeySecrets are base64 encoded 32 byte secrets used to encrypt private signing
+	// keys. The first secret encrypts, the others are only used to decrypt keys
+	// encrypted before the secrets were rotated.
+	KeySecrets []string `json:"keySecrets"`
 }
 
 // Open creates a new storage implementation backed by SQLite3
@@ -26,6 +31,10 @@ func (s *SQLite3) Open(logger logrus.FieldLogger) (storage.Storage, error) {
 }
 
 func (s *SQLite3) open(logger logrus.FieldLogger) (*conn, error) {
+	secrets, err := storage.ParseKeySecrets(s.KeySecrets)
+	if err != nil {
+		return nil, err
+	}
 	db, err := sql.Open("sqlite3", s.File)
 	if err != nil {
 		return nil, err
@@ -35,10 +44,13 @@ func (s *SQLite3) open(logger logrus.FieldLogger) (*conn, error) {
 		// doesn't support this, so limit the number of connections to 1.
 		db.SetMaxOpenConns(1)
 	}
-	c := &conn{db, flavorSQLite3, logger}
+	c := &conn{db, flavorSQLite3, logger, secrets}
 	if _, err := c.migrate(); err != nil {
 		return nil, fmt.Errorf("failed to perform migrations: %v", err)
 	}
+	if err := c.reencryptKeys(); err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt keys: %v", err)
+	}
 	return c, nil
 }
 
@@ -68,6 +80,11 @@ type Postgres struct {
 	SSL PostgresSSL `json:"ssl" yaml:"ssl"`
 
 	ConnectionTimeout int // Seconds
+
+	// KeySecrets are base64 encoded 32 byte secrets used to encrypt private signing
+	// keys. The first secret encrypts, the others are only used to decrypt keys
+	// encrypted before the secrets were rotated.
+	KeySecrets []string `json:"keySecrets"`
 }
 
 // Open creates a new storage implementation backed by Postgres.
@@ -80,6 +97,11 @@ func (p *Postgres) Open(logger logrus.FieldLogger) (storage.Storage, error) {
 }
 
 func (p *Postgres) open(logger logrus.FieldLogger) (*conn, error) {
+	secrets, err := storage.ParseKeySecrets(p.KeySecrets)
+	if err != nil {
+		return nil, err
+	}
+
 	v := url.Values{}
 	set := func(key, val string) {
 		if val != "" {
@@ -114,9 +136,12 @@ func (p *Postgres) open(logger logrus.FieldLogger) (*conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := &conn{db, flavorPostgres, logger}
+	c := &conn{db, flavorPostgres, logger, secrets}
 	if _, err := c.migrate(); err != nil {
 		return nil, fmt.Errorf("failed to perform migrations: %v", err)
 	}
+	if err := c.reencryptKeys(); err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt keys: %v", err)
+	}
 	return c, nil
 }
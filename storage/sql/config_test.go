@@ -53,7 +53,7 @@ func TestSQLite3(t *testing.T) {
 		// NOTE(ericchiang): In memory means we only get one connection at a time. If we
 		// ever write tests that require using multiple connections, for instance to test
 		// transactions, we need to move to a file based system.
-		s := &SQLite3{":memory:"}
+		s := &SQLite3{File: ":memory:"}
 		conn, err := s.open(logger)
 		if err != nil {
 			fmt.Fprintln(os.Stdout, err)
@@ -67,6 +67,24 @@ func TestSQLite3(t *testing.T) {
 	})
 }
 
+func TestSQLite3KeySecrets(t *testing.T) {
+	newStorage := func() storage.Storage {
+		s := &SQLite3{
+			File:       ":memory:",
+			KeySecrets: []string{"b0ImTvMYHeANMw1Ri+aPaJEoV1fBBPBcv+kGa7K6XoY="},
+		}
+		conn, err := s.open(logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	withTimeout(time.Second*10, func() {
+		conformance.RunTests(t, newStorage)
+	})
+}
+
 func getenv(key, defaultVal string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
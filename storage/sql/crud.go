@@ -100,6 +100,53 @@ func (c *conn) GarbageCollect(now time.Time) (result storage.GCResult, err error
 	if n, err := r.RowsAffected(); err == nil {
 		result.AuthCodes = n
 	}
+
+	r, err = c.Exec(`delete from device_request where expiry < $1`, now)
+	if err != nil {
+		return result, fmt.Errorf("gc device_request: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.DeviceRequests = n
+	}
+
+	r, err = c.Exec(`delete from device_token where expiry < $1`, now)
+	if err != nil {
+		return result, fmt.Errorf("gc device_token: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.DeviceTokens = n
+	}
+
+	r, err = c.Exec(`delete from client_assertion where expiry < $1`, now)
+	if err != nil {
+		return result, fmt.Errorf("gc client_assertion: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.ClientAssertions = n
+	}
+
+	// Refresh tokens with a zero expiry never expire.
+	r, err = c.Exec(`delete from refresh_token where expiry < $1 and expiry > $2`, now, time.Time{})
+	if err != nil {
+		return result, fmt.Errorf("gc refresh_token: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.RefreshTokens = n
+	}
+
+	// Rotated tokens are collected once their family has no other token left.
+	r, err = c.Exec(`
+		delete from refresh_token
+		where rotated = $1 and family_id not in (
+			select family_id from refresh_token where rotated = $2
+		)
+	`, true, false)
+	if err != nil {
+		return result, fmt.Errorf("gc rotated refresh_token: %v", err)
+	}
+	if n, err := r.RowsAffected(); err == nil {
+		result.RefreshTokens += n
+	}
 	return
 }
 
@@ -109,20 +156,27 @@ func (c *conn) CreateAuthRequest(a storage.AuthRequest) error {
 			id, client_id, response_types, scopes, redirect_uri, nonce, state,
 			force_approval_prompt, logged_in,
 			claims_user_id, claims_username, claims_email, claims_email_verified,
-			claims_groups,
+			claims_groups, claims_custom,
 			connector_id, connector_data,
-			expiry
+			expiry,
+			code_challenge, code_challenge_method,
+			login_hint, auth_time, response_mode,
+			claims_request
 		)
 		values (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19,
+			$20, $21, $22, $23, $24
 		);
 	`,
 		a.ID, a.ClientID, encoder(a.ResponseTypes), encoder(a.Scopes), a.RedirectURI, a.Nonce, a.State,
 		a.ForceApprovalPrompt, a.LoggedIn,
 		a.Claims.UserID, a.Claims.Username, a.Claims.Email, a.Claims.EmailVerified,
-		encoder(a.Claims.Groups),
+		encoder(a.Claims.Groups), encoder(a.Claims.CustomClaims),
 		a.ConnectorID, a.ConnectorData,
 		a.Expiry,
+		a.PKCE.CodeChallenge, a.PKCE.CodeChallengeMethod,
+		a.LoginHint, a.AuthTime, a.ResponseMode,
+		encoder(a.ClaimsRequest),
 	)
 	if err != nil {
 		return fmt.Errorf("insert auth request: %v", err)
@@ -148,17 +202,24 @@ func (c *conn) UpdateAuthRequest(id string, updater func(a storage.AuthRequest)
 				nonce = $5, state = $6, force_approval_prompt = $7, logged_in = $8,
 				claims_user_id = $9, claims_username = $10, claims_email = $11,
 				claims_email_verified = $12,
-				claims_groups = $13,
-				connector_id = $14, connector_data = $15,
-				expiry = $16
-			where id = $17;
+				claims_groups = $13, claims_custom = $14,
+				connector_id = $15, connector_data = $16,
+				expiry = $17,
+				code_challenge = $18, code_challenge_method = $19,
+				login_hint = $20, auth_time = $21, response_mode = $22,
+				claims_request = $23
+			where id = $24;
 		`,
 			a.ClientID, encoder(a.ResponseTypes), encoder(a.Scopes), a.RedirectURI, a.Nonce, a.State,
 			a.ForceApprovalPrompt, a.LoggedIn,
 			a.Claims.UserID, a.Claims.Username, a.Claims.Email, a.Claims.EmailVerified,
-			encoder(a.Claims.Groups),
+			encoder(a.Claims.Groups), encoder(a.Claims.CustomClaims),
 			a.ConnectorID, a.ConnectorData,
-			a.Expiry, r.ID,
+			a.Expiry,
+			a.PKCE.CodeChallenge, a.PKCE.CodeChallengeMethod,
+			a.LoginHint, a.AuthTime, a.ResponseMode,
+			encoder(a.ClaimsRequest),
+			r.ID,
 		)
 		if err != nil {
 			return fmt.Errorf("update auth request: %v", err)
@@ -178,15 +239,21 @@ func getAuthRequest(q querier, id string) (a storage.AuthRequest, err error) {
 			id, client_id, response_types, scopes, redirect_uri, nonce, state,
 			force_approval_prompt, logged_in,
 			claims_user_id, claims_username, claims_email, claims_email_verified,
-			claims_groups,
-			connector_id, connector_data, expiry
+			claims_groups, claims_custom,
+			connector_id, connector_data, expiry,
+			code_challenge, code_challenge_method,
+			login_hint, auth_time, response_mode,
+			claims_request
 		from auth_request where id = $1;
 	`, id).Scan(
 		&a.ID, &a.ClientID, decoder(&a.ResponseTypes), decoder(&a.Scopes), &a.RedirectURI, &a.Nonce, &a.State,
 		&a.ForceApprovalPrompt, &a.LoggedIn,
 		&a.Claims.UserID, &a.Claims.Username, &a.Claims.Email, &a.Claims.EmailVerified,
-		decoder(&a.Claims.Groups),
+		decoder(&a.Claims.Groups), decoder(&a.Claims.CustomClaims),
 		&a.ConnectorID, &a.ConnectorData, &a.Expiry,
+		&a.PKCE.CodeChallenge, &a.PKCE.CodeChallengeMethod,
+		&a.LoginHint, &a.AuthTime, &a.ResponseMode,
+		decoder(&a.ClaimsRequest),
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -202,15 +269,20 @@ func (c *conn) CreateAuthCode(a storage.AuthCode) error {
 		insert into auth_code (
 			id, client_id, scopes, nonce, redirect_uri,
 			claims_user_id, claims_username,
-			claims_email, claims_email_verified, claims_groups,
+			claims_email, claims_email_verified, claims_groups, claims_custom,
 			connector_id, connector_data,
-			expiry
+			expiry,
+			code_challenge, code_challenge_method,
+			auth_time, claims_request
 		)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18);
 	`,
 		a.ID, a.ClientID, encoder(a.Scopes), a.Nonce, a.RedirectURI, a.Claims.UserID,
 		a.Claims.Username, a.Claims.Email, a.Claims.EmailVerified, encoder(a.Claims.Groups),
+		encoder(a.Claims.CustomClaims),
 		a.ConnectorID, a.ConnectorData, a.Expiry,
+		a.PKCE.CodeChallenge, a.PKCE.CodeChallengeMethod,
+		a.AuthTime, encoder(a.ClaimsRequest),
 	)
 	return err
 }
@@ -220,14 +292,19 @@ func (c *conn) GetAuthCode(id string) (a storage.AuthCode, err error) {
 		select
 			id, client_id, scopes, nonce, redirect_uri,
 			claims_user_id, claims_username,
-			claims_email, claims_email_verified, claims_groups,
+			claims_email, claims_email_verified, claims_groups, claims_custom,
 			connector_id, connector_data,
-			expiry
+			expiry,
+			code_challenge, code_challenge_method,
+			auth_time, claims_request
 		from auth_code where id = $1;
 	`, id).Scan(
 		&a.ID, &a.ClientID, decoder(&a.Scopes), &a.Nonce, &a.RedirectURI, &a.Claims.UserID,
 		&a.Claims.Username, &a.Claims.Email, &a.Claims.EmailVerified, decoder(&a.Claims.Groups),
+		decoder(&a.Claims.CustomClaims),
 		&a.ConnectorID, &a.ConnectorData, &a.Expiry,
+		&a.PKCE.CodeChallenge, &a.PKCE.CodeChallengeMethod,
+		&a.AuthTime, decoder(&a.ClaimsRequest),
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -243,15 +320,22 @@ func (c *conn) CreateRefresh(r storage.RefreshToken) error {
 		insert into refresh_token (
 			id, client_id, scopes, nonce,
 			claims_user_id, claims_username, claims_email, claims_email_verified,
-			claims_groups,
-			connector_id, connector_data
+			claims_groups, claims_custom,
+			connector_id, connector_data,
+			auth_time, claims_request, cert_thumbprint,
+			family_id, rotated, next_token, created_at, last_used, expiry
 		)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+		values (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+			$16, $17, $18, $19, $20, $21
+		);
 	`,
 		r.RefreshToken, r.ClientID, encoder(r.Scopes), r.Nonce,
 		r.Claims.UserID, r.Claims.Username, r.Claims.Email, r.Claims.EmailVerified,
-		encoder(r.Claims.Groups),
+		encoder(r.Claims.Groups), encoder(r.Claims.CustomClaims),
 		r.ConnectorID, r.ConnectorData,
+		r.AuthTime, encoder(r.ClaimsRequest), r.CertThumbprint,
+		r.FamilyID, r.Rotated, r.NextToken, r.CreatedAt, r.LastUsed, r.Expiry,
 	)
 	if err != nil {
 		return fmt.Errorf("insert refresh_token: %v", err)
@@ -259,13 +343,70 @@ func (c *conn) CreateRefresh(r storage.RefreshToken) error {
 	return nil
 }
 
+func (c *conn) UpdateRefreshToken(id string, updater func(old storage.RefreshToken) (storage.RefreshToken, error)) error {
+	return c.ExecTx(func(tx *trans) error {
+		r, err := getRefresh(tx, id)
+		if err != nil {
+			return err
+		}
+		nr, err := updater(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			update refresh_token
+			set
+				client_id = $1,
+				scopes = $2,
+				nonce = $3,
+				claims_user_id = $4,
+				claims_username = $5,
+				claims_email = $6,
+				claims_email_verified = $7,
+				claims_groups = $8,
+				claims_custom = $9,
+				connector_id = $10,
+				connector_data = $11,
+				auth_time = $12,
+				claims_request = $13,
+				cert_thumbprint = $14,
+				family_id = $15,
+				rotated = $16,
+				next_token = $17,
+				created_at = $18,
+				last_used = $19,
+				expiry = $20
+			where id = $21;
+		`,
+			nr.ClientID, encoder(nr.Scopes), nr.Nonce,
+			nr.Claims.UserID, nr.Claims.Username, nr.Claims.Email, nr.Claims.EmailVerified,
+			encoder(nr.Claims.Groups), encoder(nr.Claims.CustomClaims),
+			nr.ConnectorID, nr.ConnectorData,
+			nr.AuthTime, encoder(nr.ClaimsRequest), nr.CertThumbprint,
+			nr.FamilyID, nr.Rotated, nr.NextToken, nr.CreatedAt, nr.LastUsed, nr.Expiry,
+			id,
+		)
+		if err != nil {
+			return fmt.Errorf("update refresh_token: %v", err)
+		}
+		return nil
+	})
+}
+
 func (c *conn) GetRefresh(id string) (storage.RefreshToken, error) {
-	return scanRefresh(c.QueryRow(`
+	return getRefresh(c, id)
+}
+
+func getRefresh(q querier, id string) (storage.RefreshToken, error) {
+	return scanRefresh(q.QueryRow(`
 		select
 			id, client_id, scopes, nonce,
 			claims_user_id, claims_username, claims_email, claims_email_verified,
-			claims_groups,
-			connector_id, connector_data
+			claims_groups, claims_custom,
+			connector_id, connector_data,
+			auth_time, claims_request, cert_thumbprint,
+			family_id, rotated, next_token, created_at, last_used, expiry
 		from refresh_token where id = $1;
 	`, id))
 }
@@ -275,8 +416,10 @@ func (c *conn) ListRefreshTokens() ([]storage.RefreshToken, error) {
 		select
 			id, client_id, scopes, nonce,
 			claims_user_id, claims_username, claims_email, claims_email_verified,
-			claims_groups,
-			connector_id, connector_data
+			claims_groups, claims_custom,
+			connector_id, connector_data,
+			auth_time, claims_request, cert_thumbprint,
+			family_id, rotated, next_token, created_at, last_used, expiry
 		from refresh_token;
 	`)
 	if err != nil {
@@ -300,8 +443,10 @@ func scanRefresh(s scanner) (r storage.RefreshToken, err error) {
 	err = s.Scan(
 		&r.RefreshToken, &r.ClientID, decoder(&r.Scopes), &r.Nonce,
 		&r.Claims.UserID, &r.Claims.Username, &r.Claims.Email, &r.Claims.EmailVerified,
-		decoder(&r.Claims.Groups),
+		decoder(&r.Claims.Groups), decoder(&r.Claims.CustomClaims),
 		&r.ConnectorID, &r.ConnectorData,
+		&r.AuthTime, decoder(&r.ClaimsRequest), &r.CertThumbprint,
+		&r.FamilyID, &r.Rotated, &r.NextToken, &r.CreatedAt, &r.LastUsed, &r.Expiry,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -317,7 +462,7 @@ func (c *conn) UpdateKeys(updater func(old storage.Keys) (storage.Keys, error))
 		firstUpdate := false
 		// TODO(ericchiang): errors may cause a transaction be rolled back by the SQL
 		// server. Test this, and consider adding a COUNT() command beforehand.
-		old, err := getKeys(tx)
+		old, _, err := getKeys(tx, c.keySecrets)
 		if err != nil {
 			if err != storage.ErrNotFound {
 				return fmt.Errorf("get keys: %v", err)
@@ -331,15 +476,26 @@ func (c *conn) UpdateKeys(updater func(old storage.Keys) (storage.Keys, error))
 			return err
 		}
 
+		signingKey, err := c.keySecrets.EncryptKey(nk.SigningKey)
+		if err != nil {
+			return err
+		}
+		additionalSigningKeys, err := c.keySecrets.EncryptKeyPairs(nk.AdditionalSigningKeys)
+		if err != nil {
+			return err
+		}
+
 		if firstUpdate {
 			_, err = tx.Exec(`
 				insert into keys (
-					id, verification_keys, signing_key, signing_key_pub, next_rotation
+					id, verification_keys, signing_key, signing_key_pub, next_rotation,
+					additional_signing_keys
 				)
-				values ($1, $2, $3, $4, $5);
+				values ($1, $2, $3, $4, $5, $6);
 			`,
-				keysRowID, encoder(nk.VerificationKeys), encoder(nk.SigningKey),
+				keysRowID, encoder(nk.VerificationKeys), encoder(signingKey),
 				encoder(nk.SigningKeyPub), nk.NextRotation,
+				encoder(additionalSigningKeys),
 			)
 			if err != nil {
 				return fmt.Errorf("insert: %v", err)
@@ -351,11 +507,13 @@ func (c *conn) UpdateKeys(updater func(old storage.Keys) (storage.Keys, error))
 				    verification_keys = $1,
 					signing_key = $2,
 					signing_key_pub = $3,
-					next_rotation = $4
-				where id = $5;
+					next_rotation = $4,
+					additional_signing_keys = $5
+				where id = $6;
 			`,
-				encoder(nk.VerificationKeys), encoder(nk.SigningKey),
-				encoder(nk.SigningKeyPub), nk.NextRotation, keysRowID,
+				encoder(nk.VerificationKeys), encoder(signingKey),
+				encoder(nk.SigningKeyPub), nk.NextRotation,
+				encoder(additionalSigningKeys), keysRowID,
 			)
 			if err != nil {
 				return fmt.Errorf("update: %v", err)
@@ -366,26 +524,60 @@ func (c *conn) UpdateKeys(updater func(old storage.Keys) (storage.Keys, error))
 }
 
 func (c *conn) GetKeys() (keys storage.Keys, err error) {
-	return getKeys(c)
+	keys, _, err = getKeys(c, c.keySecrets)
+	return keys, err
 }
 
-func getKeys(q querier) (keys storage.Keys, err error) {
+// getKeys returns the keys, decrypting the private keys. They're stale if they
+// should be encrypted again with the current key secret.
+func getKeys(q querier, secrets storage.KeySecrets) (keys storage.Keys, stale bool, err error) {
+	var (
+		signingKey            json.RawMessage
+		additionalSigningKeys []storage.EncryptedSigningKeyPair
+	)
 	err = q.QueryRow(`
 		select
-			verification_keys, signing_key, signing_key_pub, next_rotation
+			verification_keys, signing_key, signing_key_pub, next_rotation,
+			additional_signing_keys
 		from keys
 		where id=$1
 	`, keysRowID).Scan(
-		decoder(&keys.VerificationKeys), decoder(&keys.SigningKey),
+		decoder(&keys.VerificationKeys), decoder(&signingKey),
 		decoder(&keys.SigningKeyPub), &keys.NextRotation,
+		decoder(&additionalSigningKeys),
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return keys, storage.ErrNotFound
+			return keys, false, storage.ErrNotFound
 		}
-		return keys, fmt.Errorf("query keys: %v", err)
+		return keys, false, fmt.Errorf("query keys: %v", err)
 	}
-	return keys, nil
+
+	var pairsStale bool
+	if keys.SigningKey, stale, err = secrets.DecryptKey(signingKey); err != nil {
+		return keys, false, fmt.Errorf("decrypt signing key: %v", err)
+	}
+	if keys.AdditionalSigningKeys, pairsStale, err = secrets.DecryptKeyPairs(additionalSigningKeys); err != nil {
+		return keys, false, fmt.Errorf("decrypt additional signing keys: %v", err)
+	}
+	return keys, stale || pairsStale, nil
+}
+
+// reencryptKeys encrypts the keys again if they aren't encrypted with the current
+// key secret, for instance after secrets were rotated.
+func (c *conn) reencryptKeys() error {
+	_, stale, err := getKeys(c, c.keySecrets)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if !stale {
+		return nil
+	}
+	c.logger.Infof("re-encrypting signing keys with the current key secret")
+	return c.UpdateKeys(func(old storage.Keys) (storage.Keys, error) { return old, nil })
 }
 
 func (c *conn) UpdateClient(id string, updater func(old storage.Client) (storage.Client, error)) error {
@@ -407,9 +599,31 @@ func (c *conn) UpdateClient(id string, updater func(old storage.Client) (storage
 				trusted_peers = $3,
 				public = $4,
 				name = $5,
-				logo_url = $6
-			where id = $7;
-		`, nc.Secret, encoder(nc.RedirectURIs), encoder(nc.TrustedPeers), nc.Public, nc.Name, nc.LogoURL, id,
+				logo_url = $6,
+				post_logout_redirect_uris = $7,
+				allow_client_credentials = $8,
+				allowed_scopes = $9,
+				allow_password_grant = $10,
+				jwks = $11,
+				id_token_signed_response_alg = $12,
+				subject_type = $13,
+				sector_identifier = $14,
+				claim_mappings = $15,
+				jwks_uri = $16,
+				token_endpoint_auth_method = $17,
+				tls_client_auth_subject_dn = $18,
+				tls_client_certificate_thumbprint = $19,
+				secret_hash = $20,
+				registration_access_token_hash = $21,
+				request_uris = $22
+			where id = $23;
+		`, nc.Secret, encoder(nc.RedirectURIs), encoder(nc.TrustedPeers), nc.Public, nc.Name, nc.LogoURL,
+			encoder(nc.PostLogoutRedirectURIs), nc.AllowClientCredentials, encoder(nc.AllowedScopes),
+			nc.AllowPasswordGrant, encoder(nc.JWKS), nc.IDTokenSignedResponseAlg,
+			nc.SubjectType, nc.SectorIdentifier, encoder(nc.ClaimMappings),
+			nc.JWKSURI, nc.TokenEndpointAuthMethod,
+			nc.TLSClientAuthSubjectDN, nc.TLSClientCertificateThumbprint, nc.SecretHash,
+			nc.RegistrationAccessTokenHash, encoder(nc.RequestURIs), id,
 		)
 		if err != nil {
 			return fmt.Errorf("update client: %v", err)
@@ -421,12 +635,24 @@ func (c *conn) UpdateClient(id string, updater func(old storage.Client) (storage
 func (c *conn) CreateClient(cli storage.Client) error {
 	_, err := c.Exec(`
 		insert into client (
-			id, secret, redirect_uris, trusted_peers, public, name, logo_url
+			id, secret, redirect_uris, trusted_peers, public, name, logo_url,
+			post_logout_redirect_uris, allow_client_credentials, allowed_scopes,
+			allow_password_grant, jwks, id_token_signed_response_alg,
+			subject_type, sector_identifier, claim_mappings,
+			jwks_uri, token_endpoint_auth_method,
+			tls_client_auth_subject_dn, tls_client_certificate_thumbprint, secret_hash,
+			registration_access_token_hash, request_uris
 		)
-		values ($1, $2, $3, $4, $5, $6, $7);
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23);
 	`,
 		cli.ID, cli.Secret, encoder(cli.RedirectURIs), encoder(cli.TrustedPeers),
-		cli.Public, cli.Name, cli.LogoURL,
+		cli.Public, cli.Name, cli.LogoURL, encoder(cli.PostLogoutRedirectURIs),
+		cli.AllowClientCredentials, encoder(cli.AllowedScopes), cli.AllowPasswordGrant,
+		encoder(cli.JWKS), cli.IDTokenSignedResponseAlg, cli.SubjectType,
+		cli.SectorIdentifier, encoder(cli.ClaimMappings),
+		cli.JWKSURI, cli.TokenEndpointAuthMethod,
+		cli.TLSClientAuthSubjectDN, cli.TLSClientCertificateThumbprint, cli.SecretHash,
+		cli.RegistrationAccessTokenHash, encoder(cli.RequestURIs),
 	)
 	if err != nil {
 		return fmt.Errorf("insert client: %v", err)
@@ -437,7 +663,13 @@ func (c *conn) CreateClient(cli storage.Client) error {
 func getClient(q querier, id string) (storage.Client, error) {
 	return scanClient(q.QueryRow(`
 		select
-			id, secret, redirect_uris, trusted_peers, public, name, logo_url
+			id, secret, redirect_uris, trusted_peers, public, name, logo_url,
+			post_logout_redirect_uris, allow_client_credentials, allowed_scopes,
+			allow_password_grant, jwks, id_token_signed_response_alg,
+			subject_type, sector_identifier, claim_mappings,
+			jwks_uri, token_endpoint_auth_method,
+			tls_client_auth_subject_dn, tls_client_certificate_thumbprint, secret_hash,
+			registration_access_token_hash, request_uris
 	    from client where id = $1;
 	`, id))
 }
@@ -449,7 +681,13 @@ func (c *conn) GetClient(id string) (storage.Client, error) {
 func (c *conn) ListClients() ([]storage.Client, error) {
 	rows, err := c.Query(`
 		select
-			id, secret, redirect_uris, trusted_peers, public, name, logo_url
+			id, secret, redirect_uris, trusted_peers, public, name, logo_url,
+			post_logout_redirect_uris, allow_client_credentials, allowed_scopes,
+			allow_password_grant, jwks, id_token_signed_response_alg,
+			subject_type, sector_identifier, claim_mappings,
+			jwks_uri, token_endpoint_auth_method,
+			tls_client_auth_subject_dn, tls_client_certificate_thumbprint, secret_hash,
+			registration_access_token_hash, request_uris
 		from client;
 	`)
 	if err != nil {
@@ -472,7 +710,13 @@ func (c *conn) ListClients() ([]storage.Client, error) {
 func scanClient(s scanner) (cli storage.Client, err error) {
 	err = s.Scan(
 		&cli.ID, &cli.Secret, decoder(&cli.RedirectURIs), decoder(&cli.TrustedPeers),
-		&cli.Public, &cli.Name, &cli.LogoURL,
+		&cli.Public, &cli.Name, &cli.LogoURL, decoder(&cli.PostLogoutRedirectURIs),
+		&cli.AllowClientCredentials, decoder(&cli.AllowedScopes), &cli.AllowPasswordGrant,
+		decoder(&cli.JWKS), &cli.IDTokenSignedResponseAlg, &cli.SubjectType,
+		&cli.SectorIdentifier, decoder(&cli.ClaimMappings),
+		&cli.JWKSURI, &cli.TokenEndpointAuthMethod,
+		&cli.TLSClientAuthSubjectDN, &cli.TLSClientCertificateThumbprint, &cli.SecretHash,
+		&cli.RegistrationAccessTokenHash, decoder(&cli.RequestURIs),
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -576,6 +820,122 @@ func scanPassword(s scanner) (p storage.Password, err error) {
 	return p, nil
 }
 
+func (c *conn) CreateDeviceRequest(d storage.DeviceRequest) error {
+	_, err := c.Exec(`
+		insert into device_request (
+			user_code, device_code, client_id, scopes, expiry
+		)
+		values ($1, $2, $3, $4, $5);
+	`,
+		d.UserCode, d.DeviceCode, d.ClientID, encoder(d.Scopes), d.Expiry,
+	)
+	if err != nil {
+		return fmt.Errorf("insert device request: %v", err)
+	}
+	return nil
+}
+
+func (c *conn) GetDeviceRequest(userCode string) (d storage.DeviceRequest, err error) {
+	err = c.QueryRow(`
+		select
+			user_code, device_code, client_id, scopes, expiry
+		from device_request where user_code = $1;
+	`, userCode).Scan(
+		&d.UserCode, &d.DeviceCode, &d.ClientID, decoder(&d.Scopes), &d.Expiry,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return d, storage.ErrNotFound
+		}
+		return d, fmt.Errorf("select device request: %v", err)
+	}
+	return d, nil
+}
+
+func (c *conn) CreateDeviceToken(t storage.DeviceToken) error {
+	_, err := c.Exec(`
+		insert into device_token (
+			device_code, client_id, status, token, expiry, last_request, poll_interval
+		)
+		values ($1, $2, $3, $4, $5, $6, $7);
+	`,
+		t.DeviceCode, t.ClientID, t.Status, t.Token, t.Expiry, t.LastRequestTime, t.PollIntervalSeconds,
+	)
+	if err != nil {
+		return fmt.Errorf("insert device token: %v", err)
+	}
+	return nil
+}
+
+func (c *conn) UpdateDeviceToken(deviceCode string, updater func(old storage.DeviceToken) (storage.DeviceToken, error)) error {
+	return c.ExecTx(func(tx *trans) error {
+		t, err := getDeviceToken(tx, deviceCode)
+		if err != nil {
+			return err
+		}
+
+		nt, err := updater(t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			update device_token
+			set
+				client_id = $1, status = $2, token = $3, expiry = $4, last_request = $5,
+				poll_interval = $6
+			where device_code = $7;
+		`,
+			nt.ClientID, nt.Status, nt.Token, nt.Expiry, nt.LastRequestTime, nt.PollIntervalSeconds,
+			t.DeviceCode,
+		)
+		if err != nil {
+			return fmt.Errorf("update device token: %v", err)
+		}
+		return nil
+	})
+}
+
+func (c *conn) GetDeviceToken(deviceCode string) (storage.DeviceToken, error) {
+	return getDeviceToken(c, deviceCode)
+}
+
+func getDeviceToken(q querier, deviceCode string) (t storage.DeviceToken, err error) {
+	err = q.QueryRow(`
+		select
+			device_code, client_id, status, token, expiry, last_request, poll_interval
+		from device_token where device_code = $1;
+	`, deviceCode).Scan(
+		&t.DeviceCode, &t.ClientID, &t.Status, &t.Token, &t.Expiry, &t.LastRequestTime, &t.PollIntervalSeconds,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, storage.ErrNotFound
+		}
+		return t, fmt.Errorf("select device token: %v", err)
+	}
+	return t, nil
+}
+
+func (c *conn) CreateClientAssertion(a storage.ClientAssertion) error {
+	return c.ExecTx(func(tx *trans) error {
+		var n int
+		if err := tx.QueryRow(`select count(*) from client_assertion where id = $1;`, a.ID).Scan(&n); err != nil {
+			return fmt.Errorf("select client assertion: %v", err)
+		}
+		if n > 0 {
+			return storage.ErrAlreadyExists
+		}
+		_, err := tx.Exec(`
+			insert into client_assertion (id, client_id, expiry)
+			values ($1, $2, $3);
+		`, a.ID, a.ClientID, a.Expiry)
+		if err != nil {
+			return fmt.Errorf("insert client assertion: %v", err)
+		}
+		return nil
+	})
+}
+
 func (c *conn) DeleteAuthRequest(id string) error { return c.delete("auth_request", "id", id) }
 func (c *conn) DeleteAuthCode(id string) error    { return c.delete("auth_code", "id", id) }
 func (c *conn) DeleteClient(id string) error      { return c.delete("client", "id", id) }
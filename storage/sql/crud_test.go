@@ -1,9 +1,23 @@
 package sql
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/coreos/dex/storage"
 )
 
 func TestDecoder(t *testing.T) {
@@ -53,3 +67,119 @@ func TestEncoder(t *testing.T) {
 		t.Errorf("wanted %q got %q", want, got)
 	}
 }
+
+func TestKeySecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dex.db")
+
+	var (
+		secret1 = "b0ImTvMYHeANMw1Ri+aPaJEoV1fBBPBcv+kGa7K6XoY="
+		secret2 = "4LrTqJHZLIpeS40ALJY7+r1Zsv+o/E7jKHHwuXfvJuE="
+		secret3 = "3JBnixlmyyntBjL0pbZVJkLhAIKpq8JMf8YtDfAEbuE="
+	)
+	open := func(secrets ...string) (*conn, error) {
+		s := &SQLite3{File: file, KeySecrets: secrets}
+		return s.open(logger)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Round trip the keys through JSON so they compare equal to the stored keys.
+	roundTrip := func(key *jose.JSONWebKey) *jose.JSONWebKey {
+		data, err := json.Marshal(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key = new(jose.JSONWebKey)
+		if err := json.Unmarshal(data, key); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	priv := roundTrip(&jose.JSONWebKey{Key: rsaKey, KeyID: "foo", Algorithm: "RS256", Use: "sig"})
+	pub := roundTrip(&jose.JSONWebKey{Key: rsaKey.Public(), KeyID: "foo", Algorithm: "RS256", Use: "sig"})
+	want := storage.Keys{
+		SigningKey:    priv,
+		SigningKeyPub: pub,
+		AdditionalSigningKeys: []storage.SigningKeyPair{
+			{PrivateKey: priv, PublicKey: pub},
+		},
+		NextRotation: time.Now().UTC().Round(time.Millisecond),
+	}
+
+	// rawKeys returns the persisted private keys.
+	rawKeys := func(c *conn) string {
+		var signingKey, additionalSigningKeys []byte
+		err := c.QueryRow(`
+			select signing_key, additional_signing_keys from keys where id = $1;
+		`, keysRowID).Scan(&signingKey, &additionalSigningKeys)
+		if err != nil {
+			t.Fatalf("query keys: %v", err)
+		}
+		return string(signingKey) + string(additionalSigningKeys)
+	}
+	privateExponent := base64.RawURLEncoding.EncodeToString(rsaKey.D.Bytes())
+
+	checkKeys := func(c *conn) {
+		got, err := c.GetKeys()
+		if err != nil {
+			t.Fatalf("get keys: %v", err)
+		}
+		if diff := pretty.Compare(want, got); diff != "" {
+			t.Errorf("keys retrieved from storage did not match: %s", diff)
+		}
+	}
+
+	// Keys stored before secrets are configured are encrypted once they are.
+	c, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateKeys(func(old storage.Keys) (storage.Keys, error) { return want, nil }); err != nil {
+		t.Fatalf("update keys: %v", err)
+	}
+	c.Close()
+
+	if c, err = open(secret1); err != nil {
+		t.Fatal(err)
+	}
+	if raw := rawKeys(c); strings.Contains(raw, privateExponent) {
+		t.Errorf("expected private keys to be encrypted, got %s", raw)
+	}
+	checkKeys(c)
+	encrypted := rawKeys(c)
+	c.Close()
+
+	// Rotating secrets encrypts the keys with the new secret.
+	if c, err = open(secret2, secret1); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(c)
+	if raw := rawKeys(c); raw == encrypted {
+		t.Errorf("expected keys to be encrypted with the new secret")
+	}
+	c.Close()
+
+	// The old secret can then be removed.
+	if c, err = open(secret2); err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(c)
+	c.Close()
+
+	if _, err := open(secret3); err == nil {
+		t.Errorf("expected keys encrypted with another secret to be rejected")
+	}
+	if _, err := open(); err == nil {
+		t.Errorf("expected encrypted keys to be rejected without secrets")
+	}
+	if _, err := open("bm90IDMyIGJ5dGVz"); err == nil {
+		t.Errorf("expected secret which isn't 32 bytes to be rejected")
+	}
+}
@@ -155,4 +155,184 @@ var migrations = []migration{
 			);
 		`,
 	},
+	{
+		stmt: `
+			alter table auth_request
+				add column code_challenge text not null default '';
+			alter table auth_request
+				add column code_challenge_method text not null default '';
+			alter table auth_code
+				add column code_challenge text not null default '';
+			alter table auth_code
+				add column code_challenge_method text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column post_logout_redirect_uris bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column allow_client_credentials boolean not null default false;
+			alter table client
+				add column allowed_scopes bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			create table device_request (
+				user_code text not null primary key,
+				device_code text not null,
+				client_id text not null,
+				scopes bytea not null, -- JSON array of strings
+				expiry timestamptz not null
+			);
+
+			create table device_token (
+				device_code text not null primary key,
+				client_id text not null,
+				status text not null,
+				token bytea,
+				expiry timestamptz not null,
+				last_request timestamptz not null,
+				poll_interval integer not null
+			);
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column allow_password_grant boolean not null default false;
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column login_hint text not null default '';
+			alter table auth_request
+				add column auth_time timestamptz not null default '0001-01-01 00:00:00+00:00';
+			alter table auth_code
+				add column auth_time timestamptz not null default '0001-01-01 00:00:00+00:00';
+			alter table refresh_token
+				add column auth_time timestamptz not null default '0001-01-01 00:00:00+00:00';
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column response_mode text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column jwks bytea not null default 'null';
+		`,
+	},
+	{
+		stmt: `
+			alter table keys
+				add column additional_signing_keys bytea not null default 'null'; -- JSON array
+			alter table client
+				add column id_token_signed_response_alg text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column subject_type text not null default '';
+			alter table client
+				add column sector_identifier text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column claims_custom bytea not null default 'null'; -- JSON object
+			alter table auth_code
+				add column claims_custom bytea not null default 'null'; -- JSON object
+			alter table refresh_token
+				add column claims_custom bytea not null default 'null'; -- JSON object
+			alter table client
+				add column claim_mappings bytea not null default 'null'; -- JSON array
+		`,
+	},
+	{
+		stmt: `
+			alter table auth_request
+				add column claims_request bytea not null default 'null'; -- JSON object
+			alter table auth_code
+				add column claims_request bytea not null default 'null'; -- JSON object
+			alter table refresh_token
+				add column claims_request bytea not null default 'null'; -- JSON object
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column jwks_uri text not null default '';
+			alter table client
+				add column token_endpoint_auth_method text not null default '';
+
+			create table client_assertion (
+				id text not null primary key,
+				client_id text not null,
+				expiry timestamptz not null
+			);
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column tls_client_auth_subject_dn text not null default '';
+			alter table client
+				add column tls_client_certificate_thumbprint text not null default '';
+			alter table refresh_token
+				add column cert_thumbprint text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column secret_hash text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column registration_access_token_hash text not null default '';
+		`,
+	},
+	{
+		stmt: `
+			alter table refresh_token
+				add column family_id text not null default '';
+			alter table refresh_token
+				add column rotated boolean not null default false;
+			alter table refresh_token
+				add column previous_token text not null default '';
+			alter table refresh_token
+				add column created_at timestamptz not null default '0001-01-01 00:00:00+00:00';
+			alter table refresh_token
+				add column last_used timestamptz not null default '0001-01-01 00:00:00+00:00';
+			alter table refresh_token
+				add column expiry timestamptz not null default '0001-01-01 00:00:00+00:00';
+		`,
+	},
+	{
+		stmt: `
+			alter table client
+				add column request_uris bytea not null default 'null'; -- JSON array of strings
+		`,
+	},
+	{
+		stmt: `
+			alter table refresh_token
+				rename column previous_token to next_token;
+			update refresh_token set next_token = '';
+		`,
+	},
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/coreos/dex/storage"
 
 	// import third party drivers
 	_ "github.com/go-sql-driver/mysql"
@@ -134,6 +135,9 @@ type conn struct {
 	db     *sql.DB
 	flavor flavor
 	logger logrus.FieldLogger
+
+	// Secrets encrypting private signing keys. If empty, keys aren't encrypted.
+	keySecrets storage.KeySecrets
 }
 
 func (c *conn) Close() error {
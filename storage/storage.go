@@ -40,8 +40,12 @@ func NewID() string {
 
 // GCResult returns the number of objects deleted by garbage collection.
 type GCResult struct {
-	AuthRequests int64
-	AuthCodes    int64
+	AuthRequests     int64
+	AuthCodes        int64
+	DeviceRequests   int64
+	DeviceTokens     int64
+	ClientAssertions int64
+	RefreshTokens    int64
 }
 
 // Storage is the storage interface used by the server. Implementations are
@@ -56,6 +60,12 @@ type Storage interface {
 	CreateAuthCode(c AuthCode) error
 	CreateRefresh(r RefreshToken) error
 	CreatePassword(p Password) error
+	CreateDeviceRequest(d DeviceRequest) error
+	CreateDeviceToken(t DeviceToken) error
+
+	// CreateClientAssertion returns ErrAlreadyExists if the assertion has been
+	// created before, which means it's being replayed.
+	CreateClientAssertion(a ClientAssertion) error
 
 	// TODO(ericchiang): return (T, bool, error) so we can indicate not found
 	// requests that way instead of using ErrNotFound.
@@ -65,6 +75,8 @@ type Storage interface {
 	GetKeys() (Keys, error)
 	GetRefresh(id string) (RefreshToken, error)
 	GetPassword(email string) (Password, error)
+	GetDeviceRequest(userCode string) (DeviceRequest, error)
+	GetDeviceToken(deviceCode string) (DeviceToken, error)
 
 	ListClients() ([]Client, error)
 	ListRefreshTokens() ([]RefreshToken, error)
@@ -95,8 +107,13 @@ type Storage interface {
 	UpdateKeys(updater func(old Keys) (Keys, error)) error
 	UpdateAuthRequest(id string, updater func(a AuthRequest) (AuthRequest, error)) error
 	UpdatePassword(email string, updater func(p Password) (Password, error)) error
+	UpdateDeviceToken(deviceCode string, updater func(t DeviceToken) (DeviceToken, error)) error
+	UpdateRefreshToken(id string, updater func(old RefreshToken) (RefreshToken, error)) error
 
-	// GarbageCollect deletes all expired AuthCodes and AuthRequests.
+	// GarbageCollect deletes all expired AuthCodes, AuthRequests, DeviceRequests,
+	// DeviceTokens, ClientAssertions and RefreshTokens. RefreshTokens with a zero
+	// expiry never expire. Rotated RefreshTokens are deleted once every other token
+	// of their family is rotated or gone.
 	GarbageCollect(now time.Time) (GCResult, error)
 }
 
@@ -110,10 +127,20 @@ type Client struct {
 	ID     string `json:"id" yaml:"id"`
 	Secret string `json:"secret" yaml:"secret"`
 
+	// SecretHash is a bcrypt hash of the client's secret, stored instead of Secret
+	// so the storage doesn't reveal it. Clients which sign JWTs with their secret,
+	// using "client_secret_jwt", keep it in plaintext since it's needed to verify
+	// them.
+	SecretHash string `json:"secretHash" yaml:"secretHash"`
+
 	// A registered set of redirect URIs. When redirecting from dex to the client, the URI
 	// requested to redirect to MUST match one of these values, unless the client is "public".
 	RedirectURIs []string `json:"redirectURIs" yaml:"redirectURIs"`
 
+	// A registered set of URIs the end user may be sent back to after logging out
+	// through the end session endpoint. Values must match exactly.
+	PostLogoutRedirectURIs []string `json:"postLogoutRedirectURIs" yaml:"postLogoutRedirectURIs"`
+
 	// TrustedPeers are a list of peers which can issue tokens on this client's behalf using
 	// the dynamic "oauth2:server:client_id:(client_id)" scope. If a peer makes such a request,
 	// this client's ID will appear as the ID Token's audience.
@@ -124,11 +151,100 @@ type Client struct {
 	// Public clients must use either use a redirectURL 127.0.0.1:X or "urn:ietf:wg:oauth:2.0:oob"
 	Public bool `json:"public" yaml:"public"`
 
+	// AllowClientCredentials lets the client request tokens for itself, rather than
+	// an end user, using the "client_credentials" grant. The scopes it may request
+	// are limited to AllowedScopes.
+	AllowClientCredentials bool     `json:"allowClientCredentials" yaml:"allowClientCredentials"`
+	AllowedScopes          []string `json:"allowedScopes" yaml:"allowedScopes"`
+
+	// AllowPasswordGrant lets the client exchange an end user's username and password
+	// for tokens directly, using the "password" grant. The credentials are checked by
+	// a connector that supports password logins.
+	AllowPasswordGrant bool `json:"allowPasswordGrant" yaml:"allowPasswordGrant"`
+
+	// JWKS holds the public keys of the client. They're used to verify request
+	// objects the client signs to protect its authorization requests from tampering,
+	// and JWTs the client authenticates with.
+	JWKS *jose.JSONWebKeySet `json:"jwks" yaml:"jwks"`
+
+	// JWKSURI is an https URL where the client publishes its public keys, used
+	// instead of JWKS. The keys are cached for a few minutes once fetched.
+	JWKSURI string `json:"jwksURI" yaml:"jwksURI"`
+
+	// RequestURIs are the https URLs the client may pass request objects by
+	// reference from. Other request_uri values are never fetched.
+	RequestURIs []string `json:"requestURIs" yaml:"requestURIs"`
+
+	// TokenEndpointAuthMethod is the only way the client may authenticate to the
+	// token endpoint: "client_secret_basic", "client_secret_post",
+	// "client_secret_jwt", "private_key_jwt", "tls_client_auth" or
+	// "self_signed_tls_client_auth". If empty, the client may use any method it
+	// has credentials for. With "client_secret_jwt" the secret is stored in
+	// plaintext, so a copy of the storage reveals a working credential.
+	TokenEndpointAuthMethod string `json:"tokenEndpointAuthMethod" yaml:"tokenEndpointAuthMethod"`
+
+	// TLSClientAuthSubjectDN is the subject distinguished name of the certificate
+	// the client authenticates with using "tls_client_auth", in the format of RFC
+	// 4514. The certificate must be issued by one of the server's client CAs.
+	TLSClientAuthSubjectDN string `json:"tlsClientAuthSubjectDN" yaml:"tlsClientAuthSubjectDN"`
+
+	// TLSClientCertificateThumbprint is the base64url encoded SHA-256 thumbprint
+	// of the self-signed certificate the client authenticates with using
+	// "self_signed_tls_client_auth".
+	TLSClientCertificateThumbprint string `json:"tlsClientCertificateThumbprint" yaml:"tlsClientCertificateThumbprint"`
+
+	// RegistrationAccessTokenHash is the base64url encoded SHA-256 hash of the
+	// token a dynamically registered client manages its registration with. It's
+	// empty for other clients.
+	RegistrationAccessTokenHash string `json:"registrationAccessTokenHash" yaml:"registrationAccessTokenHash"`
+
+	// IDTokenSignedResponseAlg is the algorithm used to sign ID tokens issued to the
+	// client. It must be one of the server's signing algorithms. If empty, ID tokens
+	// are signed with the server's default algorithm.
+	IDTokenSignedResponseAlg string `json:"idTokenSignedResponseAlg" yaml:"idTokenSignedResponseAlg"`
+
+	// SubjectType is the kind of subject identifiers issued to the client, "public"
+	// or "pairwise". Public identifiers are the same for every client, pairwise ones
+	// differ between sectors so clients can't correlate end users. Defaults to
+	// "public".
+	SubjectType string `json:"subjectType" yaml:"subjectType"`
+
+	// SectorIdentifier groups clients which receive the same pairwise identifiers,
+	// e.g. "example.com". If empty, it's the host of the client's redirect URIs.
+	SectorIdentifier string `json:"sectorIdentifier" yaml:"sectorIdentifier"`
+
+	// ClaimMappings release the end user's custom claims to the client, in its ID
+	// tokens, access tokens and UserInfo responses. Custom claims without a
+	// mapping are never released.
+	ClaimMappings []ClaimMapping `json:"claimMappings" yaml:"claimMappings"`
+
 	// Name and LogoURL used when displaying this client to the end user.
 	Name    string `json:"name" yaml:"name"`
 	LogoURL string `json:"logoURL" yaml:"logoURL"`
 }
 
+// ClaimMapping releases a custom claim of the end user to a client. The value is
+// either copied from a custom claim, possibly renaming it, or rendered from a
+// template.
+type ClaimMapping struct {
+	// Claim is the name of the claim released to the client, e.g. "employee_id".
+	// It can't be one of the claims set by the server, such as "sub" or "email".
+	Claim string `json:"claim" yaml:"claim"`
+
+	// From is the name of the custom claim whose value is released. If the end
+	// user doesn't have the custom claim, the claim is left out.
+	From string `json:"from" yaml:"from"`
+
+	// Template is a Go text/template rendered with the custom claims to produce a
+	// string value, e.g. "{{.login}}@github.com". It's used instead of From. If a
+	// custom claim used by the template is missing, the claim is left out.
+	Template string `json:"template" yaml:"template"`
+
+	// Scope limits the claim to requests granted the scope, e.g. "profile". If
+	// empty, the claim is always released.
+	Scope string `json:"scope" yaml:"scope"`
+}
+
 // Claims represents the ID Token claims supported by the server.
 type Claims struct {
 	UserID        string
@@ -137,6 +253,10 @@ type Claims struct {
 	EmailVerified bool
 
 	Groups []string
+
+	// CustomClaims are the connector's claims beyond the ones above. They're
+	// released to clients according to their claim mappings.
+	CustomClaims map[string]interface{}
 }
 
 // AuthRequest represents a OAuth2 client authorization request. It holds the state
@@ -156,11 +276,26 @@ type AuthRequest struct {
 	Nonce         string
 	State         string
 
+	// How the response is returned to the redirect URI: "query", "fragment" or
+	// "form_post". If empty, the default mode of the response types is used.
+	ResponseMode string
+
 	// The client has indicated that the end user must be shown an approval prompt
 	// on all requests. The server cannot cache their initial action for subsequent
 	// attempts.
 	ForceApprovalPrompt bool
 
+	// Hint about the identifier the end user might use to login, such as their email
+	// address. Used to prefill the login form.
+	LoginHint string
+
+	// PKCE challenge supplied by the client. Carried over to the AuthCode so the
+	// token endpoint can check the code_verifier.
+	PKCE PKCE
+
+	// Claims requested individually through the "claims" parameter.
+	ClaimsRequest ClaimsRequest
+
 	Expiry time.Time
 
 	// Has the user proved their identity through a backing identity provider?
@@ -176,6 +311,9 @@ type AuthRequest struct {
 	// Set when the user authenticates.
 	ConnectorID   string
 	ConnectorData []byte
+
+	// When the user authenticated with the connector.
+	AuthTime time.Time
 }
 
 // AuthCode represents a code which can be exchanged for an OAuth2 token response.
@@ -210,9 +348,48 @@ type AuthCode struct {
 	ConnectorData []byte
 	Claims        Claims
 
+	// When the end user authenticated. Reported in the "auth_time" claim.
+	AuthTime time.Time
+
+	// PKCE challenge from the initial request. If set, the client MUST present a
+	// matching code_verifier when exchanging the code.
+	PKCE PKCE
+
+	// Claims requested individually in the initial request.
+	ClaimsRequest ClaimsRequest
+
 	Expiry time.Time
 }
 
+// PKCE holds the challenge of a Proof Key for Code Exchange request.
+//
+// See: https://tools.ietf.org/html/rfc7636
+type PKCE struct {
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// ClaimsRequest holds the OpenID Connect "claims" request parameter, which asks for
+// individual claims to be returned in the ID Token or from the UserInfo endpoint.
+// Both members map claim names to how the claim is requested. A nil ClaimRequest
+// requests the claim as a voluntary claim.
+//
+// See: https://openid.net/specs/openid-connect-core-1_0.html#ClaimsParameter
+type ClaimsRequest struct {
+	UserInfo map[string]*ClaimRequest `json:"userinfo,omitempty"`
+	IDToken  map[string]*ClaimRequest `json:"id_token,omitempty"`
+}
+
+// ClaimRequest holds how a single claim is requested.
+type ClaimRequest struct {
+	// Essential claims are needed for the end user's authorization to go smoothly.
+	Essential bool `json:"essential,omitempty"`
+
+	// The claim is requested with a particular value, or one of a set of values.
+	Value  interface{}   `json:"value,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
 // RefreshToken is an OAuth2 refresh token which allows a client to request new
 // tokens on the end user's behalf.
 type RefreshToken struct {
@@ -235,6 +412,98 @@ type RefreshToken struct {
 	// Nonce value supplied during the initial redirect. This is required to be part
 	// of the claims of any future id_token generated by the client.
 	Nonce string
+
+	// When the end user originally authenticated. Refreshing doesn't authenticate the
+	// end user again, so ID tokens keep reporting this time.
+	AuthTime time.Time
+
+	// Claims requested individually in the initial request. They keep being
+	// returned by refreshed tokens.
+	ClaimsRequest ClaimsRequest
+
+	// Thumbprint of the certificate the client presented when the token was
+	// issued. If set, the token can only be redeemed with the same certificate.
+	CertThumbprint string
+
+	// Tokens rotated from the same original token share a family. If a token
+	// which has been rotated is presented again, the whole family is revoked.
+	FamilyID string
+
+	// Set if the token has been exchanged for a new one, or revoked along with its
+	// family. Rotated tokens can't be redeemed. They're kept, stripped of their
+	// claims, to detect reuse until no other token of their family is left.
+	Rotated bool
+
+	// The token a rotated token was exchanged for. Following it from any rotated
+	// token of a family leads to the token in use. Empty if the token was revoked.
+	NextToken string
+
+	// When the end user authorized the original token of the family, and when the
+	// family was last refreshed.
+	CreatedAt time.Time
+	LastUsed  time.Time
+
+	// When the token expires. If zero, it never expires.
+	Expiry time.Time
+}
+
+// DeviceRequest represents an OAuth2 device authorization request. It holds the
+// state of a request from an input constrained device until the end user enters
+// the user code on the verification page or the request expires.
+//
+// See: https://tools.ietf.org/html/rfc8628
+type DeviceRequest struct {
+	// The code the end user enters on the verification page. Primary key.
+	UserCode string
+
+	// The code the device uses to poll the token endpoint.
+	DeviceCode string
+
+	// The client the device authenticated as and the scopes it requested.
+	ClientID string
+	Scopes   []string
+
+	Expiry time.Time
+}
+
+// Possible values of the Status field of a DeviceToken.
+const (
+	DeviceTokenPending  = "pending"
+	DeviceTokenComplete = "complete"
+)
+
+// DeviceToken holds the token response a device is polling for. It's created
+// alongside a DeviceRequest and completed once the end user has logged in.
+type DeviceToken struct {
+	// The device code issued to the device. Primary key.
+	DeviceCode string
+
+	// The client the device code was issued to.
+	ClientID string
+
+	// Either "pending" or "complete".
+	Status string
+
+	// The serialized token response. Only set once the token is complete.
+	Token []byte
+
+	Expiry time.Time
+
+	// Used to tell devices which poll too frequently to slow down.
+	LastRequestTime     time.Time
+	PollIntervalSeconds int
+}
+
+// ClientAssertion records a JWT a client authenticated with, so the JWT can't be
+// used again. It's kept until the JWT expires.
+type ClientAssertion struct {
+	// ID is derived from the client ID and the "jti" claim of the JWT. Primary key.
+	ID string
+
+	// The client which authenticated with the JWT.
+	ClientID string
+
+	Expiry time.Time
 }
 
 // Password is an email to password mapping managed by the storage.
@@ -265,12 +534,24 @@ type VerificationKey struct {
 	Expiry    time.Time        `json:"expiry"`
 }
 
+// SigningKeyPair is a key used to sign payloads and its public part.
+type SigningKeyPair struct {
+	PrivateKey *jose.JSONWebKey `json:"privateKey"`
+	PublicKey  *jose.JSONWebKey `json:"publicKey"`
+}
+
 // Keys hold encryption and signing keys.
 type Keys struct {
 	// Key for creating and verifying signatures. These may be nil.
 	SigningKey    *jose.JSONWebKey
 	SigningKeyPub *jose.JSONWebKey
 
+	// Keys for signing with algorithms other than the signing key's, for clients
+	// which require a particular algorithm. They're rotated with the signing key.
+	//
+	// If signing is delegated to an external signer, only the public keys are set.
+	AdditionalSigningKeys []SigningKeyPair
+
 	// Old signing keys which have been rotated but can still be used to validate
 	// existing signatures.
 	VerificationKeys []VerificationKey
@@ -281,31 +562,112 @@ type Keys struct {
 	NextRotation time.Time
 }
 
-// Sign creates a JWT using the signing key.
-func (k Keys) Sign(payload []byte) (jws string, err error) {
-	if k.SigningKey == nil {
-		return "", fmt.Errorf("no key to sign payload with")
+// signingAlgorithm returns the algorithm a key signs with. Keys which don't
+// specify an algorithm use the default algorithm for their type.
+func signingAlgorithm(key *jose.JSONWebKey) (jose.SignatureAlgorithm, error) {
+	if key.Algorithm != "" {
+		return jose.SignatureAlgorithm(key.Algorithm), nil
 	}
-	signingKey := jose.SigningKey{Key: k.SigningKey}
 
-	switch key := k.SigningKey.Key.(type) {
+	switch key := key.Key.(type) {
 	case *rsa.PrivateKey:
-		// TODO(ericchiang): Allow different cryptographic hashes.
-		signingKey.Algorithm = jose.RS256
+		return jose.RS256, nil
 	case *ecdsa.PrivateKey:
 		switch key.Params() {
 		case elliptic.P256().Params():
-			signingKey.Algorithm = jose.ES256
+			return jose.ES256, nil
 		case elliptic.P384().Params():
-			signingKey.Algorithm = jose.ES384
+			return jose.ES384, nil
 		case elliptic.P521().Params():
-			signingKey.Algorithm = jose.ES512
+			return jose.ES512, nil
 		default:
 			return "", errors.New("unsupported ecdsa curve")
 		}
 	}
+	return "", fmt.Errorf("unsupported signing key type %T", key.Key)
+}
+
+// SigningAlgorithm returns the algorithm used to sign payloads with the signing key.
+func (k Keys) SigningAlgorithm() (jose.SignatureAlgorithm, error) {
+	if k.SigningKey == nil {
+		return "", fmt.Errorf("no key to sign payload with")
+	}
+	return signingAlgorithm(k.SigningKey)
+}
+
+// SigningAlgorithms returns the algorithms payloads can be signed with, starting
+// with the signing key's.
+func (k Keys) SigningAlgorithms() []jose.SignatureAlgorithm {
+	var algs []jose.SignatureAlgorithm
+	if alg, err := k.SigningAlgorithm(); err == nil {
+		algs = append(algs, alg)
+	}
+	for _, pair := range k.AdditionalSigningKeys {
+		if pair.PrivateKey == nil {
+			continue
+		}
+		if alg, err := signingAlgorithm(pair.PrivateKey); err == nil {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// PublicKeys returns the keys which can verify signatures: the public parts of the
+// current signing keys followed by the verification keys.
+func (k Keys) PublicKeys() []*jose.JSONWebKey {
+	var keys []*jose.JSONWebKey
+	if k.SigningKeyPub != nil {
+		keys = append(keys, k.SigningKeyPub)
+	}
+	for _, pair := range k.AdditionalSigningKeys {
+		keys = append(keys, pair.PublicKey)
+	}
+	for _, key := range k.VerificationKeys {
+		keys = append(keys, key.PublicKey)
+	}
+	return keys
+}
+
+// Sign creates a JWT using the signing key.
+func (k Keys) Sign(payload []byte) (jws string, err error) {
+	alg, err := k.SigningAlgorithm()
+	if err != nil {
+		return "", err
+	}
+	return sign(k.SigningKey, alg, payload)
+}
+
+// SignWith creates a JWT using the signing key for the algorithm.
+func (k Keys) SignWith(alg jose.SignatureAlgorithm, payload []byte) (jws string, err error) {
+	key, err := k.SigningKeyFor(alg)
+	if err != nil {
+		return "", err
+	}
+	return sign(key, alg, payload)
+}
+
+// SigningKeyFor returns the signing key for the algorithm, either the current
+// signing key or one of the additional signing keys.
+func (k Keys) SigningKeyFor(alg jose.SignatureAlgorithm) (*jose.JSONWebKey, error) {
+	if k.SigningKey != nil {
+		if keyAlg, err := signingAlgorithm(k.SigningKey); err == nil && keyAlg == alg {
+			return k.SigningKey, nil
+		}
+	}
+	for _, pair := range k.AdditionalSigningKeys {
+		if pair.PrivateKey == nil {
+			continue
+		}
+		if keyAlg, err := signingAlgorithm(pair.PrivateKey); err == nil && keyAlg == alg {
+			return pair.PrivateKey, nil
+		}
+	}
+	return nil, fmt.Errorf("no key to sign payload with %s", alg)
+}
 
-	signer, err := jose.NewSigner(signingKey, &jose.SignerOptions{})
+func sign(key *jose.JSONWebKey, alg jose.SignatureAlgorithm, payload []byte) (jws string, err error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Key: key, Algorithm: alg}, &jose.SignerOptions{})
 	if err != nil {
 		return "", fmt.Errorf("new signier: %v", err)
 	}